@@ -0,0 +1,609 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/spf13/cobra"
+
+	"github.com/emaland/devbox/internal/awsutil"
+	"github.com/emaland/devbox/internal/config"
+)
+
+// bakedTag marks an AMI baked by devbox; its value is the box it was
+// baked from.
+const bakedTag = "devbox-baked"
+
+// BakeTimeout bounds the wait for a baked image to become available.
+var BakeTimeout = time.Hour
+
+// amiArchs are the architectures devbox picks NixOS AMIs for.
+var amiArchs = []string{string(types.ArchitectureTypeX8664), string(types.ArchitectureTypeArm64)}
+
+func newAMICmd() *cobra.Command {
+	ami := &cobra.Command{
+		Use:   "ami",
+		Short: "Manage the NixOS images boxes launch from (ls, pin, upgrade, bake)",
+		Long: `Boxes launch from the newest NixOS AMI whose name matches
+nixos_ami_pattern, per architecture, unless an AMI is pinned for that
+architecture. Baked images are snapshots of a configured box, so new boxes
+boot with their system already built.
+
+The launch template holds its own AMI: run "devbox template sync" after
+changing the pins or the pattern.`,
+	}
+
+	ami.AddCommand(
+		newAMILSCmd(),
+		newAMIPinCmd(),
+		newAMIUpgradeCmd(),
+		newAMIBakeCmd(),
+	)
+
+	return ami
+}
+
+// --- ls ---
+
+func newAMILSCmd() *cobra.Command {
+	var limit int
+
+	cmd := &cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "List candidate NixOS and baked images",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return amiLS(cmd.Context(), dcfg, ec2Client, limit)
+		},
+	}
+
+	cmd.Flags().IntVar(&limit, "limit", 20, "Show at most this many images (0 for all)")
+
+	return cmd
+}
+
+func amiLS(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, limit int) error {
+	nixos, err := describeImages(ctx, client, &ec2.DescribeImagesInput{
+		Owners: []string{dcfg.NixOSAMIOwner},
+		Filters: []types.Filter{
+			{Name: aws.String("name"), Values: []string{dcfg.NixOSAMIPattern}},
+			{Name: aws.String("architecture"), Values: amiArchs},
+			{Name: aws.String("state"), Values: []string{"available"}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	baked, err := describeImages(ctx, client, &ec2.DescribeImagesInput{
+		Owners:  []string{"self"},
+		Filters: []types.Filter{{Name: aws.String("tag-key"), Values: []string{bakedTag}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	inUse := selectedAMIs(dcfg, nixos)
+	images := append(nixos, baked...)
+	if len(images) == 0 {
+		fmt.Printf("No images match %s.\n", dcfg.NixOSAMIPattern)
+		return nil
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return aws.ToString(images[i].CreationDate) > aws.ToString(images[j].CreationDate)
+	})
+	if limit > 0 && len(images) > limit {
+		images = images[:limit]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE ID\tNAME\tARCH\tCREATED\tSOURCE\tSTATE\tIN USE")
+	for _, img := range images {
+		id := aws.ToString(img.ImageId)
+		source := "nixos"
+		if box := awsutil.TagValue(img.Tags, bakedTag); box != "" {
+			source = "baked from " + box
+		}
+		use := "-"
+		if sel, ok := inUse[string(img.Architecture)]; ok && sel.ID == id {
+			use = sel.Why
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			id,
+			aws.ToString(img.Name),
+			string(img.Architecture),
+			imageDate(img),
+			source,
+			string(img.State),
+			use,
+		)
+	}
+	w.Flush()
+
+	for _, arch := range amiArchs {
+		if sel, ok := inUse[arch]; ok && sel.Why == "pinned" && !slices.ContainsFunc(images, func(img types.Image) bool { return aws.ToString(img.ImageId) == sel.ID }) {
+			fmt.Printf("%s is pinned to %s, which isn't listed.\n", arch, sel.ID)
+		}
+	}
+	return nil
+}
+
+// amiSelection is the image lookupAMI picks for an architecture and why.
+type amiSelection struct {
+	ID  string
+	Why string // "pinned" or "latest"
+}
+
+// selectedAMIs works out, per architecture, which image spawn would use:
+// the pin, or else the newest by name of the NixOS images.
+func selectedAMIs(dcfg config.DevboxConfig, nixos []types.Image) map[string]amiSelection {
+	sel := map[string]amiSelection{}
+	for arch, id := range dcfg.NixOSAMIPins {
+		if id != "" {
+			sel[arch] = amiSelection{ID: id, Why: "pinned"}
+		}
+	}
+	latest := map[string]string{}
+	for _, img := range nixos {
+		arch, name := string(img.Architecture), aws.ToString(img.Name)
+		if name > latest[arch] {
+			latest[arch] = name
+			if sel[arch].Why != "pinned" {
+				sel[arch] = amiSelection{ID: aws.ToString(img.ImageId), Why: "latest"}
+			}
+		}
+	}
+	return sel
+}
+
+func describeImages(ctx context.Context, client *ec2.Client, input *ec2.DescribeImagesInput) ([]types.Image, error) {
+	result, err := client.DescribeImages(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("describing images: %w", err)
+	}
+	return result.Images, nil
+}
+
+func imageDate(img types.Image) string {
+	t, err := time.Parse(time.RFC3339, aws.ToString(img.CreationDate))
+	if err != nil {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+// --- pin ---
+
+func newAMIPinCmd() *cobra.Command {
+	var (
+		clearPins bool
+		arch      string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "pin [image-id]",
+		Short: "Launch from a specific AMI instead of the latest NixOS one",
+		Long: `Pin an AMI for its architecture, so spawn, resize --cross-arch and
+template sync use it instead of the newest image matching
+nixos_ami_pattern. Without an argument, show the pins.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			switch {
+			case clearPins:
+				if len(args) > 0 {
+					return fmt.Errorf("--clear takes no image ID")
+				}
+				return amiUnpin(dcfg, arch)
+			case len(args) == 0:
+				return amiShowPins(dcfg)
+			}
+			return amiPin(cmd.Context(), dcfg, ec2Client, args[0])
+		},
+	}
+
+	cmd.Flags().BoolVar(&clearPins, "clear", false, "Remove the pins and go back to the latest NixOS AMI")
+	cmd.Flags().StringVar(&arch, "arch", "", "With --clear, only remove the pin for this architecture")
+
+	return cmd
+}
+
+func amiPin(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, imageID string) error {
+	images, err := describeImages(ctx, client, &ec2.DescribeImagesInput{ImageIds: []string{imageID}})
+	if err != nil {
+		return err
+	}
+	if len(images) == 0 {
+		return fmt.Errorf("image %s not found", imageID)
+	}
+	img := images[0]
+	if img.State != types.ImageStateAvailable {
+		return fmt.Errorf("image %s is %s, not available", imageID, img.State)
+	}
+	if err := checkRootFits(dcfg, img); err != nil {
+		return err
+	}
+	arch := string(img.Architecture)
+	if err := savePin(dcfg, arch, imageID); err != nil {
+		return err
+	}
+	fmt.Printf("Pinned %s AMI to %s (%s).\n", arch, imageID, aws.ToString(img.Name))
+	printTemplateSyncHint(dcfg)
+	return nil
+}
+
+// imageRootSize returns the size in GiB of img's root volume snapshot, or
+// 0 if the image doesn't record one.
+func imageRootSize(img types.Image) int32 {
+	for _, bdm := range img.BlockDeviceMappings {
+		if aws.ToString(bdm.DeviceName) == aws.ToString(img.RootDeviceName) && bdm.Ebs != nil {
+			return aws.ToInt32(bdm.Ebs.VolumeSize)
+		}
+	}
+	return 0
+}
+
+// checkRootFits reports an error if boxes can't launch from img with the
+// configured root volume. EBS won't create a volume smaller than its
+// snapshot, so an image baked after "root grow" needs a bigger
+// root_volume.size.
+func checkRootFits(dcfg config.DevboxConfig, img types.Image) error {
+	if size := imageRootSize(img); size > dcfg.RootVolume.SizeGiB {
+		return fmt.Errorf("image %s has a %d GiB root snapshot, larger than root_volume.size (%d GiB), so boxes couldn't launch from it; set root_volume.size to at least %d in the config first",
+			aws.ToString(img.ImageId), size, dcfg.RootVolume.SizeGiB, size)
+	}
+	return nil
+}
+
+// savePin records imageID as the AMI for arch in the config file.
+func savePin(dcfg config.DevboxConfig, arch, imageID string) error {
+	pins := maps.Clone(dcfg.NixOSAMIPins)
+	if pins == nil {
+		pins = map[string]string{}
+	}
+	pins[arch] = imageID
+	return config.Update(map[string]any{"nixos_ami_pins": pins})
+}
+
+func amiUnpin(dcfg config.DevboxConfig, arch string) error {
+	if len(dcfg.NixOSAMIPins) == 0 {
+		fmt.Println("No AMIs are pinned.")
+		return nil
+	}
+	var pins map[string]string
+	if arch != "" {
+		if dcfg.NixOSAMIPins[arch] == "" {
+			fmt.Printf("No AMI is pinned for %s.\n", arch)
+			return nil
+		}
+		pins = maps.Clone(dcfg.NixOSAMIPins)
+		delete(pins, arch)
+	}
+	var value any = pins
+	if len(pins) == 0 {
+		value = nil
+	}
+	if err := config.Update(map[string]any{"nixos_ami_pins": value}); err != nil {
+		return err
+	}
+	fmt.Printf("Unpinned; boxes launch from the latest AMI matching %s.\n", dcfg.NixOSAMIPattern)
+	printTemplateSyncHint(dcfg)
+	return nil
+}
+
+func amiShowPins(dcfg config.DevboxConfig) error {
+	if len(dcfg.NixOSAMIPins) == 0 {
+		fmt.Printf("No AMIs are pinned; boxes launch from the latest AMI matching %s.\n", dcfg.NixOSAMIPattern)
+		return nil
+	}
+	for _, arch := range slices.Sorted(maps.Keys(dcfg.NixOSAMIPins)) {
+		fmt.Printf("%s\t%s\n", arch, dcfg.NixOSAMIPins[arch])
+	}
+	return nil
+}
+
+func printTemplateSyncHint(dcfg config.DevboxConfig) {
+	if dcfg.LaunchTemplate != "" {
+		fmt.Printf("Run devbox template sync to put it in launch template %s.\n", dcfg.LaunchTemplate)
+	}
+}
+
+// --- upgrade ---
+
+// channelRE matches NixOS release channels like 25.05.
+var channelRE = regexp.MustCompile(`^\d{2}\.\d{2}$`)
+
+func newAMIUpgradeCmd() *cobra.Command {
+	var channel string
+
+	cmd := &cobra.Command{
+		Use:   "upgrade --channel <release>",
+		Short: "Switch nixos_ami_pattern to another NixOS release",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return amiUpgrade(cmd.Context(), dcfg, ec2Client, channel)
+		},
+	}
+
+	cmd.Flags().StringVar(&channel, "channel", "", "NixOS release, e.g. 25.05")
+	cmd.MarkFlagRequired("channel")
+
+	return cmd
+}
+
+func amiUpgrade(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, channel string) error {
+	if !channelRE.MatchString(channel) {
+		return fmt.Errorf("invalid --channel %q: want a NixOS release like 25.05", channel)
+	}
+	pattern := "nixos/" + channel + "*"
+	if pattern == dcfg.NixOSAMIPattern {
+		fmt.Printf("Already on %s.\n", pattern)
+		return nil
+	}
+
+	// Only switch if there is an image to launch from.
+	next := dcfg
+	next.NixOSAMIPattern = pattern
+	next.NixOSAMIPins = nil
+	found := 0
+	for _, arch := range amiArchs {
+		amiID, err := lookupAMI(ctx, next, client, arch)
+		if err != nil {
+			fmt.Printf("  %s: none\n", arch)
+			continue
+		}
+		fmt.Printf("  %s: %s\n", arch, amiID)
+		found++
+	}
+	if found == 0 {
+		return fmt.Errorf("no NixOS AMIs match %s; config unchanged", pattern)
+	}
+
+	if err := config.Update(map[string]any{"nixos_ami_pattern": pattern}); err != nil {
+		return err
+	}
+	fmt.Printf("nixos_ami_pattern: %s -> %s\n", dcfg.NixOSAMIPattern, pattern)
+	for _, arch := range slices.Sorted(maps.Keys(dcfg.NixOSAMIPins)) {
+		fmt.Fprintf(os.Stderr, "Warning: %s is still pinned to %s; run devbox ami pin --clear --arch %s to follow %s\n", arch, dcfg.NixOSAMIPins[arch], arch, channel)
+	}
+	printTemplateSyncHint(dcfg)
+	return nil
+}
+
+// --- bake ---
+
+type bakeOptions struct {
+	NoReboot bool
+	NoPin    bool
+	// Keep is how many baked images of the box to keep; older ones are
+	// deregistered along with their snapshots. 0 keeps them all.
+	Keep int
+}
+
+func newAMIBakeCmd() *cobra.Command {
+	var opts bakeOptions
+
+	cmd := &cobra.Command{
+		Use:   "bake <instance-id>",
+		Short: "Create an AMI from a configured box so new boxes start pre-built",
+		Long: `Create an image of an instance's root volume and pin it for the
+instance's architecture. Data volumes are left out. The instance is
+rebooted for a consistent image unless --no-reboot is given.
+
+The image isn't pinned if its root is larger than root_volume.size, as it
+is after "devbox root grow", since boxes couldn't launch from it; raise
+root_volume.size and pin it with "devbox ami pin".
+
+Images are tagged devbox-baked=<box name>. Only the newest --keep images
+of each box and architecture are kept; older ones are deregistered and
+their snapshots deleted. An older image that is pinned, is the launch
+template's, or backs a live instance is kept as well, beyond --keep.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return amiBake(cmd.Context(), dcfg, ec2Client, args[0], opts)
+		},
+	}
+
+	cmd.Flags().BoolVar(&opts.NoReboot, "no-reboot", false, "Don't reboot the instance; the image may be inconsistent")
+	cmd.Flags().BoolVar(&opts.NoPin, "no-pin", false, "Don't pin the new image")
+	cmd.Flags().IntVar(&opts.Keep, "keep", 3, "Baked images of the box to keep (0 keeps all)")
+
+	return cmd
+}
+
+func amiBake(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, instanceID string, opts bakeOptions) error {
+	inst, err := describeInstance(ctx, client, instanceID)
+	if err != nil {
+		return err
+	}
+	box := awsutil.NameTag(inst.Tags)
+	if box == "" || box == "-" {
+		box = instanceID
+	}
+	arch := string(inst.Architecture)
+
+	// 1. Leave the data volumes out; only the root volume is baked.
+	var mappings []types.BlockDeviceMapping
+	for _, bdm := range inst.BlockDeviceMappings {
+		if aws.ToString(bdm.DeviceName) == aws.ToString(inst.RootDeviceName) {
+			continue
+		}
+		mappings = append(mappings, types.BlockDeviceMapping{DeviceName: bdm.DeviceName, NoDevice: aws.String("")})
+	}
+
+	// 2. Create the image, tagging it and its snapshot.
+	now := time.Now().UTC()
+	name := fmt.Sprintf("devbox/%s-%s-%s", box, arch, now.Format("20060102-150405"))
+	tags := []types.Tag{
+		{Key: aws.String("Name"), Value: aws.String(name)},
+		{Key: aws.String(bakedTag), Value: aws.String(box)},
+		{Key: aws.String("devbox-managed"), Value: aws.String("true")},
+	}
+	if opts.NoReboot {
+		fmt.Printf("Baking %s without a reboot...\n", instanceID)
+	} else {
+		fmt.Printf("Baking %s; it will reboot...\n", instanceID)
+	}
+	result, err := client.CreateImage(ctx, &ec2.CreateImageInput{
+		InstanceId:          aws.String(instanceID),
+		Name:                aws.String(name),
+		Description:         aws.String(fmt.Sprintf("devbox ami bake: %s (%s)", box, instanceID)),
+		NoReboot:            aws.Bool(opts.NoReboot),
+		BlockDeviceMappings: mappings,
+		TagSpecifications: []types.TagSpecification{
+			{ResourceType: types.ResourceTypeImage, Tags: tags},
+			{ResourceType: types.ResourceTypeSnapshot, Tags: tags},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("creating image of %s: %w", instanceID, err)
+	}
+	imageID := aws.ToString(result.ImageId)
+
+	// 3. Wait for it to become available.
+	fmt.Printf("Image %s (%s) created, waiting for it to become available...\n", imageID, name)
+	waiter := ec2.NewImageAvailableWaiter(client)
+	if err := waiter.Wait(ctx, &ec2.DescribeImagesInput{ImageIds: []string{imageID}}, BakeTimeout); err != nil {
+		return fmt.Errorf("waiting for image %s: %w", imageID, err)
+	}
+	fmt.Printf("Image %s is available.\n", imageID)
+
+	// 4. Pin it so new boxes of this architecture launch from it, unless
+	// its root is bigger than the boxes' root volume.
+	pins := maps.Clone(dcfg.NixOSAMIPins)
+	if pins == nil {
+		pins = map[string]string{}
+	}
+	pin := !opts.NoPin
+	if pin {
+		images, err := describeImages(ctx, client, &ec2.DescribeImagesInput{ImageIds: []string{imageID}})
+		if err != nil {
+			return err
+		}
+		if len(images) > 0 {
+			if err := checkRootFits(dcfg, images[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: not pinning: %v\n", err)
+				fmt.Fprintf(os.Stderr, "Then pin it with: devbox ami pin %s\n", imageID)
+				pin = false
+			}
+		}
+	}
+	if pin {
+		if err := savePin(dcfg, arch, imageID); err != nil {
+			return fmt.Errorf("pinning %s: %w", imageID, err)
+		}
+		pins[arch] = imageID
+		fmt.Printf("Pinned %s AMI to %s.\n", arch, imageID)
+		printTemplateSyncHint(dcfg)
+	}
+
+	// 5. Prune older bakes of this box.
+	if opts.Keep <= 0 {
+		return nil
+	}
+	baked, err := describeImages(ctx, client, &ec2.DescribeImagesInput{
+		Owners: []string{"self"},
+		Filters: []types.Filter{
+			{Name: aws.String("tag:" + bakedTag), Values: []string{box}},
+			{Name: aws.String("architecture"), Values: []string{arch}},
+		},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: not pruning old images: %v\n", err)
+		return nil
+	}
+	inUse, err := imagesInUse(ctx, dcfg, client, pins)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: not pruning old images: %v\n", err)
+		return nil
+	}
+	for _, img := range bakedToPrune(baked, opts.Keep, inUse) {
+		deregisterImage(ctx, client, img)
+	}
+	return nil
+}
+
+// imagesInUse returns the AMIs pruning must keep: the pinned ones, the
+// launch template's, and those of every instance that isn't terminated,
+// since resize, rebid and recover relaunch a box from its own AMI.
+func imagesInUse(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, pins map[string]string) (map[string]bool, error) {
+	inUse := map[string]bool{}
+	for _, id := range pins {
+		inUse[id] = true
+	}
+	lt, err := findLaunchTemplate(ctx, client, dcfg.LaunchTemplate)
+	if err != nil {
+		return nil, err
+	}
+	if lt != nil {
+		data, err := defaultTemplateVersion(ctx, client, lt)
+		if err != nil {
+			return nil, err
+		}
+		if id := aws.ToString(data.ImageId); id != "" {
+			inUse[id] = true
+		}
+	}
+	paginator := ec2.NewDescribeInstancesPaginator(client, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "shutting-down", "stopping", "stopped"}},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing instances: %w", err)
+		}
+		for _, res := range page.Reservations {
+			for _, inst := range res.Instances {
+				inUse[aws.ToString(inst.ImageId)] = true
+			}
+		}
+	}
+	return inUse, nil
+}
+
+// bakedToPrune returns the images beyond the newest keep, leaving out
+// those in inUse. In-use images among the newest count toward keep.
+func bakedToPrune(images []types.Image, keep int, inUse map[string]bool) []types.Image {
+	sorted := slices.Clone(images)
+	sort.Slice(sorted, func(i, j int) bool {
+		return aws.ToString(sorted[i].CreationDate) > aws.ToString(sorted[j].CreationDate)
+	})
+	var prune []types.Image
+	for i, img := range sorted {
+		if i < keep || inUse[aws.ToString(img.ImageId)] {
+			continue
+		}
+		prune = append(prune, img)
+	}
+	return prune
+}
+
+// deregisterImage removes a baked image and its snapshots. Failures are
+// warnings; the next bake tries again.
+func deregisterImage(ctx context.Context, client *ec2.Client, img types.Image) {
+	imageID := aws.ToString(img.ImageId)
+	if _, err := client.DeregisterImage(ctx, &ec2.DeregisterImageInput{ImageId: img.ImageId}); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not deregister %s: %v\n", imageID, err)
+		return
+	}
+	fmt.Printf("Pruned image %s (%s)\n", imageID, aws.ToString(img.Name))
+	for _, bdm := range img.BlockDeviceMappings {
+		if bdm.Ebs == nil || bdm.Ebs.SnapshotId == nil {
+			continue
+		}
+		if _, err := client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: bdm.Ebs.SnapshotId}); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not delete snapshot %s of %s: %v\n", *bdm.Ebs.SnapshotId, imageID, err)
+		}
+	}
+}
@@ -0,0 +1,642 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/spf13/cobra"
+
+	"github.com/emaland/devbox/internal/awsutil"
+	"github.com/emaland/devbox/internal/boxspec"
+	"github.com/emaland/devbox/internal/config"
+)
+
+// Instance tags recording what apply last pushed over SSH, so plan can tell
+// whether the box is up to date without logging in.
+const (
+	nixConfigTag = "devbox-nix-config"
+	autoStopTag  = "devbox-autostop"
+)
+
+// Reconcile steps, in the order apply runs them.
+const (
+	opSpawn    = "spawn"
+	opStart    = "start"
+	opResize   = "resize"
+	opTag      = "tag"
+	opAttach   = "attach"
+	opDNS      = "dns"
+	opNix      = "nix"
+	opAutoStop = "auto-stop"
+)
+
+// boxAction is one step of bringing a box in line with its spec.
+type boxAction struct {
+	Op     string
+	Detail string
+	// Target is the AZ for spawn and resize, the volume ID for attach
+	// and the record name for dns.
+	Target string
+	Device string
+}
+
+// boxState is what AWS currently has for a spec.
+type boxState struct {
+	// Instance is nil when no box has the spec's name.
+	Instance *types.Instance
+	// Volumes by the reference used in the spec.
+	Volumes map[string]types.Volume
+	// DNS holds the current A record value of each name; "" if missing.
+	DNS map[string]string
+	// NixHash identifies the contents of the spec's nix_config.
+	NixHash string
+}
+
+func newPlanCmd() *cobra.Command {
+	var file string
+
+	cmd := &cobra.Command{
+		Use:   "plan -f <box.yaml>",
+		Short: "Show what apply would change to match a box spec",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			r53client := route53.NewFromConfig(awsCfg)
+			_, _, err := planSpec(cmd.Context(), dcfg, ec2Client, r53client, file)
+			return err
+		},
+	}
+
+	cmd.Flags().StringVarP(&file, "file", "f", "", "Box spec (YAML)")
+	cmd.MarkFlagRequired("file")
+
+	return cmd
+}
+
+func newApplyCmd() *cobra.Command {
+	var file string
+	var autoApprove bool
+
+	cmd := &cobra.Command{
+		Use:   "apply -f <box.yaml>",
+		Short: "Spawn, resize and configure a box to match a box spec",
+		Long: `Reconcile a box with a YAML spec. The box is found by its Name tag.
+
+Missing boxes are spawned and stopped ones started. A box of another type or
+in another AZ is resized. Then tags are set, volumes attached, DNS records
+upserted, and the Nix config and auto-stop delay pushed over SSH. Steps that
+are already in effect are skipped, so apply can be run repeatedly.
+
+Run "devbox plan -f" to see the steps without making changes.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			r53client := route53.NewFromConfig(awsCfg)
+			return applySpec(cmd.Context(), dcfg, ec2Client, r53client, file, autoApprove)
+		},
+	}
+
+	cmd.Flags().StringVarP(&file, "file", "f", "", "Box spec (YAML)")
+	cmd.Flags().BoolVar(&autoApprove, "auto-approve", false, "Skip the confirmation prompt")
+	cmd.MarkFlagRequired("file")
+
+	return cmd
+}
+
+// planSpec loads the spec at path, works out the steps to reconcile it and
+// prints them.
+func planSpec(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, path string) (*boxspec.Spec, []boxAction, error) {
+	spec, err := boxspec.Load(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	st, err := observeBox(ctx, dcfg, client, r53client, spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	actions, err := planBox(dcfg, spec, st)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if inst := st.Instance; inst != nil {
+		fmt.Printf("Box %s: %s, %s in %s, %s\n", spec.Name, aws.ToString(inst.InstanceId),
+			inst.InstanceType, aws.ToString(inst.Placement.AvailabilityZone), inst.State.Name)
+	} else {
+		fmt.Printf("Box %s: not found\n", spec.Name)
+	}
+	if len(actions) == 0 {
+		fmt.Println("No changes. The box matches the spec.")
+		return spec, nil, nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, a := range actions {
+		fmt.Fprintf(w, "  %s\t%s\n", a.Op, a.Detail)
+	}
+	w.Flush()
+	return spec, actions, nil
+}
+
+func applySpec(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, path string, autoApprove bool) error {
+	spec, actions, err := planSpec(ctx, dcfg, client, r53client, path)
+	if err != nil || len(actions) == 0 {
+		return err
+	}
+	if !autoApprove {
+		ok, err := promptYesNo("Apply these changes?")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Println("Aborted.")
+			return nil
+		}
+	}
+	return applyBox(ctx, dcfg, client, r53client, spec, actions)
+}
+
+// findBox returns the live instance whose Name tag is name, or nil if there
+// is none.
+func findBox(ctx context.Context, client *ec2.Client, name string) (*types.Instance, error) {
+	desc, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("tag:Name"), Values: []string{name}},
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("looking up box %q: %w", name, err)
+	}
+	var found []types.Instance
+	for _, res := range desc.Reservations {
+		found = append(found, res.Instances...)
+	}
+	switch len(found) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &found[0], nil
+	}
+	var ids []string
+	for _, inst := range found {
+		ids = append(ids, aws.ToString(inst.InstanceId))
+	}
+	return nil, fmt.Errorf("multiple instances are named %q (%s); rename or terminate the extras", name, strings.Join(ids, ", "))
+}
+
+// observeBox collects the current state of everything the spec mentions.
+func observeBox(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, spec *boxspec.Spec) (boxState, error) {
+	st := boxState{Volumes: map[string]types.Volume{}, DNS: map[string]string{}}
+
+	inst, err := findBox(ctx, client, spec.Name)
+	if err != nil {
+		return st, err
+	}
+	st.Instance = inst
+
+	for _, v := range spec.Volumes {
+		volID, err := resolveVolume(ctx, client, v.Volume)
+		if err != nil {
+			return st, err
+		}
+		desc, err := client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{volID}})
+		if err != nil {
+			return st, fmt.Errorf("describing volume %s: %w", volID, err)
+		}
+		if len(desc.Volumes) == 0 {
+			return st, fmt.Errorf("volume %s not found", volID)
+		}
+		st.Volumes[v.Volume] = desc.Volumes[0]
+	}
+
+	// A box that doesn't exist yet has no IP to compare records with.
+	if inst != nil && len(spec.DNS) > 0 {
+		zoneID, err := awsutil.FindHostedZone(ctx, r53client, dcfg.DNSZone)
+		if err != nil {
+			return st, err
+		}
+		for _, name := range spec.DNS {
+			if st.DNS[name], err = currentARecord(ctx, r53client, zoneID, name); err != nil {
+				return st, err
+			}
+		}
+	}
+
+	if spec.NixConfig != "" {
+		data, err := os.ReadFile(spec.NixConfig)
+		if err != nil {
+			return st, fmt.Errorf("reading nix_config: %w", err)
+		}
+		st.NixHash = contentHash(data)
+	}
+	return st, nil
+}
+
+// spawnSource resolves the box a spawned box clones its user_data from:
+// from as an instance ID or Name tag, or, when from is empty and there is
+// no launch template, the box dns_name points at. apply creates several
+// spot boxes, so spawn's own guess of the only one would soon fail.
+func spawnSource(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, from string) (string, error) {
+	if strings.HasPrefix(from, "i-") {
+		return from, nil
+	}
+	if from != "" {
+		inst, err := findBox(ctx, client, from)
+		if err != nil {
+			return "", err
+		}
+		if inst == nil {
+			return "", fmt.Errorf("from: no live box is named %q", from)
+		}
+		return aws.ToString(inst.InstanceId), nil
+	}
+	lt, err := findLaunchTemplate(ctx, client, dcfg.LaunchTemplate)
+	if err != nil {
+		return "", err
+	}
+	if lt != nil {
+		return "", nil
+	}
+
+	zoneID, err := awsutil.FindHostedZone(ctx, r53client, dcfg.DNSZone)
+	if err != nil {
+		return "", err
+	}
+	ip, err := currentARecord(ctx, r53client, zoneID, dcfg.DNSName)
+	if err != nil || ip == "" {
+		return "", err
+	}
+	desc, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("ip-address"), Values: []string{ip}},
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("looking up the box at %s: %w", dcfg.DNSName, err)
+	}
+	for _, res := range desc.Reservations {
+		for _, inst := range res.Instances {
+			return aws.ToString(inst.InstanceId), nil
+		}
+	}
+	return "", nil
+}
+
+// currentARecord returns the value of the A record name in the hosted zone,
+// or "" if there is none.
+func currentARecord(ctx context.Context, r53client *route53.Client, zoneID, name string) (string, error) {
+	out, err := r53client.ListResourceRecordSets(ctx, &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(zoneID),
+		StartRecordName: aws.String(name),
+		StartRecordType: "A",
+		MaxItems:        aws.Int32(1),
+	})
+	if err != nil {
+		return "", fmt.Errorf("looking up DNS record %s: %w", name, err)
+	}
+	for _, rrs := range out.ResourceRecordSets {
+		if !strings.EqualFold(strings.TrimSuffix(aws.ToString(rrs.Name), "."), strings.TrimSuffix(name, ".")) || rrs.Type != "A" {
+			continue
+		}
+		if len(rrs.ResourceRecords) > 0 {
+			return aws.ToString(rrs.ResourceRecords[0].Value), nil
+		}
+	}
+	return "", nil
+}
+
+// contentHash is a short, stable fingerprint of a file pushed to the box.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("sha256:%x", sum[:6])
+}
+
+// planBox compares the spec with the observed state and returns the steps
+// that would bring the box in line, in the order apply runs them. It fails
+// on conflicts apply can't resolve, like a volume attached to another box.
+func planBox(dcfg config.DevboxConfig, spec *boxspec.Spec, st boxState) ([]boxAction, error) {
+	var actions []boxAction
+	inst := st.Instance
+
+	// fresh means the box will have a new public IP by the time DNS is
+	// reconciled: it is spawned, started or replaced.
+	fresh := inst == nil
+	az := spec.AZ
+	if inst == nil {
+		volAZ, err := volumesAZ(spec, st)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case volAZ != "" && (az == "" || az == autoAZ):
+			az = volAZ
+		case az == "":
+			az = dcfg.DefaultAZ
+		}
+		what := spec.Type
+		if r := spec.Requirements; r != nil {
+			what = fmt.Sprintf("%s vCPU, %s GiB", orAny(r.VCPU), orAny(r.Mem))
+		} else if what == "" {
+			what = dcfg.DefaultType
+		}
+		where := "in " + az
+		if az == autoAZ {
+			where = "in the AZ with the best placement score"
+		}
+		actions = append(actions, boxAction{Op: opSpawn, Detail: fmt.Sprintf("%s %s", what, where), Target: az})
+	} else {
+		curType := string(inst.InstanceType)
+		curAZ := aws.ToString(inst.Placement.AvailabilityZone)
+		switch inst.State.Name {
+		case types.InstanceStateNameStopped:
+			actions = append(actions, boxAction{Op: opStart, Detail: aws.ToString(inst.InstanceId)})
+			fresh = true
+		case types.InstanceStateNameRunning, types.InstanceStateNamePending:
+		default:
+			return nil, fmt.Errorf("box %s is %s; try again once it has settled", spec.Name, inst.State.Name)
+		}
+		if az == "" || az == autoAZ {
+			az = curAZ
+		}
+		var changes []string
+		if spec.Type != "" && spec.Type != curType {
+			changes = append(changes, fmt.Sprintf("%s -> %s", curType, spec.Type))
+		}
+		if az != curAZ {
+			changes = append(changes, fmt.Sprintf("%s -> %s", curAZ, az))
+		}
+		if len(changes) > 0 {
+			actions = append(actions, boxAction{Op: opResize, Detail: strings.Join(changes, ", "), Target: az})
+			fresh = true
+		}
+	}
+
+	var tags []string
+	for _, k := range slices.Sorted(maps.Keys(spec.Tags)) {
+		if inst == nil || awsutil.TagValue(inst.Tags, k) != spec.Tags[k] {
+			tags = append(tags, k+"="+spec.Tags[k])
+		}
+	}
+	if len(tags) > 0 {
+		actions = append(actions, boxAction{Op: opTag, Detail: strings.Join(tags, ", ")})
+	}
+
+	for _, v := range spec.Volumes {
+		vol := st.Volumes[v.Volume]
+		volID := aws.ToString(vol.VolumeId)
+		label := volID
+		if name := awsutil.NameTag(vol.Tags); name != "" {
+			label = fmt.Sprintf("%s (%s)", volID, name)
+		}
+		attachedTo := ""
+		if len(vol.Attachments) > 0 {
+			attachedTo = aws.ToString(vol.Attachments[0].InstanceId)
+		}
+		if inst != nil && attachedTo == aws.ToString(inst.InstanceId) {
+			// Already there; a cross-AZ resize copies it along.
+			continue
+		}
+		if attachedTo != "" {
+			return nil, fmt.Errorf("volume %s is attached to %s; detach it first", label, attachedTo)
+		}
+		if volAZ := aws.ToString(vol.AvailabilityZone); az != autoAZ && volAZ != az {
+			return nil, fmt.Errorf("volume %s is in %s but the box will be in %s", label, volAZ, az)
+		}
+		actions = append(actions, boxAction{Op: opAttach, Detail: fmt.Sprintf("%s as %s", label, v.Device), Target: volID, Device: v.Device})
+	}
+
+	ip := ""
+	if inst != nil {
+		ip = aws.ToString(inst.PublicIpAddress)
+	}
+	for _, name := range spec.DNS {
+		cur := st.DNS[name]
+		if !fresh && ip != "" && cur == ip {
+			continue
+		}
+		to := ip
+		if fresh || to == "" {
+			to = "the box's new IP"
+		}
+		if cur == "" {
+			cur = "(none)"
+		}
+		actions = append(actions, boxAction{Op: opDNS, Detail: fmt.Sprintf("%s: %s -> %s", name, cur, to), Target: name})
+	}
+
+	if spec.NixConfig != "" && (inst == nil || awsutil.TagValue(inst.Tags, nixConfigTag) != st.NixHash) {
+		actions = append(actions, boxAction{Op: opNix, Detail: fmt.Sprintf("push %s (%s)", spec.NixConfig, st.NixHash)})
+	}
+
+	if spec.AutoStop != "" {
+		cur := ""
+		if inst != nil {
+			cur = awsutil.TagValue(inst.Tags, autoStopTag)
+		}
+		if cur != spec.AutoStop {
+			if cur == "" {
+				cur = "(unknown)"
+			}
+			actions = append(actions, boxAction{Op: opAutoStop, Detail: fmt.Sprintf("%s -> %s", cur, spec.AutoStop)})
+		}
+	}
+	return actions, nil
+}
+
+// volumesAZ returns the AZ the spec's volumes share, or "" if there are
+// none. A box can only use volumes from its own AZ.
+func volumesAZ(spec *boxspec.Spec, st boxState) (string, error) {
+	az := ""
+	for _, v := range spec.Volumes {
+		volAZ := aws.ToString(st.Volumes[v.Volume].AvailabilityZone)
+		if az != "" && volAZ != az {
+			return "", fmt.Errorf("volumes are in different AZs (%s, %s); a box can only attach volumes in its own AZ", az, volAZ)
+		}
+		az = volAZ
+	}
+	return az, nil
+}
+
+func orAny(r string) string {
+	if r == "" {
+		return "any"
+	}
+	return r
+}
+
+// applyBox runs the planned steps. Spawning, starting and resizing change
+// the instance, so it is looked up again by name after each of them.
+func applyBox(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, spec *boxspec.Spec, actions []boxAction) error {
+	instanceID := ""
+	if inst, err := findBox(ctx, client, spec.Name); err != nil {
+		return err
+	} else if inst != nil {
+		instanceID = aws.ToString(inst.InstanceId)
+	}
+	refind := func() error {
+		inst, err := findBox(ctx, client, spec.Name)
+		if err != nil {
+			return err
+		}
+		if inst == nil {
+			return fmt.Errorf("box %s disappeared", spec.Name)
+		}
+		instanceID = aws.ToString(inst.InstanceId)
+		return nil
+	}
+	// SSH steps on a box that was just booted wait for its status checks.
+	booted := false
+	waitForSSH := func() error {
+		if !booted {
+			return nil
+		}
+		fmt.Printf("Waiting for %s to pass status checks...\n", instanceID)
+		waiter := ec2.NewInstanceStatusOkWaiter(client)
+		if err := waiter.Wait(ctx, &ec2.DescribeInstanceStatusInput{
+			InstanceIds: []string{instanceID},
+		}, healthCheckTimeout); err != nil {
+			return fmt.Errorf("waiting for %s: %w", instanceID, err)
+		}
+		booted = false
+		return nil
+	}
+
+	for _, a := range actions {
+		fmt.Printf("\n==> %s %s\n", a.Op, a.Detail)
+		switch a.Op {
+		case opSpawn:
+			from, err := spawnSource(ctx, dcfg, client, r53client, spec.From)
+			if err != nil {
+				return err
+			}
+			opts := spawnOptions{
+				InstanceType: spec.Type,
+				AZ:           a.Target,
+				Name:         spec.Name,
+				MaxPrice:     spec.MaxPrice,
+				From:         from,
+			}
+			if r := spec.Requirements; r != nil {
+				opts.VCPU, opts.Mem, opts.Strategy, opts.OneTime = r.VCPU, r.Mem, r.Strategy, r.OneTime
+				if opts.Strategy == "" {
+					opts.Strategy = string(types.SpotAllocationStrategyPriceCapacityOptimized)
+				}
+				opts.Filter = awsutil.TypeFilter{Families: r.Families, CPU: r.CPU}
+			}
+			id, err := spawnInstance(ctx, dcfg, client, r53client, opts)
+			if err != nil {
+				return err
+			}
+			instanceID = id
+			booted = true
+
+		case opStart:
+			rest, err := applyPendingRebids(ctx, dcfg, client, r53client, []string{instanceID})
+			if err != nil {
+				return err
+			}
+			if len(rest) > 0 {
+				if err := startInstances(ctx, client, rest); err != nil {
+					return err
+				}
+				waiter := ec2.NewInstanceRunningWaiter(client)
+				if err := waiter.Wait(ctx, &ec2.DescribeInstancesInput{
+					InstanceIds: []string{instanceID},
+				}, 5*time.Minute); err != nil {
+					return fmt.Errorf("waiting for instance to start: %w", err)
+				}
+			}
+			if err := refind(); err != nil {
+				return err
+			}
+			booted = true
+
+		case opResize:
+			inst, err := describeInstance(ctx, client, instanceID)
+			if err != nil {
+				return err
+			}
+			newType := spec.Type
+			if newType == "" {
+				newType = string(inst.InstanceType)
+			}
+			opts := resizeOptions{Bid: spec.MaxPrice, AZ: a.Target}
+			if err := resizeInstance(ctx, dcfg, client, r53client, instanceID, newType, opts); err != nil {
+				return err
+			}
+			if err := refind(); err != nil {
+				return err
+			}
+			booted = true
+
+		case opTag:
+			var tags []types.Tag
+			for _, k := range slices.Sorted(maps.Keys(spec.Tags)) {
+				tags = append(tags, types.Tag{Key: aws.String(k), Value: aws.String(spec.Tags[k])})
+			}
+			if err := tagInstance(ctx, client, instanceID, tags...); err != nil {
+				return err
+			}
+
+		case opAttach:
+			if err := volumeAttach(ctx, client, a.Target, instanceID, a.Device); err != nil {
+				return err
+			}
+
+		case opDNS:
+			if err := updateDNS(ctx, dcfg, client, r53client, instanceID, a.Target); err != nil {
+				return err
+			}
+
+		case opNix:
+			if err := waitForSSH(); err != nil {
+				return err
+			}
+			data, err := os.ReadFile(spec.NixConfig)
+			if err != nil {
+				return fmt.Errorf("reading nix_config: %w", err)
+			}
+			if err := nixUpdate(ctx, dcfg, client, instanceID, spec.NixConfig); err != nil {
+				return err
+			}
+			if err := tagInstance(ctx, client, instanceID, types.Tag{Key: aws.String(nixConfigTag), Value: aws.String(contentHash(data))}); err != nil {
+				return err
+			}
+
+		case opAutoStop:
+			if err := waitForSSH(); err != nil {
+				return err
+			}
+			if err := scheduleStop(ctx, dcfg, client, spec.AutoStop, []string{instanceID}); err != nil {
+				return err
+			}
+			if err := tagInstance(ctx, client, instanceID, types.Tag{Key: aws.String(autoStopTag), Value: aws.String(spec.AutoStop)}); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Printf("\nBox %s (%s) matches the spec.\n", spec.Name, instanceID)
+	return nil
+}
+
+func tagInstance(ctx context.Context, client *ec2.Client, instanceID string, tags ...types.Tag) error {
+	_, err := client.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{instanceID},
+		Tags:      tags,
+	})
+	if err != nil {
+		return fmt.Errorf("tagging %s: %w", instanceID, err)
+	}
+	return nil
+}
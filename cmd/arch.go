@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/emaland/devbox/internal/config"
+)
+
+// typeArch returns the architecture an instance type's AMI must be built
+// for. x86 types also list i386, so x86_64 wins when it is there.
+func typeArch(info types.InstanceTypeInfo) string {
+	var archs []types.ArchitectureType
+	if info.ProcessorInfo != nil {
+		archs = info.ProcessorInfo.SupportedArchitectures
+	}
+	for _, want := range []types.ArchitectureType{types.ArchitectureTypeX8664, types.ArchitectureTypeArm64} {
+		if slices.Contains(archs, want) {
+			return string(want)
+		}
+	}
+	if len(archs) > 0 {
+		return string(archs[0])
+	}
+	return string(types.ArchitectureTypeX8664)
+}
+
+// instanceTypeArch looks up the architecture of an instance type.
+func instanceTypeArch(ctx context.Context, client *ec2.Client, instanceType string) (string, error) {
+	desc, err := client.DescribeInstanceTypes(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []types.InstanceType{types.InstanceType(instanceType)},
+	})
+	if err != nil {
+		return "", fmt.Errorf("describing instance type %s: %w", instanceType, err)
+	}
+	if len(desc.InstanceTypes) == 0 {
+		return "", fmt.Errorf("instance type %s not found", instanceType)
+	}
+	return typeArch(desc.InstanceTypes[0]), nil
+}
+
+// imageArch looks up the architecture an AMI was built for.
+func imageArch(ctx context.Context, client *ec2.Client, imageID string) (string, error) {
+	desc, err := client.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []string{imageID},
+	})
+	if err != nil {
+		return "", fmt.Errorf("describing image %s: %w", imageID, err)
+	}
+	if len(desc.Images) == 0 {
+		return "", fmt.Errorf("image %s not found", imageID)
+	}
+	return string(desc.Images[0].Architecture), nil
+}
+
+// templateImageFor returns the NixOS AMI to launch instanceType from when
+// the launch template's AMI is built for another architecture, or "" when
+// the template's AMI will do.
+func templateImageFor(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, data *types.ResponseLaunchTemplateData, arch string) (string, error) {
+	tmplArch, err := imageArch(ctx, client, aws.ToString(data.ImageId))
+	if err != nil {
+		return "", err
+	}
+	if tmplArch == arch {
+		return "", nil
+	}
+	return lookupAMI(ctx, dcfg, client, arch)
+}
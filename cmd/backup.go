@@ -0,0 +1,464 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/emaland/devbox/internal/awsutil"
+)
+
+// Volume and snapshot tags for scheduled backups. backupPolicyTag holds a
+// volume's policy, like "daily:7,weekly:4"; the other two mark the
+// snapshots backup run takes, so it only ever prunes its own.
+const (
+	backupPolicyTag   = "devbox-backup"
+	backupOfTag       = "devbox-backup-of"
+	backupScheduleTag = "devbox-backup-schedule"
+)
+
+// backupPeriods are the schedules a policy can use, in display order.
+var backupPeriods = []struct {
+	Name        string
+	Period      time.Duration
+	DefaultKeep int
+}{
+	{"daily", 24 * time.Hour, 7},
+	{"weekly", 7 * 24 * time.Hour, 4},
+	{"monthly", 30 * 24 * time.Hour, 12},
+}
+
+// backupSlack lets a snapshot count as due slightly early, so a daily cron
+// job isn't skipped because yesterday's run started a minute later.
+const backupSlack = time.Hour
+
+type backupRule struct {
+	Schedule string
+	Keep     int
+}
+
+// backupPolicy is the set of schedules a volume is backed up on.
+type backupPolicy []backupRule
+
+func (p backupPolicy) String() string {
+	parts := make([]string, len(p))
+	for i, r := range p {
+		parts[i] = fmt.Sprintf("%s:%d", r.Schedule, r.Keep)
+	}
+	return strings.Join(parts, ",")
+}
+
+func backupPeriod(schedule string) (time.Duration, bool) {
+	for _, b := range backupPeriods {
+		if b.Name == schedule {
+			return b.Period, true
+		}
+	}
+	return 0, false
+}
+
+// parseBackupPolicy parses a policy tag value.
+func parseBackupPolicy(s string) (backupPolicy, error) {
+	var p backupPolicy
+	for _, part := range strings.Split(s, ",") {
+		schedule, keepStr, ok := strings.Cut(strings.TrimSpace(part), ":")
+		keep, err := strconv.Atoi(keepStr)
+		if _, known := backupPeriod(schedule); !ok || !known || err != nil || keep < 1 {
+			return nil, fmt.Errorf("invalid backup policy %q: want schedule:keep pairs like daily:7,weekly:4", s)
+		}
+		p = p.with(schedule, keep)
+	}
+	return p, nil
+}
+
+// with returns p with schedule's rule added or replaced.
+func (p backupPolicy) with(schedule string, keep int) backupPolicy {
+	for i := range p {
+		if p[i].Schedule == schedule {
+			p[i].Keep = keep
+			return p
+		}
+	}
+	return append(p, backupRule{schedule, keep})
+}
+
+// --- flags ---
+
+// The policy flags are order-sensitive: each --keep applies to the
+// schedule flag before it, as in --daily --keep 7 --weekly --keep 4.
+
+type scheduleFlag struct {
+	policy   *backupPolicy
+	schedule string
+	keep     int
+}
+
+func (f *scheduleFlag) Set(v string) error {
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	if on {
+		*f.policy = f.policy.with(f.schedule, f.keep)
+	}
+	return nil
+}
+
+func (f *scheduleFlag) String() string   { return "false" }
+func (f *scheduleFlag) Type() string     { return "bool" }
+func (f *scheduleFlag) IsBoolFlag() bool { return true }
+
+type keepFlag struct {
+	policy *backupPolicy
+}
+
+func (f *keepFlag) Set(v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return fmt.Errorf("want a positive number of snapshots to keep")
+	}
+	p := *f.policy
+	if len(p) == 0 {
+		return fmt.Errorf("--keep must follow --daily, --weekly or --monthly")
+	}
+	p[len(p)-1].Keep = n
+	return nil
+}
+
+func (f *keepFlag) String() string { return "" }
+func (f *keepFlag) Type() string   { return "int" }
+
+// addBackupPolicyFlags adds --daily, --weekly, --monthly and --keep, which
+// build up policy as they are parsed.
+func addBackupPolicyFlags(fs *pflag.FlagSet, policy *backupPolicy) {
+	for _, b := range backupPeriods {
+		f := fs.VarPF(&scheduleFlag{policy: policy, schedule: b.Name, keep: b.DefaultKeep}, b.Name, "",
+			fmt.Sprintf("Snapshot %s (keeps %d unless --keep follows)", b.Name, b.DefaultKeep))
+		f.NoOptDefVal = "true"
+	}
+	fs.Var(&keepFlag{policy: policy}, "keep", "Snapshots to keep for the preceding schedule")
+}
+
+// --- backup-policy ---
+
+func newVolumeBackupPolicyCmd() *cobra.Command {
+	bp := &cobra.Command{
+		Use:   "backup-policy",
+		Short: "Manage scheduled snapshot policies (set, clear, ls)",
+	}
+
+	var policy backupPolicy
+	set := &cobra.Command{
+		Use:   "set <volume>",
+		Short: "Set a volume's backup schedules and retention",
+		Long: `Set which schedules a volume is snapshotted on and how many snapshots of
+each to keep. Each --keep applies to the schedule flag before it; without
+one, daily keeps 7, weekly 4 and monthly 12. The policy is stored in the
+volume's devbox-backup tag and replaces any earlier one.
+
+Snapshots are taken by "devbox volume backup run", from cron or by hand.`,
+		Example: "  devbox volume backup-policy set dev-data-volume --daily --keep 7 --weekly --keep 4",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return backupPolicySet(cmd.Context(), ec2Client, args[0], policy)
+		},
+	}
+	addBackupPolicyFlags(set.Flags(), &policy)
+
+	bp.AddCommand(
+		set,
+		&cobra.Command{
+			Use:   "clear <volume>",
+			Short: "Stop scheduled backups of a volume (existing snapshots are kept)",
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return backupPolicyClear(cmd.Context(), ec2Client, args[0])
+			},
+		},
+		&cobra.Command{
+			Use:     "ls",
+			Aliases: []string{"list"},
+			Short:   "List volumes with a backup policy",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return backupPolicyLS(cmd.Context(), ec2Client)
+			},
+		},
+	)
+
+	return bp
+}
+
+func backupPolicySet(ctx context.Context, client *ec2.Client, volumeRef string, policy backupPolicy) error {
+	if len(policy) == 0 {
+		return fmt.Errorf("give at least one of --daily, --weekly or --monthly")
+	}
+	volID, err := resolveVolume(ctx, client, volumeRef)
+	if err != nil {
+		return err
+	}
+	if _, err := client.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{volID},
+		Tags:      []types.Tag{{Key: aws.String(backupPolicyTag), Value: aws.String(policy.String())}},
+	}); err != nil {
+		return fmt.Errorf("tagging %s: %w", volID, err)
+	}
+	fmt.Printf("Backup policy for %s: %s\n", volID, policy)
+	fmt.Println("Snapshots are taken by: devbox volume backup run")
+	return nil
+}
+
+func backupPolicyClear(ctx context.Context, client *ec2.Client, volumeRef string) error {
+	volID, err := resolveVolume(ctx, client, volumeRef)
+	if err != nil {
+		return err
+	}
+	if _, err := client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+		Resources: []string{volID},
+		Tags:      []types.Tag{{Key: aws.String(backupPolicyTag)}},
+	}); err != nil {
+		return fmt.Errorf("untagging %s: %w", volID, err)
+	}
+	fmt.Printf("Cleared the backup policy of %s. Its backup snapshots were kept.\n", volID)
+	return nil
+}
+
+func backupPolicyLS(ctx context.Context, client *ec2.Client) error {
+	vols, err := backupVolumes(ctx, client, nil)
+	if err != nil {
+		return err
+	}
+	if len(vols) == 0 {
+		fmt.Println("No volumes have a backup policy.")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VOLUME ID\tNAME\tPOLICY")
+	for _, v := range vols {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", aws.ToString(v.VolumeId), awsutil.NameTag(v.Tags), awsutil.TagValue(v.Tags, backupPolicyTag))
+	}
+	w.Flush()
+	return nil
+}
+
+// --- backup run ---
+
+func newVolumeBackupCmd() *cobra.Command {
+	backup := &cobra.Command{
+		Use:   "backup",
+		Short: "Take scheduled snapshots (run)",
+	}
+
+	var dryRun bool
+	run := &cobra.Command{
+		Use:   "run [volume...]",
+		Short: "Snapshot volumes whose backups are due and prune old ones",
+		Long: `For every volume with a backup policy, or just the ones named, start a
+snapshot for each schedule whose last backup is older than its period
+(less an hour of slack), then delete the oldest completed backups beyond
+each schedule's --keep. Only snapshots taken by backup run are pruned.
+
+Run it from cron at least as often as the shortest schedule, e.g.
+
+  0 3 * * * devbox volume backup run`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return backupRun(cmd.Context(), ec2Client, args, time.Now(), dryRun)
+		},
+	}
+	run.Flags().BoolVar(&dryRun, "dry-run", false, "Show what would be snapshotted and pruned")
+
+	backup.AddCommand(run)
+	return backup
+}
+
+func backupRun(ctx context.Context, client *ec2.Client, volumeRefs []string, now time.Time, dryRun bool) error {
+	var volIDs []string
+	for _, ref := range volumeRefs {
+		id, err := resolveVolume(ctx, client, ref)
+		if err != nil {
+			return err
+		}
+		volIDs = append(volIDs, id)
+	}
+	vols, err := backupVolumes(ctx, client, volIDs)
+	if err != nil {
+		return err
+	}
+	if len(vols) == 0 {
+		fmt.Println("No volumes have a backup policy. Set one with: devbox volume backup-policy set")
+		return nil
+	}
+
+	// One volume's failure shouldn't stop the others being backed up.
+	var errs []error
+	for _, v := range vols {
+		if err := backupVolume(ctx, client, v, now, dryRun); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func backupVolume(ctx context.Context, client *ec2.Client, vol types.Volume, now time.Time, dryRun bool) error {
+	volID := aws.ToString(vol.VolumeId)
+	policy, err := parseBackupPolicy(awsutil.TagValue(vol.Tags, backupPolicyTag))
+	if err != nil {
+		return fmt.Errorf("%s: %w", volID, err)
+	}
+	snaps, err := backupSnapshots(ctx, client, vol)
+	if err != nil {
+		return err
+	}
+
+	// 1. Start the due snapshots.
+	name := awsutil.TagValue(vol.Tags, "Name")
+	if name == "" {
+		name = volID
+	}
+	for _, schedule := range dueSchedules(policy, snaps, now) {
+		snapName := fmt.Sprintf("%s-%s-%s", name, schedule, now.UTC().Format("2006-01-02-1504"))
+		if dryRun {
+			fmt.Printf("%s: would snapshot %s\n", volID, snapName)
+			continue
+		}
+		out, err := client.CreateSnapshot(ctx, &ec2.CreateSnapshotInput{
+			VolumeId:    aws.String(volID),
+			Description: aws.String(fmt.Sprintf("devbox %s backup of %s", schedule, volID)),
+			TagSpecifications: []types.TagSpecification{{
+				ResourceType: types.ResourceTypeSnapshot,
+				Tags: []types.Tag{
+					{Key: aws.String("Name"), Value: aws.String(snapName)},
+					{Key: aws.String(backupOfTag), Value: aws.String(volID)},
+					{Key: aws.String(backupScheduleTag), Value: aws.String(schedule)},
+					{Key: aws.String("devbox-managed"), Value: aws.String("true")},
+				},
+			}},
+		})
+		if err != nil {
+			return fmt.Errorf("snapshotting %s: %w", volID, err)
+		}
+		fmt.Printf("%s: started %s backup %s\n", volID, schedule, aws.ToString(out.SnapshotId))
+	}
+
+	// 2. Prune the backups each schedule no longer keeps.
+	for _, s := range backupsToPrune(policy, snaps) {
+		snapID := aws.ToString(s.SnapshotId)
+		if dryRun {
+			fmt.Printf("%s: would delete %s backup %s from %s\n", volID, awsutil.TagValue(s.Tags, backupScheduleTag), snapID, aws.ToTime(s.StartTime).Format("2006-01-02 15:04"))
+			continue
+		}
+		if _, err := client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(snapID)}); err != nil {
+			// A snapshot backing an AMI can't be deleted; the rest can.
+			fmt.Fprintf(os.Stderr, "Warning: could not delete %s: %v\n", snapID, err)
+			continue
+		}
+		fmt.Printf("%s: deleted %s backup %s\n", volID, awsutil.TagValue(s.Tags, backupScheduleTag), snapID)
+	}
+	return nil
+}
+
+// dueSchedules returns the schedules in policy whose newest backup in
+// snaps is missing or at least a period (less backupSlack) old.
+func dueSchedules(policy backupPolicy, snaps []types.Snapshot, now time.Time) []string {
+	var due []string
+	for _, r := range policy {
+		period, _ := backupPeriod(r.Schedule)
+		var latest time.Time
+		for _, s := range snaps {
+			if awsutil.TagValue(s.Tags, backupScheduleTag) != r.Schedule || s.State == types.SnapshotStateError {
+				continue
+			}
+			if t := aws.ToTime(s.StartTime); t.After(latest) {
+				latest = t
+			}
+		}
+		if latest.IsZero() || now.Sub(latest) >= period-backupSlack {
+			due = append(due, r.Schedule)
+		}
+	}
+	return due
+}
+
+// backupsToPrune returns the completed backups in snaps beyond each
+// schedule's keep, newest kept first, plus any that failed. Pending
+// snapshots are left alone, and schedules no longer in the policy are
+// kept until the snapshots are deleted by hand.
+func backupsToPrune(policy backupPolicy, snaps []types.Snapshot) []types.Snapshot {
+	var prune []types.Snapshot
+	for _, r := range policy {
+		var done []types.Snapshot
+		for _, s := range snaps {
+			if awsutil.TagValue(s.Tags, backupScheduleTag) != r.Schedule {
+				continue
+			}
+			switch s.State {
+			case types.SnapshotStateCompleted:
+				done = append(done, s)
+			case types.SnapshotStateError:
+				prune = append(prune, s)
+			}
+		}
+		slices.SortFunc(done, func(a, b types.Snapshot) int {
+			return aws.ToTime(b.StartTime).Compare(aws.ToTime(a.StartTime))
+		})
+		if len(done) > r.Keep {
+			prune = append(prune, done[r.Keep:]...)
+		}
+	}
+	return prune
+}
+
+// backupVolumes returns the volumes with a backup policy, limited to
+// volIDs when any are given.
+func backupVolumes(ctx context.Context, client *ec2.Client, volIDs []string) ([]types.Volume, error) {
+	input := &ec2.DescribeVolumesInput{
+		Filters: []types.Filter{{Name: aws.String("tag-key"), Values: []string{backupPolicyTag}}},
+	}
+	if len(volIDs) > 0 {
+		input.VolumeIds = volIDs
+	}
+	out, err := client.DescribeVolumes(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("describing volumes: %w", err)
+	}
+	if len(volIDs) > len(out.Volumes) {
+		for _, id := range volIDs {
+			if !slices.ContainsFunc(out.Volumes, func(v types.Volume) bool { return aws.ToString(v.VolumeId) == id }) {
+				return nil, fmt.Errorf("%s has no backup policy; set one with: devbox volume backup-policy set %s --daily", id, id)
+			}
+		}
+	}
+	return out.Volumes, nil
+}
+
+// backupSnapshots returns the snapshots backup run has taken of vol and of
+// the volumes it replaced. Restore, encrypt and cross-AZ moves hand the
+// policy to the new volume, so its retention covers the whole lineage.
+func backupSnapshots(ctx context.Context, client *ec2.Client, vol types.Volume) ([]types.Snapshot, error) {
+	volID := aws.ToString(vol.VolumeId)
+	var snaps []types.Snapshot
+	p := ec2.NewDescribeSnapshotsPaginator(client, &ec2.DescribeSnapshotsInput{
+		OwnerIds: []string{"self"},
+		Filters:  []types.Filter{{Name: aws.String("tag:" + backupOfTag), Values: volumeLineage(vol)}},
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing backups of %s: %w", volID, err)
+		}
+		snaps = append(snaps, page.Snapshots...)
+	}
+	return snaps, nil
+}
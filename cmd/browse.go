@@ -0,0 +1,320 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/spf13/cobra"
+
+	"github.com/emaland/devbox/internal/awsutil"
+	"github.com/emaland/devbox/internal/config"
+)
+
+// browseTag marks a temporary volume made by volume browse, with the
+// snapshot it was created from.
+const browseTag = "devbox-browse"
+
+type browseOptions struct {
+	Instance string
+	Cleanup  bool
+	NoShell  bool
+}
+
+func newVolumeBrowseCmd() *cobra.Command {
+	var opts browseOptions
+
+	cmd := &cobra.Command{
+		Use:   "browse <snapshot-id>",
+		Short: "Mount a snapshot read-only on a running box to copy files back",
+		Long: `Create a temporary volume from a snapshot, attach it to a running box at
+a spare device, and mount it read-only at /mnt/restore-<snapshot-id>. An SSH
+session opens in the mount; when it ends, the volume is unmounted, detached
+and deleted.
+
+The copy's home-data label is cleared before it is mounted, so the box
+can't mistake it for /home if it reboots with the copy attached.
+
+With --no-shell the volume stays mounted until
+"devbox volume browse --cleanup [snapshot-id]", which removes the temporary
+volumes of that snapshot, or of every snapshot when none is given.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if opts.Cleanup {
+				return cobra.MaximumNArgs(1)(cmd, args)
+			}
+			return cobra.ExactArgs(1)(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.Cleanup {
+				snapID := ""
+				if len(args) == 1 {
+					snapID = args[0]
+				}
+				return browseCleanup(cmd.Context(), dcfg, ec2Client, snapID)
+			}
+			if opts.Instance == "" {
+				id, err := autoDetectRunningInstance(cmd.Context(), ec2Client)
+				if err != nil {
+					return err
+				}
+				opts.Instance = id
+			}
+			return volumeBrowse(cmd.Context(), dcfg, ec2Client, args[0], opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.Instance, "instance", "", "Running instance to mount on (default: auto-detect)")
+	cmd.Flags().BoolVar(&opts.Cleanup, "cleanup", false, "Unmount, detach and delete temporary browse volumes")
+	cmd.Flags().BoolVar(&opts.NoShell, "no-shell", false, "Leave the snapshot mounted instead of opening a shell in it")
+
+	return cmd
+}
+
+// browseMountPoint is where the snapshot is mounted on the box.
+func browseMountPoint(snapID string) string {
+	return "/mnt/restore-" + snapID
+}
+
+// spareDevice returns the first device name from /dev/xvdg to /dev/xvdz
+// that inst isn't using. /dev/sdX and /dev/xvdX are the same slot.
+func spareDevice(inst types.Instance) (string, error) {
+	used := map[string]bool{}
+	for _, bdm := range inst.BlockDeviceMappings {
+		name := aws.ToString(bdm.DeviceName)
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "/dev/xvd"), "/dev/sd")
+		used[name] = true
+	}
+	for c := 'g'; c <= 'z'; c++ {
+		if !used[string(c)] {
+			return "/dev/xvd" + string(c), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no spare device from /dev/xvdg to /dev/xvdz", aws.ToString(inst.InstanceId))
+}
+
+// browseMountScript mounts the volume read-only by its device path. A
+// snapshot of /home carries the home-data label, and the box mounts /home by
+// label, so the copy is relabelled first; otherwise a reboot with it still
+// attached could mount the copy as /home. A snapshot of a live filesystem
+// has an unreplayed journal, so replay is skipped (noload, norecovery);
+// nouuid lets XFS mount a copy of a mounted filesystem.
+const browseMountScript = `set -e
+mnt=@@MOUNT@@
+disk=
+for i in $(seq 30); do
+  disk=$(lsblk -dno NAME,SERIAL | awk '$2 == "@@SERIAL@@" {print $1}')
+  [ -n "$disk" ] && break
+  [ -e @@DEVICE@@ ] && { disk=$(basename "$(readlink -f @@DEVICE@@)"); break; }
+  sleep 1
+done
+[ -n "$disk" ] || { echo "the volume didn't show up as a disk" >&2; exit 1; }
+src=/dev/$disk
+part=$(lsblk -lno NAME,TYPE "$src" | awk '$2 == "part" {p = $1} END {print p}')
+[ -n "$part" ] && src=/dev/$part
+fstype=$(sudo blkid -o value -s TYPE "$src")
+if [ "$(sudo blkid -o value -s LABEL "$src")" = home-data ]; then
+  relabeled=
+  case $fstype in
+    xfs) sudo xfs_admin -L -- "$src" >/dev/null 2>&1 && relabeled=1 ;;
+    ext2|ext3|ext4) sudo e2label "$src" "" >/dev/null 2>&1 && relabeled=1 ;;
+  esac
+  if [ -n "$relabeled" ]; then
+    sudo udevadm trigger --action=change "$src" >/dev/null 2>&1 || true
+    sudo udevadm settle >/dev/null 2>&1 || true
+  else
+    echo "Warning: couldn't clear the home-data label on $src; detach it before the box reboots, or it may be mounted as /home" >&2
+  fi
+fi
+case $fstype in
+  xfs) opts=ro,norecovery,nouuid ;;
+  ext3|ext4) opts=ro,noload ;;
+  *) opts=ro ;;
+esac
+sudo mkdir -p "$mnt"
+sudo mount -o "$opts" "$src" "$mnt"`
+
+// browseUnmountScript unmounts the volume if it is mounted.
+const browseUnmountScript = `mnt=@@MOUNT@@
+if mountpoint -q "$mnt"; then sudo umount "$mnt" || exit 1; fi
+sudo rmdir "$mnt" 2>/dev/null || true`
+
+func volumeBrowse(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, snapID string, opts browseOptions) error {
+	snapDesc, err := client.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: []string{snapID}})
+	if err != nil {
+		return fmt.Errorf("describing snapshot %s: %w", snapID, err)
+	}
+	if len(snapDesc.Snapshots) == 0 {
+		return fmt.Errorf("snapshot %s not found", snapID)
+	}
+	if state := snapDesc.Snapshots[0].State; state != types.SnapshotStateCompleted {
+		return fmt.Errorf("snapshot %s is %s, not completed", snapID, state)
+	}
+	existing, err := browseVolumes(ctx, client, snapID)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("%s is already being browsed on %s; clean up with: devbox volume browse --cleanup %s",
+			snapID, aws.ToString(existing[0].VolumeId), snapID)
+	}
+
+	inst, err := describeInstance(ctx, client, opts.Instance)
+	if err != nil {
+		return err
+	}
+	if inst.State.Name != types.InstanceStateNameRunning || inst.PublicIpAddress == nil {
+		return fmt.Errorf("%s isn't running", opts.Instance)
+	}
+	ip := aws.ToString(inst.PublicIpAddress)
+	device, err := spareDevice(inst)
+	if err != nil {
+		return err
+	}
+	mnt := browseMountPoint(snapID)
+
+	// 1. Create the temporary volume next to the box.
+	created, err := client.CreateVolume(ctx, &ec2.CreateVolumeInput{
+		AvailabilityZone: inst.Placement.AvailabilityZone,
+		SnapshotId:       aws.String(snapID),
+		VolumeType:       types.VolumeTypeGp3,
+		TagSpecifications: []types.TagSpecification{{
+			ResourceType: types.ResourceTypeVolume,
+			Tags: []types.Tag{
+				{Key: aws.String("Name"), Value: aws.String("restore-" + snapID)},
+				{Key: aws.String(browseTag), Value: aws.String(snapID)},
+				{Key: aws.String("devbox-managed"), Value: aws.String("true")},
+			},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("creating volume from %s: %w", snapID, err)
+	}
+	volID := aws.ToString(created.VolumeId)
+	fmt.Printf("Created temporary volume %s from %s, waiting for available state...\n", volID, snapID)
+
+	// From here on, a failure removes whatever was set up.
+	undo := func(err error) error {
+		fmt.Fprintf(os.Stderr, "Cleaning up %s...\n", volID)
+		if cerr := browseCleanup(ctx, dcfg, client, snapID); cerr != nil {
+			return errors.Join(err, cerr)
+		}
+		return err
+	}
+	if err := awsutil.PollVolumeState(ctx, client, volID, "available", VolumePollInterval, 10*time.Minute); err != nil {
+		return undo(err)
+	}
+
+	// 2. Attach it at a spare device and mount it read-only.
+	if err := volumeAttach(ctx, client, volID, opts.Instance, device); err != nil {
+		return undo(err)
+	}
+	script := strings.NewReplacer(
+		"@@MOUNT@@", mnt,
+		"@@SERIAL@@", strings.ReplaceAll(volID, "-", ""),
+		"@@DEVICE@@", device,
+	).Replace(browseMountScript)
+	mount := sshCommand(ctx, dcfg, ip, script)
+	mount.Stdout = os.Stdout
+	mount.Stderr = os.Stderr
+	if err := mount.Run(); err != nil {
+		return undo(fmt.Errorf("mounting %s on %s: %w", volID, opts.Instance, err))
+	}
+	fmt.Printf("\nSnapshot %s is mounted read-only at %s on %s.\n", snapID, mnt, opts.Instance)
+
+	if opts.NoShell {
+		fmt.Printf("It stays attached until you clean up with: devbox volume browse --cleanup %s\n", snapID)
+		return nil
+	}
+
+	// 3. Open a shell in the mount, and clean up when it ends. Ctrl-C goes
+	// to the remote shell; it mustn't kill devbox before the cleanup.
+	fmt.Println("Copy what you need, then exit the shell to unmount and delete the volume.")
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	session := sshSessionCommand(ctx, dcfg, ip, fmt.Sprintf("cd %s && exec $SHELL -l", mnt))
+	sessionErr := session.Run()
+	signal.Stop(sigs)
+	if sessionErr != nil {
+		fmt.Fprintf(os.Stderr, "Warning: SSH session ended with %v\n", sessionErr)
+	}
+	return browseCleanup(ctx, dcfg, client, snapID)
+}
+
+// browseCleanup unmounts, detaches and deletes the temporary volumes of
+// snapID, or of every snapshot if snapID is empty.
+func browseCleanup(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, snapID string) error {
+	vols, err := browseVolumes(ctx, client, snapID)
+	if err != nil {
+		return err
+	}
+	if len(vols) == 0 {
+		fmt.Println("No browse volumes to clean up.")
+		return nil
+	}
+	var errs []error
+	for _, v := range vols {
+		if err := cleanupBrowseVolume(ctx, dcfg, client, v); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func cleanupBrowseVolume(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, vol types.Volume) error {
+	volID := aws.ToString(vol.VolumeId)
+	mnt := browseMountPoint(awsutil.TagValue(vol.Tags, browseTag))
+
+	if len(vol.Attachments) > 0 {
+		instanceID := aws.ToString(vol.Attachments[0].InstanceId)
+		inst, err := describeInstance(ctx, client, instanceID)
+		if err != nil {
+			return err
+		}
+		// A stopped box has nothing mounted; a running one must unmount
+		// first, or the detach hangs until forced.
+		if inst.State.Name == types.InstanceStateNameRunning && inst.PublicIpAddress != nil {
+			fmt.Printf("Unmounting %s on %s...\n", mnt, instanceID)
+			umount := sshCommand(ctx, dcfg, *inst.PublicIpAddress, strings.ReplaceAll(browseUnmountScript, "@@MOUNT@@", mnt))
+			umount.Stdout = os.Stdout
+			umount.Stderr = os.Stderr
+			if err := umount.Run(); err != nil {
+				return fmt.Errorf("unmounting %s on %s (is a shell still in it?): %w", mnt, instanceID, err)
+			}
+		}
+		fmt.Printf("Detaching %s...\n", volID)
+		if _, err := client.DetachVolume(ctx, &ec2.DetachVolumeInput{VolumeId: aws.String(volID)}); err != nil {
+			return fmt.Errorf("detaching %s: %w", volID, err)
+		}
+		if err := awsutil.PollVolumeState(ctx, client, volID, "available", VolumePollInterval, 2*time.Minute); err != nil {
+			return err
+		}
+	}
+
+	if _, err := client.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: aws.String(volID)}); err != nil {
+		return fmt.Errorf("deleting %s: %w", volID, err)
+	}
+	fmt.Printf("Deleted temporary volume %s.\n", volID)
+	return nil
+}
+
+// browseVolumes returns the temporary volumes of snapID, or of every
+// snapshot if snapID is empty.
+func browseVolumes(ctx context.Context, client *ec2.Client, snapID string) ([]types.Volume, error) {
+	filter := types.Filter{Name: aws.String("tag-key"), Values: []string{browseTag}}
+	if snapID != "" {
+		filter = types.Filter{Name: aws.String("tag:" + browseTag), Values: []string{snapID}}
+	}
+	out, err := client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{Filters: []types.Filter{filter}})
+	if err != nil {
+		return nil, fmt.Errorf("describing browse volumes: %w", err)
+	}
+	return out.Volumes, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"testing"
@@ -16,11 +17,15 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go-v2/service/route53"
 	r53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/aws/smithy-go"
 	"github.com/docker/go-connections/nat"
+	"github.com/spf13/pflag"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/localstack"
 
 	"github.com/emaland/devbox/internal/awsutil"
+	"github.com/emaland/devbox/internal/boxspec"
+	"github.com/emaland/devbox/internal/cache"
 	"github.com/emaland/devbox/internal/config"
 )
 
@@ -170,6 +175,7 @@ func testDevboxConfig() config.DevboxConfig {
 		SpawnName:        "test-spawn",
 		NixOSAMIOwner:   "123456789012",
 		NixOSAMIPattern: "test-ami*",
+		RootVolume:      config.RootVolume{SizeGiB: 75, Type: "gp3"},
 	}
 }
 
@@ -198,6 +204,7 @@ func TestToLaunchSpec(t *testing.T) {
 		ImageId:      aws.String("ami-abc"),
 		InstanceType: types.InstanceTypeM5Large,
 		KeyName:      aws.String("mykey"),
+		UserData:     aws.String("IyEvYmluL2Jhc2g="),
 	}
 	got := toLaunchSpec(from)
 	if got == nil {
@@ -209,6 +216,520 @@ func TestToLaunchSpec(t *testing.T) {
 	if got.InstanceType != types.InstanceTypeM5Large {
 		t.Errorf("InstanceType = %v, want %v", got.InstanceType, types.InstanceTypeM5Large)
 	}
+	if aws.ToString(got.UserData) != "IyEvYmluL2Jhc2g=" {
+		t.Errorf("UserData = %q, want it preserved", aws.ToString(got.UserData))
+	}
+}
+
+func TestRenderDNSBootFiles(t *testing.T) {
+	script, unit, err := renderDNSBootFiles("/hostedzone/Z123", "dev.example.com")
+	if err != nil {
+		t.Fatalf("renderDNSBootFiles: %v", err)
+	}
+	if !strings.HasPrefix(script, "#!/bin/bash\n") {
+		t.Errorf("script does not start with a shebang: %q", script[:20])
+	}
+	for _, want := range []string{`--hosted-zone-id "/hostedzone/Z123"`, `"Name": "dev.example.com"`, `"TTL": 60`} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script missing %q", want)
+		}
+	}
+	for _, want := range []string{"Description=Update dev.example.com DNS on boot", "ExecStart=" + dnsScriptPath} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit missing %q", want)
+		}
+	}
+}
+
+func TestIsNixOSManagedUnit(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/nix/store/abc-unit-update-route53.service/update-route53.service\n", true},
+		{"/etc/static/systemd/system/update-route53.service", true},
+		{"/etc/systemd/system/update-route53.service", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isNixOSManagedUnit(tt.path); got != tt.want {
+			t.Errorf("isNixOSManagedUnit(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestEstimateCrossAZMove(t *testing.T) {
+	if got := estimateCrossAZMove(0); got != crossAZOverhead {
+		t.Errorf("estimate with no data volumes = %s, want %s", got, crossAZOverhead)
+	}
+	small, large := estimateCrossAZMove(64), estimateCrossAZMove(512)
+	if large <= small {
+		t.Errorf("estimate for 512 GiB (%s) not longer than for 64 GiB (%s)", large, small)
+	}
+	if got := estimateCrossAZMove(256); got != crossAZOverhead+32*time.Minute {
+		t.Errorf("estimate for 256 GiB = %s, want %s", got, crossAZOverhead+32*time.Minute)
+	}
+}
+
+func TestIsCapacityError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&smithy.GenericAPIError{Code: "InsufficientInstanceCapacity"}, true},
+		{&smithy.GenericAPIError{Code: "SpotMaxPriceTooLow"}, true},
+		{&smithy.GenericAPIError{Code: "Unsupported"}, true},
+		{fmt.Errorf("launching: %w", &smithy.GenericAPIError{Code: "InsufficientInstanceCapacity"}), true},
+		{&smithy.GenericAPIError{Code: "UnauthorizedOperation"}, false},
+		{&smithy.GenericAPIError{Code: "InvalidAMIID.NotFound"}, false},
+		{fmt.Errorf("network unreachable"), false},
+	}
+	for _, tt := range tests {
+		if got := isCapacityError(tt.err); got != tt.want {
+			t.Errorf("isCapacityError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRecordCapacityFailure(t *testing.T) {
+	awsutil.Cache = &cache.Store{Dir: t.TempDir()}
+	t.Cleanup(func() { awsutil.Cache = nil })
+
+	if got := recentCapacityFailures("us-east-2"); len(got) != 0 {
+		t.Fatalf("recentCapacityFailures on empty cache = %v", got)
+	}
+	recordCapacityFailure(launchCandidate{Type: "m6i.4xlarge", AZ: "us-east-2a"})
+	recordCapacityFailure(launchCandidate{Type: "c6i.4xlarge", AZ: "us-east-2b"})
+	recordCapacityFailure(launchCandidate{Type: "m6i.4xlarge", AZ: "us-west-2a"})
+
+	got := recentCapacityFailures("us-east-2")
+	if len(got) != 2 {
+		t.Fatalf("recentCapacityFailures = %v, want two entries", got)
+	}
+	if _, ok := got["m6i.4xlarge/us-east-2a"]; !ok {
+		t.Errorf("m6i.4xlarge/us-east-2a not recorded: %v", got)
+	}
+	if _, ok := got["m6i.4xlarge/us-west-2a"]; ok {
+		t.Errorf("us-west-2 failure leaked into us-east-2: %v", got)
+	}
+
+	// --refresh must neither hide recorded failures nor drop them on the
+	// next write.
+	awsutil.Cache.Refresh = true
+	if got := recentCapacityFailures("us-east-2"); len(got) != 2 {
+		t.Fatalf("recentCapacityFailures with refresh = %v, want two entries", got)
+	}
+	recordCapacityFailure(launchCandidate{Type: "r6i.4xlarge", AZ: "us-east-2c"})
+	if got := recentCapacityFailures("us-east-2"); len(got) != 3 {
+		t.Errorf("recentCapacityFailures after write with refresh = %v, want three entries", got)
+	}
+}
+
+// fakeScorer returns canned placement scores, filtered like the real API.
+type fakeScorer struct {
+	scores []awsutil.PlacementScore
+	got    awsutil.PlacementRequest
+}
+
+func (f *fakeScorer) PlacementScores(_ context.Context, req awsutil.PlacementRequest) ([]awsutil.PlacementScore, error) {
+	f.got = req
+	var out []awsutil.PlacementScore
+	for _, s := range f.scores {
+		if (s.AZ != "") == req.SingleAZ {
+			out = append(out, s)
+		}
+	}
+	awsutil.SortPlacementScores(out)
+	return out, nil
+}
+
+func TestPickAZ(t *testing.T) {
+	scorer := &fakeScorer{scores: []awsutil.PlacementScore{
+		{Region: "us-east-2", AZ: "us-east-2a", Score: 3},
+		{Region: "us-east-2", AZ: "us-east-2b", Score: 9},
+		{Region: "us-east-2", AZ: "us-east-2c", Score: 9},
+		{Region: "us-west-2", AZ: "us-west-2a", Score: 10},
+	}}
+	req := awsutil.PlacementRequest{InstanceTypes: []string{"m6i.4xlarge", "m7i.4xlarge", "m6a.4xlarge"}}
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		allowed []string
+		prefer  string
+		want    string
+	}{
+		{"best in region", nil, "", "us-east-2b"},
+		{"tie goes to preferred AZ", nil, "us-east-2c", "us-east-2c"},
+		{"pinned by data volume", []string{"us-east-2a"}, "us-east-2a", "us-east-2a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := pickAZ(ctx, scorer, req, "us-east-2", tt.allowed, tt.prefer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("pickAZ = %s, want %s", got, tt.want)
+			}
+			if !scorer.got.SingleAZ || len(scorer.got.Regions) != 1 || scorer.got.Regions[0] != "us-east-2" {
+				t.Errorf("request = %+v, want a single-AZ request for us-east-2", scorer.got)
+			}
+		})
+	}
+
+	if _, _, err := pickAZ(ctx, scorer, req, "us-east-2", []string{"us-east-2d"}, ""); err == nil {
+		t.Error("pickAZ with no scored allowed AZ should fail")
+	}
+}
+
+func TestFleetMaxPrice(t *testing.T) {
+	if got, err := fleetMaxPrice("0.55", false); err != nil || got != "0.5500" {
+		t.Errorf("fleetMaxPrice(0.55) = %q, %v; want 0.5500", got, err)
+	}
+	if got, err := fleetMaxPrice("", false); err != nil || got != "" {
+		t.Errorf("fleetMaxPrice(\"\") = %q, %v; want no cap", got, err)
+	}
+	for _, expr := range []string{"on-demand", "p95+10%", "current"} {
+		if got, err := fleetMaxPrice(expr, false); err != nil || got != "" {
+			t.Errorf("fleetMaxPrice(%q) = %q, %v; want no cap", expr, got, err)
+		}
+	}
+}
+
+func TestLaunchTemplateData(t *testing.T) {
+	in := &ec2.RunInstancesInput{
+		ImageId:            aws.String("ami-123"),
+		InstanceType:       types.InstanceTypeM6i4xlarge,
+		KeyName:            aws.String("dev"),
+		SubnetId:           aws.String("subnet-1"),
+		SecurityGroupIds:   []string{"sg-1"},
+		IamInstanceProfile: &types.IamInstanceProfileSpecification{Name: aws.String("devbox")},
+		BlockDeviceMappings: []types.BlockDeviceMapping{{
+			DeviceName: aws.String("/dev/xvda"),
+			Ebs:        &types.EbsBlockDevice{VolumeSize: aws.Int32(75), VolumeType: types.VolumeTypeGp3},
+		}},
+		TagSpecifications: []types.TagSpecification{{
+			ResourceType: types.ResourceTypeInstance,
+			Tags:         []types.Tag{{Key: aws.String("Name"), Value: aws.String("box")}},
+		}},
+		InstanceMarketOptions: &types.InstanceMarketOptionsRequest{
+			MarketType:  types.MarketTypeSpot,
+			SpotOptions: &types.SpotMarketOptions{MaxPrice: aws.String("0.50")},
+		},
+	}
+	data := launchTemplateData(in)
+	if aws.ToString(data.ImageId) != "ami-123" || data.InstanceType != types.InstanceTypeM6i4xlarge {
+		t.Errorf("image/type = %s/%s", aws.ToString(data.ImageId), data.InstanceType)
+	}
+	if aws.ToString(data.IamInstanceProfile.Name) != "devbox" {
+		t.Errorf("IamInstanceProfile = %+v", data.IamInstanceProfile)
+	}
+	if len(data.BlockDeviceMappings) != 1 || aws.ToInt32(data.BlockDeviceMappings[0].Ebs.VolumeSize) != 75 {
+		t.Errorf("BlockDeviceMappings = %+v", data.BlockDeviceMappings)
+	}
+	if len(data.TagSpecifications) != 1 || awsutil.NameTag(data.TagSpecifications[0].Tags) != "box" {
+		t.Errorf("TagSpecifications = %+v", data.TagSpecifications)
+	}
+	if aws.ToString(data.InstanceMarketOptions.SpotOptions.MaxPrice) != "0.50" {
+		t.Errorf("spot max price = %v", data.InstanceMarketOptions.SpotOptions.MaxPrice)
+	}
+}
+
+func TestRootBlockDevices(t *testing.T) {
+	plain := rootBlockDevices(config.RootVolume{SizeGiB: 75, Type: "gp3"})[0]
+	if aws.ToString(plain.DeviceName) != "/dev/xvda" || aws.ToInt32(plain.Ebs.VolumeSize) != 75 {
+		t.Errorf("root = %s %+v", aws.ToString(plain.DeviceName), *plain.Ebs)
+	}
+	if plain.Ebs.Iops != nil || plain.Ebs.Throughput != nil || plain.Ebs.Encrypted != nil {
+		t.Errorf("unset fields were filled in: %+v", *plain.Ebs)
+	}
+
+	ebs := rootBlockDevices(config.RootVolume{SizeGiB: 200, Type: "gp3", IOPS: 6000, Throughput: 500, KMSKeyID: "alias/devbox"})[0].Ebs
+	if aws.ToInt32(ebs.Iops) != 6000 || aws.ToInt32(ebs.Throughput) != 500 {
+		t.Errorf("performance = %v IOPS, %v MiB/s", aws.ToInt32(ebs.Iops), aws.ToInt32(ebs.Throughput))
+	}
+	if !aws.ToBool(ebs.Encrypted) || aws.ToString(ebs.KmsKeyId) != "alias/devbox" {
+		t.Errorf("a KMS key should imply encryption: %+v", *ebs)
+	}
+}
+
+func TestParseGrowSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int32
+	}{
+		{"200", 200},
+		{"200G", 200},
+		{"+50", 125},
+	}
+	for _, tt := range tests {
+		if got, err := parseGrowSize(tt.in, 75); err != nil || got != tt.want {
+			t.Errorf("parseGrowSize(%q, 75) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"75", "50", "+0", "big", ""} {
+		if _, err := parseGrowSize(in, 75); err == nil {
+			t.Errorf("parseGrowSize(%q, 75) succeeded, want error", in)
+		}
+	}
+}
+
+func TestTemplateRootMatches(t *testing.T) {
+	rv := config.RootVolume{SizeGiB: 100, Type: "gp3", Encrypted: true}
+	data := &types.ResponseLaunchTemplateData{BlockDeviceMappings: []types.LaunchTemplateBlockDeviceMapping{{
+		DeviceName: aws.String("/dev/xvda"),
+		Ebs:        &types.LaunchTemplateEbsBlockDevice{VolumeSize: aws.Int32(100), VolumeType: types.VolumeTypeGp3, Encrypted: aws.Bool(true)},
+	}}}
+	if !templateRootMatches(rv, data) {
+		t.Error("matching root volume reported as drifted")
+	}
+	data.BlockDeviceMappings[0].Ebs.VolumeSize = aws.Int32(75)
+	if templateRootMatches(rv, data) {
+		t.Error("smaller template root volume not reported")
+	}
+}
+
+func TestDiffTemplate(t *testing.T) {
+	userData := base64.StdEncoding.EncodeToString([]byte("{ config, pkgs, ... }: {}"))
+	desired := launchTemplateData(boxDefinition(testDevboxConfig(), "ami-new", "sg-1", userData))
+	current := &types.ResponseLaunchTemplateData{
+		ImageId:          aws.String("ami-old"),
+		KeyName:          aws.String("test-key"),
+		SecurityGroupIds: []string{"sg-1"},
+		IamInstanceProfile: &types.LaunchTemplateIamInstanceProfileSpecification{
+			Name: aws.String("test-profile"),
+		},
+		UserData: aws.String(userData),
+		BlockDeviceMappings: []types.LaunchTemplateBlockDeviceMapping{{
+			DeviceName: aws.String("/dev/xvda"),
+			Ebs:        &types.LaunchTemplateEbsBlockDevice{VolumeSize: aws.Int32(50), VolumeType: types.VolumeTypeGp3},
+		}},
+		TagSpecifications: []types.LaunchTemplateTagSpecification{{
+			ResourceType: types.ResourceTypeInstance,
+			Tags:         []types.Tag{{Key: aws.String("devbox-managed"), Value: aws.String("true")}},
+		}},
+	}
+
+	got := diffTemplate(flattenTemplate(current), flattenTemplate(desired))
+	want := []string{
+		"- BlockDeviceMappings[0].Ebs.VolumeSize: 50",
+		"+ BlockDeviceMappings[0].Ebs.VolumeSize: 75",
+		"- ImageId: ami-old",
+		"+ ImageId: ami-new",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("diffTemplate =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if lines := diffTemplate(nil, flattenTemplate(desired)); len(lines) == 0 || !strings.HasPrefix(lines[0], "+ ") {
+		t.Errorf("diff against a missing template = %v, want only additions", lines)
+	}
+	if flat := flattenTemplate(desired); !strings.Contains(flat["UserData"], "sha256") {
+		t.Errorf("UserData = %q, want a summary", flat["UserData"])
+	}
+}
+
+func TestParseDataSource(t *testing.T) {
+	valid := map[string]dataSource{
+		"new:256":               {Kind: "new", SizeGiB: 256},
+		"snapshot:snap-0abc123": {Kind: "snapshot", Snapshot: "snap-0abc123"},
+		"snapshot:latest":       {Kind: "snapshot", Snapshot: "latest"},
+		"clone":                 {Kind: "clone"},
+	}
+	for in, want := range valid {
+		got, err := parseDataSource(in)
+		if err != nil || got != want {
+			t.Errorf("parseDataSource(%q) = %+v, %v; want %+v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "new", "new:0", "new:big", "snapshot:", "snapshot:vol-1", "clone:vol-1", "copy"} {
+		if _, err := parseDataSource(in); err == nil {
+			t.Errorf("parseDataSource(%q) succeeded, want error", in)
+		}
+	}
+
+	blank := dataBlockDevice(256, "")
+	if aws.ToInt32(blank.Ebs.VolumeSize) != 256 || blank.Ebs.SnapshotId != nil || !aws.ToBool(blank.Ebs.DeleteOnTermination) {
+		t.Errorf("blank data volume = %+v", *blank.Ebs)
+	}
+	fromSnap := dataBlockDevice(0, "snap-1")
+	if fromSnap.Ebs.VolumeSize != nil || aws.ToString(fromSnap.Ebs.SnapshotId) != "snap-1" {
+		t.Errorf("data volume from snapshot = %+v, want the snapshot's size", *fromSnap.Ebs)
+	}
+}
+
+func TestAddTTLTimer(t *testing.T) {
+	nix := "{ config, pkgs, ... }:\n{\n  networking.hostName = \"dev\";\n}\n"
+	b64 := base64.StdEncoding.EncodeToString([]byte(nix))
+	first := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	patched, ok := addTTLTimer(b64, first, "Z123")
+	if !ok {
+		t.Fatal("addTTLTimer didn't patch a NixOS config")
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(patched)
+	got := string(decoded)
+	if !strings.Contains(got, `OnCalendar = "2026-03-01 12:00:00 UTC";`) {
+		t.Errorf("timer not set to the expiry:\n%s", got)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(got), "}") || !strings.Contains(got, "networking.hostName") {
+		t.Errorf("block not inserted inside the config:\n%s", got)
+	}
+	if !strings.Contains(got, `ZONE_ID="Z123"`) {
+		t.Errorf("timer doesn't clean up DNS in the hosted zone:\n%s", got)
+	}
+
+	// Re-patching, e.g. spawning from a TTL box, replaces the timer.
+	again, _ := addTTLTimer(patched, first.Add(time.Hour), "Z123")
+	decoded, _ = base64.StdEncoding.DecodeString(again)
+	got = string(decoded)
+	if n := strings.Count(got, "systemd.timers.devbox-ttl"); n != 1 {
+		t.Errorf("%d TTL timers after re-patching, want 1", n)
+	}
+	if !strings.Contains(got, "2026-03-01 13:00:00 UTC") || strings.Contains(got, "12:00:00") {
+		t.Errorf("re-patch kept the old expiry:\n%s", got)
+	}
+
+	script := base64.StdEncoding.EncodeToString([]byte("#!/bin/bash\necho hi\n"))
+	if out, ok := addTTLTimer(script, first, "Z123"); ok || out != script {
+		t.Error("addTTLTimer patched user_data that isn't a NixOS config")
+	}
+}
+
+func TestRemoveTTLTimer(t *testing.T) {
+	nix := "{ config, pkgs, ... }:\n{\n  networking.hostName = \"dev\";\n}\n"
+	b64 := base64.StdEncoding.EncodeToString([]byte(nix))
+	patched, _ := addTTLTimer(b64, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC), "Z123")
+
+	if got := removeTTLTimer(patched); got != b64 {
+		decoded, _ := base64.StdEncoding.DecodeString(got)
+		t.Errorf("removeTTLTimer = %q, want the config as it was before the timer", decoded)
+	}
+	if got := removeTTLTimer(b64); got != b64 {
+		t.Error("removeTTLTimer changed user_data without a timer")
+	}
+	if got := removeTTLTimer("not base64!"); got != "not base64!" {
+		t.Error("removeTTLTimer changed undecodable user_data")
+	}
+}
+
+func TestTTLRemaining(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tags := func(v string) []types.Tag {
+		return []types.Tag{{Key: aws.String(expiresTag), Value: aws.String(v)}}
+	}
+	tests := []struct {
+		tags []types.Tag
+		want string
+	}{
+		{nil, "-"},
+		{tags("garbage"), "-"},
+		{tags("2026-03-01T15:12:40Z"), "3h12m"},
+		{tags("2026-03-01T12:00:30Z"), "<1m"},
+		{tags("2026-03-03T14:00:00Z"), "2d2h"},
+		{tags("2026-03-01T11:00:00Z"), "expired"},
+	}
+	for _, tt := range tests {
+		if got := ttlRemaining(tt.tags, now); got != tt.want {
+			t.Errorf("ttlRemaining(%v) = %q, want %q", awsutil.TagValue(tt.tags, expiresTag), got, tt.want)
+		}
+	}
+}
+
+func TestPlanBox(t *testing.T) {
+	spec, err := boxspec.Parse([]byte(`
+name: dev
+type: m6i.4xlarge
+volumes: [{volume: data}]
+dns: [dev.example.com]
+auto_stop: 8h
+tags: {team: infra}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := types.Volume{VolumeId: aws.String("vol-1"), AvailabilityZone: aws.String("us-east-1b")}
+	ops := func(actions []boxAction) string {
+		var out []string
+		for _, a := range actions {
+			out = append(out, a.Op+" "+a.Target)
+		}
+		return strings.Join(out, ", ")
+	}
+
+	// Missing box: spawned in the data volume's AZ, then configured.
+	st := boxState{Volumes: map[string]types.Volume{"data": data}}
+	actions, err := planBox(testDevboxConfig(), spec, st)
+	if err != nil {
+		t.Fatalf("planBox: %v", err)
+	}
+	if got, want := ops(actions), "spawn us-east-1b, tag , attach vol-1, dns dev.example.com, auto-stop "; got != want {
+		t.Errorf("missing box: %s, want %s", got, want)
+	}
+
+	// Matching box: nothing to do.
+	inst := types.Instance{
+		InstanceId:      aws.String("i-1"),
+		InstanceType:    types.InstanceTypeM6i4xlarge,
+		Placement:       &types.Placement{AvailabilityZone: aws.String("us-east-1b")},
+		State:           &types.InstanceState{Name: types.InstanceStateNameRunning},
+		PublicIpAddress: aws.String("1.2.3.4"),
+		Tags: []types.Tag{
+			{Key: aws.String("team"), Value: aws.String("infra")},
+			{Key: aws.String(autoStopTag), Value: aws.String("8h")},
+		},
+	}
+	attached := data
+	attached.Attachments = []types.VolumeAttachment{{InstanceId: aws.String("i-1")}}
+	st = boxState{
+		Instance: &inst,
+		Volumes:  map[string]types.Volume{"data": attached},
+		DNS:      map[string]string{"dev.example.com": "1.2.3.4"},
+	}
+	if actions, err = planBox(testDevboxConfig(), spec, st); err != nil || len(actions) != 0 {
+		t.Errorf("matching box: %v, %v; want no actions", ops(actions), err)
+	}
+
+	// Stopped box of another type: started, resized, DNS repointed.
+	stopped := inst
+	stopped.InstanceType = types.InstanceTypeM6iLarge
+	stopped.State = &types.InstanceState{Name: types.InstanceStateNameStopped}
+	st.Instance = &stopped
+	actions, err = planBox(testDevboxConfig(), spec, st)
+	if err != nil {
+		t.Fatalf("planBox: %v", err)
+	}
+	if got, want := ops(actions), "start , resize us-east-1b, dns dev.example.com"; got != want {
+		t.Errorf("stopped box: %s, want %s", got, want)
+	}
+
+	// A volume attached to some other instance is a conflict.
+	elsewhere := data
+	elsewhere.Attachments = []types.VolumeAttachment{{InstanceId: aws.String("i-other")}}
+	st = boxState{Instance: &inst, Volumes: map[string]types.Volume{"data": elsewhere}}
+	if _, err := planBox(testDevboxConfig(), spec, st); err == nil || !strings.Contains(err.Error(), "i-other") {
+		t.Errorf("volume attached elsewhere: err = %v", err)
+	}
+}
+
+func TestCheaperElsewhere(t *testing.T) {
+	results := []awsutil.SpotSearchResult{
+		{InstanceType: "m6i.4xlarge", AZ: "us-east-2a", Price: 0.60},
+		{InstanceType: "m6i.4xlarge", AZ: "us-east-2b", Price: 0.50},
+		{InstanceType: "m6i.4xlarge", AZ: "us-west-2a", Price: 0.30},
+		{InstanceType: "c6i.4xlarge", AZ: "us-east-2a", Price: 0.40},
+		{InstanceType: "c6i.4xlarge", AZ: "us-west-2a", Price: 0.35},
+		{InstanceType: "r6i.4xlarge", AZ: "eu-west-1a", Price: 0.10},
+	}
+	notes := cheaperElsewhere(results, "us-east-2", 0.25)
+	if len(notes) != 1 {
+		t.Fatalf("cheaperElsewhere = %v, want one note", notes)
+	}
+	want := "m6i.4xlarge: $0.3000 in us-west-2a vs $0.5000 in us-east-2b (40% cheaper)"
+	if notes[0] != want {
+		t.Errorf("note = %q, want %q", notes[0], want)
+	}
 }
 
 // ==================== Instance lifecycle tests ====================
@@ -382,10 +903,12 @@ func TestRebid(t *testing.T) {
 	skipIfNoDocker(t)
 	ctx := context.Background()
 
-	// Create a spot request.
+	// Create a persistent spot request.
 	spotResult, err := testEC2Client.RequestSpotInstances(ctx, &ec2.RequestSpotInstancesInput{
-		SpotPrice:     aws.String("0.05"),
-		InstanceCount: aws.Int32(1),
+		SpotPrice:                    aws.String("0.05"),
+		InstanceCount:                aws.Int32(1),
+		Type:                         types.SpotInstanceTypePersistent,
+		InstanceInterruptionBehavior: types.InstanceInterruptionBehaviorStop,
 		LaunchSpecification: &types.RequestSpotLaunchSpecification{
 			ImageId:      aws.String("ami-test12345"),
 			InstanceType: types.InstanceTypeT2Micro,
@@ -399,11 +922,39 @@ func TestRebid(t *testing.T) {
 	}
 	oldReqID := *spotResult.SpotInstanceRequests[0].SpotInstanceRequestId
 
-	if err := rebid(ctx, testEC2Client, oldReqID, "0.10"); err != nil {
+	// LocalStack may fulfil the request straight away; rebid must then
+	// resolve the request to its instance.
+	before, err := testEC2Client.DescribeSpotInstanceRequests(ctx, &ec2.DescribeSpotInstanceRequestsInput{
+		SpotInstanceRequestIds: []string{oldReqID},
+	})
+	if err != nil {
+		t.Fatalf("DescribeSpotInstanceRequests: %v", err)
+	}
+	instanceID := ""
+	if len(before.SpotInstanceRequests) > 0 {
+		instanceID = aws.ToString(before.SpotInstanceRequests[0].InstanceId)
+	}
+
+	if err := rebid(ctx, testDevboxConfig(), testEC2Client, testR53Client, oldReqID, "0.10", false); err != nil {
 		t.Fatalf("rebid: %v", err)
 	}
 
-	// Verify old request is cancelled.
+	if instanceID != "" {
+		desc, err := testEC2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceID}})
+		if err != nil {
+			t.Fatalf("DescribeInstances: %v", err)
+		}
+		got := desc.Reservations[0].Instances[0]
+		if got.State.Name == types.InstanceStateNameTerminated {
+			t.Error("running instance was terminated by rebid")
+		}
+		if price := awsutil.TagValue(got.Tags, pendingMaxPriceTag); price != "0.1000" {
+			t.Errorf("pending max price tag = %q, want %q", price, "0.1000")
+		}
+		return
+	}
+
+	// Verify the open request is cancelled.
 	desc, err := testEC2Client.DescribeSpotInstanceRequests(ctx, &ec2.DescribeSpotInstanceRequestsInput{
 		SpotInstanceRequestIds: []string{oldReqID},
 	})
@@ -418,13 +969,56 @@ func TestRebid(t *testing.T) {
 	}
 }
 
+func TestRebidRunningInstance(t *testing.T) {
+	skipIfNoDocker(t)
+	ctx := context.Background()
+
+	result, err := testEC2Client.RunInstances(ctx, &ec2.RunInstancesInput{
+		ImageId:      aws.String("ami-test12345"),
+		InstanceType: types.InstanceTypeT2Micro,
+		MinCount:     aws.Int32(1),
+		MaxCount:     aws.Int32(1),
+		InstanceMarketOptions: &types.InstanceMarketOptionsRequest{
+			MarketType: types.MarketTypeSpot,
+			SpotOptions: &types.SpotMarketOptions{
+				SpotInstanceType:             types.SpotInstanceTypePersistent,
+				InstanceInterruptionBehavior: types.InstanceInterruptionBehaviorStop,
+				MaxPrice:                     aws.String("0.05"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("RunInstances: %v", err)
+	}
+	inst := result.Instances[0]
+	if inst.SpotInstanceRequestId == nil {
+		t.Skip("LocalStack did not create a spot request for the instance")
+	}
+
+	if err := rebid(ctx, testDevboxConfig(), testEC2Client, testR53Client, *inst.InstanceId, "0.10", false); err != nil {
+		t.Fatalf("rebid: %v", err)
+	}
+
+	desc, err := testEC2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{*inst.InstanceId}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := desc.Reservations[0].Instances[0]
+	if got.State.Name == types.InstanceStateNameTerminated {
+		t.Error("running instance was terminated by rebid")
+	}
+	if price := awsutil.TagValue(got.Tags, pendingMaxPriceTag); price != "0.1000" {
+		t.Errorf("pending max price tag = %q, want %q", price, "0.1000")
+	}
+}
+
 // ==================== Search tests ====================
 
 func TestSearchSpotPrices(t *testing.T) {
 	skipIfNoDocker(t)
 	ctx := context.Background()
 	// LocalStack returns empty spot price history; verify the code handles it gracefully.
-	if err := runSearch(ctx, testEC2Client, []string{"t2.micro"}, 8, 16, 0, "x86_64", false, "", "price", 20); err != nil {
+	if err := runSearch(ctx, testEC2Client, []string{"t2.micro"}, searchOptions{MinVCPU: 8, MinMem: 16, Arch: "x86_64", SortBy: "price", Limit: 20}); err != nil {
 		t.Fatalf("runSearch: %v", err)
 	}
 }
@@ -440,6 +1034,30 @@ func TestFetchInstanceTypes(t *testing.T) {
 	_ = results
 }
 
+func TestFetchInstanceTypesCached(t *testing.T) {
+	skipIfNoDocker(t)
+	ctx := context.Background()
+	store := &cache.Store{Dir: t.TempDir()}
+	awsutil.Cache = store
+	t.Cleanup(func() { awsutil.Cache = nil })
+
+	first, err := awsutil.FetchInstanceTypes(ctx, testEC2Client, "x86_64", 1, 0.5, false)
+	if err != nil {
+		t.Fatalf("FetchInstanceTypes: %v", err)
+	}
+	var cached []awsutil.InstanceTypeInfo
+	if !store.Get("instance-types/"+testEC2Client.Options().Region+"/x86_64", awsutil.InstanceTypeTTL, &cached) {
+		t.Fatal("catalogue was not cached")
+	}
+	second, err := awsutil.FetchInstanceTypes(ctx, testEC2Client, "x86_64", 1, 0.5, false)
+	if err != nil {
+		t.Fatalf("FetchInstanceTypes (cached): %v", err)
+	}
+	if len(first) != len(second) {
+		t.Errorf("cached fetch returned %d types, want %d", len(second), len(first))
+	}
+}
+
 func TestDescribeSpecificTypes(t *testing.T) {
 	skipIfNoDocker(t)
 	ctx := context.Background()
@@ -528,7 +1146,7 @@ func TestLookupAMI(t *testing.T) {
 		t.Fatalf("RegisterImage: %v", err)
 	}
 
-	amiID, err := lookupAMI(ctx, cfg, testEC2Client)
+	amiID, err := lookupAMI(ctx, cfg, testEC2Client, "x86_64")
 	if err != nil {
 		// LocalStack may not support owner filter correctly.
 		t.Skipf("lookupAMI failed (likely LocalStack filter limitation): %v", err)
@@ -536,14 +1154,118 @@ func TestLookupAMI(t *testing.T) {
 	if amiID == "" {
 		t.Error("lookupAMI returned empty string")
 	}
+	if armID, err := lookupAMI(ctx, cfg, testEC2Client, "arm64"); err == nil && armID == amiID {
+		t.Errorf("lookupAMI(arm64) = %s, the x86_64 AMI", armID)
+	}
+}
+
+func TestTypeArch(t *testing.T) {
+	archs := func(a ...types.ArchitectureType) types.InstanceTypeInfo {
+		return types.InstanceTypeInfo{ProcessorInfo: &types.ProcessorInfo{SupportedArchitectures: a}}
+	}
+	tests := []struct {
+		info types.InstanceTypeInfo
+		want string
+	}{
+		{archs(types.ArchitectureTypeI386, types.ArchitectureTypeX8664), "x86_64"},
+		{archs(types.ArchitectureTypeArm64), "arm64"},
+		{archs(types.ArchitectureTypeArm64Mac), "arm64_mac"},
+		{types.InstanceTypeInfo{}, "x86_64"},
+	}
+	for _, tt := range tests {
+		if got := typeArch(tt.info); got != tt.want {
+			t.Errorf("typeArch(%v) = %s, want %s", tt.info.ProcessorInfo, got, tt.want)
+		}
+	}
+}
+
+func TestSelectedAMIs(t *testing.T) {
+	img := func(id, name, arch string) types.Image {
+		return types.Image{ImageId: aws.String(id), Name: aws.String(name), Architecture: types.ArchitectureValues(arch)}
+	}
+	nixos := []types.Image{
+		img("ami-x1", "nixos/24.11.100-x86_64-linux", "x86_64"),
+		img("ami-x2", "nixos/24.11.200-x86_64-linux", "x86_64"),
+		img("ami-a1", "nixos/24.11.100-aarch64-linux", "arm64"),
+	}
+	cfg := config.DevboxConfig{NixOSAMIPins: map[string]string{"arm64": "ami-baked"}}
+	got := selectedAMIs(cfg, nixos)
+	if got["x86_64"] != (amiSelection{ID: "ami-x2", Why: "latest"}) {
+		t.Errorf("x86_64 = %+v, want the newest by name", got["x86_64"])
+	}
+	if got["arm64"] != (amiSelection{ID: "ami-baked", Why: "pinned"}) {
+		t.Errorf("arm64 = %+v, want the pin", got["arm64"])
+	}
+}
+
+func TestBakedToPrune(t *testing.T) {
+	img := func(id, created string) types.Image {
+		return types.Image{ImageId: aws.String(id), CreationDate: aws.String(created)}
+	}
+	images := []types.Image{
+		img("ami-2", "2026-02-01T00:00:00.000Z"),
+		img("ami-4", "2026-04-01T00:00:00.000Z"),
+		img("ami-1", "2026-01-01T00:00:00.000Z"),
+		img("ami-3", "2026-03-01T00:00:00.000Z"),
+	}
+	var ids []string
+	for _, p := range bakedToPrune(images, 2, map[string]bool{"ami-1": true}) {
+		ids = append(ids, *p.ImageId)
+	}
+	if got := strings.Join(ids, " "); got != "ami-2" {
+		t.Errorf("pruned %q, want the oldest unused beyond the newest 2", got)
+	}
+
+	// An image a box runs from is kept even when it falls outside keep.
+	ids = nil
+	for _, p := range bakedToPrune(images, 1, map[string]bool{"ami-2": true}) {
+		ids = append(ids, *p.ImageId)
+	}
+	if got := strings.Join(ids, " "); got != "ami-3 ami-1" {
+		t.Errorf("pruned %q, want ami-3 ami-1", got)
+	}
+
+	// The image just baked and pinned is one of the keep, not extra.
+	ids = nil
+	for _, p := range bakedToPrune(images, 2, map[string]bool{"ami-4": true}) {
+		ids = append(ids, *p.ImageId)
+	}
+	if got := strings.Join(ids, " "); got != "ami-2 ami-1" {
+		t.Errorf("pruned %q, want ami-2 ami-1", got)
+	}
+}
+
+func TestCheckRootFits(t *testing.T) {
+	img := func(size int32) types.Image {
+		return types.Image{
+			ImageId:        aws.String("ami-1"),
+			RootDeviceName: aws.String("/dev/xvda"),
+			BlockDeviceMappings: []types.BlockDeviceMapping{
+				{DeviceName: aws.String("/dev/xvdf"), Ebs: &types.EbsBlockDevice{VolumeSize: aws.Int32(500)}},
+				{DeviceName: aws.String("/dev/xvda"), Ebs: &types.EbsBlockDevice{VolumeSize: aws.Int32(size)}},
+			},
+		}
+	}
+	cfg := config.DevboxConfig{RootVolume: config.RootVolume{SizeGiB: 75}}
+	if err := checkRootFits(cfg, img(75)); err != nil {
+		t.Errorf("75 GiB root with 75 GiB root_volume: %v", err)
+	}
+	err := checkRootFits(cfg, img(100))
+	if err == nil || !strings.Contains(err.Error(), "at least 100") {
+		t.Errorf("100 GiB root with 75 GiB root_volume: err = %v, want the size to set", err)
+	}
 }
 
 func TestSpawnInstance(t *testing.T) {
 	skipIfNoDocker(t)
 	ctx := context.Background()
 
-	// Create a source instance with user_data for cloning.
-	userData := base64.StdEncoding.EncodeToString([]byte("#!/bin/bash\necho hello"))
+	// Create a source instance for cloning, spawned earlier with --ttl.
+	nix := "{ config, pkgs, ... }:\n{\n  networking.hostName = \"dev\";\n}\n"
+	userData, ok := addTTLTimer(base64.StdEncoding.EncodeToString([]byte(nix)), time.Now().Add(-time.Hour), "")
+	if !ok {
+		t.Fatal("addTTLTimer didn't patch the source config")
+	}
 	srcResult, err := testEC2Client.RunInstances(ctx, &ec2.RunInstancesInput{
 		ImageId:      aws.String("ami-test12345"),
 		InstanceType: types.InstanceTypeT2Micro,
@@ -595,7 +1317,13 @@ func TestSpawnInstance(t *testing.T) {
 	}
 	cfg.SecurityGroup = "test-sg-spawn"
 
-	err = spawnInstance(ctx, cfg, testEC2Client, "t2.micro", "us-east-1a", "test-spawn", "0.50", sourceID)
+	newID, err := spawnInstance(ctx, cfg, testEC2Client, testR53Client, spawnOptions{
+		InstanceType: "t2.micro",
+		AZ:           "us-east-1a",
+		Name:         "test-spawn",
+		MaxPrice:     "0.50",
+		From:         sourceID,
+	})
 	if err != nil {
 		// Spawn may fail at AMI lookup due to owner filter. That's a known LocalStack limitation.
 		if strings.Contains(err.Error(), "AMI") || strings.Contains(err.Error(), "user_data") {
@@ -603,6 +1331,84 @@ func TestSpawnInstance(t *testing.T) {
 		}
 		t.Fatalf("spawnInstance: %v", err)
 	}
+
+	// Without --ttl the clone must not inherit the source's expired timer.
+	got, err := awsutil.FetchUserData(ctx, testEC2Client, newID)
+	if err != nil {
+		t.Skipf("FetchUserData failed (may be LocalStack limitation): %v", err)
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(got)
+	if string(decoded) != nix {
+		t.Errorf("spawned user_data = %q, want the source's config without its TTL timer", decoded)
+	}
+}
+
+func TestTemplateSync(t *testing.T) {
+	skipIfNoDocker(t)
+	ctx := context.Background()
+
+	userData := base64.StdEncoding.EncodeToString([]byte("#!/bin/bash\necho template"))
+	src, err := testEC2Client.RunInstances(ctx, &ec2.RunInstancesInput{
+		ImageId:      aws.String("ami-test12345"),
+		InstanceType: types.InstanceTypeT2Micro,
+		MinCount:     aws.Int32(1),
+		MaxCount:     aws.Int32(1),
+		UserData:     aws.String(userData),
+	})
+	if err != nil {
+		t.Fatalf("create source instance: %v", err)
+	}
+	sourceID := *src.Instances[0].InstanceId
+
+	cfg := testDevboxConfig()
+	cfg.LaunchTemplate = "test-devbox-template"
+	cfg.SecurityGroup = "test-sg-template"
+	if _, err := testEC2Client.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(cfg.SecurityGroup),
+		Description: aws.String("template test sg"),
+	}); err != nil && !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("CreateSecurityGroup: %v", err)
+	}
+	if _, err := testEC2Client.RegisterImage(ctx, &ec2.RegisterImageInput{
+		Name:           aws.String("test-ami-template-2024.01"),
+		Architecture:   types.ArchitectureValuesX8664,
+		RootDeviceName: aws.String("/dev/xvda"),
+	}); err != nil {
+		t.Fatalf("RegisterImage: %v", err)
+	}
+
+	if err := templateSync(ctx, cfg, testEC2Client, sourceID); err != nil {
+		if strings.Contains(err.Error(), "AMI") {
+			t.Skipf("templateSync failed (LocalStack limitation): %v", err)
+		}
+		t.Fatalf("templateSync: %v", err)
+	}
+	changes, err := templateDiff(ctx, cfg, testEC2Client, "")
+	if err != nil {
+		t.Fatalf("templateDiff: %v", err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("template differs right after sync: %v", changes)
+	}
+
+	cfg.SSHKeyName = "other-key"
+	changes, err = templateDiff(ctx, cfg, testEC2Client, "")
+	if err != nil {
+		t.Fatalf("templateDiff: %v", err)
+	}
+	if strings.Join(changes, "\n") != "- KeyName: test-key\n+ KeyName: other-key" {
+		t.Errorf("changes after editing ssh_key_name = %v", changes)
+	}
+	if err := templateSync(ctx, cfg, testEC2Client, ""); err != nil {
+		t.Fatalf("second templateSync: %v", err)
+	}
+	lt, err := findLaunchTemplate(ctx, testEC2Client, cfg.LaunchTemplate)
+	if err != nil || lt == nil {
+		t.Fatalf("findLaunchTemplate = %v, %v", lt, err)
+	}
+	if v := aws.ToInt64(lt.DefaultVersionNumber); v != 2 {
+		t.Errorf("default version = %d, want 2", v)
+	}
 }
 
 // ==================== Resize test ====================
@@ -618,7 +1424,7 @@ func TestResizeInstance(t *testing.T) {
 	cfg.DNSZone = domain
 	cfg.DNSName = "dev.resize.test"
 
-	if err := resizeInstance(ctx, cfg, testEC2Client, testR53Client, id, "t2.small"); err != nil {
+	if err := resizeInstance(ctx, cfg, testEC2Client, testR53Client, id, "t2.small", resizeOptions{}); err != nil {
 		t.Fatalf("resizeInstance: %v", err)
 	}
 
@@ -647,7 +1453,7 @@ func TestVolumeCreateAndList(t *testing.T) {
 	skipIfNoDocker(t)
 	ctx := context.Background()
 	cfg := testDevboxConfig()
-	if err := volumeCreate(ctx, cfg, testEC2Client, 1, "gp3", 3000, 250, "us-east-1a", "test-vol-list"); err != nil {
+	if err := volumeCreate(ctx, cfg, testEC2Client, 1, "gp3", 3000, 250, "us-east-1a", "test-vol-list", volumeEncryption{}); err != nil {
 		t.Fatalf("volumeCreate: %v", err)
 	}
 	if err := volumeLS(ctx, testEC2Client); err != nil {
@@ -689,6 +1495,377 @@ func TestVolumeCreateAndDestroy(t *testing.T) {
 	}
 }
 
+func TestEncryptionLabel(t *testing.T) {
+	tests := []struct {
+		vol  types.Volume
+		want string
+	}{
+		{types.Volume{}, "no"},
+		{types.Volume{Encrypted: aws.Bool(true)}, "default"},
+		{types.Volume{Encrypted: aws.Bool(true), KmsKeyId: aws.String("arn:aws:kms:us-east-2:123456789012:key/1234abcd")}, "1234abcd"},
+	}
+	for _, tt := range tests {
+		if got := encryptionLabel(tt.vol); got != tt.want {
+			t.Errorf("encryptionLabel(%+v) = %q, want %q", tt.vol, got, tt.want)
+		}
+	}
+
+	if (volumeEncryption{}).enabled() || (volumeEncryption{}).kmsKeyID() != nil {
+		t.Error("zero volumeEncryption should leave encryption unset")
+	}
+	if enc := (volumeEncryption{KMSKey: "alias/devbox"}); !enc.enabled() || aws.ToString(enc.kmsKeyID()) != "alias/devbox" {
+		t.Error("a KMS key should imply encryption")
+	}
+}
+
+func TestModifiedSpec(t *testing.T) {
+	gp3 := types.Volume{VolumeType: types.VolumeTypeGp3, Size: aws.Int32(512), Iops: aws.Int32(3000), Throughput: aws.Int32(250)}
+
+	spec, err := modifiedSpec(gp3, volumeModifyOptions{Size: "1024", IOPS: 6000, Throughput: 500})
+	if err != nil {
+		t.Fatalf("modifiedSpec: %v", err)
+	}
+	if spec != (awsutil.VolumeSpec{Type: "gp3", SizeGiB: 1024, IOPS: 6000, Throughput: 500}) {
+		t.Errorf("spec = %+v", spec)
+	}
+	// Unset flags keep the current performance.
+	if spec, err := modifiedSpec(gp3, volumeModifyOptions{Size: "+100"}); err != nil || spec.IOPS != 3000 || spec.Throughput != 250 || spec.SizeGiB != 612 {
+		t.Errorf("modifiedSpec(+100) = %+v, %v", spec, err)
+	}
+
+	bad := []volumeModifyOptions{
+		{},                         // nothing to do
+		{Size: "256"},              // shrink
+		{Type: "io2"},              // io2 needs IOPS
+		{Type: "io1", IOPS: 30000}, // 50 IOPS/GiB caps io1 at 25600 for 512 GiB
+		{Throughput: 1000},         // needs 4000 IOPS
+		{Type: "gp2", IOPS: 3000},  // gp2 IOPS aren't provisioned
+		{Type: "floppy"},           // unknown type
+	}
+	for _, opts := range bad {
+		if _, err := modifiedSpec(gp3, opts); err == nil {
+			t.Errorf("modifiedSpec(%+v) should fail", opts)
+		}
+	}
+}
+
+func TestBackupPolicyFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--daily", "--keep", "7", "--weekly", "--keep", "4"}, "daily:7,weekly:4"},
+		{[]string{"--weekly", "--monthly", "--keep", "6"}, "weekly:4,monthly:6"},
+		{[]string{"--daily", "--keep", "3", "--daily", "--keep", "5"}, "daily:5"},
+	}
+	for _, tt := range tests {
+		var policy backupPolicy
+		fs := pflag.NewFlagSet("set", pflag.ContinueOnError)
+		addBackupPolicyFlags(fs, &policy)
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatalf("Parse(%v): %v", tt.args, err)
+		}
+		if policy.String() != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, policy, tt.want)
+		}
+		parsed, err := parseBackupPolicy(policy.String())
+		if err != nil || parsed.String() != tt.want {
+			t.Errorf("parseBackupPolicy(%q) = %q, %v", tt.want, parsed, err)
+		}
+	}
+
+	var policy backupPolicy
+	fs := pflag.NewFlagSet("set", pflag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	addBackupPolicyFlags(fs, &policy)
+	if err := fs.Parse([]string{"--keep", "3", "--daily"}); err == nil {
+		t.Error("--keep before a schedule should fail")
+	}
+	for _, bad := range []string{"", "daily", "hourly:3", "daily:0"} {
+		if _, err := parseBackupPolicy(bad); err == nil {
+			t.Errorf("parseBackupPolicy(%q) should fail", bad)
+		}
+	}
+}
+
+func TestBackupSchedule(t *testing.T) {
+	now := time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC)
+	snap := func(id, schedule string, age time.Duration, state types.SnapshotState) types.Snapshot {
+		return types.Snapshot{
+			SnapshotId: aws.String(id),
+			StartTime:  aws.Time(now.Add(-age)),
+			State:      state,
+			Tags:       []types.Tag{{Key: aws.String(backupScheduleTag), Value: aws.String(schedule)}},
+		}
+	}
+	policy := backupPolicy{{"daily", 2}, {"weekly", 1}}
+	day := 24 * time.Hour
+
+	snaps := []types.Snapshot{
+		snap("snap-d1", "daily", day-time.Minute, types.SnapshotStateCompleted),
+		snap("snap-d2", "daily", 2*day, types.SnapshotStateCompleted),
+		snap("snap-d3", "daily", 3*day, types.SnapshotStateCompleted),
+		snap("snap-d4", "daily", 4*day, types.SnapshotStateError),
+		snap("snap-w1", "weekly", 3*day, types.SnapshotStateCompleted),
+		snap("snap-m1", "monthly", 90*day, types.SnapshotStateCompleted),
+	}
+	// Yesterday's daily ran a minute later than today's; the slack makes
+	// it due anyway. The weekly is three days old.
+	if due := dueSchedules(policy, snaps, now); len(due) != 1 || due[0] != "daily" {
+		t.Errorf("dueSchedules = %v, want [daily]", due)
+	}
+	if due := dueSchedules(policy, nil, now); len(due) != 2 {
+		t.Errorf("dueSchedules with no backups = %v, want both", due)
+	}
+
+	var pruned []string
+	for _, s := range backupsToPrune(policy, snaps) {
+		pruned = append(pruned, aws.ToString(s.SnapshotId))
+	}
+	// The two newest dailies are kept, the failed one goes, and the
+	// monthly is left alone since the policy no longer has that schedule.
+	if strings.Join(pruned, ",") != "snap-d4,snap-d3" {
+		t.Errorf("backupsToPrune = %v, want [snap-d4 snap-d3]", pruned)
+	}
+}
+
+func TestBackupSnapshotsLineage(t *testing.T) {
+	skipIfNoDocker(t)
+	ctx := context.Background()
+
+	// A backup of the volume that restore or encrypt later replaced.
+	old, err := testEC2Client.CreateVolume(ctx, &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String("us-east-1a"),
+		Size:             aws.Int32(1),
+		VolumeType:       types.VolumeTypeGp3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID := aws.ToString(old.VolumeId)
+	snap, err := testEC2Client.CreateSnapshot(ctx, &ec2.CreateSnapshotInput{
+		VolumeId: old.VolumeId,
+		TagSpecifications: []types.TagSpecification{{
+			ResourceType: types.ResourceTypeSnapshot,
+			Tags: []types.Tag{
+				{Key: aws.String(backupOfTag), Value: aws.String(oldID)},
+				{Key: aws.String(backupScheduleTag), Value: aws.String("daily")},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The successor carries the policy and the lineage.
+	succ, err := testEC2Client.CreateVolume(ctx, &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String("us-east-1a"),
+		Size:             aws.Int32(1),
+		VolumeType:       types.VolumeTypeGp3,
+		TagSpecifications: []types.TagSpecification{{
+			ResourceType: types.ResourceTypeVolume,
+			Tags: []types.Tag{
+				{Key: aws.String(backupPolicyTag), Value: aws.String("daily:7")},
+				{Key: aws.String(previousVolumesTag), Value: aws.String(oldID)},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := testEC2Client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{aws.ToString(succ.VolumeId)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snaps, err := backupSnapshots(ctx, testEC2Client, desc.Volumes[0])
+	if err != nil {
+		t.Fatalf("backupSnapshots: %v", err)
+	}
+	found := false
+	for _, s := range snaps {
+		found = found || aws.ToString(s.SnapshotId) == aws.ToString(snap.SnapshotId)
+	}
+	if !found {
+		t.Errorf("backupSnapshots missed the predecessor's backup %s: %v", aws.ToString(snap.SnapshotId), snaps)
+	}
+}
+
+func TestSnapshotAt(t *testing.T) {
+	loc := time.FixedZone("test", -7*3600)
+	at, err := parseRestoreAt("2026-10-01", loc)
+	if err != nil {
+		t.Fatalf("parseRestoreAt: %v", err)
+	}
+	if want := time.Date(2026, 10, 2, 0, 0, 0, 0, loc).Add(-time.Nanosecond); !at.Equal(want) {
+		t.Errorf("parseRestoreAt(2026-10-01) = %v, want %v", at, want)
+	}
+	if _, err := parseRestoreAt("2026-10-01T12:00:00Z", loc); err != nil {
+		t.Errorf("parseRestoreAt(RFC 3339): %v", err)
+	}
+	if _, err := parseRestoreAt("last tuesday", loc); err == nil {
+		t.Error("parseRestoreAt should reject free text")
+	}
+
+	snap := func(id string, taken time.Time, state types.SnapshotState) types.Snapshot {
+		return types.Snapshot{SnapshotId: aws.String(id), StartTime: aws.Time(taken), State: state}
+	}
+	snaps := []types.Snapshot{
+		snap("snap-oct2", time.Date(2026, 10, 2, 3, 0, 0, 0, loc), types.SnapshotStateCompleted),
+		snap("snap-oct1-late", time.Date(2026, 10, 1, 23, 0, 0, 0, loc), types.SnapshotStateError),
+		snap("snap-oct1", time.Date(2026, 10, 1, 3, 0, 0, 0, loc), types.SnapshotStateCompleted),
+		snap("snap-sep", time.Date(2026, 9, 24, 3, 0, 0, 0, loc), types.SnapshotStateCompleted),
+	}
+	if got := snapshotAt(snaps, at); got != "snap-oct1" {
+		t.Errorf("snapshotAt(2026-10-01) = %q, want snap-oct1", got)
+	}
+	if got := snapshotAt(snaps, time.Date(2026, 9, 1, 0, 0, 0, 0, loc)); got != "" {
+		t.Errorf("snapshotAt before any snapshot = %q, want none", got)
+	}
+}
+
+func TestParsePick(t *testing.T) {
+	if n, err := parsePick(" 2\n", 3); err != nil || n != 2 {
+		t.Errorf("parsePick(2) = %d, %v", n, err)
+	}
+	if n, err := parsePick("", 3); err != nil || n != 0 {
+		t.Errorf("parsePick(empty) = %d, %v; want 0 to cancel", n, err)
+	}
+	for _, bad := range []string{"0", "4", "snap-1"} {
+		if _, err := parsePick(bad, 3); err == nil {
+			t.Errorf("parsePick(%q, 3) should fail", bad)
+		}
+	}
+}
+
+func TestSuccessorTags(t *testing.T) {
+	vol := types.Volume{
+		VolumeId: aws.String("vol-c"),
+		Tags: []types.Tag{
+			{Key: aws.String("Name"), Value: aws.String("dev-data-volume")},
+			{Key: aws.String(previousVolumesTag), Value: aws.String("vol-b,vol-a")},
+		},
+	}
+	if got := volumeLineage(vol); strings.Join(got, ",") != "vol-c,vol-b,vol-a" {
+		t.Errorf("volumeLineage = %v", got)
+	}
+	tags := successorTags(vol)
+	if awsutil.TagValue(tags, "Name") != "dev-data-volume" || awsutil.TagValue(tags, previousVolumesTag) != "vol-c,vol-b,vol-a" {
+		t.Errorf("successorTags = %v", tags)
+	}
+	if len(tags) != 2 {
+		t.Errorf("successorTags has %d tags, want the lineage tag replaced, not added", len(tags))
+	}
+
+	// The lineage is capped to fit EC2's tag value limit.
+	var long []string
+	for i := range 12 {
+		long = append(long, fmt.Sprintf("vol-%017d", i))
+	}
+	vol.Tags = []types.Tag{{Key: aws.String(previousVolumesTag), Value: aws.String(strings.Join(long, ","))}}
+	prev := awsutil.TagValue(successorTags(vol), previousVolumesTag)
+	if n := len(strings.Split(prev, ",")); n != maxPreviousVolumes || len(prev) > 256 {
+		t.Errorf("lineage has %d volumes, %d chars; want %d, at most 256", n, len(prev), maxPreviousVolumes)
+	}
+}
+
+func TestSpareDevice(t *testing.T) {
+	mapping := func(devices ...string) types.Instance {
+		inst := types.Instance{InstanceId: aws.String("i-test")}
+		for _, d := range devices {
+			inst.BlockDeviceMappings = append(inst.BlockDeviceMappings, types.InstanceBlockDeviceMapping{DeviceName: aws.String(d)})
+		}
+		return inst
+	}
+	if got, err := spareDevice(mapping("/dev/xvda", "/dev/xvdf")); err != nil || got != "/dev/xvdg" {
+		t.Errorf("spareDevice = %q, %v; want /dev/xvdg", got, err)
+	}
+	// /dev/sdg is the same slot as /dev/xvdg.
+	if got, err := spareDevice(mapping("/dev/xvda", "/dev/sdg", "/dev/xvdh")); err != nil || got != "/dev/xvdi" {
+		t.Errorf("spareDevice = %q, %v; want /dev/xvdi", got, err)
+	}
+	var all []string
+	for c := 'g'; c <= 'z'; c++ {
+		all = append(all, "/dev/xvd"+string(c))
+	}
+	if _, err := spareDevice(mapping(all...)); err == nil {
+		t.Error("spareDevice should fail with every slot in use")
+	}
+}
+
+func TestBrowseCleanup(t *testing.T) {
+	skipIfNoDocker(t)
+	ctx := context.Background()
+
+	result, err := testEC2Client.CreateVolume(ctx, &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String("us-east-1a"),
+		Size:             aws.Int32(1),
+		VolumeType:       types.VolumeTypeGp3,
+		TagSpecifications: []types.TagSpecification{{
+			ResourceType: types.ResourceTypeVolume,
+			Tags:         []types.Tag{{Key: aws.String(browseTag), Value: aws.String("snap-browse")}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+	if err := awsutil.PollVolumeState(ctx, testEC2Client, aws.ToString(result.VolumeId), "available", VolumePollInterval, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := browseCleanup(ctx, testDevboxConfig(), testEC2Client, "snap-browse"); err != nil {
+		t.Fatalf("browseCleanup: %v", err)
+	}
+	vols, err := browseVolumes(ctx, testEC2Client, "snap-browse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vols {
+		if v.State != types.VolumeStateDeleting && v.State != types.VolumeStateDeleted {
+			t.Errorf("browse volume %s is still %s", aws.ToString(v.VolumeId), v.State)
+		}
+	}
+}
+
+func TestVolumeEncrypt(t *testing.T) {
+	skipIfNoDocker(t)
+	ctx := context.Background()
+
+	result, err := testEC2Client.CreateVolume(ctx, &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String("us-east-1a"),
+		Size:             aws.Int32(1),
+		VolumeType:       types.VolumeTypeGp3,
+		TagSpecifications: []types.TagSpecification{{
+			ResourceType: types.ResourceTypeVolume,
+			Tags:         []types.Tag{{Key: aws.String("Name"), Value: aws.String("test-encrypt")}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+	volID := aws.ToString(result.VolumeId)
+
+	if err := volumeEncrypt(ctx, testEC2Client, nil, volID, "", true, true); err != nil {
+		t.Fatalf("volumeEncrypt: %v", err)
+	}
+
+	newID, err := resolveVolume(ctx, testEC2Client, "test-encrypt")
+	if err != nil {
+		t.Fatalf("resolveVolume: %v", err)
+	}
+	if newID == volID {
+		t.Fatal("the name should resolve to the encrypted copy")
+	}
+	vol, err := describeVolume(ctx, testEC2Client, newID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !aws.ToBool(vol.Encrypted) {
+		t.Errorf("%s is not encrypted", newID)
+	}
+	testEC2Client.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: aws.String(newID)})
+}
+
 func TestResolveVolumeByName(t *testing.T) {
 	skipIfNoDocker(t)
 	ctx := context.Background()
@@ -877,7 +2054,7 @@ func TestVolumeMove(t *testing.T) {
 	}
 	volID := *vol.VolumeId
 
-	err = volumeMove(ctx, testEC2Client, testAWSCfg, volID, "us-west-2", "", true)
+	err = volumeMove(ctx, testEC2Client, testAWSCfg, volID, "us-west-2", "", true, "")
 	if err != nil {
 		t.Fatalf("volumeMove: %v", err)
 	}
@@ -885,6 +2062,74 @@ func TestVolumeMove(t *testing.T) {
 
 // ==================== FetchUserData test ====================
 
+func TestCopyVolumesToAZ(t *testing.T) {
+	skipIfNoDocker(t)
+	ctx := context.Background()
+
+	vol, err := testEC2Client.CreateVolume(ctx, &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String("us-east-1a"),
+		Size:             aws.Int32(1),
+		VolumeType:       types.VolumeTypeGp3,
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeVolume,
+				Tags:         []types.Tag{{Key: aws.String("Name"), Value: aws.String("test-cross-az")}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := copyVolumesToAZ(ctx, testEC2Client, []volumeAttachment{{VolumeID: *vol.VolumeId, Device: "/dev/sdf"}}, "us-east-1b")
+	if err != nil {
+		t.Fatalf("copyVolumesToAZ: %v", err)
+	}
+	if len(moved) != 1 || moved[0].NewID == "" || moved[0].Device != "/dev/sdf" {
+		t.Fatalf("moved = %+v", moved)
+	}
+
+	desc, err := testEC2Client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{moved[0].NewID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := desc.Volumes[0]
+	if aws.ToString(got.AvailabilityZone) != "us-east-1b" {
+		t.Errorf("copy AZ = %s, want us-east-1b", aws.ToString(got.AvailabilityZone))
+	}
+	if awsutil.NameTag(got.Tags) != "test-cross-az" {
+		t.Errorf("copy Name tag = %q, want test-cross-az", awsutil.NameTag(got.Tags))
+	}
+	if lineage := awsutil.TagValue(got.Tags, previousVolumesTag); lineage != *vol.VolumeId {
+		t.Errorf("copy %s = %q, want %s", previousVolumesTag, lineage, *vol.VolumeId)
+	}
+	// The original is untouched.
+	if _, err := testEC2Client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{*vol.VolumeId}}); err != nil {
+		t.Errorf("original volume gone: %v", err)
+	}
+
+	// gp2 reports baseline IOPS that CreateVolume won't take as a setting.
+	gp2, err := testEC2Client.CreateVolume(ctx, &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String("us-east-1a"),
+		Size:             aws.Int32(1),
+		VolumeType:       types.VolumeTypeGp2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err = copyVolumesToAZ(ctx, testEC2Client, []volumeAttachment{{VolumeID: *gp2.VolumeId, Device: "/dev/sdg"}}, "us-east-1b")
+	if err != nil {
+		t.Fatalf("copyVolumesToAZ gp2: %v", err)
+	}
+	desc, err = testEC2Client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{moved[0].NewID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := desc.Volumes[0]; got.VolumeType != types.VolumeTypeGp2 {
+		t.Errorf("gp2 copy type = %s, want gp2", got.VolumeType)
+	}
+}
+
 func TestFetchUserData(t *testing.T) {
 	skipIfNoDocker(t)
 	ctx := context.Background()
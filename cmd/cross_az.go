@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/emaland/devbox/internal/awsutil"
+)
+
+const (
+	// snapshotGiBPerMinute is a conservative rate for a first, full EBS
+	// snapshot. Later snapshots of the same volume are incremental and
+	// usually much faster.
+	snapshotGiBPerMinute = 8
+	// crossAZOverhead covers launching, stopping and starting the boxes
+	// and waiting for status checks.
+	crossAZOverhead = 6 * time.Minute
+	// healthCheckTimeout bounds the wait for the new box's status checks
+	// before the original volumes are deleted.
+	healthCheckTimeout = 10 * time.Minute
+)
+
+// movedVolume is a data volume copied into another AZ.
+type movedVolume struct {
+	OldID      string
+	NewID      string
+	SnapshotID string
+	Device     string
+}
+
+// estimateCrossAZMove estimates how long moving a box with totalGiB of data
+// volumes to another AZ takes.
+func estimateCrossAZMove(totalGiB int32) time.Duration {
+	copyTime := time.Duration(float64(totalGiB) / snapshotGiBPerMinute * float64(time.Minute))
+	return (crossAZOverhead + copyTime).Round(time.Minute)
+}
+
+// dataVolumeSizes returns the total size of the instance's non-root EBS
+// volumes.
+func dataVolumeSizes(ctx context.Context, client *ec2.Client, inst types.Instance) (int32, error) {
+	var ids []string
+	for _, bdm := range inst.BlockDeviceMappings {
+		if bdm.Ebs == nil || bdm.Ebs.VolumeId == nil || aws.ToString(bdm.DeviceName) == aws.ToString(inst.RootDeviceName) {
+			continue
+		}
+		ids = append(ids, *bdm.Ebs.VolumeId)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	desc, err := client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: ids})
+	if err != nil {
+		return 0, fmt.Errorf("describing data volumes: %w", err)
+	}
+	var total int32
+	for _, v := range desc.Volumes {
+		total += aws.ToInt32(v.Size)
+	}
+	return total, nil
+}
+
+// printCrossAZEstimate tells the user what a move to targetAZ will cost
+// before anything is changed.
+func printCrossAZEstimate(ctx context.Context, client *ec2.Client, inst types.Instance, targetAZ string) error {
+	total, err := dataVolumeSizes(ctx, client, inst)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Moving from %s to %s: data volumes (%d GiB) will be snapshotted and recreated there.\n",
+		aws.ToString(inst.Placement.AvailabilityZone), targetAZ, total)
+	fmt.Printf("Estimated time: ~%s (a first snapshot; later ones are incremental and faster).\n",
+		estimateCrossAZMove(total))
+	fmt.Println("The original volumes are deleted only after the new instance passes its status checks.")
+	return nil
+}
+
+// lookupSubnetInVPC finds a subnet in az within the instance's VPC,
+// preferring the AZ's default subnet.
+func lookupSubnetInVPC(ctx context.Context, client *ec2.Client, vpcID, az string) (string, error) {
+	result, err := client.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{
+		Filters: []types.Filter{
+			{Name: aws.String("vpc-id"), Values: []string{vpcID}},
+			{Name: aws.String("availability-zone"), Values: []string{az}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("looking up subnet: %w", err)
+	}
+	if len(result.Subnets) == 0 {
+		return "", fmt.Errorf("no subnet in %s for VPC %s", az, vpcID)
+	}
+	for _, s := range result.Subnets {
+		if aws.ToBool(s.DefaultForAz) {
+			return *s.SubnetId, nil
+		}
+	}
+	return *result.Subnets[0].SubnetId, nil
+}
+
+// copyVolumesToAZ snapshots each volume and creates a copy in targetAZ with
+// the same type, performance settings and tags. The originals are left
+// untouched. On error, copies made so far are deleted.
+func copyVolumesToAZ(ctx context.Context, client *ec2.Client, volumes []volumeAttachment, targetAZ string) ([]movedVolume, error) {
+	var moved []movedVolume
+	cleanup := func() {
+		for _, m := range moved {
+			if m.NewID != "" {
+				client.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: aws.String(m.NewID)})
+			}
+			if m.SnapshotID != "" {
+				client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(m.SnapshotID)})
+			}
+		}
+	}
+
+	// Start every snapshot first so they run in parallel.
+	for _, vol := range volumes {
+		fmt.Printf("Creating snapshot of %s...\n", vol.VolumeID)
+		snap, err := client.CreateSnapshot(ctx, &ec2.CreateSnapshotInput{
+			VolumeId:    aws.String(vol.VolumeID),
+			Description: aws.String(fmt.Sprintf("devbox cross-AZ move: %s -> %s", vol.VolumeID, targetAZ)),
+		})
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("creating snapshot of %s: %w", vol.VolumeID, err)
+		}
+		moved = append(moved, movedVolume{OldID: vol.VolumeID, SnapshotID: *snap.SnapshotId, Device: vol.Device})
+	}
+
+	for i, m := range moved {
+		fmt.Printf("Waiting for snapshot %s of %s...\n", m.SnapshotID, m.OldID)
+		if err := pollSnapshotState(ctx, client, m.SnapshotID, "completed", SnapshotPollInterval, 2*time.Hour); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("waiting for snapshot %s: %w", m.SnapshotID, err)
+		}
+
+		desc, err := client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{m.OldID}})
+		if err != nil || len(desc.Volumes) == 0 {
+			cleanup()
+			return nil, fmt.Errorf("describing volume %s: %w", m.OldID, err)
+		}
+		src := desc.Volumes[0]
+		// The copy keeps the snapshot lineage, so restore still finds the
+		// original's snapshots.
+		input := &ec2.CreateVolumeInput{
+			AvailabilityZone: aws.String(targetAZ),
+			SnapshotId:       aws.String(m.SnapshotID),
+			Size:             src.Size,
+			VolumeType:       src.VolumeType,
+			TagSpecifications: []types.TagSpecification{
+				{ResourceType: types.ResourceTypeVolume, Tags: successorTags(src)},
+			},
+		}
+		setPerformance(input, awsutil.CurrentSpec(src))
+		fmt.Printf("Creating copy of %s in %s...\n", m.OldID, targetAZ)
+		newVol, err := client.CreateVolume(ctx, input)
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("creating volume in %s: %w", targetAZ, err)
+		}
+		moved[i].NewID = *newVol.VolumeId
+		if err := awsutil.PollVolumeState(ctx, client, moved[i].NewID, "available", VolumePollInterval, 5*time.Minute); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("waiting for volume %s: %w", moved[i].NewID, err)
+		}
+		fmt.Printf("  %s -> %s\n", m.OldID, moved[i].NewID)
+	}
+	return moved, nil
+}
+
+// finishCrossAZMove waits for the new instance to pass its status checks
+// and then deletes the original volumes and the transfer snapshots. If the
+// box doesn't come up healthy, everything is kept for manual recovery.
+func finishCrossAZMove(ctx context.Context, client *ec2.Client, newID string, moved []movedVolume) {
+	fmt.Printf("Waiting for %s to pass status checks before removing the original volumes...\n", newID)
+	waiter := ec2.NewInstanceStatusOkWaiter(client)
+	if err := waiter.Wait(ctx, &ec2.DescribeInstanceStatusInput{
+		InstanceIds: []string{newID},
+	}, healthCheckTimeout); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s did not pass status checks: %v\n", newID, err)
+		fmt.Fprintln(os.Stderr, "Keeping the original volumes and snapshots:")
+		for _, m := range moved {
+			fmt.Fprintf(os.Stderr, "  %s (snapshot %s, copy %s)\n", m.OldID, m.SnapshotID, m.NewID)
+		}
+		return
+	}
+	fmt.Println("Status checks passed.")
+
+	for _, m := range moved {
+		if _, err := client.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: aws.String(m.OldID)}); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to delete original volume %s: %v\n", m.OldID, err)
+		} else {
+			fmt.Printf("  Deleted original volume %s\n", m.OldID)
+		}
+		if _, err := client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(m.SnapshotID)}); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to delete transfer snapshot %s: %v\n", m.SnapshotID, err)
+		} else {
+			fmt.Printf("  Deleted transfer snapshot %s\n", m.SnapshotID)
+		}
+	}
+}
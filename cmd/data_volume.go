@@ -0,0 +1,232 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const (
+	// dataVolumeDevice is where spawn attaches the /home volume.
+	dataVolumeDevice = "/dev/xvdf"
+	// dataBoxTag names the box a spawned data volume belongs to.
+	dataBoxTag = "devbox-box"
+)
+
+// dataSource is a parsed --data flag: where spawn gets the box's /home
+// volume from.
+type dataSource struct {
+	Kind     string // "new", "snapshot" or "clone"
+	SizeGiB  int32  // for new
+	Snapshot string // snapshot ID or "latest", for snapshot
+}
+
+// parseDataSource parses "new:<GiB>", "snapshot:<snap-id|latest>" or "clone".
+func parseDataSource(s string) (dataSource, error) {
+	kind, arg, _ := strings.Cut(s, ":")
+	switch kind {
+	case "new":
+		size, err := strconv.ParseInt(arg, 10, 32)
+		if err != nil || size < 1 || size > 16384 {
+			return dataSource{}, fmt.Errorf("invalid --data %q: want new:<size in GiB>, e.g. new:256", s)
+		}
+		return dataSource{Kind: kind, SizeGiB: int32(size)}, nil
+	case "snapshot":
+		if arg != "latest" && !strings.HasPrefix(arg, "snap-") {
+			return dataSource{}, fmt.Errorf("invalid --data %q: want snapshot:<snap-id> or snapshot:latest", s)
+		}
+		return dataSource{Kind: kind, Snapshot: arg}, nil
+	case "clone":
+		if arg != "" {
+			return dataSource{}, fmt.Errorf("invalid --data %q: clone takes no argument", s)
+		}
+		return dataSource{Kind: kind}, nil
+	}
+	return dataSource{}, fmt.Errorf("invalid --data %q: want new:<GiB>, snapshot:<snap-id|latest> or clone", s)
+}
+
+// needsPrimary reports whether the source is read from the primary's data
+// volume.
+func (d dataSource) needsPrimary() bool {
+	return d.Kind == "clone" || d.Snapshot == "latest"
+}
+
+// dataBlockDevice is the mapping that creates the data volume together with
+// the instance, so it is attached on first boot and deleted when the box is
+// terminated. An empty snapshotID makes a blank volume, which
+// configuration.nix formats with the home-data label.
+func dataBlockDevice(sizeGiB int32, snapshotID string) types.BlockDeviceMapping {
+	ebs := &types.EbsBlockDevice{
+		VolumeType:          types.VolumeTypeGp3,
+		DeleteOnTermination: aws.Bool(true),
+	}
+	if snapshotID != "" {
+		ebs.SnapshotId = aws.String(snapshotID)
+	} else {
+		ebs.VolumeSize = aws.Int32(sizeGiB)
+	}
+	return types.BlockDeviceMapping{DeviceName: aws.String(dataVolumeDevice), Ebs: ebs}
+}
+
+// primaryDataVolume returns the data volume of the primary box: its one
+// non-root EBS volume.
+func primaryDataVolume(ctx context.Context, client *ec2.Client, primaryID string) (string, error) {
+	inst, err := describeInstance(ctx, client, primaryID)
+	if err != nil {
+		return "", err
+	}
+	var vols []string
+	for _, bdm := range dataVolumeMappings(inst) {
+		vols = append(vols, aws.ToString(bdm.Ebs.VolumeId))
+	}
+	switch len(vols) {
+	case 0:
+		return "", fmt.Errorf("%s has no data volume", primaryID)
+	case 1:
+		return vols[0], nil
+	}
+	return "", fmt.Errorf("%s has several data volumes (%s); use --data snapshot:<snap-id>", primaryID, strings.Join(vols, ", "))
+}
+
+// dataVolumeMappings returns an instance's non-root EBS attachments.
+func dataVolumeMappings(inst types.Instance) []types.InstanceBlockDeviceMapping {
+	var out []types.InstanceBlockDeviceMapping
+	for _, bdm := range inst.BlockDeviceMappings {
+		if bdm.Ebs == nil || aws.ToString(bdm.DeviceName) == aws.ToString(inst.RootDeviceName) {
+			continue
+		}
+		out = append(out, bdm)
+	}
+	return out
+}
+
+// latestSnapshot returns the newest completed snapshot of volID.
+func latestSnapshot(ctx context.Context, client *ec2.Client, volID string) (string, error) {
+	result, err := client.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{
+		OwnerIds: []string{"self"},
+		Filters: []types.Filter{
+			{Name: aws.String("volume-id"), Values: []string{volID}},
+			{Name: aws.String("status"), Values: []string{"completed"}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("describing snapshots: %w", err)
+	}
+	if len(result.Snapshots) == 0 {
+		return "", fmt.Errorf("no completed snapshots of %s", volID)
+	}
+	sort.Slice(result.Snapshots, func(i, j int) bool {
+		return aws.ToTime(result.Snapshots[i].StartTime).After(aws.ToTime(result.Snapshots[j].StartTime))
+	})
+	return *result.Snapshots[0].SnapshotId, nil
+}
+
+// cloneSnapshot snapshots volID for a clone and waits for it to complete.
+// The box is live, so the copy is crash-consistent.
+func cloneSnapshot(ctx context.Context, client *ec2.Client, volID, name string) (string, error) {
+	fmt.Printf("  Snapshotting %s for the clone...\n", volID)
+	snap, err := client.CreateSnapshot(ctx, &ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(volID),
+		Description: aws.String(fmt.Sprintf("devbox spawn --data clone: %s for %s", volID, name)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("creating snapshot of %s: %w", volID, err)
+	}
+	snapID := *snap.SnapshotId
+	if err := pollSnapshotState(ctx, client, snapID, "completed", SnapshotPollInterval, 2*time.Hour); err != nil {
+		client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(snapID)})
+		return "", fmt.Errorf("waiting for snapshot %s: %w", snapID, err)
+	}
+	return snapID, nil
+}
+
+// prepareDataVolume resolves the data source to a block device mapping.
+// primary resolves the primary box's ID for sources that need it. For a
+// clone it also returns the temporary snapshot, to delete after launch.
+func prepareDataVolume(ctx context.Context, client *ec2.Client, src dataSource, primary func() (string, error), name string) (types.BlockDeviceMapping, string, error) {
+	if src.Kind == "new" {
+		fmt.Printf("  Data volume: new %d GiB gp3\n", src.SizeGiB)
+		return dataBlockDevice(src.SizeGiB, ""), "", nil
+	}
+	snapID := src.Snapshot
+	var tempSnap string
+	if src.needsPrimary() {
+		primaryID, err := primary()
+		if err != nil {
+			return types.BlockDeviceMapping{}, "", err
+		}
+		volID, err := primaryDataVolume(ctx, client, primaryID)
+		if err != nil {
+			return types.BlockDeviceMapping{}, "", err
+		}
+		if src.Kind == "clone" {
+			if snapID, err = cloneSnapshot(ctx, client, volID, name); err != nil {
+				return types.BlockDeviceMapping{}, "", err
+			}
+			tempSnap = snapID
+		} else if snapID, err = latestSnapshot(ctx, client, volID); err != nil {
+			return types.BlockDeviceMapping{}, "", err
+		}
+		fmt.Printf("  Data volume: from %s's %s via %s\n", primaryID, volID, snapID)
+	} else {
+		fmt.Printf("  Data volume: from %s\n", snapID)
+	}
+	return dataBlockDevice(0, snapID), tempSnap, nil
+}
+
+// tagDataVolume names the data volume spawn created with inst and tags it
+// with the box it belongs to.
+func tagDataVolume(ctx context.Context, client *ec2.Client, inst types.Instance, name string) {
+	for _, bdm := range inst.BlockDeviceMappings {
+		if aws.ToString(bdm.DeviceName) != dataVolumeDevice || bdm.Ebs == nil {
+			continue
+		}
+		volID := aws.ToString(bdm.Ebs.VolumeId)
+		_, err := client.CreateTags(ctx, &ec2.CreateTagsInput{
+			Resources: []string{volID},
+			Tags: []types.Tag{
+				{Key: aws.String("Name"), Value: aws.String(name + "-home")},
+				{Key: aws.String(dataBoxTag), Value: aws.String(name)},
+				{Key: aws.String("devbox-managed"), Value: aws.String("true")},
+			},
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not tag data volume %s: %v\n", volID, err)
+			return
+		}
+		fmt.Printf("  Data:      %s (%s-home)\n", volID, name)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Warning: no data volume found at %s on %s\n", dataVolumeDevice, aws.ToString(inst.InstanceId))
+}
+
+// templateBlockDevices converts a launch template's block device mappings
+// for a RunInstances override, which replaces the template's list whole.
+func templateBlockDevices(data *types.ResponseLaunchTemplateData) []types.BlockDeviceMapping {
+	var out []types.BlockDeviceMapping
+	for _, bdm := range data.BlockDeviceMappings {
+		m := types.BlockDeviceMapping{DeviceName: bdm.DeviceName, NoDevice: bdm.NoDevice, VirtualName: bdm.VirtualName}
+		if e := bdm.Ebs; e != nil {
+			m.Ebs = &types.EbsBlockDevice{
+				VolumeSize:          e.VolumeSize,
+				VolumeType:          e.VolumeType,
+				Iops:                e.Iops,
+				Throughput:          e.Throughput,
+				Encrypted:           e.Encrypted,
+				KmsKeyId:            e.KmsKeyId,
+				SnapshotId:          e.SnapshotId,
+				DeleteOnTermination: e.DeleteOnTermination,
+			}
+		}
+		out = append(out, m)
+	}
+	return out
+}
@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/emaland/devbox/internal/awsutil"
+	"github.com/emaland/devbox/internal/bid"
+)
+
+// fleetRequirements validates the attribute-based spawn flags and turns
+// them into EC2 instance requirements.
+func fleetRequirements(opts spawnOptions) (*types.InstanceRequirementsRequest, error) {
+	strategies := types.SpotAllocationStrategy("").Values()
+	if !slices.Contains(strategies, types.SpotAllocationStrategy(opts.Strategy)) {
+		var names []string
+		for _, s := range strategies {
+			names = append(names, string(s))
+		}
+		return nil, fmt.Errorf("invalid --strategy %q: want one of %s", opts.Strategy, strings.Join(names, ", "))
+	}
+	if err := opts.Filter.Validate(); err != nil {
+		return nil, err
+	}
+	vcpu, err := awsutil.ParseRange(opts.VCPU)
+	if err != nil {
+		return nil, fmt.Errorf("--vcpu: %w", err)
+	}
+	mem, err := awsutil.ParseRange(opts.Mem)
+	if err != nil {
+		return nil, fmt.Errorf("--mem: %w", err)
+	}
+	return opts.Filter.Requirements(vcpu, mem)
+}
+
+// fleetMaxPrice resolves a bid for a fleet launch. The type isn't known
+// until AWS picks it, so only literal prices set a cap; an empty
+// expression, or a strategy that depends on the type, means no cap beyond
+// the on-demand price.
+func fleetMaxPrice(expr string, explain bool) (string, error) {
+	if expr == "" {
+		return "", nil
+	}
+	strategy, err := bid.Parse(expr)
+	if err != nil {
+		return "", fmt.Errorf("resolving bid %q: %w", expr, err)
+	}
+	if strategy.NeedsHistory() || strategy.NeedsOnDemand() {
+		fmt.Printf("Bid %q depends on the instance type, which the fleet picks; launching with no cap beyond the on-demand price.\n", expr)
+		return "", nil
+	}
+	result, err := strategy.Evaluate(bid.Inputs{})
+	if err != nil {
+		return "", fmt.Errorf("resolving bid %q: %w", expr, err)
+	}
+	if explain {
+		fmt.Printf("Bid %q for the fleet:\n%s\n", expr, result.Explain())
+	}
+	return result.MaxPrice(), nil
+}
+
+// defaultSubnets maps each AZ of the region to its default subnet.
+func defaultSubnets(ctx context.Context, client *ec2.Client) (map[string]string, error) {
+	result, err := client.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{
+		Filters: []types.Filter{
+			{Name: aws.String("default-for-az"), Values: []string{"true"}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("looking up subnets: %w", err)
+	}
+	if len(result.Subnets) == 0 {
+		return nil, fmt.Errorf("no default subnets found")
+	}
+	subnets := make(map[string]string, len(result.Subnets))
+	for _, s := range result.Subnets {
+		subnets[aws.ToString(s.AvailabilityZone)] = aws.ToString(s.SubnetId)
+	}
+	return subnets, nil
+}
+
+// launchTemplateData converts a RunInstances request into launch template
+// data. Instance count, subnet and dry-run settings have no template
+// equivalent and are dropped.
+func launchTemplateData(in *ec2.RunInstancesInput) *types.RequestLaunchTemplateData {
+	data := &types.RequestLaunchTemplateData{
+		ImageId:          in.ImageId,
+		InstanceType:     in.InstanceType,
+		KeyName:          in.KeyName,
+		SecurityGroupIds: in.SecurityGroupIds,
+		UserData:         in.UserData,
+	}
+	if in.IamInstanceProfile != nil {
+		data.IamInstanceProfile = &types.LaunchTemplateIamInstanceProfileSpecificationRequest{
+			Arn:  in.IamInstanceProfile.Arn,
+			Name: in.IamInstanceProfile.Name,
+		}
+	}
+	for _, bdm := range in.BlockDeviceMappings {
+		m := types.LaunchTemplateBlockDeviceMappingRequest{DeviceName: bdm.DeviceName}
+		if bdm.Ebs != nil {
+			m.Ebs = &types.LaunchTemplateEbsBlockDeviceRequest{
+				VolumeSize:          bdm.Ebs.VolumeSize,
+				VolumeType:          bdm.Ebs.VolumeType,
+				Iops:                bdm.Ebs.Iops,
+				Throughput:          bdm.Ebs.Throughput,
+				Encrypted:           bdm.Ebs.Encrypted,
+				KmsKeyId:            bdm.Ebs.KmsKeyId,
+				SnapshotId:          bdm.Ebs.SnapshotId,
+				DeleteOnTermination: bdm.Ebs.DeleteOnTermination,
+			}
+		}
+		data.BlockDeviceMappings = append(data.BlockDeviceMappings, m)
+	}
+	for _, ts := range in.TagSpecifications {
+		data.TagSpecifications = append(data.TagSpecifications, types.LaunchTemplateTagSpecificationRequest{
+			ResourceType: ts.ResourceType,
+			Tags:         ts.Tags,
+		})
+	}
+	if mo := in.InstanceMarketOptions; mo != nil {
+		data.InstanceMarketOptions = &types.LaunchTemplateInstanceMarketOptionsRequest{MarketType: mo.MarketType}
+		if so := mo.SpotOptions; so != nil {
+			data.InstanceMarketOptions.SpotOptions = &types.LaunchTemplateSpotMarketOptionsRequest{
+				InstanceInterruptionBehavior: so.InstanceInterruptionBehavior,
+				MaxPrice:                     so.MaxPrice,
+				SpotInstanceType:             so.SpotInstanceType,
+			}
+		}
+	}
+	return data
+}
+
+// launchFleet launches one spot instance matching reqs through an instant
+// EC2 Fleet, letting AWS choose the type and AZ with the allocation
+// strategy. If runInput names a launch template the fleet launches from
+// it; otherwise runInput supplies everything but the type, subnet and
+// market options and is turned into a temporary template. It returns the
+// instance ID and the type and AZ that won.
+func launchFleet(ctx context.Context, client *ec2.Client, runInput *ec2.RunInstancesInput, reqs *types.InstanceRequirementsRequest, subnets map[string]string, strategy types.SpotAllocationStrategy, maxPrice string) (id, instanceType, az string, err error) {
+	ltSpec := &types.FleetLaunchTemplateSpecificationRequest{Version: aws.String("$Default")}
+	if runInput.LaunchTemplate != nil {
+		ltSpec.LaunchTemplateId = runInput.LaunchTemplate.LaunchTemplateId
+		ltSpec.Version = runInput.LaunchTemplate.Version
+	} else {
+		// EC2 Fleet sets the market options itself and picks the type
+		// from the requirements, so the template must leave both out.
+		data := launchTemplateData(runInput)
+		data.InstanceType = ""
+		data.InstanceMarketOptions = nil
+
+		ltName := fmt.Sprintf("devbox-fleet-%d", time.Now().Unix())
+		lt, err := client.CreateLaunchTemplate(ctx, &ec2.CreateLaunchTemplateInput{
+			LaunchTemplateName: aws.String(ltName),
+			LaunchTemplateData: data,
+		})
+		if err != nil {
+			return "", "", "", fmt.Errorf("creating launch template: %w", err)
+		}
+		ltSpec.LaunchTemplateId = lt.LaunchTemplate.LaunchTemplateId
+		defer func() {
+			// Instances don't depend on the template once launched.
+			client.DeleteLaunchTemplate(ctx, &ec2.DeleteLaunchTemplateInput{LaunchTemplateId: ltSpec.LaunchTemplateId})
+		}()
+	}
+
+	azBySubnet := map[string]string{}
+	var overrides []types.FleetLaunchTemplateOverridesRequest
+	for zone, subnetID := range subnets {
+		azBySubnet[subnetID] = zone
+		overrides = append(overrides, types.FleetLaunchTemplateOverridesRequest{
+			SubnetId:             aws.String(subnetID),
+			InstanceRequirements: reqs,
+		})
+	}
+
+	spotOpts := &types.SpotOptionsRequest{AllocationStrategy: strategy}
+	if maxPrice != "" {
+		spotOpts.MaxTotalPrice = aws.String(maxPrice)
+	}
+	out, err := client.CreateFleet(ctx, &ec2.CreateFleetInput{
+		Type: types.FleetTypeInstant,
+		LaunchTemplateConfigs: []types.FleetLaunchTemplateConfigRequest{{
+			LaunchTemplateSpecification: ltSpec,
+			Overrides:                   overrides,
+		}},
+		TargetCapacitySpecification: &types.TargetCapacitySpecificationRequest{
+			TotalTargetCapacity:       aws.Int32(1),
+			DefaultTargetCapacityType: types.DefaultTargetCapacityTypeSpot,
+		},
+		SpotOptions:       spotOpts,
+		TagSpecifications: runInput.TagSpecifications,
+	})
+	if err != nil {
+		return "", "", "", fmt.Errorf("creating fleet: %w", err)
+	}
+
+	for _, inst := range out.Instances {
+		if len(inst.InstanceIds) == 0 {
+			continue
+		}
+		instanceType = string(inst.InstanceType)
+		if o := inst.LaunchTemplateAndOverrides; o != nil && o.Overrides != nil {
+			az = aws.ToString(o.Overrides.AvailabilityZone)
+			if az == "" {
+				az = azBySubnet[aws.ToString(o.Overrides.SubnetId)]
+			}
+		}
+		return inst.InstanceIds[0], instanceType, az, nil
+	}
+
+	var reasons []string
+	for _, e := range out.Errors {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", aws.ToString(e.ErrorCode), aws.ToString(e.ErrorMessage)))
+	}
+	if len(reasons) == 0 {
+		reasons = append(reasons, "no instance launched")
+	}
+	return "", "", "", fmt.Errorf("fleet launch failed: %s", strings.Join(slices.Compact(reasons), "; "))
+}
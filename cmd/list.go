@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
@@ -46,7 +47,9 @@ func listInstances(ctx context.Context, client *ec2.Client) error {
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
-	fmt.Fprintln(w, "INSTANCE ID\tNAME\tTYPE\tSTATE\tAZ\tPUBLIC IP\tSPOT REQUEST")
+	fmt.Fprintln(w, "INSTANCE ID\tNAME\tTYPE\tSTATE\tAZ\tPUBLIC IP\tSPOT REQUEST\tTTL")
+
+	now := time.Now()
 
 	for _, reservation := range result.Reservations {
 		for _, inst := range reservation.Instances {
@@ -59,7 +62,7 @@ func listInstances(ctx context.Context, client *ec2.Client) error {
 			if inst.SpotInstanceRequestId != nil {
 				spotReqID = *inst.SpotInstanceRequestId
 			}
-			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
 				*inst.InstanceId,
 				name,
 				string(inst.InstanceType),
@@ -67,6 +70,7 @@ func listInstances(ctx context.Context, client *ec2.Client) error {
 				*inst.Placement.AvailabilityZone,
 				publicIP,
 				spotReqID,
+				ttlRemaining(inst.Tags, now),
 			)
 		}
 	}
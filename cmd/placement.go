@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/emaland/devbox/internal/awsutil"
+)
+
+// autoAZ is the --az value that picks the AZ by spot placement score.
+const autoAZ = "auto"
+
+// placementMaxTypes caps how many candidate types are sent for scoring.
+const placementMaxTypes = 50
+
+// lowPlacementScore is the score at or below which a launch is unlikely;
+// when every AZ scores this low, the pick is little better than a guess.
+const lowPlacementScore = 3
+
+// newPlacementScorer returns the scorer spawn and recover use; tests
+// replace it with a fake.
+var newPlacementScorer = func(client *ec2.Client) awsutil.PlacementScorer {
+	return &awsutil.EC2PlacementScorer{Client: client}
+}
+
+// pickAZ scores the AZs of region for req and returns the best-scoring one
+// in allowed, or in the whole region if allowed is empty. Ties go to
+// prefer, so a flat set of scores keeps the usual AZ.
+func pickAZ(ctx context.Context, scorer awsutil.PlacementScorer, req awsutil.PlacementRequest, region string, allowed []string, prefer string) (string, []awsutil.PlacementScore, error) {
+	req.Regions = []string{region}
+	req.SingleAZ = true
+	scores, err := scorer.PlacementScores(ctx, req)
+	if err != nil {
+		return "", nil, err
+	}
+	best := -1
+	for i, s := range scores {
+		if s.Region != region || (len(allowed) > 0 && !slices.Contains(allowed, s.AZ)) {
+			continue
+		}
+		if best < 0 || s.Score > scores[best].Score || (s.Score == scores[best].Score && s.AZ == prefer) {
+			best = i
+		}
+	}
+	if best < 0 {
+		if len(allowed) > 0 {
+			return "", scores, fmt.Errorf("no placement score for %s in %s", strings.Join(allowed, ", "), region)
+		}
+		return "", scores, fmt.Errorf("no placement scores for %s", region)
+	}
+	return scores[best].AZ, scores, nil
+}
+
+// printPlacementScores lists AZ scores best first and marks the pick.
+func printPlacementScores(scores []awsutil.PlacementScore, picked string) {
+	fmt.Println("Spot placement scores (1-10, higher is more likely to launch):")
+	for _, s := range scores {
+		mark := ""
+		if s.AZ == picked {
+			mark = "  <- picked"
+		}
+		fmt.Printf("  %-14s %2d%s\n", s.AZ, s.Score, mark)
+	}
+	for _, s := range scores {
+		if s.Score > lowPlacementScore {
+			return
+		}
+	}
+	if len(scores) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: every AZ scores %d or lower, so the pick is little better than the default.\n", lowPlacementScore)
+	}
+}
+
+// printRegionScores shows the best regions for req, noting when the
+// current region isn't among the leaders. Failures only warn: the region
+// ranking is advice and spawn always runs in the configured region.
+func printRegionScores(ctx context.Context, scorer awsutil.PlacementScorer, req awsutil.PlacementRequest, current string) {
+	req.Regions, req.SingleAZ = nil, false
+	scores, err := scorer.PlacementScores(ctx, req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not score regions: %v\n", err)
+		return
+	}
+	if len(scores) == 0 {
+		return
+	}
+	var top []string
+	for _, s := range scores[:min(5, len(scores))] {
+		top = append(top, fmt.Sprintf("%s (%d)", s.Region, s.Score))
+	}
+	fmt.Printf("Best regions: %s\n", strings.Join(top, ", "))
+	for _, s := range scores {
+		if s.Region == current {
+			if s.Score < scores[0].Score {
+				fmt.Printf("  %s scores %d; set the AWS region to launch elsewhere.\n", current, s.Score)
+			}
+			return
+		}
+	}
+}
+
+// hasDataVolumes reports whether inst has EBS volumes besides its root
+// volume, which tie it to its AZ.
+func hasDataVolumes(inst types.Instance) bool {
+	for _, bdm := range inst.BlockDeviceMappings {
+		if bdm.Ebs != nil && aws.ToString(bdm.DeviceName) != aws.ToString(inst.RootDeviceName) {
+			return true
+		}
+	}
+	return false
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sort"
 	"text/tabwriter"
 	"time"
 
@@ -11,16 +12,104 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/spf13/cobra"
+
+	"github.com/emaland/devbox/internal/awsutil"
+	"github.com/emaland/devbox/internal/spotstats"
 )
 
 func newPricesCmd() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "prices",
 		Short: "Show current spot market prices for our instance types",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return showPrices(cmd.Context(), ec2Client)
 		},
 	}
+
+	cmd.AddCommand(newPricesHistoryCmd())
+
+	return cmd
+}
+
+func newPricesHistoryCmd() *cobra.Command {
+	var (
+		az    string
+		days  int
+		width int
+	)
+
+	cmd := &cobra.Command{
+		Use:   "history <instance-type>",
+		Short: "Chart spot price history and statistics per AZ",
+		Long: `Chart spot price history for an instance type, one row per AZ.
+
+Statistics are time-weighted: a price that held for a week counts for more
+than one that held for an hour. RISK is a rough interruption estimate from
+how volatile the price was (coefficient of variation and changes per day).`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return showPriceHistory(cmd.Context(), ec2Client, args[0], az, days, width)
+		},
+	}
+
+	cmd.Flags().StringVar(&az, "az", "", "Only show this availability zone")
+	cmd.Flags().IntVar(&days, "days", 30, "Days of history to fetch")
+	cmd.Flags().IntVar(&width, "width", 40, "Sparkline width in characters")
+
+	return cmd
+}
+
+func showPriceHistory(ctx context.Context, client *ec2.Client, instanceType, az string, days, width int) error {
+	if days <= 0 {
+		return fmt.Errorf("--days must be positive")
+	}
+	end := time.Now()
+	start := end.Add(-time.Duration(days) * 24 * time.Hour)
+
+	points, err := awsutil.FetchSpotPriceHistory(ctx, client, []string{instanceType}, az, start)
+	if err != nil {
+		return err
+	}
+	if len(points) == 0 {
+		fmt.Printf("No spot price history for %s in the last %d days.\n", instanceType, days)
+		return nil
+	}
+
+	// Chart every AZ on the same scale so rows are comparable.
+	lo, hi := points[0].Price, points[0].Price
+	for _, p := range points {
+		if p.Price < lo {
+			lo = p.Price
+		}
+		if p.Price > hi {
+			hi = p.Price
+		}
+	}
+
+	series := spotstats.Series(points)
+	var keys []spotstats.SeriesKey
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].AZ < keys[j].AZ })
+
+	fmt.Printf("Spot price history for %s, %s to %s\n\n", instanceType, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "AZ\tTREND\tMIN\tMEDIAN\tP95\tMAX\tCURRENT\tCHANGES\tRISK")
+	for _, k := range keys {
+		pts := series[k]
+		st := spotstats.Summarize(pts, start, end)
+		fmt.Fprintf(w, "%s\t%s\t$%.4f\t$%.4f\t$%.4f\t$%.4f\t$%.4f\t%d\t%s\n",
+			k.AZ,
+			spotstats.Sparkline(pts, start, end, width, lo, hi),
+			st.Min, st.Median, st.P95, st.Max, st.Current,
+			st.Changes,
+			st.Risk,
+		)
+	}
+	w.Flush()
+	fmt.Printf("\nScale: %c = $%.4f  %c = $%.4f\n", '▁', lo, '█', hi)
+	return nil
 }
 
 func showPrices(ctx context.Context, client *ec2.Client) error {
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+
+	"github.com/emaland/devbox/internal/awsutil"
+	"github.com/emaland/devbox/internal/bid"
+)
+
+// capacityFailureTTL is how long a type that failed to launch in an AZ is
+// skipped by later probes.
+const capacityFailureTTL = 30 * time.Minute
+
+// launchCandidate is one type/AZ/price combination a replacement may be
+// launched with.
+type launchCandidate struct {
+	Type     string
+	AZ       string
+	MaxPrice string
+}
+
+// probeFailure records why a candidate was passed over.
+type probeFailure struct {
+	Candidate launchCandidate
+	// Stage is "dry-run" or "launch".
+	Stage string
+	Err   error
+}
+
+// apiErrorCode returns the EC2 error code behind err, or "".
+func apiErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// isCapacityError reports whether a launch failed for a reason another type
+// or AZ might not share.
+func isCapacityError(err error) bool {
+	switch apiErrorCode(err) {
+	case "InsufficientInstanceCapacity", "InsufficientHostCapacity",
+		"InsufficientCapacity", "SpotMaxPriceTooLow", "Unsupported":
+		return true
+	}
+	return false
+}
+
+// launchFirstAvailable tries each candidate in order: a dry-run of
+// RunInstances to catch types the AMI, AZ or account can't use, then a real
+// launch. Candidates that fail either step are recorded and the next one is
+// tried. subnetFor returns the subnet to launch into for an AZ.
+//
+// A dry-run can't reserve capacity, so InsufficientInstanceCapacity usually
+// only shows up on the real launch.
+func launchFirstAvailable(ctx context.Context, client *ec2.Client, base ec2.RunInstancesInput, candidates []launchCandidate, subnetFor func(az string) (string, error)) (string, launchCandidate, []probeFailure, error) {
+	var failures []probeFailure
+	for i, c := range candidates {
+		input := base
+		input.InstanceType = types.InstanceType(c.Type)
+		opts := *base.InstanceMarketOptions
+		spot := *opts.SpotOptions
+		spot.MaxPrice = aws.String(c.MaxPrice)
+		opts.SpotOptions = &spot
+		input.InstanceMarketOptions = &opts
+		subnetID, err := subnetFor(c.AZ)
+		if err != nil {
+			failures = append(failures, probeFailure{Candidate: c, Stage: "dry-run", Err: err})
+			continue
+		}
+		if subnetID != "" {
+			input.SubnetId = aws.String(subnetID)
+		} else {
+			input.Placement = &types.Placement{AvailabilityZone: aws.String(c.AZ)}
+		}
+
+		if len(candidates) > 1 {
+			fmt.Printf("Probing %s in %s ($%s/hr) [%d/%d]...\n", c.Type, c.AZ, c.MaxPrice, i+1, len(candidates))
+		}
+
+		dry := input
+		dry.DryRun = aws.Bool(true)
+		if _, err := client.RunInstances(ctx, &dry); err != nil && apiErrorCode(err) != "DryRunOperation" {
+			if apiErrorCode(err) == "UnauthorizedOperation" {
+				return "", c, failures, fmt.Errorf("launching %s: %w", c.Type, err)
+			}
+			fmt.Fprintf(os.Stderr, "  %s in %s rejected: %v\n", c.Type, c.AZ, err)
+			failures = append(failures, probeFailure{Candidate: c, Stage: "dry-run", Err: err})
+			continue
+		}
+
+		result, err := client.RunInstances(ctx, &input)
+		if err != nil {
+			if !isCapacityError(err) {
+				return "", c, failures, err
+			}
+			fmt.Fprintf(os.Stderr, "  %s in %s has no capacity: %v\n", c.Type, c.AZ, err)
+			failures = append(failures, probeFailure{Candidate: c, Stage: "launch", Err: err})
+			recordCapacityFailure(c)
+			continue
+		}
+		return *result.Instances[0].InstanceId, c, failures, nil
+	}
+	return "", launchCandidate{}, failures, fmt.Errorf("no capacity for any of %d candidate(s)", len(candidates))
+}
+
+// printProbeFailures summarizes the candidates passed over before a launch.
+func printProbeFailures(failures []probeFailure) {
+	if len(failures) == 0 {
+		return
+	}
+	fmt.Printf("Passed over %d candidate(s):\n", len(failures))
+	for _, f := range failures {
+		reason := apiErrorCode(f.Err)
+		if reason == "" {
+			reason = f.Err.Error()
+		}
+		fmt.Printf("  %-16s %-12s %s (%s)\n", f.Candidate.Type, f.Candidate.AZ, reason, f.Stage)
+	}
+}
+
+func capacityCacheKey(region string) string {
+	return "capacity-failures/" + region
+}
+
+// recordCapacityFailure remembers that c had no capacity so later recover
+// runs try it last.
+func recordCapacityFailure(c launchCandidate) {
+	key := capacityCacheKey(bid.RegionFromAZ(c.AZ))
+	failed := recentCapacityFailures(bid.RegionFromAZ(c.AZ))
+	if failed == nil {
+		failed = map[string]time.Time{}
+	}
+	failed[c.Type+"/"+c.AZ] = time.Now()
+	if err := awsutil.Cache.Put(key, failed); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not record capacity failure: %v\n", err)
+	}
+}
+
+// recentCapacityFailures returns the type/AZ pairs in region that failed to
+// launch within capacityFailureTTL, keyed "type/az". Each entry carries its
+// own time, so the file is read with Peek: --refresh and the age of the
+// file as a whole don't drop failures that are still recent.
+func recentCapacityFailures(region string) map[string]time.Time {
+	var failed map[string]time.Time
+	if !awsutil.Cache.Peek(capacityCacheKey(region), &failed) {
+		return nil
+	}
+	for k, at := range failed {
+		if time.Since(at) > capacityFailureTTL {
+			delete(failed, k)
+		}
+	}
+	return failed
+}
@@ -3,43 +3,163 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
 	"github.com/spf13/cobra"
+
+	"github.com/emaland/devbox/internal/awsutil"
+	"github.com/emaland/devbox/internal/bid"
+	"github.com/emaland/devbox/internal/config"
 )
 
+// pendingMaxPriceTag records a max price that rebid could not apply yet
+// because the instance was running. devbox start applies it.
+const pendingMaxPriceTag = "devbox:pending-max-price"
+
 func newRebidCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "rebid <spot-request-id> <new-price>",
-		Short: "Cancel and re-create a spot request with a new max price",
-		Args:  cobra.ExactArgs(2),
+	var (
+		bidExpr string
+		explain bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "rebid <instance-id|spot-request-id> [new-price]",
+		Short: "Change the spot max price of an instance's persistent request",
+		Long: `Change the spot max price of an instance's persistent spot request.
+
+EC2 can't change the price of an existing spot request, and a new request
+would launch a separate instance. So rebid replaces the box instead. It
+launches a copy at the new price from the launch template (or, without one,
+the old instance's AMI, IAM profile and user_data), keeping the network, tags
+and interruption behavior, then moves the data volumes across.
+
+  Stopped instance   replaced now; the copy is left stopped
+  Running instance   keeps running; the new price is recorded and applied
+                     by the next "devbox start". Until then the old price
+                     stays in effect, including when AWS restarts the box
+                     after an interruption or it is started outside devbox
+
+The price can be a literal $/hr or a bid strategy via --bid:
+
+  devbox rebid i-abc123 0.50
+  devbox rebid i-abc123 --bid on-demand
+  devbox rebid i-abc123 --bid p95+10% --explain
+
+A spot request ID is accepted too. If the request has no instance yet, it is
+re-created with the new price.`,
+		Args: cobra.RangeArgs(1, 2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return rebid(cmd.Context(), ec2Client, args[0], args[1])
+			if len(args) == 2 {
+				if bidExpr != "" {
+					return fmt.Errorf("pass either a price argument or --bid, not both")
+				}
+				bidExpr = args[1]
+			}
+			if bidExpr == "" {
+				return fmt.Errorf("a new price or --bid strategy is required")
+			}
+			r53client := route53.NewFromConfig(awsCfg)
+			return rebid(cmd.Context(), dcfg, ec2Client, r53client, args[0], bidExpr, explain)
 		},
 	}
+
+	cmd.Flags().StringVar(&bidExpr, "bid", "", "Bid strategy: price, on-demand, current, pNN, with optional +N%, +N or *N")
+	cmd.Flags().BoolVar(&explain, "explain", false, "Show how the max price was derived")
+
+	return cmd
 }
 
-func rebid(ctx context.Context, client *ec2.Client, spotRequestID string, newPrice string) error {
-	// Validate the price parses as a float
-	price, err := strconv.ParseFloat(newPrice, 64)
-	if err != nil || price <= 0 {
-		return fmt.Errorf("invalid price %q: must be a positive number", newPrice)
+func rebid(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, target, bidExpr string, explain bool) error {
+	// Validate the strategy before touching AWS
+	if _, err := bid.Parse(bidExpr); err != nil {
+		return err
 	}
 
-	// Fetch the existing spot request to clone its parameters
-	desc, err := client.DescribeSpotInstanceRequests(ctx, &ec2.DescribeSpotInstanceRequestsInput{
-		SpotInstanceRequestIds: []string{spotRequestID},
-	})
+	instanceID := target
+	if strings.HasPrefix(target, "sir-") {
+		desc, err := client.DescribeSpotInstanceRequests(ctx, &ec2.DescribeSpotInstanceRequestsInput{
+			SpotInstanceRequestIds: []string{target},
+		})
+		if err != nil {
+			return fmt.Errorf("describing spot request: %w", err)
+		}
+		if len(desc.SpotInstanceRequests) == 0 {
+			return fmt.Errorf("spot request %s not found", target)
+		}
+		req := desc.SpotInstanceRequests[0]
+		if req.InstanceId == nil {
+			return rebidOpenRequest(ctx, client, req, bidExpr, explain)
+		}
+		instanceID = *req.InstanceId
+		fmt.Printf("Spot request %s belongs to instance %s.\n", target, instanceID)
+	}
+
+	inst, err := describeInstance(ctx, client, instanceID)
+	if err != nil {
+		return err
+	}
+	spotReq := describeSpotRequest(ctx, client, inst)
+	if spotReq == nil {
+		return fmt.Errorf("instance %s has no spot request to rebid", instanceID)
+	}
+	if spotReq.Type != types.SpotInstanceTypePersistent {
+		return fmt.Errorf("spot request %s is %s; only persistent requests can be re-bid in place", *spotReq.SpotInstanceRequestId, spotReq.Type)
+	}
+
+	itype := string(inst.InstanceType)
+	az := *inst.Placement.AvailabilityZone
+	newPrice, err := resolveBid(ctx, client, bidExpr, itype, az, explain)
 	if err != nil {
-		return fmt.Errorf("describing spot request: %w", err)
+		return err
+	}
+	oldPrice := "(unset/on-demand)"
+	if spotReq.SpotPrice != nil {
+		oldPrice = "$" + *spotReq.SpotPrice
+	}
+
+	switch inst.State.Name {
+	case types.InstanceStateNameStopped:
+		fmt.Printf("Instance %s is stopped; replacing it at max price $%s (was %s)...\n", instanceID, newPrice, oldPrice)
+		return replaceSpotInstance(ctx, dcfg, client, r53client, inst, spotReq, spotReplacement{Type: itype, MaxPrice: newPrice})
+	case types.InstanceStateNameRunning, types.InstanceStateNamePending:
+		_, err := client.CreateTags(ctx, &ec2.CreateTagsInput{
+			Resources: []string{instanceID},
+			Tags:      []types.Tag{{Key: aws.String(pendingMaxPriceTag), Value: aws.String(newPrice)}},
+		})
+		if err != nil {
+			return fmt.Errorf("recording pending max price: %w", err)
+		}
+		fmt.Printf("Instance %s is %s and keeps its current request (max %s).\n", instanceID, inst.State.Name, oldPrice)
+		fmt.Printf("New max price $%s will be applied by the next \"devbox start %s\".\n", newPrice, instanceID)
+		fmt.Printf("Until then the old max price (%s) stays in effect, even if AWS restarts the box after an\n", oldPrice)
+		fmt.Printf("interruption or it is started outside devbox. Stop it and run \"devbox start\" to apply it now.\n")
+		return nil
+	default:
+		return fmt.Errorf("instance %s is in state %s, cannot rebid", instanceID, inst.State.Name)
+	}
+}
+
+// rebidOpenRequest re-creates a spot request that has not launched an
+// instance yet, keeping its launch specification, tags and interruption
+// behavior.
+func rebidOpenRequest(ctx context.Context, client *ec2.Client, old types.SpotInstanceRequest, bidExpr string, explain bool) error {
+	spotRequestID := *old.SpotInstanceRequestId
+
+	itype, az := "", ""
+	if old.LaunchSpecification != nil {
+		itype = string(old.LaunchSpecification.InstanceType)
+		if old.LaunchSpecification.Placement != nil {
+			az = aws.ToString(old.LaunchSpecification.Placement.AvailabilityZone)
+		}
 	}
-	if len(desc.SpotInstanceRequests) == 0 {
-		return fmt.Errorf("spot request %s not found", spotRequestID)
+	newPrice, err := resolveBid(ctx, client, bidExpr, itype, az, explain)
+	if err != nil {
+		return err
 	}
-	old := desc.SpotInstanceRequests[0]
 
 	oldPrice := "(unset/on-demand)"
 	if old.SpotPrice != nil {
@@ -56,16 +176,28 @@ func rebid(ctx context.Context, client *ec2.Client, spotRequestID string, newPri
 	fmt.Printf("Canceled old request %s (was %s)\n", spotRequestID, oldPrice)
 
 	// Create a new request with the same launch spec but new price
-	priceStr := newPrice
-	newReq, err := client.RequestSpotInstances(ctx, &ec2.RequestSpotInstancesInput{
-		SpotPrice:             &priceStr,
-		InstanceCount:         aws.Int32(1),
-		Type:                  old.Type,
-		LaunchSpecification:   toLaunchSpec(old.LaunchSpecification),
-		AvailabilityZoneGroup: old.AvailabilityZoneGroup,
-		BlockDurationMinutes:  old.BlockDurationMinutes,
-		ValidUntil:            old.ValidUntil,
-	})
+	input := &ec2.RequestSpotInstancesInput{
+		SpotPrice:                    aws.String(newPrice),
+		InstanceCount:                aws.Int32(1),
+		Type:                         old.Type,
+		InstanceInterruptionBehavior: old.InstanceInterruptionBehavior,
+		LaunchSpecification:          toLaunchSpec(old.LaunchSpecification),
+		AvailabilityZoneGroup:        old.AvailabilityZoneGroup,
+		BlockDurationMinutes:         old.BlockDurationMinutes,
+		ValidUntil:                   old.ValidUntil,
+	}
+	var tags []types.Tag
+	for _, t := range old.Tags {
+		if t.Key != nil && !strings.HasPrefix(*t.Key, "aws:") {
+			tags = append(tags, t)
+		}
+	}
+	if len(tags) > 0 {
+		input.TagSpecifications = []types.TagSpecification{
+			{ResourceType: types.ResourceTypeSpotInstancesRequest, Tags: tags},
+		}
+	}
+	newReq, err := client.RequestSpotInstances(ctx, input)
 	if err != nil {
 		return fmt.Errorf("creating new spot request: %w", err)
 	}
@@ -77,6 +209,34 @@ func rebid(ctx context.Context, client *ec2.Client, spotRequestID string, newPri
 	return nil
 }
 
+// applyPendingRebids replaces each stopped instance that carries a pending
+// max price with a started copy at that price. It returns the IDs that still
+// need a plain start.
+func applyPendingRebids(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, ids []string) ([]string, error) {
+	desc, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: ids,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describing instances: %w", err)
+	}
+	var rest []string
+	for _, res := range desc.Reservations {
+		for _, inst := range res.Instances {
+			price := awsutil.TagValue(inst.Tags, pendingMaxPriceTag)
+			if price == "" || inst.State.Name != types.InstanceStateNameStopped {
+				rest = append(rest, *inst.InstanceId)
+				continue
+			}
+			fmt.Printf("Instance %s has a pending max price of $%s; replacing it before starting...\n", *inst.InstanceId, price)
+			spotReq := describeSpotRequest(ctx, client, inst)
+			if err := replaceSpotInstance(ctx, dcfg, client, r53client, inst, spotReq, spotReplacement{Type: string(inst.InstanceType), MaxPrice: price, Start: true}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rest, nil
+}
+
 func toLaunchSpec(from *types.LaunchSpecification) *types.RequestSpotLaunchSpecification {
 	if from == nil {
 		return nil
@@ -86,6 +246,7 @@ func toLaunchSpec(from *types.LaunchSpecification) *types.RequestSpotLaunchSpeci
 		InstanceType: from.InstanceType,
 		KeyName:      from.KeyName,
 		SubnetId:     from.SubnetId,
+		UserData:     from.UserData,
 	}
 	if from.Placement != nil {
 		spec.Placement = &types.SpotPlacement{
@@ -120,3 +281,16 @@ func toLaunchSpec(from *types.LaunchSpecification) *types.RequestSpotLaunchSpeci
 	}
 	return spec
 }
+
+// resolveBid turns a bid expression into a max price for instanceType in az,
+// printing the derivation when explain is set.
+func resolveBid(ctx context.Context, client *ec2.Client, expr, instanceType, az string, explain bool) (string, error) {
+	result, err := bid.Resolve(ctx, client, expr, instanceType, az)
+	if err != nil {
+		return "", fmt.Errorf("resolving bid %q: %w", expr, err)
+	}
+	if explain {
+		fmt.Printf("Bid %q for %s in %s:\n%s\n", expr, instanceType, az, result.Explain())
+	}
+	return result.MaxPrice(), nil
+}
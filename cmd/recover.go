@@ -6,6 +6,7 @@ import (
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"text/tabwriter"
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
@@ -13,21 +14,48 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/route53"
 	"github.com/spf13/cobra"
 
+	"github.com/emaland/devbox/internal/advisor"
 	"github.com/emaland/devbox/internal/awsutil"
+	"github.com/emaland/devbox/internal/bid"
 	"github.com/emaland/devbox/internal/config"
+	"github.com/emaland/devbox/internal/perf"
 )
 
+// recoverOptions holds the recover flags.
+type recoverOptions struct {
+	MinVCPU  int
+	MinMem   float64
+	MaxPrice float64
+	AutoYes  bool
+	// Bid is the strategy used for the replacement's max price on --yes.
+	Bid     string
+	Explain bool
+	// Weights ranks candidates by price and interruption frequency.
+	Weights advisor.Weights
+	Filter  awsutil.TypeFilter
+	// Rank is the cost metric candidates are ranked on: price,
+	// perf-per-dollar or mem-per-dollar.
+	Rank string
+	// CrossAZ searches every AZ in the region; picking another AZ moves
+	// the data volumes there.
+	CrossAZ bool
+	// AZ searches a single AZ other than the instance's; auto picks the
+	// best spot placement score among the AZs the box may move to.
+	AZ string
+	// Probe is how many of the top candidates --yes tries, in order, before
+	// giving up for lack of capacity.
+	Probe int
+}
+
 func newRecoverCmd() *cobra.Command {
 	var (
-		minVCPUFlag int
-		minMemFlag  float64
-		maxPrice    float64
-		autoYes     bool
+		opts    recoverOptions
+		refresh bool
 	)
 
 	cmd := &cobra.Command{
 		Use:   "recover [instance-id]",
-		Short: "Find alternative instance types with spot capacity in the same AZ",
+		Short: "Find alternative instance types with spot capacity in the same AZ (or any, with --cross-az)",
 		Args:  cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			instanceID := ""
@@ -40,20 +68,67 @@ func newRecoverCmd() *cobra.Command {
 				}
 				instanceID = id
 			}
+			if refresh && awsutil.Cache != nil {
+				awsutil.Cache.Refresh = true
+			}
+			if !cmd.Flags().Changed("price-weight") {
+				opts.Weights.Price = dcfg.RecoverPriceWeight
+			}
+			if !cmd.Flags().Changed("stability-weight") {
+				opts.Weights.Stability = dcfg.RecoverStabilityWeight
+			}
 			r53client := route53.NewFromConfig(awsCfg)
-			return recoverInstance(cmd.Context(), dcfg, ec2Client, r53client, instanceID, minVCPUFlag, minMemFlag, maxPrice, autoYes)
+			return recoverInstance(cmd.Context(), dcfg, ec2Client, r53client, instanceID, opts)
 		},
 	}
 
-	cmd.Flags().IntVar(&minVCPUFlag, "min-vcpu", 0, "Minimum vCPUs (default: 50% of current)")
-	cmd.Flags().Float64Var(&minMemFlag, "min-mem", 0, "Minimum memory in GiB (default: 50% of current)")
-	cmd.Flags().Float64Var(&maxPrice, "max-price", 0, "Max spot price $/hr (0 = use config default)")
-	cmd.Flags().BoolVar(&autoYes, "yes", false, "Auto-pick cheapest candidate and resize")
+	cmd.Flags().IntVar(&opts.MinVCPU, "min-vcpu", 0, "Minimum vCPUs (default: 50% of current)")
+	cmd.Flags().Float64Var(&opts.MinMem, "min-mem", 0, "Minimum memory in GiB (default: 50% of current)")
+	cmd.Flags().Float64Var(&opts.MaxPrice, "max-price", 0, "Max spot price $/hr (0 = use config default)")
+	cmd.Flags().BoolVar(&opts.AutoYes, "yes", false, "Auto-pick the best-scoring candidate and resize")
+	cmd.Flags().StringVar(&opts.Bid, "bid", "", "Bid strategy for the replacement with --yes (default: keep the old max price)")
+	cmd.Flags().BoolVar(&opts.Explain, "explain", false, "Show how the max price was derived")
+	addTypeFilterFlags(cmd, &opts.Filter)
+	cmd.Flags().StringVar(&opts.AZ, "az", "", "Search this AZ instead, or auto to pick by spot placement score")
+	cmd.Flags().BoolVar(&opts.CrossAZ, "cross-az", false, "Search every AZ in the region, moving the data volumes if the best option is elsewhere")
+	cmd.Flags().IntVar(&opts.Probe, "probe", 3, "With --yes, try up to this many top candidates until one launches")
+	cmd.Flags().BoolVar(&refresh, "refresh", false, "Ignore cached instance types and spot prices")
+	cmd.Flags().StringVar(&opts.Rank, "rank", "price", "Rank candidates by: price, perf-per-dollar, mem-per-dollar")
+	cmd.Flags().Float64Var(&opts.Weights.Price, "price-weight", 0, "Weight of cost (price, or the --rank metric) in the ranking (default: recover_price_weight)")
+	cmd.Flags().Float64Var(&opts.Weights.Stability, "stability-weight", 0, "Weight of interruption frequency in the ranking (default: recover_stability_weight)")
 
 	return cmd
 }
 
-func recoverInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, instanceID string, minVCPUFlag int, minMemFlag, maxPriceFlag float64, autoYes bool) error {
+func recoverInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, instanceID string, opts recoverOptions) error {
+	minVCPUFlag, minMemFlag, maxPriceFlag := opts.MinVCPU, opts.MinMem, opts.MaxPrice
+	if err := opts.Filter.Validate(); err != nil {
+		return err
+	}
+	if opts.Probe < 1 {
+		return fmt.Errorf("--probe must be at least 1")
+	}
+	perfTable, err := perf.LoadDefault()
+	if err != nil {
+		return err
+	}
+	// cost is what ranking minimizes: the hourly price, or the price of one
+	// unit of performance or memory.
+	var cost func(r awsutil.SpotSearchResult) float64
+	switch opts.Rank {
+	case "", "price":
+		cost = func(r awsutil.SpotSearchResult) float64 { return r.Price }
+	case "perf-per-dollar":
+		cost = func(r awsutil.SpotSearchResult) float64 {
+			score, _ := perfTable.Score(r.InstanceType)
+			return perf.PerVCPUHour(r.Price, r.VCPUs) / score
+		}
+	case "mem-per-dollar":
+		cost = func(r awsutil.SpotSearchResult) float64 { return perf.PerGiBHour(r.Price, r.MemoryMiB) }
+	default:
+		return fmt.Errorf("invalid --rank %q: want price, perf-per-dollar or mem-per-dollar", opts.Rank)
+	}
+
 	// 1. Describe the instance
 	desc, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: []string{instanceID},
@@ -97,10 +172,7 @@ func recoverInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.
 	memMiB := *typeInfo.MemoryInfo.SizeInMiB
 	hasGPU := typeInfo.GpuInfo != nil && len(typeInfo.GpuInfo.Gpus) > 0
 
-	arch := "x86_64"
-	if len(typeInfo.ProcessorInfo.SupportedArchitectures) > 0 {
-		arch = string(typeInfo.ProcessorInfo.SupportedArchitectures[0])
-	}
+	arch := typeArch(typeInfo)
 	currentNetPerf := ""
 	if typeInfo.NetworkInfo != nil && typeInfo.NetworkInfo.NetworkPerformance != nil {
 		currentNetPerf = *typeInfo.NetworkInfo.NetworkPerformance
@@ -129,52 +201,134 @@ func recoverInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.
 		defaultMaxPrice, _ = strconv.ParseFloat(dcfg.DefaultMaxPrice, 64)
 	}
 
+	// EBS volumes are AZ-locked, so stay in the instance's AZ unless asked
+	// to consider moving them.
+	searchAZ, where := az, az
+	if opts.CrossAZ {
+		searchAZ, where = "", "all AZs of "+bid.RegionFromAZ(az)
+	}
+	pinned := hasDataVolumes(inst) && !opts.CrossAZ
+	switch opts.AZ {
+	case "":
+	case autoAZ:
+		where = "the best-scoring AZ"
+	default:
+		if opts.AZ != az && pinned {
+			return fmt.Errorf("the data volumes live in %s; add --cross-az to move them to %s", az, opts.AZ)
+		}
+		searchAZ, where = opts.AZ, opts.AZ
+	}
 	fmt.Printf("\nSearching for alternatives (>=%d vCPU, >=%.0f GiB, %s) in %s...\n",
-		minVCPU, minMem, arch, az)
+		minVCPU, minMem, arch, where)
 
 	// 4. Find candidate instance types
 	candidates, err := awsutil.FetchInstanceTypes(ctx, client, arch, minVCPU, minMem, hasGPU)
 	if err != nil {
 		return err
 	}
+	candidates = opts.Filter.Apply(candidates)
 	if len(candidates) == 0 {
 		fmt.Println("No instance types match the given specs.")
 		return nil
 	}
 
+	// 4b. With --az auto, score the AZs for the candidate set. Data volumes
+	//     pin the box to its AZ unless --cross-az lets them move.
+	if opts.AZ == autoAZ {
+		var names []string
+		for _, c := range candidates[:min(placementMaxTypes, len(candidates))] {
+			names = append(names, c.Name)
+		}
+		var allowed []string
+		if pinned {
+			allowed = []string{az}
+		}
+		picked, scores, err := pickAZ(ctx, newPlacementScorer(client), awsutil.PlacementRequest{InstanceTypes: names}, bid.RegionFromAZ(az), allowed, az)
+		if err != nil {
+			return err
+		}
+		printPlacementScores(scores, picked)
+		if pinned {
+			fmt.Printf("  The data volumes keep the box in %s; use --cross-az to allow a move.\n", az)
+		}
+		searchAZ = picked
+	}
+
 	// 5. Fetch spot prices filtered to the instance's AZ
-	results, err := awsutil.FetchSpotPrices(ctx, client, candidates, az)
+	results, err := awsutil.FetchSpotPrices(ctx, client, candidates, searchAZ)
 	if err != nil {
 		return err
 	}
 
-	// 6. Apply max price filter
-	if defaultMaxPrice > 0 {
-		var filtered []awsutil.SpotSearchResult
-		for _, r := range results {
-			if r.Price <= defaultMaxPrice {
-				filtered = append(filtered, r)
-			}
+	// 6. Apply max price filter, and drop the box's own type in its own
+	//    AZ: resize would treat it as nothing to do, and it is the pool
+	//    being recovered from.
+	var filtered []awsutil.SpotSearchResult
+	for _, r := range results {
+		if defaultMaxPrice > 0 && r.Price > defaultMaxPrice {
+			continue
 		}
-		results = filtered
+		if r.InstanceType == currentType && r.AZ == az {
+			continue
+		}
+		filtered = append(filtered, r)
 	}
+	results = filtered
 
 	if len(results) == 0 {
 		fmt.Println("No spot capacity found matching filters.")
 		return nil
 	}
 
-	// 7. Sort by price ascending
-	sort.Slice(results, func(i, j int) bool { return results[i].Price < results[j].Price })
+	// 7. Rank. With spot advisor data, blend cost and interruption
+	// frequency; otherwise lowest cost first.
+	adv, err := advisor.LoadDefault()
+	if err != nil {
+		return err
+	}
+	region := bid.RegionFromAZ(az)
+	lo, hi := cost(results[0]), cost(results[0])
+	for _, r := range results {
+		lo, hi = min(lo, cost(r)), max(hi, cost(r))
+	}
+	type candidateKey struct{ itype, az string }
+	scores := make(map[candidateKey]float64, len(results))
+	scoreOf := func(r awsutil.SpotSearchResult) float64 { return scores[candidateKey{r.InstanceType, r.AZ}] }
+	for _, r := range results {
+		scores[candidateKey{r.InstanceType, r.AZ}] = advisor.Score(cost(r), lo, hi, adv.Stability(region, r.InstanceType), opts.Weights)
+	}
+	if adv != nil {
+		sort.Slice(results, func(i, j int) bool {
+			a, b := scoreOf(results[i]), scoreOf(results[j])
+			if a != b {
+				return a < b
+			}
+			return results[i].Price < results[j].Price
+		})
+	} else {
+		sort.Slice(results, func(i, j int) bool { return cost(results[i]) < cost(results[j]) })
+	}
+	// A recent price says nothing about capacity. Types that recently
+	// failed to launch go last.
+	failed := recentCapacityFailures(region)
+	recentlyFailed := func(r awsutil.SpotSearchResult) bool {
+		_, ok := failed[r.InstanceType+"/"+r.AZ]
+		return ok
+	}
+	sort.SliceStable(results, func(i, j int) bool { return !recentlyFailed(results[i]) && recentlyFailed(results[j]) })
 
 	// 8. Display (top 10 by default)
 	display := results
 	if len(display) > 10 {
 		display = display[:10]
 	}
-	fmt.Printf("Found %d instance types with spot capacity (showing top %d):\n\n", len(results), len(display))
+	fmt.Printf("Found %d candidates with spot capacity (showing top %d):\n\n", len(results), len(display))
 	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
-	fmt.Fprintln(w, "TYPE\tVCPU\tMEMORY\tNETWORK\tPRICE\tGPU")
+	header := "TYPE\tVCPU\tMEMORY\tNETWORK\tPRICE\t$/VCPU-HR\t$/GIB-HR\tGPU\tINTERRUPT\tSCORE"
+	if opts.CrossAZ {
+		header = "TYPE\tAZ" + strings.TrimPrefix(header, "TYPE")
+	}
+	fmt.Fprintln(w, header)
 	for _, r := range display {
 		netPerf := r.NetworkPerformance
 		if netPerf == "" {
@@ -184,18 +338,71 @@ func recoverInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.
 		if r.GPU {
 			gpuStr = "yes"
 		}
-		fmt.Fprintf(w, "%s\t%d\t%.0f GiB\t%s\t$%.4f\t%s\n",
-			r.InstanceType, r.VCPUs, float64(r.MemoryMiB)/1024.0, netPerf, r.Price, gpuStr)
+		scoreStr := "-"
+		if adv != nil {
+			scoreStr = fmt.Sprintf("%.2f", scoreOf(r))
+		}
+		name := r.InstanceType
+		if recentlyFailed(r) {
+			name += " (no capacity)"
+		}
+		if opts.CrossAZ {
+			name += "\t" + r.AZ
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.0f GiB\t%s\t$%.4f\t$%.4f\t$%.4f\t%s\t%s\t%s\n",
+			name, r.VCPUs, float64(r.MemoryMiB)/1024.0, netPerf, r.Price,
+			perf.PerVCPUHour(r.Price, r.VCPUs), perf.PerGiBHour(r.Price, r.MemoryMiB), gpuStr, interruptBand(adv, r), scoreStr)
 	}
 	w.Flush()
+	if adv != nil {
+		fmt.Printf("\nRanked by score (lower is better): %s weight %g, stability weight %g.\n", rankLabel(opts.Rank), opts.Weights.Price, opts.Weights.Stability)
+	} else {
+		fmt.Printf("\nNo spot advisor data; ranked by %s alone. Run `devbox search --update-advisor` to rank by stability too.\n", rankLabel(opts.Rank))
+	}
+
+	best := results[0]
+	resizeOpts := resizeOptions{Bid: opts.Bid, Explain: opts.Explain}
+	if best.AZ != az {
+		resizeOpts.AZ = best.AZ
+		// With --yes, resize prints the estimate before it starts.
+		if !opts.AutoYes {
+			fmt.Println()
+			if err := printCrossAZEstimate(ctx, client, inst, best.AZ); err != nil {
+				return err
+			}
+		}
+	}
 
-	if !autoYes {
-		fmt.Printf("\nTo resize: devbox resize %s %s\n", instanceID, results[0].InstanceType)
+	if !opts.AutoYes {
+		if resizeOpts.AZ != "" {
+			fmt.Printf("\nTo move and resize: devbox resize --az %s %s %s\n", best.AZ, instanceID, best.InstanceType)
+		} else {
+			fmt.Printf("\nTo resize: devbox resize %s %s\n", instanceID, best.InstanceType)
+		}
 		return nil
 	}
 
-	// 9. Auto-resize to cheapest
-	cheapest := results[0].InstanceType
-	fmt.Printf("\nAuto-resizing to %s (cheapest at $%.4f)...\n", cheapest, results[0].Price)
-	return resizeInstance(ctx, dcfg, client, r53client, instanceID, cheapest)
+	// 9. Auto-resize to the top-ranked candidate, falling back down the
+	//    ranking if it has no capacity.
+	for _, r := range results[1:min(opts.Probe, len(results))] {
+		resizeOpts.Fallbacks = append(resizeOpts.Fallbacks, launchCandidate{Type: r.InstanceType, AZ: r.AZ})
+	}
+	if adv != nil {
+		fmt.Printf("\nAuto-resizing to %s in %s ($%.4f, interruption %s, score %.2f)...\n",
+			best.InstanceType, best.AZ, best.Price, interruptBand(adv, best), scoreOf(best))
+	} else {
+		fmt.Printf("\nAuto-resizing to %s in %s (best %s at $%.4f)...\n", best.InstanceType, best.AZ, rankLabel(opts.Rank), best.Price)
+	}
+	return resizeInstance(ctx, dcfg, client, r53client, instanceID, best.InstanceType, resizeOpts)
+}
+
+// rankLabel names the cost metric in recover's output.
+func rankLabel(rank string) string {
+	switch rank {
+	case "perf-per-dollar":
+		return "price per unit of performance"
+	case "mem-per-dollar":
+		return "price per GiB"
+	}
+	return "price"
 }
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// regionClient returns an EC2 client for another region, honoring the test
+// endpoint override.
+func regionClient(ctx context.Context, region string) (*ec2.Client, error) {
+	loadOpts := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(region)}
+	if BaseEndpointOverride != "" {
+		loadOpts = append(loadOpts, awsconfig.WithBaseEndpoint(BaseEndpointOverride))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("loading config for region %s: %w", region, err)
+	}
+	return ec2.NewFromConfig(cfg), nil
+}
+
+// enabledRegions lists the regions the account can use, sorted by name.
+func enabledRegions(ctx context.Context, client *ec2.Client) ([]string, error) {
+	out, err := client.DescribeRegions(ctx, &ec2.DescribeRegionsInput{
+		Filters: []types.Filter{
+			{Name: aws.String("opt-in-status"), Values: []string{"opt-in-not-required", "opted-in"}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describing regions: %w", err)
+	}
+	var regions []string
+	for _, r := range out.Regions {
+		regions = append(regions, aws.ToString(r.RegionName))
+	}
+	sort.Strings(regions)
+	return regions, nil
+}
+
+// forEachRegion runs fn concurrently with a client for each region and
+// returns the per-region errors keyed by region.
+func forEachRegion(ctx context.Context, regions []string, fn func(ctx context.Context, region string, client *ec2.Client) error) map[string]error {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs = map[string]error{}
+	)
+	for _, region := range regions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := regionClient(ctx, region)
+			if err == nil {
+				err = fn(ctx, region, client)
+			}
+			if err != nil {
+				mu.Lock()
+				errs[region] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
@@ -18,19 +18,74 @@ import (
 	"github.com/emaland/devbox/internal/config"
 )
 
+// resizeOptions holds the optional resize flags.
+type resizeOptions struct {
+	// Bid, when set, replaces the old spot request's max price with a
+	// strategy evaluated for the new type.
+	Bid     string
+	Explain bool
+	// AZ, when set to another availability zone, moves the box there:
+	// its data volumes are copied through snapshots.
+	AZ string
+	// Fallbacks are tried in order if a spot replacement of the requested
+	// type can't be launched for lack of capacity. Their max prices are
+	// resolved from Bid like the primary's.
+	Fallbacks []launchCandidate
+	// CrossArch allows moving between x86_64 and arm64. The replacement
+	// boots the NixOS AMI for the new architecture and gets its config
+	// back from the /home volume.
+	CrossArch bool
+}
+
+// spotReplacement describes the instance replaceSpotInstance launches.
+type spotReplacement struct {
+	Type     string
+	MaxPrice string
+	// Start boots the replacement once its volumes are attached;
+	// otherwise it is left stopped.
+	Start bool
+	// AZ, when set and different from the old instance's, launches the
+	// replacement there with copies of the data volumes.
+	AZ string
+	// Fallbacks are launched instead, in order, if there is no capacity
+	// for Type in AZ.
+	Fallbacks []launchCandidate
+	// ImageID, when set, replaces the old instance's AMI, e.g. for a
+	// type of another architecture.
+	ImageID string
+}
+
+// volumeAttachment is a non-root EBS volume and the device it is attached as.
+type volumeAttachment struct {
+	VolumeID string
+	Device   string
+	// DeleteOnTermination is carried over to the replacement, so a
+	// volume spawned with the box still goes when the box does.
+	DeleteOnTermination bool
+}
+
 func newResizeCmd() *cobra.Command {
-	return &cobra.Command{
+	var opts resizeOptions
+
+	cmd := &cobra.Command{
 		Use:   "resize <instance-id> <new-type>",
 		Short: "Stop instance, change type, restart, update DNS",
 		Args:  cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			r53client := route53.NewFromConfig(awsCfg)
-			return resizeInstance(cmd.Context(), dcfg, ec2Client, r53client, args[0], args[1])
+			return resizeInstance(cmd.Context(), dcfg, ec2Client, r53client, args[0], args[1], opts)
 		},
 	}
+
+	cmd.Flags().StringVar(&opts.Bid, "bid", "", "Bid strategy for the new spot request (default: keep the old max price)")
+	cmd.Flags().BoolVar(&opts.Explain, "explain", false, "Show how the max price was derived")
+	cmd.Flags().StringVar(&opts.AZ, "az", "", "Move a spot instance to another AZ, copying its data volumes")
+	cmd.Flags().BoolVar(&opts.CrossArch, "cross-arch", false, "Allow moving between x86_64 and arm64 by relaunching from the matching NixOS AMI")
+
+	return cmd
 }
 
-func resizeInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, instanceID, newType string) error {
+func resizeInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, instanceID, newType string, opts resizeOptions) error {
 	desc, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: []string{instanceID},
 	})
@@ -46,18 +101,45 @@ func resizeInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.C
 
 	fmt.Printf("Instance %s: type=%s state=%s\n", instanceID, currentType, state)
 
-	if currentType == newType {
+	crossAZ := opts.AZ != "" && opts.AZ != aws.ToString(inst.Placement.AvailabilityZone)
+	if currentType == newType && !crossAZ {
 		fmt.Println("Already the requested type, nothing to do.")
 		return nil
 	}
 
+	// The root volume only fits types of its own architecture; moving to
+	// the other one means relaunching from another AMI.
+	currentArch, err := instanceTypeArch(ctx, client, currentType)
+	if err != nil {
+		return err
+	}
+	newArch, err := instanceTypeArch(ctx, client, newType)
+	if err != nil {
+		return err
+	}
+	if currentArch != newArch {
+		if !opts.CrossArch {
+			return fmt.Errorf("%s is %s but %s is %s; pass --cross-arch to relaunch the box from the %s NixOS AMI", currentType, currentArch, newType, newArch, newArch)
+		}
+		if inst.SpotInstanceRequestId == nil {
+			return fmt.Errorf("moving an on-demand instance to another architecture is not supported")
+		}
+		fmt.Printf("Moving from %s to %s.\n", currentArch, newArch)
+	}
+
 	// Spot instances don't support ModifyInstanceAttribute for type changes.
 	// We need to terminate and recreate with the new type.
 	if inst.SpotInstanceRequestId != nil {
-		return resizeSpotInstance(ctx, dcfg, client, r53client, inst, newType)
+		return resizeSpotInstance(ctx, dcfg, client, r53client, inst, newType, opts)
 	}
 
 	// On-demand path: stop → modify → start
+	if crossAZ {
+		return fmt.Errorf("moving an on-demand instance to another AZ is not supported")
+	}
+	if opts.Bid != "" {
+		fmt.Println("On-demand instance — ignoring --bid.")
+	}
 	if state == types.InstanceStateNameRunning || state == types.InstanceStateNamePending {
 		fmt.Printf("Stopping instance %s...\n", instanceID)
 		_, err := client.StopInstances(ctx, &ec2.StopInstancesInput{
@@ -114,12 +196,20 @@ func resizeInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.C
 // resizeSpotInstance replaces a spot instance with a new one of a different type.
 // Spot instances don't support ModifyInstanceAttribute for type changes, so we
 // terminate the old instance and launch a new one, preserving non-root EBS volumes.
-func resizeSpotInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, inst types.Instance, newType string) error {
+func resizeSpotInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, inst types.Instance, newType string, opts resizeOptions) error {
 	instanceID := *inst.InstanceId
 	state := inst.State.Name
 	az := *inst.Placement.AvailabilityZone
+	if opts.AZ != "" {
+		az = opts.AZ
+	}
 
 	fmt.Println("Spot instance detected — will replace instance with new type.")
+	if az != *inst.Placement.AvailabilityZone {
+		if err := printCrossAZEstimate(ctx, client, inst, az); err != nil {
+			return err
+		}
+	}
 
 	// 1. Stop if running
 	if state == types.InstanceStateNameRunning || state == types.InstanceStateNamePending {
@@ -141,69 +231,174 @@ func resizeSpotInstance(ctx context.Context, dcfg config.DevboxConfig, client *e
 		return fmt.Errorf("instance is in state %s, cannot resize", state)
 	}
 
-	// 2. Gather instance config for recreation
-	imageID := ""
-	if inst.ImageId != nil {
-		imageID = *inst.ImageId
+	// 2. Work out the new max price: the --bid strategy, or carry it over
+	//    from the spot request, falling back to the configured default.
+	spotReq := describeSpotRequest(ctx, client, inst)
+	bidExpr := opts.Bid
+	if bidExpr == "" && spotReq != nil && spotReq.SpotPrice != nil {
+		bidExpr = *spotReq.SpotPrice
 	}
-	keyName := ""
-	if inst.KeyName != nil {
-		keyName = *inst.KeyName
+	if bidExpr == "" {
+		bidExpr = dcfg.DefaultMaxPrice
 	}
-	subnetID := ""
-	if inst.SubnetId != nil {
-		subnetID = *inst.SubnetId
+	maxPrice, err := resolveBid(ctx, client, bidExpr, newType, az, opts.Explain)
+	if err != nil {
+		return err
 	}
-	var sgIDs []string
-	for _, sg := range inst.SecurityGroups {
-		if sg.GroupId != nil {
-			sgIDs = append(sgIDs, *sg.GroupId)
+	var fallbacks []launchCandidate
+	for _, c := range opts.Fallbacks {
+		if c.AZ == "" {
+			c.AZ = az
+		}
+		c.MaxPrice, err = resolveBid(ctx, client, bidExpr, c.Type, c.AZ, false)
+		if err != nil {
+			return err
 		}
+		fallbacks = append(fallbacks, c)
 	}
-	var iamProfile *types.IamInstanceProfileSpecification
-	if inst.IamInstanceProfile != nil && inst.IamInstanceProfile.Arn != nil {
-		iamProfile = &types.IamInstanceProfileSpecification{
-			Arn: inst.IamInstanceProfile.Arn,
+
+	// A cross-architecture move boots the new type's NixOS AMI; the rest
+	// of the box comes back from user_data and /home.
+	var imageID string
+	if opts.CrossArch {
+		arch, err := instanceTypeArch(ctx, client, newType)
+		if err != nil {
+			return err
+		}
+		if arch != string(inst.Architecture) {
+			if imageID, err = lookupAMI(ctx, dcfg, client, arch); err != nil {
+				return err
+			}
+			fmt.Printf("Launching from %s AMI %s.\n", arch, imageID)
 		}
 	}
 
-	// Get user_data and patch it to ensure the amazon-image.nix import is present.
-	// Stale user_data may be missing it, which prevents nixos-rebuild on first boot.
-	userData, err := awsutil.FetchUserData(ctx, client, instanceID)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: could not fetch user_data: %v\n", err)
-		userData = ""
+	return replaceSpotInstance(ctx, dcfg, client, r53client, inst, spotReq, spotReplacement{
+		Type: newType, MaxPrice: maxPrice, Start: true, AZ: az, Fallbacks: fallbacks, ImageID: imageID,
+	})
+}
+
+// describeSpotRequest returns the spot request behind inst, or nil if it has
+// none or the request can no longer be described.
+func describeSpotRequest(ctx context.Context, client *ec2.Client, inst types.Instance) *types.SpotInstanceRequest {
+	if inst.SpotInstanceRequestId == nil {
+		return nil
 	}
-	if userData != "" {
-		userData = patchNixOSUserData(userData, awsutil.NameTag(inst.Tags))
+	desc, err := client.DescribeSpotInstanceRequests(ctx, &ec2.DescribeSpotInstanceRequestsInput{
+		SpotInstanceRequestIds: []string{*inst.SpotInstanceRequestId},
+	})
+	if err != nil || len(desc.SpotInstanceRequests) == 0 {
+		return nil
 	}
+	return &desc.SpotInstanceRequests[0]
+}
 
-	// Get spot max price from the spot request
-	maxPrice := dcfg.DefaultMaxPrice
-	if inst.SpotInstanceRequestId != nil {
-		spotDesc, err := client.DescribeSpotInstanceRequests(ctx, &ec2.DescribeSpotInstanceRequestsInput{
-			SpotInstanceRequestIds: []string{*inst.SpotInstanceRequestId},
-		})
-		if err == nil && len(spotDesc.SpotInstanceRequests) > 0 {
-			if spotDesc.SpotInstanceRequests[0].SpotPrice != nil {
-				maxPrice = *spotDesc.SpotInstanceRequests[0].SpotPrice
+// replaceSpotInstance launches a copy of the stopped spot instance inst with
+// the type and max price in repl, moves its non-root EBS volumes across,
+// cancels the old spot request and terminates the old instance. The copy
+// launches from the launch template when there is one, and otherwise keeps
+// the old instance's AMI, key, security groups, IAM profile and user_data.
+// Either way it keeps the network, tags and the old request's spot type and
+// interruption behavior. If repl.Start is false the replacement is left
+// stopped with its volumes attached.
+//
+// When repl.AZ names another AZ the volumes are copied there instead of
+// moved, and the originals are deleted once the new box passes its status
+// checks. If the requested type has no capacity, repl.Fallbacks are tried
+// in order and the first that launches is used.
+func replaceSpotInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, inst types.Instance, spotReq *types.SpotInstanceRequest, repl spotReplacement) error {
+	instanceID := *inst.InstanceId
+	start := repl.Start
+	oldAZ := *inst.Placement.AvailabilityZone
+	primaryAZ := oldAZ
+	if repl.AZ != "" {
+		primaryAZ = repl.AZ
+	}
+	candidates := []launchCandidate{{Type: repl.Type, AZ: primaryAZ, MaxPrice: repl.MaxPrice}}
+	candidates = append(candidates, repl.Fallbacks...)
+
+	// Subnets are AZ-bound; in another AZ pick one of the same VPC so the
+	// security groups still apply.
+	subnetFor := func(az string) (string, error) {
+		if az == oldAZ {
+			return aws.ToString(inst.SubnetId), nil
+		}
+		return lookupSubnetInVPC(ctx, client, aws.ToString(inst.VpcId), az)
+	}
+
+	// With a launch template the box definition comes from it; otherwise
+	// the AMI, key, security groups, IAM profile and user_data are carried
+	// over from the old instance.
+	lt := launchTemplateOrWarn(ctx, dcfg, client)
+	imageID, keyName, userData := repl.ImageID, "", ""
+	var sgIDs []string
+	var iamProfile *types.IamInstanceProfileSpecification
+	if lt != nil {
+		if imageID == "" {
+			tmplData, err := defaultTemplateVersion(ctx, client, lt)
+			if err != nil {
+				return err
+			}
+			arch, err := instanceTypeArch(ctx, client, repl.Type)
+			if err != nil {
+				return err
+			}
+			if imageID, err = templateImageFor(ctx, dcfg, client, tmplData, arch); err != nil {
+				return err
+			}
+		}
+	} else {
+		if imageID == "" {
+			imageID = aws.ToString(inst.ImageId)
+		}
+		keyName = aws.ToString(inst.KeyName)
+		for _, sg := range inst.SecurityGroups {
+			if sg.GroupId != nil {
+				sgIDs = append(sgIDs, *sg.GroupId)
+			}
+		}
+		if inst.IamInstanceProfile != nil && inst.IamInstanceProfile.Arn != nil {
+			iamProfile = &types.IamInstanceProfileSpecification{
+				Arn: inst.IamInstanceProfile.Arn,
 			}
 		}
+
+		// Get user_data and patch it to ensure the amazon-image.nix import is present.
+		// Stale user_data may be missing it, which prevents nixos-rebuild on first boot.
+		var err error
+		userData, err = awsutil.FetchUserData(ctx, client, instanceID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not fetch user_data: %v\n", err)
+			userData = ""
+		}
+		if userData != "" {
+			userData = patchNixOSUserData(userData, awsutil.NameTag(inst.Tags))
+		}
 	}
 
-	// Collect tags (excluding aws: prefix)
+	// Collect tags (excluding aws: prefix and any pending rebid, which this
+	// replacement fulfils)
 	var instanceTags []types.Tag
 	for _, t := range inst.Tags {
-		if t.Key != nil && !strings.HasPrefix(*t.Key, "aws:") {
+		if t.Key != nil && !strings.HasPrefix(*t.Key, "aws:") && *t.Key != pendingMaxPriceTag {
 			instanceTags = append(instanceTags, t)
 		}
 	}
 
-	// 3. Identify non-root EBS volumes to reattach later
-	type volumeAttachment struct {
-		VolumeID string
-		Device   string
+	// Keep the old request's spot semantics; devbox boxes are persistent
+	// and stop on interruption unless someone set them up otherwise.
+	spotType := types.SpotInstanceTypePersistent
+	interruption := types.InstanceInterruptionBehaviorStop
+	if spotReq != nil {
+		if spotReq.Type != "" {
+			spotType = spotReq.Type
+		}
+		if spotReq.InstanceInterruptionBehavior != "" {
+			interruption = spotReq.InstanceInterruptionBehavior
+		}
 	}
+
+	// 3. Identify non-root EBS volumes to reattach later
 	rootDevice := ""
 	if inst.RootDeviceName != nil {
 		rootDevice = *inst.RootDeviceName
@@ -217,47 +412,46 @@ func resizeSpotInstance(ctx context.Context, dcfg config.DevboxConfig, client *e
 			continue
 		}
 		extraVolumes = append(extraVolumes, volumeAttachment{
-			VolumeID: *bdm.Ebs.VolumeId,
-			Device:   *bdm.DeviceName,
+			VolumeID:            *bdm.Ebs.VolumeId,
+			Device:              *bdm.DeviceName,
+			DeleteOnTermination: aws.ToBool(bdm.Ebs.DeleteOnTermination),
 		})
 	}
 
-	// 4. Launch new spot instance with new type.
+	// 4. Launch new spot instance with new type, falling back to the next
+	//    candidate when one has no capacity.
 	//    We launch BEFORE touching the old instance so that if this fails
 	//    (e.g. InsufficientInstanceCapacity), the old instance, its spot
 	//    request, and its volumes are all still intact.
-	fmt.Printf("Launching new %s spot instance in %s...\n", newType, az)
+	fmt.Printf("Launching new %s spot instance in %s...\n", repl.Type, primaryAZ)
 
-	runInput := &ec2.RunInstancesInput{
-		ImageId:          aws.String(imageID),
-		InstanceType:     types.InstanceType(newType),
+	runInput := ec2.RunInstancesInput{
 		MinCount:         aws.Int32(1),
 		MaxCount:         aws.Int32(1),
 		SecurityGroupIds: sgIDs,
 		InstanceMarketOptions: &types.InstanceMarketOptionsRequest{
 			MarketType: types.MarketTypeSpot,
 			SpotOptions: &types.SpotMarketOptions{
-				SpotInstanceType:             types.SpotInstanceTypePersistent,
-				InstanceInterruptionBehavior: types.InstanceInterruptionBehaviorStop,
-				MaxPrice:                     aws.String(maxPrice),
-			},
-		},
-		BlockDeviceMappings: []types.BlockDeviceMapping{
-			{
-				DeviceName: aws.String("/dev/xvda"),
-				Ebs: &types.EbsBlockDevice{
-					VolumeSize: aws.Int32(75),
-					VolumeType: types.VolumeTypeGp3,
-				},
+				SpotInstanceType:             spotType,
+				InstanceInterruptionBehavior: interruption,
 			},
 		},
 	}
+	// The launch template supplies the whole box definition; only the
+	// type, subnet, market options and tags are overridden, plus the AMI
+	// when the template's is for another architecture.
+	if lt != nil {
+		fmt.Printf("Using launch template %s (version %d).\n", dcfg.LaunchTemplate, aws.ToInt64(lt.DefaultVersionNumber))
+		runInput.LaunchTemplate = templateSpec(lt)
+	} else {
+		runInput.BlockDeviceMappings = rootBlockDevices(dcfg.RootVolume)
+	}
+	if imageID != "" {
+		runInput.ImageId = aws.String(imageID)
+	}
 	if keyName != "" {
 		runInput.KeyName = aws.String(keyName)
 	}
-	if subnetID != "" {
-		runInput.SubnetId = aws.String(subnetID)
-	}
 	if iamProfile != nil {
 		runInput.IamInstanceProfile = iamProfile
 	}
@@ -272,13 +466,30 @@ func resizeSpotInstance(ctx context.Context, dcfg config.DevboxConfig, client *e
 			},
 		}
 	}
+	// A TTL box may only cancel a spot request that carries its expiry.
+	if expires := awsutil.TagValue(inst.Tags, expiresTag); expires != "" {
+		runInput.TagSpecifications = append(runInput.TagSpecifications, types.TagSpecification{
+			ResourceType: types.ResourceTypeSpotInstancesRequest,
+			Tags:         []types.Tag{{Key: aws.String(expiresTag), Value: aws.String(expires)}},
+		})
+	}
 
-	result, err := client.RunInstances(ctx, runInput)
+	newID, chosen, failures, err := launchFirstAvailable(ctx, client, runInput, candidates, subnetFor)
+	printProbeFailures(failures)
 	if err != nil {
 		return fmt.Errorf("launching new instance (old instance %s is still intact): %w", instanceID, err)
 	}
+	newType, maxPrice, az := chosen.Type, chosen.MaxPrice, chosen.AZ
+	crossAZ := az != oldAZ
+	if len(failures) > 0 {
+		fmt.Printf("Falling back to %s in %s ($%s/hr).\n", newType, az, maxPrice)
+		if crossAZ && az != primaryAZ {
+			if err := printCrossAZEstimate(ctx, client, inst, az); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+		}
+	}
 
-	newID := *result.Instances[0].InstanceId
 	fmt.Printf("New instance %s launched, waiting for running state...\n", newID)
 
 	runWaiter := ec2.NewInstanceRunningWaiter(client)
@@ -324,6 +535,25 @@ func resizeSpotInstance(ctx context.Context, dcfg config.DevboxConfig, client *e
 		}
 	}
 
+	// 5c. Copy the data volumes into the target AZ. The old instance is
+	//     stopped, so the snapshots are consistent. If the copy fails, the
+	//     replacement is discarded and the old instance is still intact.
+	attachVolumes := extraVolumes
+	var moved []movedVolume
+	if crossAZ && len(extraVolumes) > 0 {
+		moved, err = copyVolumesToAZ(ctx, client, extraVolumes, az)
+		if err != nil {
+			client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{InstanceIds: []string{newID}})
+			return fmt.Errorf("copying volumes to %s (old instance %s is still intact): %w", az, instanceID, err)
+		}
+		attachVolumes = nil
+		for i, m := range moved {
+			attachVolumes = append(attachVolumes, volumeAttachment{
+				VolumeID: m.NewID, Device: m.Device, DeleteOnTermination: extraVolumes[i].DeleteOnTermination,
+			})
+		}
+	}
+
 	// 6. Cancel the old spot request now that replacement is confirmed.
 	if inst.SpotInstanceRequestId != nil {
 		fmt.Printf("Canceling old spot request %s...\n", *inst.SpotInstanceRequestId)
@@ -369,7 +599,7 @@ func resizeSpotInstance(ctx context.Context, dcfg config.DevboxConfig, client *e
 
 	// 9. Attach volumes to new (stopped) instance, then start it.
 	//    This way NixOS boots with the data volume present from the start.
-	for _, vol := range extraVolumes {
+	for _, vol := range attachVolumes {
 		fmt.Printf("Attaching volume %s as %s to new instance...\n", vol.VolumeID, vol.Device)
 		_, err := client.AttachVolume(ctx, &ec2.AttachVolumeInput{
 			VolumeId:   aws.String(vol.VolumeID),
@@ -381,11 +611,37 @@ func resizeSpotInstance(ctx context.Context, dcfg config.DevboxConfig, client *e
 			continue
 		}
 	}
-	for _, vol := range extraVolumes {
+	for _, vol := range attachVolumes {
 		if err := awsutil.PollVolumeState(ctx, client, vol.VolumeID, "in-use", VolumePollInterval, 2*time.Minute); err != nil {
 			fmt.Fprintf(os.Stderr, "Warning: timeout waiting for volume %s to attach: %v\n", vol.VolumeID, err)
 		}
 	}
+	for _, vol := range attachVolumes {
+		if !vol.DeleteOnTermination {
+			continue
+		}
+		_, err := client.ModifyInstanceAttribute(ctx, &ec2.ModifyInstanceAttributeInput{
+			InstanceId: aws.String(newID),
+			BlockDeviceMappings: []types.InstanceBlockDeviceMappingSpecification{{
+				DeviceName: aws.String(vol.Device),
+				Ebs: &types.EbsInstanceBlockDeviceSpecification{
+					VolumeId:            aws.String(vol.VolumeID),
+					DeleteOnTermination: aws.Bool(true),
+				},
+			}},
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: volume %s will outlive %s: %v\n", vol.VolumeID, newID, err)
+		}
+	}
+
+	if !start {
+		for _, m := range moved {
+			fmt.Printf("Original volume %s was kept; delete it once %s checks out.\n", m.OldID, newID)
+		}
+		fmt.Printf("\nDone. Old instance %s terminated, new instance %s (%s, max $%s/hr) is stopped.\n", instanceID, newID, newType, maxPrice)
+		return nil
+	}
 
 	// 10. Start new instance with volumes attached
 	fmt.Printf("Starting instance %s...\n", newID)
@@ -409,7 +665,12 @@ func resizeSpotInstance(ctx context.Context, dcfg config.DevboxConfig, client *e
 		fmt.Fprintln(os.Stderr, "The NixOS boot service should update DNS automatically.")
 	}
 
-	fmt.Printf("\nDone. Old instance %s terminated, new instance %s (%s) is running.\n", instanceID, newID, newType)
+	// 12. Only now that the box is up in its new AZ, remove the originals.
+	if len(moved) > 0 {
+		finishCrossAZMove(ctx, client, newID, moved)
+	}
+
+	fmt.Printf("\nDone. Old instance %s terminated, new instance %s (%s) is running in %s.\n", instanceID, newID, newType, az)
 	return nil
 }
 
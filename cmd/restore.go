@@ -0,0 +1,371 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/spf13/cobra"
+
+	"github.com/emaland/devbox/internal/awsutil"
+)
+
+const (
+	// previousVolumesTag lists, newest first, the volumes a data volume
+	// replaced by restore or encrypt. Snapshots keep their source volume's
+	// ID, so this is how a box's older snapshots are still found.
+	previousVolumesTag = "devbox-previous-volumes"
+	// maxPreviousVolumes keeps previousVolumesTag under EC2's 256
+	// character limit for tag values.
+	maxPreviousVolumes = 10
+	// preRestoreTag marks the volume a restore swapped out, with the time
+	// of the restore.
+	preRestoreTag = "devbox-pre-restore"
+)
+
+type restoreOptions struct {
+	Snapshot    string // snapshot ID; empty with At, or to pick
+	At          string // date or time to restore to
+	Device      string // the data volume's device, if the box has several
+	AutoApprove bool
+}
+
+func newVolumeRestoreCmd() *cobra.Command {
+	var opts restoreOptions
+
+	cmd := &cobra.Command{
+		Use:   "restore <instance-id> [snapshot-id]",
+		Short: "Restore a box's data volume from a snapshot",
+		Long: `Replace a box's data volume with a new one created from a snapshot. The
+volume is created in the box's AZ before the box is stopped. The box is
+then stopped, the volumes are swapped at the same device, and the box is
+started again. The old volume is kept, renamed <name>-pre-restore and
+tagged devbox-pre-restore, until you delete it.
+
+The snapshot is given by ID, or with --at as the newest snapshot of the
+box's volume taken on or before a date (2026-10-01) or time (RFC 3339).
+With neither, pick one from the box's snapshots.`,
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 2 {
+				if opts.At != "" {
+					return fmt.Errorf("give a snapshot ID or --at, not both")
+				}
+				opts.Snapshot = args[1]
+			}
+			return volumeRestore(cmd.Context(), ec2Client, args[0], opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.At, "at", "", "Restore the newest snapshot taken on or before this date (YYYY-MM-DD) or time")
+	cmd.Flags().StringVar(&opts.Device, "device", "", "Device of the volume to restore, if the box has several data volumes")
+	cmd.Flags().BoolVar(&opts.AutoApprove, "auto-approve", false, "Skip the confirmation prompt")
+
+	return cmd
+}
+
+func volumeRestore(ctx context.Context, client *ec2.Client, instanceID string, opts restoreOptions) error {
+	inst, err := describeInstance(ctx, client, instanceID)
+	if err != nil {
+		return err
+	}
+	switch inst.State.Name {
+	case types.InstanceStateNameRunning, types.InstanceStateNamePending, types.InstanceStateNameStopped:
+	default:
+		return fmt.Errorf("%s is %s; wait until it is running or stopped", instanceID, inst.State.Name)
+	}
+	vol, device, err := restoreTarget(ctx, client, inst, opts.Device)
+	if err != nil {
+		return err
+	}
+	volID := aws.ToString(vol.VolumeId)
+
+	// 1. Choose the snapshot.
+	snapID := opts.Snapshot
+	if snapID == "" {
+		snaps, err := volumeSnapshotsOf(ctx, client, volumeLineage(vol))
+		if err != nil {
+			return err
+		}
+		if opts.At != "" {
+			at, err := parseRestoreAt(opts.At, time.Local)
+			if err != nil {
+				return err
+			}
+			if snapID = snapshotAt(snaps, at); snapID == "" {
+				return fmt.Errorf("no completed snapshot of %s taken on or before %s", volID, opts.At)
+			}
+		} else if snapID, err = pickSnapshot(snaps); err != nil || snapID == "" {
+			return err
+		}
+	}
+	snapDesc, err := client.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: []string{snapID}})
+	if err != nil {
+		return fmt.Errorf("describing snapshot %s: %w", snapID, err)
+	}
+	if len(snapDesc.Snapshots) == 0 {
+		return fmt.Errorf("snapshot %s not found", snapID)
+	}
+	snap := snapDesc.Snapshots[0]
+	if snap.State != types.SnapshotStateCompleted {
+		return fmt.Errorf("snapshot %s is %s, not completed", snapID, snap.State)
+	}
+
+	wasRunning := inst.State.Name == types.InstanceStateNameRunning || inst.State.Name == types.InstanceStateNamePending
+	fmt.Printf("Restore %s of %s (%s) from %s, taken %s.\n",
+		device, instanceID, awsutil.NameTag(inst.Tags), snapID, aws.ToTime(snap.StartTime).Local().Format("2006-01-02 15:04"))
+	fmt.Printf("The current volume %s is detached and kept, tagged %s.\n", volID, preRestoreTag)
+	if wasRunning {
+		fmt.Printf("%s will be stopped and started again.\n", instanceID)
+	}
+	if !opts.AutoApprove {
+		ok, err := promptYesNo("Proceed?")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Println("Aborted.")
+			return nil
+		}
+	}
+
+	// 2. Create the volume while the box is still up. It keeps the current
+	// volume's type, performance, encryption and tags, and its size if it
+	// has grown since the snapshot.
+	input := &ec2.CreateVolumeInput{
+		AvailabilityZone: inst.Placement.AvailabilityZone,
+		SnapshotId:       aws.String(snapID),
+		Size:             aws.Int32(max(aws.ToInt32(vol.Size), aws.ToInt32(snap.VolumeSize))),
+		VolumeType:       vol.VolumeType,
+		TagSpecifications: []types.TagSpecification{{
+			ResourceType: types.ResourceTypeVolume,
+			Tags:         successorTags(vol),
+		}},
+	}
+	setPerformance(input, awsutil.CurrentSpec(vol))
+	if aws.ToBool(vol.Encrypted) && !aws.ToBool(snap.Encrypted) {
+		input.Encrypted = aws.Bool(true)
+		input.KmsKeyId = vol.KmsKeyId
+	}
+	newVol, err := client.CreateVolume(ctx, input)
+	if err != nil {
+		return fmt.Errorf("creating volume from %s: %w", snapID, err)
+	}
+	newID := aws.ToString(newVol.VolumeId)
+	fmt.Printf("Created volume %s from %s, waiting for available state...\n", newID, snapID)
+	if err := awsutil.PollVolumeState(ctx, client, newID, "available", VolumePollInterval, 10*time.Minute); err != nil {
+		return err
+	}
+
+	// 3. Stop the box.
+	if wasRunning {
+		if err := stopAndWait(ctx, client, instanceID); err != nil {
+			return fmt.Errorf("%w (the restored volume %s is left unattached)", err, newID)
+		}
+	}
+
+	// 4. Swap the volumes and mark the old one.
+	deleteOnTermination := false
+	for _, bdm := range dataVolumeMappings(inst) {
+		if aws.ToString(bdm.Ebs.VolumeId) == volID {
+			deleteOnTermination = aws.ToBool(bdm.Ebs.DeleteOnTermination)
+		}
+	}
+	if err := swapVolume(ctx, client, instanceID, volID, newID, device, deleteOnTermination); err != nil {
+		if wasRunning {
+			if serr := startAndWait(ctx, client, instanceID); serr != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", serr)
+			}
+		}
+		return fmt.Errorf("%w (the restored volume %s is left unattached)", err, newID)
+	}
+	retireVolume(ctx, client, vol, "pre-restore", types.Tag{
+		Key: aws.String(preRestoreTag), Value: aws.String(time.Now().UTC().Format(time.RFC3339)),
+	})
+
+	// 5. Start the box.
+	if wasRunning {
+		if err := startAndWait(ctx, client, instanceID); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("\nRestored %s of %s from %s as %s.\n", device, instanceID, snapID, newID)
+	fmt.Printf("Once you're happy with it, delete the old volume: devbox volume destroy %s\n", volID)
+	return nil
+}
+
+// restoreTarget returns the data volume of inst to restore and its device:
+// the one at device, or the box's only data volume.
+func restoreTarget(ctx context.Context, client *ec2.Client, inst types.Instance, device string) (types.Volume, string, error) {
+	instanceID := aws.ToString(inst.InstanceId)
+	var match []types.InstanceBlockDeviceMapping
+	var devices []string
+	for _, bdm := range dataVolumeMappings(inst) {
+		devices = append(devices, aws.ToString(bdm.DeviceName))
+		if device == "" || aws.ToString(bdm.DeviceName) == device {
+			match = append(match, bdm)
+		}
+	}
+	switch {
+	case len(devices) == 0:
+		return types.Volume{}, "", fmt.Errorf("%s has no data volume", instanceID)
+	case len(match) == 0:
+		return types.Volume{}, "", fmt.Errorf("%s has no data volume at %s (it has %s)", instanceID, device, strings.Join(devices, ", "))
+	case len(match) > 1:
+		return types.Volume{}, "", fmt.Errorf("%s has several data volumes (%s); pick one with --device", instanceID, strings.Join(devices, ", "))
+	}
+	vol, err := describeVolume(ctx, client, aws.ToString(match[0].Ebs.VolumeId))
+	return vol, aws.ToString(match[0].DeviceName), err
+}
+
+// volumeLineage returns vol's ID followed by the volumes it replaced.
+func volumeLineage(vol types.Volume) []string {
+	ids := []string{aws.ToString(vol.VolumeId)}
+	if prev := awsutil.TagValue(vol.Tags, previousVolumesTag); prev != "" {
+		ids = append(ids, strings.Split(prev, ",")...)
+	}
+	return ids
+}
+
+// successorTags returns the tags for a volume replacing vol: vol's own,
+// with vol added to the front of previousVolumesTag.
+func successorTags(vol types.Volume) []types.Tag {
+	var tags []types.Tag
+	for _, t := range vol.Tags {
+		if aws.ToString(t.Key) != previousVolumesTag {
+			tags = append(tags, t)
+		}
+	}
+	lineage := volumeLineage(vol)
+	if len(lineage) > maxPreviousVolumes {
+		lineage = lineage[:maxPreviousVolumes]
+	}
+	return append(tags, types.Tag{Key: aws.String(previousVolumesTag), Value: aws.String(strings.Join(lineage, ","))})
+}
+
+// retireVolume renames a volume that was swapped out to <name>-<suffix>,
+// so lookups by name find its replacement, and drops its backup policy,
+// which the replacement carries on.
+func retireVolume(ctx context.Context, client *ec2.Client, vol types.Volume, suffix string, extra ...types.Tag) {
+	volID := aws.ToString(vol.VolumeId)
+	tags := extra
+	if name := awsutil.TagValue(vol.Tags, "Name"); name != "" {
+		tags = append(tags, types.Tag{Key: aws.String("Name"), Value: aws.String(name + "-" + suffix)})
+	}
+	if len(tags) > 0 {
+		if _, err := client.CreateTags(ctx, &ec2.CreateTagsInput{Resources: []string{volID}, Tags: tags}); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not tag %s: %v\n", volID, err)
+		}
+	}
+	if awsutil.TagValue(vol.Tags, backupPolicyTag) != "" {
+		if _, err := client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+			Resources: []string{volID},
+			Tags:      []types.Tag{{Key: aws.String(backupPolicyTag)}},
+		}); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s keeps its backup policy: %v\n", volID, err)
+		}
+	}
+}
+
+// volumeSnapshotsOf returns the snapshots of any of volIDs, newest first.
+func volumeSnapshotsOf(ctx context.Context, client *ec2.Client, volIDs []string) ([]types.Snapshot, error) {
+	var snaps []types.Snapshot
+	p := ec2.NewDescribeSnapshotsPaginator(client, &ec2.DescribeSnapshotsInput{
+		OwnerIds: []string{"self"},
+		Filters:  []types.Filter{{Name: aws.String("volume-id"), Values: volIDs}},
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing snapshots: %w", err)
+		}
+		snaps = append(snaps, page.Snapshots...)
+	}
+	slices.SortFunc(snaps, func(a, b types.Snapshot) int {
+		return aws.ToTime(b.StartTime).Compare(aws.ToTime(a.StartTime))
+	})
+	return snaps, nil
+}
+
+// parseRestoreAt parses --at: a date, meaning any time that day in loc, or
+// an RFC 3339 time. It returns the latest snapshot time it allows.
+func parseRestoreAt(s string, loc *time.Location) (time.Time, error) {
+	if d, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		return d.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --at %q: want a date like 2026-10-01 or an RFC 3339 time", s)
+}
+
+// snapshotAt returns the newest completed snapshot taken no later than at,
+// or "" if there is none.
+func snapshotAt(snaps []types.Snapshot, at time.Time) string {
+	var best *types.Snapshot
+	for i, s := range snaps {
+		if s.State != types.SnapshotStateCompleted || aws.ToTime(s.StartTime).After(at) {
+			continue
+		}
+		if best == nil || aws.ToTime(s.StartTime).After(aws.ToTime(best.StartTime)) {
+			best = &snaps[i]
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return aws.ToString(best.SnapshotId)
+}
+
+// pickSnapshot lists the completed snapshots in snaps and asks which one
+// to restore. It returns "" if the user picks none.
+func pickSnapshot(snaps []types.Snapshot) (string, error) {
+	var done []types.Snapshot
+	for _, s := range snaps {
+		if s.State == types.SnapshotStateCompleted {
+			done = append(done, s)
+		}
+	}
+	if len(done) == 0 {
+		return "", fmt.Errorf("no completed snapshots to restore from")
+	}
+	printSnapshots(done, true)
+	fmt.Printf("\nRestore which snapshot? [1-%d, Enter to cancel] ", len(done))
+	scanner := bufio.NewScanner(os.Stdin)
+	if !scanner.Scan() {
+		return "", scanner.Err()
+	}
+	n, err := parsePick(scanner.Text(), len(done))
+	if err != nil || n == 0 {
+		return "", err
+	}
+	return aws.ToString(done[n-1].SnapshotId), nil
+}
+
+// parsePick parses a 1-based choice of n items; empty means none (0).
+func parsePick(answer string, n int) (int, error) {
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(answer)
+	if err != nil || i < 1 || i > n {
+		return 0, fmt.Errorf("invalid choice %q: want 1-%d", answer, n)
+	}
+	return i, nil
+}
+
+// stdinIsTerminal reports whether stdin is interactive, so a picker can
+// be offered.
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
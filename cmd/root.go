@@ -12,6 +12,8 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/spf13/cobra"
 
+	"github.com/emaland/devbox/internal/awsutil"
+	"github.com/emaland/devbox/internal/cache"
 	devboxconfig "github.com/emaland/devbox/internal/config"
 )
 
@@ -59,6 +61,10 @@ func NewRootCmd() *cobra.Command {
 			}
 
 			ec2Client = ec2.NewFromConfig(awsCfg)
+
+			if dir, err := cache.DefaultDir(); err == nil {
+				awsutil.Cache = &cache.Store{Dir: dir}
+			}
 			return nil
 		},
 		SilenceUsage: true,
@@ -81,6 +87,12 @@ func NewRootCmd() *cobra.Command {
 		newRecoverCmd(),
 		newSpawnCmd(),
 		newVolumeCmd(),
+		newTemplateCmd(),
+		newPlanCmd(),
+		newApplyCmd(),
+		newReapCmd(),
+		newAMICmd(),
+		newRootVolumeCmd(),
 		newInfraCmd(),
 		newNixUpdateCmd(),
 	)
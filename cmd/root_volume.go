@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/spf13/cobra"
+
+	"github.com/emaland/devbox/internal/awsutil"
+	"github.com/emaland/devbox/internal/config"
+)
+
+func newRootVolumeCmd() *cobra.Command {
+	root := &cobra.Command{
+		Use:   "root",
+		Short: "Manage a box's root volume (grow)",
+	}
+
+	root.AddCommand(&cobra.Command{
+		Use:   "grow <instance-id> <size-GiB|+GiB>",
+		Short: "Grow a box's root volume and its filesystem",
+		Long: `Grow the root EBS volume of an instance with ModifyVolume, then grow
+the partition and filesystem over SSH once EBS starts optimizing. The size
+is the new total in GiB, or +N to add N GiB. EBS volumes can't shrink, and
+can be modified at most once every six hours.
+
+If the instance isn't running, only the volume is grown; NixOS grows the
+root partition and filesystem on the next boot.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return rootGrow(cmd.Context(), dcfg, ec2Client, args[0], args[1])
+		},
+	})
+
+	return root
+}
+
+// parseGrowSize parses a new size in GiB, or +N relative to current.
+func parseGrowSize(s string, current int32) (int32, error) {
+	rel := strings.HasPrefix(s, "+")
+	n, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(s, "+"), "G"), 10, 32)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q: want GiB like 200, or +50", s)
+	}
+	size := int32(n)
+	if rel {
+		size += current
+	}
+	if size <= current {
+		return 0, fmt.Errorf("volume is already %d GiB; EBS volumes can only grow", current)
+	}
+	return size, nil
+}
+
+func rootGrow(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, instanceID, sizeArg string) error {
+	inst, err := describeInstance(ctx, client, instanceID)
+	if err != nil {
+		return err
+	}
+	var volID string
+	for _, bdm := range inst.BlockDeviceMappings {
+		if aws.ToString(bdm.DeviceName) == aws.ToString(inst.RootDeviceName) && bdm.Ebs != nil {
+			volID = aws.ToString(bdm.Ebs.VolumeId)
+		}
+	}
+	if volID == "" {
+		return fmt.Errorf("%s has no EBS root volume", instanceID)
+	}
+	desc, err := client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{volID}})
+	if err != nil || len(desc.Volumes) == 0 {
+		return fmt.Errorf("describing root volume %s: %w", volID, err)
+	}
+	vol := desc.Volumes[0]
+	current := aws.ToInt32(vol.Size)
+	size, err := parseGrowSize(sizeArg, current)
+	if err != nil {
+		return err
+	}
+	// io1 and io2 need their provisioned IOPS to validate.
+	spec := awsutil.CurrentSpec(vol)
+	spec.SizeGiB = size
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+
+	// 1. Grow the volume.
+	fmt.Printf("Growing root volume %s of %s: %d -> %d GiB...\n", volID, instanceID, current, size)
+	if _, err := client.ModifyVolume(ctx, &ec2.ModifyVolumeInput{
+		VolumeId: aws.String(volID),
+		Size:     aws.Int32(size),
+	}); err != nil {
+		return fmt.Errorf("modifying volume %s: %w", volID, err)
+	}
+
+	// 2. The new size is usable once the modification is optimizing.
+	if err := waitVolumeModification(ctx, client, volID, 30*time.Minute); err != nil {
+		return err
+	}
+
+	// 3. Grow the partition and filesystem.
+	if inst.State.Name != types.InstanceStateNameRunning || inst.PublicIpAddress == nil {
+		fmt.Printf("%s isn't running; the root filesystem grows on its next boot.\n", instanceID)
+	} else if err := growFilesystem(ctx, dcfg, *inst.PublicIpAddress, volID, aws.ToString(inst.RootDeviceName)); err != nil {
+		return err
+	}
+
+	if size > dcfg.RootVolume.SizeGiB {
+		fmt.Printf("New boxes still get %d GiB; raise root_volume.size in the config to match.\n", dcfg.RootVolume.SizeGiB)
+	}
+	return nil
+}
+
+// waitVolumeModification polls a volume's latest modification until EBS
+// reports it optimizing or completed, when the new size and performance
+// are in effect.
+func waitVolumeModification(ctx context.Context, client *ec2.Client, volID string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	lastProgress := int64(-1)
+	for {
+		out, err := client.DescribeVolumesModifications(ctx, &ec2.DescribeVolumesModificationsInput{
+			VolumeIds: []string{volID},
+		})
+		if err != nil {
+			return fmt.Errorf("describing modifications of %s: %w", volID, err)
+		}
+		if len(out.VolumesModifications) > 0 {
+			m := out.VolumesModifications[0]
+			switch m.ModificationState {
+			case types.VolumeModificationStateOptimizing, types.VolumeModificationStateCompleted:
+				fmt.Printf("Volume %s modified (%s).\n", volID, m.ModificationState)
+				return nil
+			case types.VolumeModificationStateFailed:
+				return fmt.Errorf("modifying volume %s failed: %s", volID, aws.ToString(m.StatusMessage))
+			}
+			if p := aws.ToInt64(m.Progress); p != lastProgress {
+				fmt.Printf("  %s: %s, %d%%\n", volID, m.ModificationState, p)
+				lastProgress = p
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for volume %s to be modified", volID)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(VolumePollInterval):
+		}
+	}
+}
+
+// growFSScript grows the partition, if any, and filesystem of an EBS
+// volume. Nitro instances expose the volume ID as the NVMe serial; Xen
+// ones use the attachment device name.
+const growFSScript = `set -e
+disk=$(lsblk -dno NAME,SERIAL | awk '$2 == "@@SERIAL@@" {print $1}')
+[ -n "$disk" ] || disk=$(basename "$(readlink -f @@DEVICE@@)")
+target=/dev/$disk
+part=$(lsblk -lno NAME,TYPE "/dev/$disk" | awk '$2 == "part" {p = $1} END {print p}')
+if [ -n "$part" ]; then
+  n=$(cat "/sys/class/block/$part/partition")
+  out=$(sudo nix-shell -p cloud-utils --run "growpart /dev/$disk $n" 2>&1) ||
+    case "$out" in *NOCHANGE*) ;; *) echo "$out" >&2; exit 1 ;; esac
+  target=/dev/$part
+fi
+mnt=$(findmnt -no TARGET --source "$target" | head -n1)
+case $(lsblk -no FSTYPE "$target") in
+  ext2|ext3|ext4) sudo resize2fs "$target" ;;
+  xfs) sudo xfs_growfs "${mnt:?$target is not mounted}" ;;
+  *) echo "don't know how to grow the filesystem on $target" >&2; exit 1 ;;
+esac
+df -h "${mnt:-$target}"`
+
+// growFilesystem grows the filesystem on volID, attached as device to the
+// instance at ip, to fill the volume.
+func growFilesystem(ctx context.Context, dcfg config.DevboxConfig, ip, volID, device string) error {
+	script := strings.NewReplacer(
+		"@@SERIAL@@", strings.ReplaceAll(volID, "-", ""),
+		"@@DEVICE@@", device,
+	).Replace(growFSScript)
+	fmt.Printf("Growing the filesystem on %s over SSH (%s)...\n", volID, ip)
+	cmd := sshCommand(ctx, dcfg, ip, script)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("growing the filesystem on %s: %w", volID, err)
+	}
+	return nil
+}
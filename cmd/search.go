@@ -3,117 +3,253 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"maps"
 	"os"
+	"slices"
 	"sort"
+	"sync"
 	"text/tabwriter"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/spf13/cobra"
 
+	"github.com/emaland/devbox/internal/advisor"
 	"github.com/emaland/devbox/internal/awsutil"
+	"github.com/emaland/devbox/internal/bid"
+	"github.com/emaland/devbox/internal/perf"
+	"github.com/emaland/devbox/internal/spotstats"
 )
 
+// searchOptions holds the search flags.
+type searchOptions struct {
+	MinVCPU  int
+	MinMem   float64
+	MaxPrice float64
+	Arch     string
+	GPU      bool
+	AZ       string
+	SortBy   string
+	Limit    int
+	Filter   awsutil.TypeFilter
+	// Stats adds price-history columns over the last Days days.
+	Stats bool
+	Days  int
+	// Regions fans the search out to these regions instead of the
+	// configured one; AllRegions uses every enabled region.
+	Regions    []string
+	AllRegions bool
+	// UpdateAdvisor refreshes the spot advisor data from AdvisorSource, a
+	// URL or path, instead of searching.
+	UpdateAdvisor bool
+	AdvisorSource string
+}
+
+// statsSortKeys are the --sort values that need price history.
+var statsSortKeys = map[string]bool{"p95": true, "volatility": true, "changes": true, "risk": true}
+
+// cheaperElsewhereThreshold is how much cheaper another region has to be
+// before a multi-region search calls it out.
+const cheaperElsewhereThreshold = 0.25
+
 func newSearchCmd() *cobra.Command {
 	var (
-		minVCPU  int
-		minMem   float64
-		maxPrice float64
-		arch     string
-		gpu      bool
-		az       string
-		sortBy   string
-		limit    int
+		opts    searchOptions
+		refresh bool
 	)
 
 	cmd := &cobra.Command{
 		Use:   "search [instance-type...]",
 		Short: "Browse spot prices by hardware specs",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runSearch(cmd.Context(), ec2Client, args, minVCPU, minMem, maxPrice, arch, gpu, az, sortBy, limit)
+			if refresh && awsutil.Cache != nil {
+				awsutil.Cache.Refresh = true
+			}
+			if cmd.Flags().Changed("advisor-source") && !opts.UpdateAdvisor {
+				return fmt.Errorf("--advisor-source only applies with --update-advisor")
+			}
+			if opts.UpdateAdvisor {
+				if len(args) > 0 {
+					return fmt.Errorf("--update-advisor takes no instance types; pass the data's URL or path with --advisor-source")
+				}
+				return updateAdvisor(cmd.Context(), opts.AdvisorSource)
+			}
+			return runSearch(cmd.Context(), ec2Client, args, opts)
 		},
 	}
 
-	cmd.Flags().IntVar(&minVCPU, "min-vcpu", 8, "Minimum vCPUs")
-	cmd.Flags().Float64Var(&minMem, "min-mem", 16, "Minimum memory (GiB)")
-	cmd.Flags().Float64Var(&maxPrice, "max-price", 0, "Max spot price $/hr (0 = no limit)")
-	cmd.Flags().StringVar(&arch, "arch", "x86_64", "Architecture (x86_64 or arm64)")
-	cmd.Flags().BoolVar(&gpu, "gpu", false, "Require GPU")
-	cmd.Flags().StringVar(&az, "az", "", "Filter by availability zone")
-	cmd.Flags().StringVar(&sortBy, "sort", "price", "Sort by: price, vcpu, mem")
-	cmd.Flags().IntVar(&limit, "limit", 20, "Max rows to display")
+	cmd.Flags().IntVar(&opts.MinVCPU, "min-vcpu", 8, "Minimum vCPUs")
+	cmd.Flags().Float64Var(&opts.MinMem, "min-mem", 16, "Minimum memory (GiB)")
+	cmd.Flags().Float64Var(&opts.MaxPrice, "max-price", 0, "Max spot price $/hr (0 = no limit)")
+	cmd.Flags().StringVar(&opts.Arch, "arch", "x86_64", "Architecture (x86_64 or arm64)")
+	cmd.Flags().BoolVar(&opts.GPU, "gpu", false, "Require GPU")
+	cmd.Flags().StringVar(&opts.AZ, "az", "", "Filter by availability zone")
+	cmd.Flags().StringVar(&opts.SortBy, "sort", "price", "Sort by: price, vcpu, mem, perf-per-dollar, mem-per-dollar, interruption, p95, volatility, changes, risk")
+	cmd.Flags().IntVar(&opts.Limit, "limit", 20, "Max rows to display")
+	addTypeFilterFlags(cmd, &opts.Filter)
+	cmd.Flags().StringSliceVar(&opts.Regions, "regions", nil, "Search these regions concurrently, e.g. us-east-2,us-west-2")
+	cmd.Flags().BoolVar(&opts.AllRegions, "all-regions", false, "Search every enabled region")
+	cmd.MarkFlagsMutuallyExclusive("regions", "all-regions")
+	cmd.Flags().BoolVar(&refresh, "refresh", false, "Ignore cached instance types and spot prices")
+	cmd.Flags().BoolVar(&opts.Stats, "stats", false, "Add price-history columns (p95, changes, volatility, risk)")
+	cmd.Flags().IntVar(&opts.Days, "days", 30, "Days of history for --stats")
+	cmd.Flags().BoolVar(&opts.UpdateAdvisor, "update-advisor", false, "Refresh the spot advisor interruption data, then exit")
+	cmd.Flags().StringVar(&opts.AdvisorSource, "advisor-source", advisor.DefaultURL, "URL or local path to refresh the spot advisor data from")
 
 	return cmd
 }
 
-func runSearch(ctx context.Context, client *ec2.Client, args []string, minVCPU int, minMem, maxPrice float64, arch string, gpu bool, az, sortBy string, limit int) error {
-	// If specific instance types were passed as positional args, look those up directly
-	var instanceTypes []awsutil.InstanceTypeInfo
-	var err error
-	if len(args) > 0 {
-		fmt.Println("Looking up instance types...")
-		var typeNames []types.InstanceType
-		for _, arg := range args {
-			typeNames = append(typeNames, types.InstanceType(arg))
+// addTypeFilterFlags registers the instance-type filter flags shared by
+// search and recover.
+func addTypeFilterFlags(cmd *cobra.Command, f *awsutil.TypeFilter) {
+	cmd.Flags().StringSliceVar(&f.Families, "family", nil, "Only these instance families, e.g. m7i,c7a (globs allowed)")
+	cmd.Flags().StringSliceVar(&f.ExcludeFamilies, "exclude-family", nil, "Skip these instance families (globs allowed)")
+	cmd.Flags().Float64Var(&f.MinNetGbps, "min-net-gbps", 0, "Minimum baseline network bandwidth (Gbps)")
+	cmd.Flags().BoolVar(&f.NVMe, "nvme", false, "Require local NVMe instance storage")
+	cmd.Flags().StringVar(&f.CPU, "cpu", "", "Processor: intel, amd or graviton")
+	cmd.Flags().BoolVar(&f.NoBurstable, "no-burstable", false, "Exclude burstable (T-family) types")
+}
+
+func runSearch(ctx context.Context, client *ec2.Client, args []string, opts searchOptions) error {
+	if err := opts.Filter.Validate(); err != nil {
+		return err
+	}
+	withStats := opts.Stats || statsSortKeys[opts.SortBy]
+	if withStats && opts.Days <= 0 {
+		return fmt.Errorf("--days must be positive")
+	}
+
+	regions := opts.Regions
+	if opts.AllRegions {
+		var err error
+		if regions, err = enabledRegions(ctx, client); err != nil {
+			return err
 		}
-		instanceTypes, err = awsutil.DescribeSpecificTypes(ctx, client, typeNames)
+	}
+	multiRegion := len(regions) > 0
+
+	var (
+		results []awsutil.SpotSearchResult
+		stats   = map[spotstats.SeriesKey]spotstats.Summary{}
+	)
+	if !multiRegion {
+		rs, err := searchRegion(ctx, client, args, opts, withStats, true)
 		if err != nil {
 			return err
 		}
+		if rs == nil {
+			return nil
+		}
+		results, stats = rs.results, rs.stats
 	} else {
-		// Broad search by hardware specs
-		fmt.Println("Fetching instance types...")
-		instanceTypes, err = awsutil.FetchInstanceTypes(ctx, client, arch, minVCPU, minMem, gpu)
-		if err != nil {
-			return err
+		fmt.Printf("Searching %d regions...\n", len(regions))
+		var mu sync.Mutex
+		errs := forEachRegion(ctx, regions, func(ctx context.Context, region string, rc *ec2.Client) error {
+			rs, err := searchRegion(ctx, rc, args, opts, withStats, false)
+			if err != nil || rs == nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, rs.results...)
+			maps.Copy(stats, rs.stats)
+			return nil
+		})
+		for _, region := range regions {
+			if err := errs[region]; err != nil {
+				fmt.Fprintf(os.Stderr, "  %s: %v\n", region, err)
+			}
+		}
+		if len(errs) == len(regions) {
+			return fmt.Errorf("search failed in all %d regions", len(regions))
 		}
 	}
-	if len(instanceTypes) == 0 {
-		fmt.Println("No instance types match the given filters.")
+
+	if len(results) == 0 {
+		fmt.Println("No spot prices found matching filters.")
 		return nil
 	}
 
-	// 2. Fetch spot prices for those types
-	fmt.Printf("Fetching spot prices for %d instance types...\n", len(instanceTypes))
-	results, err := awsutil.FetchSpotPrices(ctx, client, instanceTypes, az)
+	statOf := func(r awsutil.SpotSearchResult) spotstats.Summary {
+		return stats[spotstats.SeriesKey{InstanceType: r.InstanceType, AZ: r.AZ}]
+	}
+
+	// Interruption bands are optional; without the data file the column is blank.
+	adv, err := advisor.LoadDefault()
 	if err != nil {
 		return err
 	}
-
-	// 3. Apply max price filter
-	if maxPrice > 0 {
-		var filtered []awsutil.SpotSearchResult
-		for _, r := range results {
-			if r.Price <= maxPrice {
-				filtered = append(filtered, r)
-			}
-		}
-		results = filtered
+	stabilityOf := func(r awsutil.SpotSearchResult) float64 {
+		return adv.Stability(bid.RegionFromAZ(r.AZ), r.InstanceType)
 	}
 
-	if len(results) == 0 {
-		fmt.Println("No spot prices found matching filters.")
-		return nil
+	perfTable, err := perf.LoadDefault()
+	if err != nil {
+		return err
 	}
 
-	// 4. Sort
-	switch sortBy {
+	// 5. Sort
+	switch opts.SortBy {
 	case "vcpu":
 		sort.Slice(results, func(i, j int) bool { return results[i].VCPUs < results[j].VCPUs })
 	case "mem":
 		sort.Slice(results, func(i, j int) bool { return results[i].MemoryMiB < results[j].MemoryMiB })
+	case "perf-per-dollar":
+		sort.Slice(results, func(i, j int) bool {
+			return perfTable.PerfPerDollar(results[i].InstanceType, results[i].Price, results[i].VCPUs) >
+				perfTable.PerfPerDollar(results[j].InstanceType, results[j].Price, results[j].VCPUs)
+		})
+	case "mem-per-dollar":
+		sort.Slice(results, func(i, j int) bool {
+			return perf.MemPerDollar(results[i].Price, results[i].MemoryMiB) > perf.MemPerDollar(results[j].Price, results[j].MemoryMiB)
+		})
+	case "interruption":
+		sort.Slice(results, func(i, j int) bool {
+			a, b := stabilityOf(results[i]), stabilityOf(results[j])
+			if a != b {
+				return a < b
+			}
+			return results[i].Price < results[j].Price
+		})
+	case "p95":
+		sort.Slice(results, func(i, j int) bool { return statOf(results[i]).P95 < statOf(results[j]).P95 })
+	case "volatility":
+		sort.Slice(results, func(i, j int) bool { return statOf(results[i]).Volatility < statOf(results[j]).Volatility })
+	case "changes":
+		sort.Slice(results, func(i, j int) bool { return statOf(results[i]).Changes < statOf(results[j]).Changes })
+	case "risk":
+		sort.Slice(results, func(i, j int) bool {
+			a, b := statOf(results[i]), statOf(results[j])
+			if a.Risk.Rank() != b.Risk.Rank() {
+				return a.Risk.Rank() < b.Risk.Rank()
+			}
+			return results[i].Price < results[j].Price
+		})
 	default:
 		sort.Slice(results, func(i, j int) bool { return results[i].Price < results[j].Price })
 	}
 
-	// 5. Truncate
-	if limit > 0 && len(results) > limit {
-		results = results[:limit]
+	// 6. Truncate, keeping the full set for the cross-region comparison
+	allResults := results
+	if opts.Limit > 0 && len(results) > opts.Limit {
+		results = results[:opts.Limit]
 	}
 
-	// 6. Display
+	// 7. Display
 	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
-	fmt.Fprintln(w, "INSTANCE TYPE\tVCPU\tMEMORY\tNETWORK\tAZ\tPRICE\tGPU")
+	header := "INSTANCE TYPE\tVCPU\tMEMORY\tNETWORK\tAZ\tPRICE\t$/VCPU-HR\t$/GIB-HR\tGPU\tINTERRUPT"
+	showPerf := opts.SortBy == "perf-per-dollar"
+	if showPerf {
+		header += "\tPERF\tPERF/$"
+	}
+	if multiRegion {
+		header = "REGION\t" + header
+	}
+	if withStats {
+		header += "\tP95\tCHANGES\tVOLATILITY\tRISK"
+	}
+	fmt.Fprintln(w, header)
 	for _, r := range results {
 		gpuStr := "-"
 		if r.GPU {
@@ -123,9 +259,209 @@ func runSearch(ctx context.Context, client *ec2.Client, args []string, minVCPU i
 		if netPerf == "" {
 			netPerf = "-"
 		}
-		fmt.Fprintf(w, "%s\t%d\t%.0f GiB\t%s\t%s\t$%.4f\t%s\n",
-			r.InstanceType, r.VCPUs, float64(r.MemoryMiB)/1024.0, netPerf, r.AZ, r.Price, gpuStr)
+		if multiRegion {
+			fmt.Fprintf(w, "%s\t", bid.RegionFromAZ(r.AZ))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.0f GiB\t%s\t%s\t$%.4f\t$%.4f\t$%.4f\t%s\t%s",
+			r.InstanceType, r.VCPUs, float64(r.MemoryMiB)/1024.0, netPerf, r.AZ, r.Price,
+			perf.PerVCPUHour(r.Price, r.VCPUs), perf.PerGiBHour(r.Price, r.MemoryMiB), gpuStr, interruptBand(adv, r))
+		if showPerf {
+			score, ok := perfTable.Score(r.InstanceType)
+			scoreStr := fmt.Sprintf("%.2f", score)
+			if !ok {
+				scoreStr += "?"
+			}
+			fmt.Fprintf(w, "\t%s\t%.1f", scoreStr, perfTable.PerfPerDollar(r.InstanceType, r.Price, r.VCPUs))
+		}
+		if withStats {
+			st := statOf(r)
+			fmt.Fprintf(w, "\t$%.4f\t%d\t%.1f%%\t%s", st.P95, st.Changes, st.Volatility*100, st.Risk)
+		}
+		fmt.Fprintln(w)
 	}
 	w.Flush()
+	if multiRegion {
+		ref := client.Options().Region
+		if !slices.Contains(regions, ref) {
+			ref = regions[0]
+		}
+		if notes := cheaperElsewhere(allResults, ref, cheaperElsewhereThreshold); len(notes) > 0 {
+			fmt.Printf("\nCheaper than %s:\n", ref)
+			for _, n := range notes {
+				fmt.Println("  " + n)
+			}
+		}
+	}
+	if showPerf {
+		fmt.Println("\nPERF is relative per-vCPU performance (m5/c5/r5 = 1.00); ? marks families missing from the table, scored 1.00.")
+	}
+	if adv == nil {
+		fmt.Println("\nNo spot advisor data; run `devbox search --update-advisor` to fill the INTERRUPT column.")
+	}
+	return nil
+}
+
+// regionSearch is one region's share of a search.
+type regionSearch struct {
+	results []awsutil.SpotSearchResult
+	stats   map[spotstats.SeriesKey]spotstats.Summary
+}
+
+// searchRegion runs the per-region part of a search: instance types, spot
+// prices, the price cap and optional history. It returns nil when no
+// instance types match. verbose prints progress, which is skipped when
+// several regions run at once.
+func searchRegion(ctx context.Context, client *ec2.Client, args []string, opts searchOptions, withStats, verbose bool) (*regionSearch, error) {
+	logf := func(format string, a ...any) {
+		if verbose {
+			fmt.Printf(format, a...)
+		}
+	}
+
+	// 1. If specific instance types were passed as positional args, look those up directly
+	var instanceTypes []awsutil.InstanceTypeInfo
+	var err error
+	if len(args) > 0 {
+		logf("Looking up instance types...\n")
+		var typeNames []types.InstanceType
+		for _, arg := range args {
+			typeNames = append(typeNames, types.InstanceType(arg))
+		}
+		instanceTypes, err = awsutil.DescribeSpecificTypes(ctx, client, typeNames)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Broad search by hardware specs
+		logf("Fetching instance types...\n")
+		instanceTypes, err = awsutil.FetchInstanceTypes(ctx, client, opts.Arch, opts.MinVCPU, opts.MinMem, opts.GPU)
+		if err != nil {
+			return nil, err
+		}
+	}
+	instanceTypes = opts.Filter.Apply(instanceTypes)
+	if len(instanceTypes) == 0 {
+		logf("No instance types match the given filters.\n")
+		return nil, nil
+	}
+
+	// 2. Fetch spot prices for those types
+	logf("Fetching spot prices for %d instance types...\n", len(instanceTypes))
+	results, err := awsutil.FetchSpotPrices(ctx, client, instanceTypes, opts.AZ)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. Apply max price filter
+	if opts.MaxPrice > 0 {
+		var filtered []awsutil.SpotSearchResult
+		for _, r := range results {
+			if r.Price <= opts.MaxPrice {
+				filtered = append(filtered, r)
+			}
+		}
+		results = filtered
+	}
+
+	rs := &regionSearch{results: results}
+
+	// 4. Price-history statistics, if asked for or needed to sort
+	if withStats && len(results) > 0 {
+		logf("Fetching %d days of price history...\n", opts.Days)
+		rs.stats, err = fetchSearchStats(ctx, client, results, opts.AZ, opts.Days)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+// cheaperElsewhere compares each instance type's cheapest price outside the
+// reference region with its cheapest price inside it, and describes the
+// types where another region is at least threshold (a fraction) cheaper.
+func cheaperElsewhere(results []awsutil.SpotSearchResult, ref string, threshold float64) []string {
+	home := map[string]awsutil.SpotSearchResult{}
+	away := map[string]awsutil.SpotSearchResult{}
+	for _, r := range results {
+		m := away
+		if bid.RegionFromAZ(r.AZ) == ref {
+			m = home
+		}
+		if best, ok := m[r.InstanceType]; !ok || r.Price < best.Price {
+			m[r.InstanceType] = r
+		}
+	}
+
+	var names []string
+	for name, h := range home {
+		if a, ok := away[name]; ok && a.Price <= h.Price*(1-threshold) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		si := 1 - away[names[i]].Price/home[names[i]].Price
+		sj := 1 - away[names[j]].Price/home[names[j]].Price
+		if si != sj {
+			return si > sj
+		}
+		return names[i] < names[j]
+	})
+
+	var notes []string
+	for _, name := range names {
+		h, a := home[name], away[name]
+		notes = append(notes, fmt.Sprintf("%s: $%.4f in %s vs $%.4f in %s (%.0f%% cheaper)",
+			name, a.Price, a.AZ, h.Price, h.AZ, (1-a.Price/h.Price)*100))
+	}
+	return notes
+}
+
+// interruptBand renders the advisor's interruption band for a result.
+func interruptBand(adv *advisor.Data, r awsutil.SpotSearchResult) string {
+	b, ok := adv.Band(bid.RegionFromAZ(r.AZ), r.InstanceType)
+	if !ok {
+		return "-"
+	}
+	return b.Label
+}
+
+// updateAdvisor refreshes the local spot advisor dataset.
+func updateAdvisor(ctx context.Context, src string) error {
+	dest, err := advisor.Path()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Updating spot advisor data from %s...\n", src)
+	d, err := advisor.Update(ctx, src, dest)
+	if err != nil {
+		return err
+	}
+	regions, entries := d.Regions()
+	fmt.Printf("Wrote %s (%d regions, %d instance types)\n", dest, regions, entries)
 	return nil
 }
+
+// fetchSearchStats summarizes the last days of price history for every
+// (type, AZ) pair in results.
+func fetchSearchStats(ctx context.Context, client *ec2.Client, results []awsutil.SpotSearchResult, az string, days int) (map[spotstats.SeriesKey]spotstats.Summary, error) {
+	seen := map[string]bool{}
+	var typeNames []string
+	for _, r := range results {
+		if !seen[r.InstanceType] {
+			seen[r.InstanceType] = true
+			typeNames = append(typeNames, r.InstanceType)
+		}
+	}
+
+	end := time.Now()
+	start := end.Add(-time.Duration(days) * 24 * time.Hour)
+	points, err := awsutil.FetchSpotPriceHistory(ctx, client, typeNames, az, start)
+	if err != nil {
+		return nil, err
+	}
+	stats := map[spotstats.SeriesKey]spotstats.Summary{}
+	for k, pts := range spotstats.Series(points) {
+		stats[k] = spotstats.Summarize(pts, start, end)
+	}
+	return stats, nil
+}
@@ -1,12 +1,14 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
+	"embed"
 	"fmt"
 	"os"
-	"os/exec"
+	"strings"
+	"text/template"
 
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/route53"
 	"github.com/spf13/cobra"
@@ -15,12 +17,52 @@ import (
 	"github.com/emaland/devbox/internal/config"
 )
 
+//go:embed templates/update-dns.sh.tmpl templates/update-dns.service.tmpl
+var dnsTemplateFS embed.FS
+
+var dnsTemplates = template.Must(template.ParseFS(dnsTemplateFS, "templates/update-dns.*.tmpl"))
+
+const (
+	dnsScriptPath = "/opt/update-dns.sh"
+	dnsUnitName   = "update-dns.service"
+	dnsUnitPath   = "/etc/systemd/system/" + dnsUnitName
+
+	// nixosDNSUnit is the declarative DNS updater defined in configuration.nix.
+	nixosDNSUnit = "update-route53.service"
+)
+
+// dnsBootParams feeds the update-dns templates.
+type dnsBootParams struct {
+	ZoneID     string
+	DNSName    string
+	TTL        int
+	ScriptPath string
+}
+
 func newSetupDNSCmd() *cobra.Command {
-	return &cobra.Command{
+	var (
+		printOnly bool
+		uninstall bool
+	)
+
+	cmd := &cobra.Command{
 		Use:   "setup-dns [instance-id]",
 		Short: "Install a boot script that updates dev.frob.io on startup",
-		Args:  cobra.MaximumNArgs(1),
+		Long: `Install a systemd unit that points dns_name at the instance's public IP on
+every boot.
+
+  devbox setup-dns [id]             Render and install the script and unit
+  devbox setup-dns --print          Show the rendered files without installing
+  devbox setup-dns --uninstall [id] Remove a previously installed unit
+
+Instances whose configuration.nix already defines update-route53.service are
+left alone, since the two units would race each other on boot.`,
+		Args: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			r53client := route53.NewFromConfig(awsCfg)
+			if printOnly {
+				return printDNSBootFiles(cmd.Context(), dcfg, r53client)
+			}
 			instanceID := ""
 			if len(args) == 1 {
 				instanceID = args[0]
@@ -31,120 +73,138 @@ func newSetupDNSCmd() *cobra.Command {
 				}
 				instanceID = id
 			}
-			return setupDNSOnBoot(cmd.Context(), dcfg, ec2Client, instanceID)
+			if uninstall {
+				return uninstallDNSOnBoot(cmd.Context(), dcfg, ec2Client, instanceID)
+			}
+			return setupDNSOnBoot(cmd.Context(), dcfg, ec2Client, r53client, instanceID)
 		},
 	}
+
+	cmd.Flags().BoolVar(&printOnly, "print", false, "Print the rendered script and unit without installing")
+	cmd.Flags().BoolVar(&uninstall, "uninstall", false, "Remove a previously installed DNS boot unit")
+
+	return cmd
 }
 
-func setupDNSOnBoot(ctx context.Context, dcfg config.DevboxConfig, ec2client *ec2.Client, instanceID string) error {
-	desc, err := ec2client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
-		InstanceIds: []string{instanceID},
-	})
+// renderDNSBootFiles renders the boot script and its systemd unit.
+func renderDNSBootFiles(zoneID, dnsName string) (script, unit string, err error) {
+	params := dnsBootParams{
+		ZoneID:     zoneID,
+		DNSName:    dnsName,
+		TTL:        60,
+		ScriptPath: dnsScriptPath,
+	}
+	var sb, ub bytes.Buffer
+	if err := dnsTemplates.ExecuteTemplate(&sb, "update-dns.sh.tmpl", params); err != nil {
+		return "", "", fmt.Errorf("rendering boot script: %w", err)
+	}
+	if err := dnsTemplates.ExecuteTemplate(&ub, "update-dns.service.tmpl", params); err != nil {
+		return "", "", fmt.Errorf("rendering systemd unit: %w", err)
+	}
+	return sb.String(), ub.String(), nil
+}
+
+// isNixOSManagedUnit reports whether a resolved unit file path points into
+// the Nix store, i.e. the unit is declared in configuration.nix.
+func isNixOSManagedUnit(resolvedPath string) bool {
+	p := strings.TrimSpace(resolvedPath)
+	return strings.HasPrefix(p, "/nix/store/") || strings.HasPrefix(p, "/etc/static/")
+}
+
+func printDNSBootFiles(ctx context.Context, dcfg config.DevboxConfig, r53client *route53.Client) error {
+	zoneID, err := awsutil.FindHostedZone(ctx, r53client, dcfg.DNSZone)
 	if err != nil {
-		return fmt.Errorf("describing instance: %w", err)
+		return err
 	}
-	if len(desc.Reservations) == 0 || len(desc.Reservations[0].Instances) == 0 {
-		return fmt.Errorf("instance %s not found", instanceID)
+	script, unit, err := renderDNSBootFiles(zoneID, dcfg.DNSName)
+	if err != nil {
+		return err
 	}
-	inst := desc.Reservations[0].Instances[0]
-	if inst.PublicIpAddress == nil {
-		return fmt.Errorf("instance %s has no public IP (is it running?)", instanceID)
+	fmt.Printf("# %s\n%s\n# %s\n%s", dnsScriptPath, script, dnsUnitPath, unit)
+	return nil
+}
+
+func setupDNSOnBoot(ctx context.Context, dcfg config.DevboxConfig, ec2client *ec2.Client, r53client *route53.Client, instanceID string) error {
+	ip, err := instancePublicIP(ctx, ec2client, instanceID)
+	if err != nil {
+		return err
 	}
-	ip := *inst.PublicIpAddress
 
 	// Find the hosted zone ID so we can bake it into the script
-	loadedCfg, err := awsconfig.LoadDefaultConfig(ctx)
+	zoneID, err := awsutil.FindHostedZone(ctx, r53client, dcfg.DNSZone)
 	if err != nil {
-		return fmt.Errorf("loading AWS config: %w", err)
+		return err
 	}
-	r53client := route53.NewFromConfig(loadedCfg)
-	zoneID, err := awsutil.FindHostedZone(ctx, r53client, dcfg.DNSZone)
+
+	script, unit, err := renderDNSBootFiles(zoneID, dcfg.DNSName)
 	if err != nil {
 		return err
 	}
 
-	keyPath := dcfg.ResolveSSHKeyPath()
-
-	// The script that runs on boot to update Route 53
-	bootScript := fmt.Sprintf(`#!/bin/bash
-set -e
-
-# Wait for network and metadata
-sleep 5
-
-TOKEN=$(curl -s -X PUT "http://169.254.169.254/latest/api/token" \
-  -H "X-aws-ec2-metadata-token-ttl-seconds: 60")
-
-PUBLIC_IP=$(curl -s -H "X-aws-ec2-metadata-token: $TOKEN" \
-  http://169.254.169.254/latest/meta-data/public-ipv4)
-
-if [ -z "$PUBLIC_IP" ]; then
-  echo "No public IP found, skipping DNS update"
-  exit 0
-fi
-
-aws route53 change-resource-record-sets \
-  --hosted-zone-id %q \
-  --change-batch '{
-    "Comment": "devbox boot DNS update",
-    "Changes": [{
-      "Action": "UPSERT",
-      "ResourceRecordSet": {
-        "Name": "%s",
-        "Type": "A",
-        "TTL": 60,
-        "ResourceRecords": [{"Value": "'$PUBLIC_IP'"}]
-      }
-    }]
-  }'
-
-echo "Updated %s -> $PUBLIC_IP"
-`, zoneID, dcfg.DNSName, dcfg.DNSName)
-
-	serviceUnit := fmt.Sprintf(`[Unit]
-Description=Update %s DNS on boot
-After=network-online.target
-Wants=network-online.target
-
-[Service]
-Type=oneshot
-ExecStart=/opt/update-dns.sh
-
-[Install]
-WantedBy=multi-user.target
-`, dcfg.DNSName)
-
-	// Commands to install the script and service on the remote box
-	installCmd := fmt.Sprintf(
-		`cat > /tmp/update-dns.sh << 'SCRIPT'
-%s
-SCRIPT
-sudo mv /tmp/update-dns.sh /opt/update-dns.sh
-sudo chmod +x /opt/update-dns.sh
-
-cat > /tmp/update-dns.service << 'UNIT'
-%s
-UNIT
-sudo mv /tmp/update-dns.service /etc/systemd/system/update-dns.service
-sudo systemctl daemon-reload
-sudo systemctl enable update-dns.service
-echo "DNS boot script installed and enabled"`,
-		bootScript, serviceUnit)
+	// Refuse to install alongside the declarative updater from configuration.nix.
+	probe := sshCommand(ctx, dcfg, ip, fmt.Sprintf(
+		`readlink -f "$(systemctl show -p FragmentPath --value %s 2>/dev/null)" 2>/dev/null || true`, nixosDNSUnit))
+	probe.Stderr = os.Stderr
+	out, err := probe.Output()
+	if err != nil {
+		return fmt.Errorf("checking for %s: %w", nixosDNSUnit, err)
+	}
+	if isNixOSManagedUnit(string(out)) {
+		return fmt.Errorf("%s is managed by NixOS on %s (%s); not installing a duplicate %s",
+			nixosDNSUnit, instanceID, strings.TrimSpace(string(out)), dnsUnitName)
+	}
 
 	fmt.Printf("Installing DNS boot script on %s (%s)...\n", instanceID, ip)
 
-	sshCmd := exec.CommandContext(ctx, "ssh",
-		"-i", keyPath,
-		"-o", "StrictHostKeyChecking=no",
-		dcfg.SSHUser+"@"+ip,
-		installCmd,
-	)
+	if err := installRemoteFile(ctx, dcfg, ip, dnsScriptPath, "0755", script); err != nil {
+		return err
+	}
+	if err := installRemoteFile(ctx, dcfg, ip, dnsUnitPath, "0644", unit); err != nil {
+		return err
+	}
+
+	enable := sshCommand(ctx, dcfg, ip, fmt.Sprintf(
+		`sudo systemctl daemon-reload && sudo systemctl enable %s && echo "DNS boot script installed and enabled"`, dnsUnitName))
+	enable.Stdout = os.Stdout
+	enable.Stderr = os.Stderr
+	if err := enable.Run(); err != nil {
+		return fmt.Errorf("ssh command failed: %w", err)
+	}
+
+	fmt.Printf("Done. %s will update %s on every boot.\n", instanceID, dcfg.DNSName)
+	return nil
+}
+
+func uninstallDNSOnBoot(ctx context.Context, dcfg config.DevboxConfig, ec2client *ec2.Client, instanceID string) error {
+	ip, err := instancePublicIP(ctx, ec2client, instanceID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Removing DNS boot script from %s (%s)...\n", instanceID, ip)
+	remoteCmd := fmt.Sprintf(`if [ ! -e %[2]s ]; then echo "%[1]s is not installed"; exit 0; fi
+sudo systemctl disable %[1]s
+sudo rm -f %[2]s %[3]s
+sudo systemctl daemon-reload
+echo "DNS boot script removed"`, dnsUnitName, dnsUnitPath, dnsScriptPath)
+
+	sshCmd := sshCommand(ctx, dcfg, ip, remoteCmd)
 	sshCmd.Stdout = os.Stdout
 	sshCmd.Stderr = os.Stderr
 	if err := sshCmd.Run(); err != nil {
 		return fmt.Errorf("ssh command failed: %w", err)
 	}
+	return nil
+}
 
-	fmt.Printf("Done. %s will update %s on every boot.\n", instanceID, dcfg.DNSName)
+// installRemoteFile streams content over ssh stdin into path with the given mode.
+func installRemoteFile(ctx context.Context, dcfg config.DevboxConfig, ip, path, mode, content string) error {
+	sshCmd := sshCommand(ctx, dcfg, ip, fmt.Sprintf("sudo install -m %s /dev/stdin %s", mode, path))
+	sshCmd.Stdin = strings.NewReader(content)
+	sshCmd.Stdout = os.Stdout
+	sshCmd.Stderr = os.Stderr
+	if err := sshCmd.Run(); err != nil {
+		return fmt.Errorf("installing %s: %w", path, err)
+	}
 	return nil
 }
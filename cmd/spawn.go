@@ -3,47 +3,93 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"maps"
+	"os"
+	"slices"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
 	"github.com/spf13/cobra"
 
 	"github.com/emaland/devbox/internal/awsutil"
 	"github.com/emaland/devbox/internal/config"
 )
 
+// spawnOptions holds the spawn flags; empty fields fall back to config defaults.
+type spawnOptions struct {
+	InstanceType string
+	AZ           string
+	Name         string
+	MaxPrice     string
+	Bid          string
+	Explain      bool
+	From         string
+	// VCPU and Mem are ranges like "8-16" or "32-". Either one switches
+	// spawn to an attribute-based EC2 Fleet launch where AWS picks the type.
+	VCPU     string
+	Mem      string
+	Strategy string
+	Filter   awsutil.TypeFilter
+	// OneTime accepts the one-time spot request an instant fleet makes:
+	// the box can't be stopped and terminates if interrupted.
+	OneTime bool
+	// Data gives the box a /home volume: "new:<GiB>",
+	// "snapshot:<snap-id|latest>" or "clone".
+	Data string
+	// TTL, if set, makes the box terminate itself this long after launch.
+	TTL string
+}
+
 func newSpawnCmd() *cobra.Command {
-	var (
-		instanceType string
-		az           string
-		name         string
-		maxPrice     string
-		from         string
-	)
+	var opts spawnOptions
 
 	cmd := &cobra.Command{
 		Use:   "spawn",
 		Short: "Spin up a new spot instance cloned from the primary",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return spawnInstance(cmd.Context(), dcfg, ec2Client, instanceType, az, name, maxPrice, from)
+			r53client := route53.NewFromConfig(awsCfg)
+			_, err := spawnInstance(cmd.Context(), dcfg, ec2Client, r53client, opts)
+			return err
 		},
 	}
 
-	cmd.Flags().StringVar(&instanceType, "type", "", "Instance type (default from config)")
-	cmd.Flags().StringVar(&az, "az", "", "Availability zone (default from config)")
-	cmd.Flags().StringVar(&name, "name", "", "Name tag for the instance (default from config)")
-	cmd.Flags().StringVar(&maxPrice, "max-price", "", "Spot max price $/hr (default from config)")
-	cmd.Flags().StringVar(&from, "from", "", "Instance ID to clone user_data from")
+	cmd.Flags().StringVar(&opts.InstanceType, "type", "", "Instance type (default from config)")
+	cmd.Flags().StringVar(&opts.AZ, "az", "", "Availability zone, or auto to pick by spot placement score (default from config)")
+	cmd.Flags().StringVar(&opts.Name, "name", "", "Name tag for the instance (default from config)")
+	cmd.Flags().StringVar(&opts.MaxPrice, "max-price", "", "Spot max price $/hr (default from config)")
+	cmd.Flags().StringVar(&opts.Bid, "bid", "", "Bid strategy: on-demand, current, pNN, with optional +N%, +N or *N")
+	cmd.Flags().BoolVar(&opts.Explain, "explain", false, "Show how the max price was derived")
+	cmd.Flags().StringVar(&opts.From, "from", "", "Instance ID to clone user_data from")
+	cmd.Flags().StringVar(&opts.Data, "data", "", "Data volume for /home: new:<GiB>, snapshot:<snap-id|latest> or clone")
+	cmd.Flags().StringVar(&opts.TTL, "ttl", "", "Terminate the box this long after launch, e.g. 4h")
+	cmd.Flags().StringVar(&opts.VCPU, "vcpu", "", "vCPU range for an attribute-based launch, e.g. 8-16 or 8-")
+	cmd.Flags().StringVar(&opts.Mem, "mem", "", "Memory range in GiB for an attribute-based launch, e.g. 32-64 or 32-")
+	cmd.Flags().StringVar(&opts.Strategy, "strategy", string(types.SpotAllocationStrategyPriceCapacityOptimized), "Spot allocation strategy for attribute-based launches")
+	cmd.Flags().BoolVar(&opts.OneTime, "one-time", false, "Accept that an attribute-based launch is a one-time spot instance that terminates when interrupted")
+	addTypeFilterFlags(cmd, &opts.Filter)
+	cmd.MarkFlagsMutuallyExclusive("max-price", "bid")
+	cmd.MarkFlagsMutuallyExclusive("type", "vcpu")
+	cmd.MarkFlagsMutuallyExclusive("type", "mem")
 
 	return cmd
 }
 
-func spawnInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, instanceType, az, name, maxPrice, from string) error {
+// spawnInstance launches a new box and returns its instance ID once it is
+// running.
+func spawnInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, opts spawnOptions) (string, error) {
+	instanceType, az, name, from := opts.InstanceType, opts.AZ, opts.Name, opts.From
+	fleet := opts.VCPU != "" || opts.Mem != ""
+	if fleet && !opts.OneTime {
+		return "", fmt.Errorf("attribute-based launches go through an instant EC2 Fleet, which only makes one-time spot requests: the box can't be stopped, and an interruption terminates it along with its root volume; pass --one-time to accept that, or pick a type with --type")
+	}
+
 	// Apply config defaults for empty flags
-	if instanceType == "" {
+	if instanceType == "" && !fleet {
 		instanceType = dcfg.DefaultType
 	}
 	if az == "" {
@@ -52,102 +98,280 @@ func spawnInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Cl
 	if name == "" {
 		name = dcfg.SpawnName
 	}
-	if maxPrice == "" {
-		maxPrice = dcfg.DefaultMaxPrice
+	var data *dataSource
+	if opts.Data != "" {
+		src, err := parseDataSource(opts.Data)
+		if err != nil {
+			return "", err
+		}
+		data = &src
+	}
+	var ttl time.Duration
+	if opts.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(opts.TTL); err != nil || ttl <= 0 {
+			return "", fmt.Errorf("invalid --ttl %q: want a positive duration like 4h", opts.TTL)
+		}
+	}
+	var reqs *types.InstanceRequirementsRequest
+	if fleet {
+		var err error
+		if reqs, err = fleetRequirements(opts); err != nil {
+			return "", err
+		}
+	} else if az == autoAZ {
+		scorer := newPlacementScorer(client)
+		req := awsutil.PlacementRequest{InstanceTypes: []string{instanceType}}
+		region := client.Options().Region
+		printRegionScores(ctx, scorer, req, region)
+		picked, scores, err := pickAZ(ctx, scorer, req, region, nil, dcfg.DefaultAZ)
+		if err != nil {
+			return "", err
+		}
+		printPlacementScores(scores, picked)
+		az = picked
+	}
+	bidExpr := opts.Bid
+	if bidExpr == "" {
+		bidExpr = opts.MaxPrice
+	}
+	if bidExpr == "" {
+		bidExpr = dcfg.DefaultMaxPrice
+	}
+	var maxPrice string
+	var err error
+	if fleet {
+		maxPrice, err = fleetMaxPrice(bidExpr, opts.Explain)
+	} else {
+		maxPrice, err = resolveBid(ctx, client, bidExpr, instanceType, az, opts.Explain)
+	}
+	if err != nil {
+		return "", err
 	}
 
-	// Discover infrastructure
+	// Discover infrastructure. The launch template, when there is one,
+	// supplies the AMI, security group, user_data and the rest of the box
+	// definition; without one the same definition is built from config.
 	fmt.Println("Looking up infrastructure...")
 
-	amiID, err := lookupAMI(ctx, dcfg, client)
-	if err != nil {
-		return err
+	// The AMI must match the type's architecture. A fleet picks the type
+	// itself, so its AMI follows --cpu instead.
+	arch := string(types.ArchitectureTypeX8664)
+	if fleet {
+		if strings.EqualFold(opts.Filter.CPU, "graviton") {
+			arch = string(types.ArchitectureTypeArm64)
+		}
+	} else if arch, err = instanceTypeArch(ctx, client, instanceType); err != nil {
+		return "", err
 	}
-	fmt.Printf("  AMI: %s\n", amiID)
 
-	sgID, err := lookupSecurityGroup(ctx, dcfg, client)
-	if err != nil {
-		return err
-	}
-	fmt.Printf("  Security Group: %s\n", sgID)
+	var runInput *ec2.RunInstancesInput
+	lt := launchTemplateOrWarn(ctx, dcfg, client)
+	if lt != nil {
+		fmt.Printf("  Launch template: %s (version %d)\n", dcfg.LaunchTemplate, aws.ToInt64(lt.DefaultVersionNumber))
+		runInput = &ec2.RunInstancesInput{LaunchTemplate: templateSpec(lt)}
+		if !fleet {
+			tmplData, err := defaultTemplateVersion(ctx, client, lt)
+			if err != nil {
+				return "", err
+			}
+			amiID, err := templateImageFor(ctx, dcfg, client, tmplData, arch)
+			if err != nil {
+				return "", err
+			}
+			if amiID != "" {
+				fmt.Printf("  AMI: %s (%s, overriding the template's)\n", amiID, arch)
+				runInput.ImageId = aws.String(amiID)
+			}
+		}
+		if from != "" {
+			if fleet {
+				return "", fmt.Errorf("--from can't override the launch template's user_data in an attribute-based launch; run devbox template sync --from %s first", from)
+			}
+			fmt.Printf("  Cloning user_data from: %s\n", from)
+			userData, err := awsutil.FetchUserData(ctx, client, from)
+			if err != nil {
+				return "", err
+			}
+			runInput.UserData = aws.String(removeTTLTimer(userData))
+		}
+	} else {
+		amiID, err := lookupAMI(ctx, dcfg, client, arch)
+		if err != nil {
+			return "", err
+		}
+		fmt.Printf("  AMI: %s (%s)\n", amiID, arch)
 
-	subnetID, err := lookupSubnet(ctx, client, az)
-	if err != nil {
-		return err
+		sgID, err := lookupSecurityGroup(ctx, dcfg, client)
+		if err != nil {
+			return "", err
+		}
+		fmt.Printf("  Security Group: %s\n", sgID)
+
+		// Get user_data from source instance
+		sourceID := from
+		if sourceID == "" {
+			sourceID, err = autoDetectSourceInstance(ctx, client)
+			if err != nil {
+				return "", err
+			}
+		}
+		fmt.Printf("  Cloning user_data from: %s\n", sourceID)
+
+		userData, err := awsutil.FetchUserData(ctx, client, sourceID)
+		if err != nil {
+			return "", err
+		}
+		// The source's TTL, if any, isn't this box's; --ttl adds its own.
+		runInput = boxDefinition(dcfg, amiID, sgID, removeTTLTimer(userData))
 	}
-	fmt.Printf("  Subnet: %s\n", subnetID)
 
-	// Get user_data from source instance
-	sourceID := from
-	if sourceID == "" {
-		sourceID, err = autoDetectSourceInstance(ctx, client)
+	// The data volume is created with the instance, so it is attached on
+	// first boot and deleted when the box is terminated.
+	var cloneSnap string
+	if data != nil {
+		if lt != nil {
+			if fleet {
+				return "", fmt.Errorf("--data can't add a volume to the launch template in an attribute-based launch")
+			}
+			// Block device mappings in the request replace the template's.
+			tmplData, err := defaultTemplateVersion(ctx, client, lt)
+			if err != nil {
+				return "", err
+			}
+			runInput.BlockDeviceMappings = templateBlockDevices(tmplData)
+		}
+		primary := func() (string, error) {
+			if from != "" {
+				return from, nil
+			}
+			return autoDetectSourceInstance(ctx, client)
+		}
+		bdm, snap, err := prepareDataVolume(ctx, client, *data, primary, name)
 		if err != nil {
-			return err
+			return "", err
+		}
+		runInput.BlockDeviceMappings = append(runInput.BlockDeviceMappings, bdm)
+		cloneSnap = snap
+	}
+	// A TTL box terminates itself through a timer added to its user_data;
+	// devbox reap catches the ones that can't.
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).UTC().Truncate(time.Second)
+		userData := aws.ToString(runInput.UserData)
+		if userData == "" && lt != nil {
+			if fleet {
+				return "", fmt.Errorf("--ttl can't add a timer to the launch template's user_data in an attribute-based launch")
+			}
+			tmplData, err := defaultTemplateVersion(ctx, client, lt)
+			if err != nil {
+				return "", err
+			}
+			userData = aws.ToString(tmplData.UserData)
+		}
+		// The box removes its own DNS records when it expires.
+		zoneID, err := awsutil.FindHostedZone(ctx, r53client, dcfg.DNSZone)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v; the box won't remove its DNS records when it expires\n", err)
+			zoneID = ""
+		}
+		if patched, ok := addTTLTimer(userData, expires, zoneID); ok {
+			runInput.UserData = aws.String(patched)
+			fmt.Printf("  TTL: terminates itself at %s\n", expires.Format(time.RFC3339))
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: user_data is not a NixOS config, so the box won't terminate itself; run devbox reap after %s\n", expires.Format(time.RFC3339))
 		}
 	}
-	fmt.Printf("  Cloning user_data from: %s\n", sourceID)
 
-	userData, err := awsutil.FetchUserData(ctx, client, sourceID)
-	if err != nil {
-		return err
+	if cloneSnap != "" {
+		// The volume doesn't depend on the snapshot once it exists.
+		defer func() {
+			if _, err := client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(cloneSnap)}); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: could not delete clone snapshot %s: %v\n", cloneSnap, err)
+			}
+		}()
 	}
 
-	// Launch the instance
-	fmt.Printf("Launching %s spot instance in %s...\n", instanceType, az)
-
-	runInput := &ec2.RunInstancesInput{
-		ImageId:      aws.String(amiID),
-		InstanceType: types.InstanceType(instanceType),
-		MinCount:     aws.Int32(1),
-		MaxCount:     aws.Int32(1),
-		KeyName:      aws.String(dcfg.SSHKeyName),
-		SubnetId:     aws.String(subnetID),
-		SecurityGroupIds: []string{sgID},
-		IamInstanceProfile: &types.IamInstanceProfileSpecification{
-			Name: aws.String(dcfg.IAMProfile),
-		},
-		UserData: aws.String(userData),
-		InstanceMarketOptions: &types.InstanceMarketOptionsRequest{
-			MarketType: types.MarketTypeSpot,
-			SpotOptions: &types.SpotMarketOptions{
-				SpotInstanceType:             types.SpotInstanceTypePersistent,
-				InstanceInterruptionBehavior: types.InstanceInterruptionBehaviorStop,
-				MaxPrice:                     aws.String(maxPrice),
-			},
-		},
-		BlockDeviceMappings: []types.BlockDeviceMapping{
-			{
-				DeviceName: aws.String("/dev/xvda"),
-				Ebs: &types.EbsBlockDevice{
-					VolumeSize: aws.Int32(75),
-					VolumeType: types.VolumeTypeGp3,
-				},
-			},
+	// An attribute-based launch with --az auto may land in any AZ that has
+	// a default subnet; otherwise there is exactly one.
+	subnets := map[string]string{}
+	if fleet && az == autoAZ {
+		if subnets, err = defaultSubnets(ctx, client); err != nil {
+			return "", err
+		}
+		for _, zone := range slices.Sorted(maps.Keys(subnets)) {
+			fmt.Printf("  Subnet: %s (%s)\n", subnets[zone], zone)
+		}
+	} else {
+		subnetID, err := lookupSubnet(ctx, client, az)
+		if err != nil {
+			return "", err
+		}
+		subnets[az] = subnetID
+		fmt.Printf("  Subnet: %s\n", subnetID)
+	}
+
+	// Per-launch overrides on top of the box definition
+	runInput.InstanceType = types.InstanceType(instanceType)
+	runInput.MinCount = aws.Int32(1)
+	runInput.MaxCount = aws.Int32(1)
+	runInput.SubnetId = aws.String(subnets[az])
+	runInput.InstanceMarketOptions = &types.InstanceMarketOptionsRequest{
+		MarketType: types.MarketTypeSpot,
+		SpotOptions: &types.SpotMarketOptions{
+			SpotInstanceType:             types.SpotInstanceTypePersistent,
+			InstanceInterruptionBehavior: types.InstanceInterruptionBehaviorStop,
+			MaxPrice:                     aws.String(maxPrice),
 		},
-		TagSpecifications: []types.TagSpecification{
-			{
-				ResourceType: types.ResourceTypeInstance,
-				Tags: []types.Tag{
-					{Key: aws.String("Name"), Value: aws.String(name)},
-					{Key: aws.String("devbox-managed"), Value: aws.String("true")},
-				},
+	}
+	runInput.TagSpecifications = []types.TagSpecification{
+		{
+			ResourceType: types.ResourceTypeInstance,
+			Tags: []types.Tag{
+				{Key: aws.String("Name"), Value: aws.String(name)},
+				{Key: aws.String("devbox-managed"), Value: aws.String("true")},
 			},
 		},
 	}
-
-	result, err := client.RunInstances(ctx, runInput)
-	if err != nil {
-		return fmt.Errorf("launching instance: %w", err)
+	if ttl > 0 {
+		expiresTags := []types.Tag{{Key: aws.String(expiresTag), Value: aws.String(expires.Format(time.RFC3339))}}
+		spec := &runInput.TagSpecifications[0]
+		spec.Tags = append(spec.Tags, expiresTags...)
+		// The box may only cancel a spot request carrying the tag. A fleet
+		// can't tag the request, but its one-time request needs no cancel.
+		if !fleet {
+			runInput.TagSpecifications = append(runInput.TagSpecifications, types.TagSpecification{
+				ResourceType: types.ResourceTypeSpotInstancesRequest,
+				Tags:         expiresTags,
+			})
+		}
 	}
 
-	newID := *result.Instances[0].InstanceId
+	// Launch the instance
+	var newID string
+	if fleet {
+		fmt.Printf("Launching a spot instance with %s vCPU and %s GiB (%s)...\n", opts.VCPU, opts.Mem, opts.Strategy)
+		newID, instanceType, az, err = launchFleet(ctx, client, runInput, reqs, subnets, types.SpotAllocationStrategy(opts.Strategy), maxPrice)
+		if err != nil {
+			return "", err
+		}
+		fmt.Printf("EC2 Fleet picked %s in %s.\n", instanceType, az)
+	} else {
+		fmt.Printf("Launching %s spot instance in %s...\n", instanceType, az)
+		result, err := client.RunInstances(ctx, runInput)
+		if err != nil {
+			return "", fmt.Errorf("launching instance: %w", err)
+		}
+		newID = *result.Instances[0].InstanceId
+	}
 	fmt.Printf("Instance %s launched, waiting for running state...\n", newID)
 
 	waiter := ec2.NewInstanceRunningWaiter(client)
 	if err := waiter.Wait(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: []string{newID},
 	}, 5*60e9); err != nil {
-		return fmt.Errorf("waiting for instance to start: %w", err)
+		return "", fmt.Errorf("waiting for instance to start: %w", err)
 	}
 
 	// Re-describe to get public IP
@@ -155,7 +379,7 @@ func spawnInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Cl
 		InstanceIds: []string{newID},
 	})
 	if err != nil {
-		return fmt.Errorf("describing new instance: %w", err)
+		return "", fmt.Errorf("describing new instance: %w", err)
 	}
 	newInst := desc.Reservations[0].Instances[0]
 	publicIP := "-"
@@ -171,15 +395,26 @@ func spawnInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Cl
 	if publicIP != "-" {
 		fmt.Printf("  SSH:       ssh -i %s %s@%s\n", dcfg.SSHKeyPath, dcfg.SSHUser, publicIP)
 	}
-	return nil
+	if ttl > 0 {
+		fmt.Printf("  Expires:   %s (in %s)\n", expires.Format(time.RFC3339), ttl)
+	}
+	if data != nil {
+		tagDataVolume(ctx, client, newInst, name)
+	}
+	return newID, nil
 }
 
-func lookupAMI(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client) (string, error) {
+// lookupAMI returns the AMI pinned for arch ("x86_64" or "arm64"), or else
+// the latest NixOS AMI for it.
+func lookupAMI(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, arch string) (string, error) {
+	if id := dcfg.NixOSAMIPins[arch]; id != "" {
+		return id, nil
+	}
 	result, err := client.DescribeImages(ctx, &ec2.DescribeImagesInput{
 		Owners: []string{dcfg.NixOSAMIOwner},
 		Filters: []types.Filter{
 			{Name: aws.String("name"), Values: []string{dcfg.NixOSAMIPattern}},
-			{Name: aws.String("architecture"), Values: []string{"x86_64"}},
+			{Name: aws.String("architecture"), Values: []string{arch}},
 			{Name: aws.String("state"), Values: []string{"available"}},
 		},
 	})
@@ -187,7 +422,7 @@ func lookupAMI(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client
 		return "", fmt.Errorf("looking up AMI: %w", err)
 	}
 	if len(result.Images) == 0 {
-		return "", fmt.Errorf("no NixOS 24.11 AMI found")
+		return "", fmt.Errorf("no %s NixOS AMI matching %s found", arch, dcfg.NixOSAMIPattern)
 	}
 	// Pick the latest by sorting on name (NixOS AMI names include dates)
 	sort.Slice(result.Images, func(i, j int) bool {
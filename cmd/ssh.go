@@ -98,3 +98,56 @@ func sshToInstance(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Cl
 		dcfg.SSHUser + "@" + ip,
 	}, os.Environ())
 }
+
+// sshCommand builds an ssh invocation that runs remoteCmd on the instance at
+// ip as the configured user. Callers wire up stdout/stderr as they need.
+func sshCommand(ctx context.Context, dcfg config.DevboxConfig, ip, remoteCmd string) *exec.Cmd {
+	return exec.CommandContext(ctx, "ssh",
+		"-i", dcfg.ResolveSSHKeyPath(),
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		dcfg.SSHUser+"@"+ip,
+		remoteCmd,
+	)
+}
+
+// sshSessionCommand is sshCommand with a terminal, for an interactive
+// remoteCmd such as a shell. It is wired to this process's stdio.
+func sshSessionCommand(ctx context.Context, dcfg config.DevboxConfig, ip, remoteCmd string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "ssh",
+		"-t",
+		"-i", dcfg.ResolveSSHKeyPath(),
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		dcfg.SSHUser+"@"+ip,
+		remoteCmd,
+	)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd
+}
+
+// describeInstance returns a single instance by ID.
+func describeInstance(ctx context.Context, client *ec2.Client, instanceID string) (types.Instance, error) {
+	desc, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceID},
+	})
+	if err != nil {
+		return types.Instance{}, fmt.Errorf("describing instance: %w", err)
+	}
+	if len(desc.Reservations) == 0 || len(desc.Reservations[0].Instances) == 0 {
+		return types.Instance{}, fmt.Errorf("instance %s not found", instanceID)
+	}
+	return desc.Reservations[0].Instances[0], nil
+}
+
+// instancePublicIP returns the public IP of a running instance.
+func instancePublicIP(ctx context.Context, client *ec2.Client, instanceID string) (string, error) {
+	inst, err := describeInstance(ctx, client, instanceID)
+	if err != nil {
+		return "", err
+	}
+	if inst.PublicIpAddress == nil {
+		return "", fmt.Errorf("instance %s has no public IP (is it running?)", instanceID)
+	}
+	return *inst.PublicIpAddress, nil
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
 	"github.com/spf13/cobra"
 )
 
@@ -14,7 +15,11 @@ func newStartCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "start [instance-id...]",
 		Short: "Start stopped spot instances",
-		Args:  cobra.ArbitraryArgs,
+		Long: `Start stopped spot instances.
+
+Instances with a max price recorded by "devbox rebid" while they were running
+are replaced at the new price instead of being started as-is.`,
+		Args: cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) == 0 {
 				id, err := autoDetectInstance(cmd.Context(), ec2Client, "stopped")
@@ -23,7 +28,15 @@ func newStartCmd() *cobra.Command {
 				}
 				args = []string{id}
 			}
-			return startInstances(cmd.Context(), ec2Client, args)
+			r53client := route53.NewFromConfig(awsCfg)
+			rest, err := applyPendingRebids(cmd.Context(), dcfg, ec2Client, r53client, args)
+			if err != nil {
+				return err
+			}
+			if len(rest) == 0 {
+				return nil
+			}
+			return startInstances(cmd.Context(), ec2Client, rest)
 		},
 	}
 }
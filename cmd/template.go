@@ -0,0 +1,422 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/spf13/cobra"
+
+	"github.com/emaland/devbox/internal/awsutil"
+	"github.com/emaland/devbox/internal/config"
+)
+
+func newTemplateCmd() *cobra.Command {
+	tmpl := &cobra.Command{
+		Use:   "template",
+		Short: "Manage the launch template that defines a box (sync, diff)",
+		Long: `The launch template named by launch_template in the config is the
+canonical box definition: AMI, key pair, security group, IAM profile, root
+volume, user_data and tags. spawn, resize and rebid launch from it, adding
+the instance type, subnet, spot options and Name tag as overrides.
+
+Create or update it with "devbox template sync", or manage it in Terraform.`,
+	}
+
+	var from string
+	sync := &cobra.Command{
+		Use:   "sync",
+		Short: "Create or update the launch template from the config",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return templateSync(cmd.Context(), dcfg, ec2Client, from)
+		},
+	}
+	sync.Flags().StringVar(&from, "from", "", "Instance ID to take user_data from (default: keep the template's)")
+
+	var diffFrom string
+	diff := &cobra.Command{
+		Use:   "diff",
+		Short: "Show how the launch template differs from the config",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, err := templateDiff(cmd.Context(), dcfg, ec2Client, diffFrom)
+			return err
+		},
+	}
+	diff.Flags().StringVar(&diffFrom, "from", "", "Instance ID to take user_data from (default: keep the template's)")
+
+	tmpl.AddCommand(sync, diff)
+	return tmpl
+}
+
+// rootDevice is where NixOS AMIs put the root volume.
+const rootDevice = "/dev/xvda"
+
+// rootBlockDevices is the root volume every box launches with, from the
+// root_volume config.
+func rootBlockDevices(rv config.RootVolume) []types.BlockDeviceMapping {
+	ebs := &types.EbsBlockDevice{
+		VolumeSize: aws.Int32(rv.SizeGiB),
+		VolumeType: types.VolumeType(rv.Type),
+	}
+	if rv.IOPS > 0 {
+		ebs.Iops = aws.Int32(rv.IOPS)
+	}
+	if rv.Throughput > 0 {
+		ebs.Throughput = aws.Int32(rv.Throughput)
+	}
+	if rv.Encrypted || rv.KMSKeyID != "" {
+		ebs.Encrypted = aws.Bool(true)
+	}
+	if rv.KMSKeyID != "" {
+		ebs.KmsKeyId = aws.String(rv.KMSKeyID)
+	}
+	return []types.BlockDeviceMapping{{DeviceName: aws.String(rootDevice), Ebs: ebs}}
+}
+
+// boxDefinition is the launch definition of a box, built from the config.
+// The launch template is synced from it, and launches use it directly when
+// there is no template. Type, subnet and spot options are per launch.
+func boxDefinition(dcfg config.DevboxConfig, amiID, sgID, userData string) *ec2.RunInstancesInput {
+	return &ec2.RunInstancesInput{
+		ImageId:          aws.String(amiID),
+		KeyName:          aws.String(dcfg.SSHKeyName),
+		SecurityGroupIds: []string{sgID},
+		IamInstanceProfile: &types.IamInstanceProfileSpecification{
+			Name: aws.String(dcfg.IAMProfile),
+		},
+		UserData:            aws.String(userData),
+		BlockDeviceMappings: rootBlockDevices(dcfg.RootVolume),
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeInstance,
+				Tags:         []types.Tag{{Key: aws.String("devbox-managed"), Value: aws.String("true")}},
+			},
+		},
+	}
+}
+
+// findLaunchTemplate returns the named launch template, or nil if it
+// doesn't exist.
+func findLaunchTemplate(ctx context.Context, client *ec2.Client, name string) (*types.LaunchTemplate, error) {
+	if name == "" {
+		return nil, nil
+	}
+	out, err := client.DescribeLaunchTemplates(ctx, &ec2.DescribeLaunchTemplatesInput{
+		LaunchTemplateNames: []string{name},
+	})
+	if err != nil {
+		switch apiErrorCode(err) {
+		case "InvalidLaunchTemplateName.NotFoundException", "InvalidLaunchTemplateName.MalformedException":
+			return nil, nil
+		}
+		return nil, fmt.Errorf("describing launch template %s: %w", name, err)
+	}
+	if len(out.LaunchTemplates) == 0 {
+		return nil, nil
+	}
+	return &out.LaunchTemplates[0], nil
+}
+
+// templateSpec launches from the template's default version.
+func templateSpec(lt *types.LaunchTemplate) *types.LaunchTemplateSpecification {
+	return &types.LaunchTemplateSpecification{
+		LaunchTemplateId: lt.LaunchTemplateId,
+		Version:          aws.String("$Default"),
+	}
+}
+
+// defaultTemplateVersion returns the data of the template's default version.
+func defaultTemplateVersion(ctx context.Context, client *ec2.Client, lt *types.LaunchTemplate) (*types.ResponseLaunchTemplateData, error) {
+	out, err := client.DescribeLaunchTemplateVersions(ctx, &ec2.DescribeLaunchTemplateVersionsInput{
+		LaunchTemplateId: lt.LaunchTemplateId,
+		Versions:         []string{"$Default"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describing launch template versions: %w", err)
+	}
+	if len(out.LaunchTemplateVersions) == 0 || out.LaunchTemplateVersions[0].LaunchTemplateData == nil {
+		return nil, fmt.Errorf("launch template %s has no default version", aws.ToString(lt.LaunchTemplateName))
+	}
+	return out.LaunchTemplateVersions[0].LaunchTemplateData, nil
+}
+
+// desiredTemplateData builds what the template should contain. user_data
+// comes from the from instance if given, else the current template, else
+// the auto-detected source instance.
+func desiredTemplateData(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, from string, current *types.ResponseLaunchTemplateData) (*types.RequestLaunchTemplateData, error) {
+	// The template's AMI matches default_type; spawn overrides it for
+	// types of the other architecture.
+	arch, err := instanceTypeArch(ctx, client, dcfg.DefaultType)
+	if err != nil {
+		return nil, err
+	}
+	amiID, err := lookupAMI(ctx, dcfg, client, arch)
+	if err != nil {
+		return nil, err
+	}
+	sgID, err := lookupSecurityGroup(ctx, dcfg, client)
+	if err != nil {
+		return nil, err
+	}
+
+	var userData string
+	if from == "" && current != nil && current.UserData != nil {
+		userData = *current.UserData
+	} else {
+		if from == "" {
+			if from, err = autoDetectSourceInstance(ctx, client); err != nil {
+				return nil, err
+			}
+		}
+		if userData, err = awsutil.FetchUserData(ctx, client, from); err != nil {
+			return nil, err
+		}
+	}
+	// A TTL timer belongs to the box it was spawned as, not to every box.
+	return launchTemplateData(boxDefinition(dcfg, amiID, sgID, removeTTLTimer(userData))), nil
+}
+
+// templateState is the launch template as it is and as the config says it
+// should be.
+type templateState struct {
+	lt      *types.LaunchTemplate // nil if it doesn't exist yet
+	current *types.ResponseLaunchTemplateData
+	desired *types.RequestLaunchTemplateData
+	changes []string
+}
+
+func loadTemplateState(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, from string) (*templateState, error) {
+	if dcfg.LaunchTemplate == "" {
+		return nil, fmt.Errorf("launch_template is not set in the config")
+	}
+	var st templateState
+	var err error
+	if st.lt, err = findLaunchTemplate(ctx, client, dcfg.LaunchTemplate); err != nil {
+		return nil, err
+	}
+	if st.lt != nil {
+		if st.current, err = defaultTemplateVersion(ctx, client, st.lt); err != nil {
+			return nil, err
+		}
+	}
+	if st.desired, err = desiredTemplateData(ctx, dcfg, client, from, st.current); err != nil {
+		return nil, err
+	}
+	st.changes = diffTemplate(flattenTemplate(st.current), flattenTemplate(st.desired))
+	return &st, nil
+}
+
+// print shows the changes sync would make.
+func (st *templateState) print(name string) {
+	switch {
+	case st.lt == nil:
+		fmt.Printf("Launch template %s does not exist; sync would create it with:\n", name)
+	case len(st.changes) == 0:
+		fmt.Printf("Launch template %s (version %d) matches the config.\n", name, aws.ToInt64(st.lt.DefaultVersionNumber))
+		return
+	default:
+		fmt.Printf("Launch template %s (version %d) differs from the config:\n", name, aws.ToInt64(st.lt.DefaultVersionNumber))
+	}
+	for _, line := range st.changes {
+		fmt.Println("  " + line)
+	}
+}
+
+// flattenTemplate renders launch template data as sorted "path: value"
+// pairs so request and response shapes compare field by field. user_data
+// is summarized by size and hash.
+func flattenTemplate(data any) map[string]string {
+	flat := map[string]string{}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return flat
+	}
+	var tree any
+	if err := json.Unmarshal(raw, &tree); err != nil {
+		return flat
+	}
+	var walk func(prefix string, v any)
+	walk = func(prefix string, v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, child := range v {
+				key := k
+				if prefix != "" {
+					key = prefix + "." + k
+				}
+				walk(key, child)
+			}
+		case []any:
+			for i, child := range v {
+				walk(fmt.Sprintf("%s[%d]", prefix, i), child)
+			}
+		case nil:
+		case string:
+			if v == "" {
+				return
+			}
+			if prefix == "UserData" {
+				v = userDataSummary(v)
+			}
+			flat[prefix] = v
+		default:
+			flat[prefix] = fmt.Sprint(v)
+		}
+	}
+	walk("", tree)
+	return flat
+}
+
+func userDataSummary(b64 string) string {
+	decoded, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		decoded = []byte(b64)
+	}
+	sum := sha256.Sum256(decoded)
+	return fmt.Sprintf("%d bytes, sha256 %x", len(decoded), sum[:6])
+}
+
+// diffTemplate lists the changes from current to desired as "- path: old"
+// and "+ path: new" lines, sorted by path.
+func diffTemplate(current, desired map[string]string) []string {
+	keys := map[string]bool{}
+	for k := range current {
+		keys[k] = true
+	}
+	for k := range desired {
+		keys[k] = true
+	}
+	var sorted []string
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var lines []string
+	for _, k := range sorted {
+		old, hadOld := current[k]
+		want, hasNew := desired[k]
+		if hadOld && hasNew && old == want {
+			continue
+		}
+		if hadOld {
+			lines = append(lines, fmt.Sprintf("- %s: %s", k, old))
+		}
+		if hasNew {
+			lines = append(lines, fmt.Sprintf("+ %s: %s", k, want))
+		}
+	}
+	return lines
+}
+
+// templateDiff prints how the template differs from the config and
+// returns the changes.
+func templateDiff(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, from string) ([]string, error) {
+	st, err := loadTemplateState(ctx, dcfg, client, from)
+	if err != nil {
+		return nil, err
+	}
+	st.print(dcfg.LaunchTemplate)
+	return st.changes, nil
+}
+
+// templateSync creates the launch template, or adds a version and makes it
+// the default when the config has changed.
+func templateSync(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, from string) error {
+	st, err := loadTemplateState(ctx, dcfg, client, from)
+	if err != nil {
+		return err
+	}
+	st.print(dcfg.LaunchTemplate)
+	if st.lt != nil && len(st.changes) == 0 {
+		return nil
+	}
+
+	if st.lt == nil {
+		out, err := client.CreateLaunchTemplate(ctx, &ec2.CreateLaunchTemplateInput{
+			LaunchTemplateName: aws.String(dcfg.LaunchTemplate),
+			LaunchTemplateData: st.desired,
+			VersionDescription: aws.String("devbox template sync"),
+			TagSpecifications: []types.TagSpecification{
+				{
+					ResourceType: types.ResourceTypeLaunchTemplate,
+					Tags:         []types.Tag{{Key: aws.String("devbox-managed"), Value: aws.String("true")}},
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("creating launch template: %w", err)
+		}
+		fmt.Printf("Created launch template %s (%s).\n", dcfg.LaunchTemplate, aws.ToString(out.LaunchTemplate.LaunchTemplateId))
+		return nil
+	}
+
+	out, err := client.CreateLaunchTemplateVersion(ctx, &ec2.CreateLaunchTemplateVersionInput{
+		LaunchTemplateId:   st.lt.LaunchTemplateId,
+		LaunchTemplateData: st.desired,
+		VersionDescription: aws.String("devbox template sync"),
+	})
+	if err != nil {
+		return fmt.Errorf("creating launch template version: %w", err)
+	}
+	version := aws.ToInt64(out.LaunchTemplateVersion.VersionNumber)
+	if _, err := client.ModifyLaunchTemplate(ctx, &ec2.ModifyLaunchTemplateInput{
+		LaunchTemplateId: st.lt.LaunchTemplateId,
+		DefaultVersion:   aws.String(strconv.FormatInt(version, 10)),
+	}); err != nil {
+		return fmt.Errorf("setting default version %d: %w", version, err)
+	}
+	fmt.Printf("Launch template %s is now at version %d.\n", dcfg.LaunchTemplate, version)
+	return nil
+}
+
+// launchTemplateOrWarn finds the configured template for a launch path that
+// can fall back to the built-in definition. It also warns when the
+// template's root volume has drifted from root_volume, which launches from
+// the template don't see.
+func launchTemplateOrWarn(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client) *types.LaunchTemplate {
+	lt, err := findLaunchTemplate(ctx, client, dcfg.LaunchTemplate)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v; using the built-in box definition\n", err)
+		return nil
+	}
+	if lt == nil {
+		return nil
+	}
+	if data, err := defaultTemplateVersion(ctx, client, lt); err == nil && !templateRootMatches(dcfg.RootVolume, data) {
+		fmt.Fprintf(os.Stderr, "Warning: launch template %s's root volume differs from root_volume; run devbox template sync\n", dcfg.LaunchTemplate)
+	}
+	return lt
+}
+
+// templateRootMatches reports whether the template's root volume is the
+// one rv describes.
+func templateRootMatches(rv config.RootVolume, data *types.ResponseLaunchTemplateData) bool {
+	for _, bdm := range data.BlockDeviceMappings {
+		if aws.ToString(bdm.DeviceName) != rootDevice {
+			continue
+		}
+		ebs := bdm.Ebs
+		if ebs == nil {
+			return false
+		}
+		encrypted := rv.Encrypted || rv.KMSKeyID != ""
+		return aws.ToInt32(ebs.VolumeSize) == rv.SizeGiB &&
+			string(ebs.VolumeType) == rv.Type &&
+			(rv.IOPS == 0 || aws.ToInt32(ebs.Iops) == rv.IOPS) &&
+			(rv.Throughput == 0 || aws.ToInt32(ebs.Throughput) == rv.Throughput) &&
+			aws.ToBool(ebs.Encrypted) == encrypted &&
+			aws.ToString(ebs.KmsKeyId) == rv.KMSKeyID
+	}
+	return false
+}
@@ -0,0 +1,396 @@
+package cmd
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	r53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/spf13/cobra"
+
+	"github.com/emaland/devbox/internal/awsutil"
+	"github.com/emaland/devbox/internal/config"
+)
+
+// expiresTag holds the RFC 3339 time a box spawned with --ttl expires.
+const expiresTag = "devbox-expires"
+
+// ttlTimerStart and ttlTimerEnd delimit the block spawn --ttl adds to a
+// NixOS user_data, so a later spawn from the same source can replace it.
+const (
+	ttlTimerStart = "  # ── devbox TTL (added by devbox spawn --ttl) ──"
+	ttlTimerEnd   = "  # ── end devbox TTL ──"
+)
+
+// ttlTimerNix terminates the box at @@EXPIRES@@. Persistent timers also
+// fire on the first boot after the deadline if the box was stopped. A
+// persistent spot request is cancelled first; it would otherwise launch a
+// replacement, so the box stays up for reap if that fails. The A
+// records in hosted zone @@ZONE_ID@@ that point at the box go next, since
+// reap never sees a box once it has terminated.
+const ttlTimerNix = ttlTimerStart + `
+  systemd.timers.devbox-ttl = {
+    wantedBy    = [ "timers.target" ];
+    timerConfig = {
+      OnCalendar = "@@EXPIRES@@";
+      Persistent = true;
+    };
+  };
+
+  systemd.services.devbox-ttl = {
+    description = "Terminate this devbox when its TTL expires";
+    after       = [ "network-online.target" "update-route53.service" ];
+    wants       = [ "network-online.target" ];
+    serviceConfig = {
+      Type      = "oneshot";
+      ExecStart = toString (pkgs.writeShellScript "devbox-ttl" ''
+        echo "$(date '+%Y-%m-%d %H:%M:%S') | ttl | expired, terminating" \
+          >> /var/log/boot-history
+        TOKEN=$(${pkgs.curl}/bin/curl -sX PUT \
+          "http://169.254.169.254/latest/api/token" \
+          -H "X-aws-ec2-metadata-token-ttl-seconds: 60")
+        IID=$(${pkgs.curl}/bin/curl -s \
+          -H "X-aws-ec2-metadata-token: $TOKEN" \
+          http://169.254.169.254/latest/meta-data/instance-id)
+        AZ=$(${pkgs.curl}/bin/curl -s \
+          -H "X-aws-ec2-metadata-token: $TOKEN" \
+          http://169.254.169.254/latest/meta-data/placement/availability-zone)
+        REGION=''${AZ%?}
+        SIR=$(${pkgs.awscli2}/bin/aws ec2 describe-instances \
+          --region "$REGION" --instance-ids "$IID" \
+          --query 'Reservations[0].Instances[0].SpotInstanceRequestId' --output text)
+        if [ -n "$SIR" ] && [ "$SIR" != "None" ]; then
+          SIR_TYPE=$(${pkgs.awscli2}/bin/aws ec2 describe-spot-instance-requests \
+            --region "$REGION" --spot-instance-request-ids "$SIR" \
+            --query 'SpotInstanceRequests[0].Type' --output text)
+          if [ "$SIR_TYPE" != "one-time" ]; then
+            ${pkgs.awscli2}/bin/aws ec2 cancel-spot-instance-requests \
+              --region "$REGION" --spot-instance-request-ids "$SIR" || exit 1
+          fi
+        fi
+        IP=$(${pkgs.curl}/bin/curl -s \
+          -H "X-aws-ec2-metadata-token: $TOKEN" \
+          http://169.254.169.254/latest/meta-data/public-ipv4)
+        ZONE_ID="@@ZONE_ID@@"
+        if [ -n "$ZONE_ID" ] && [ -n "$IP" ]; then
+          CHANGES=$(${pkgs.awscli2}/bin/aws route53 list-resource-record-sets \
+            --hosted-zone-id "$ZONE_ID" --output json \
+            | ${pkgs.jq}/bin/jq -c --arg ip "$IP" \
+              '[.ResourceRecordSets[]
+                | select(.Type == "A" and (.ResourceRecords | length) == 1
+                         and .ResourceRecords[0].Value == $ip)
+                | {Action: "DELETE", ResourceRecordSet: .}]')
+          if [ -n "$CHANGES" ] && [ "$CHANGES" != "[]" ]; then
+            ${pkgs.awscli2}/bin/aws route53 change-resource-record-sets \
+              --hosted-zone-id "$ZONE_ID" \
+              --change-batch "{\"Changes\": $CHANGES}"
+          fi
+        fi
+        ${pkgs.awscli2}/bin/aws ec2 terminate-instances \
+          --region "$REGION" --instance-ids "$IID"
+      '');
+    };
+  };
+` + ttlTimerEnd + "\n"
+
+// addTTLTimer adds a timer that terminates the box at expires to a base64
+// NixOS user_data, replacing one added by an earlier spawn. The timer
+// removes the box's A records from hosted zone zoneID, if set. It reports
+// false and leaves the user_data alone if it isn't a NixOS config.
+func addTTLTimer(b64data string, expires time.Time, zoneID string) (string, bool) {
+	decoded, err := base64.StdEncoding.DecodeString(b64data)
+	if err != nil {
+		return b64data, false
+	}
+	content := stripTTLTimer(string(decoded))
+	if !strings.Contains(content, "config, pkgs") {
+		return b64data, false
+	}
+
+	closing := strings.LastIndex(content, "}")
+	if closing == -1 {
+		return b64data, false
+	}
+	block := strings.NewReplacer(
+		"@@EXPIRES@@", expires.UTC().Format("2006-01-02 15:04:05")+" UTC",
+		"@@ZONE_ID@@", zoneID,
+	).Replace(ttlTimerNix)
+	content = content[:closing] + "\n" + block + content[closing:]
+	return base64.StdEncoding.EncodeToString([]byte(content)), true
+}
+
+// removeTTLTimer drops the block spawn --ttl added from a base64 user_data,
+// so a box or launch template cloned from a TTL box doesn't inherit its
+// deadline. User data without the block is returned unchanged.
+func removeTTLTimer(b64data string) string {
+	decoded, err := base64.StdEncoding.DecodeString(b64data)
+	if err != nil {
+		return b64data
+	}
+	content := string(decoded)
+	stripped := stripTTLTimer(content)
+	if stripped == content {
+		return b64data
+	}
+	return base64.StdEncoding.EncodeToString([]byte(stripped))
+}
+
+// stripTTLTimer removes the TTL block and the blank line addTTLTimer put
+// before it.
+func stripTTLTimer(content string) string {
+	start := strings.Index(content, ttlTimerStart)
+	if start == -1 {
+		return content
+	}
+	end := strings.Index(content[start:], ttlTimerEnd)
+	if end == -1 {
+		return content
+	}
+	end += start + len(ttlTimerEnd)
+	if end < len(content) && content[end] == '\n' {
+		end++
+	}
+	if start > 0 && content[start-1] == '\n' {
+		start--
+	}
+	return content[:start] + content[end:]
+}
+
+// instanceExpiry returns when a box expires, if it has a TTL.
+func instanceExpiry(tags []types.Tag) (time.Time, bool) {
+	v := awsutil.TagValue(tags, expiresTag)
+	if v == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// ttlRemaining formats the time a box has left for list: "-" without a
+// TTL, "expired" once it has passed.
+func ttlRemaining(tags []types.Tag, now time.Time) string {
+	expires, ok := instanceExpiry(tags)
+	if !ok {
+		return "-"
+	}
+	left := expires.Sub(now)
+	if left <= 0 {
+		return "expired"
+	}
+	if left < time.Minute {
+		return "<1m"
+	}
+	left = left.Truncate(time.Minute)
+	if left >= 24*time.Hour {
+		days := left / (24 * time.Hour)
+		return fmt.Sprintf("%dd%dh", days, (left-days*24*time.Hour)/time.Hour)
+	}
+	return strings.TrimSuffix(left.String(), "0s")
+}
+
+func newReapCmd() *cobra.Command {
+	var dryRun bool
+
+	cmd := &cobra.Command{
+		Use:   "reap",
+		Short: "Terminate devbox-managed instances whose TTL has expired",
+		Long: `Terminate devbox-managed instances whose --ttl has run out, cancelling
+their spot requests. Devbox-managed volumes attached to them are deleted
+and A records in the configured zone that point at them are removed.
+
+Boxes normally remove their DNS records and terminate themselves at expiry;
+reap catches the ones that couldn't, e.g. because their user_data isn't a
+NixOS config.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			r53client := route53.NewFromConfig(awsCfg)
+			return reap(cmd.Context(), dcfg, ec2Client, r53client, time.Now(), dryRun)
+		},
+	}
+
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only list what would be reaped")
+
+	return cmd
+}
+
+// reapTarget is an expired box and what goes with it.
+type reapTarget struct {
+	Instance types.Instance
+	Expires  time.Time
+	// Volumes are the devbox-managed non-root volumes attached to it.
+	Volumes []string
+}
+
+func reap(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, r53client *route53.Client, now time.Time, dryRun bool) error {
+	desc, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("tag:devbox-managed"), Values: []string{"true"}},
+			{Name: aws.String("tag-key"), Values: []string{expiresTag}},
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("describing instances: %w", err)
+	}
+
+	var targets []reapTarget
+	for _, res := range desc.Reservations {
+		for _, inst := range res.Instances {
+			expires, ok := instanceExpiry(inst.Tags)
+			if !ok || expires.After(now) {
+				continue
+			}
+			vols, err := managedDataVolumes(ctx, client, inst)
+			if err != nil {
+				return err
+			}
+			targets = append(targets, reapTarget{Instance: inst, Expires: expires, Volumes: vols})
+		}
+	}
+	if len(targets) == 0 {
+		fmt.Println("No expired boxes.")
+		return nil
+	}
+
+	for _, t := range targets {
+		fmt.Printf("%s (%s): expired %s ago", aws.ToString(t.Instance.InstanceId), awsutil.NameTag(t.Instance.Tags), now.Sub(t.Expires).Truncate(time.Minute))
+		if len(t.Volumes) > 0 {
+			fmt.Printf(", volumes %s", strings.Join(t.Volumes, ", "))
+		}
+		fmt.Println()
+	}
+	if dryRun {
+		return nil
+	}
+
+	// DNS first, while the instances still have their public IPs.
+	ips := map[string]bool{}
+	for _, t := range targets {
+		if ip := aws.ToString(t.Instance.PublicIpAddress); ip != "" {
+			ips[ip] = true
+		}
+	}
+	if len(ips) > 0 {
+		if err := deleteARecordsFor(ctx, dcfg, r53client, ips); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: DNS cleanup failed: %v\n", err)
+		}
+	}
+
+	var ids []string
+	for _, t := range targets {
+		if sir := t.Instance.SpotInstanceRequestId; sir != nil {
+			if _, err := client.CancelSpotInstanceRequests(ctx, &ec2.CancelSpotInstanceRequestsInput{
+				SpotInstanceRequestIds: []string{*sir},
+			}); err != nil {
+				return fmt.Errorf("canceling spot request %s: %w", *sir, err)
+			}
+		}
+		ids = append(ids, aws.ToString(t.Instance.InstanceId))
+	}
+	if err := terminateInstances(ctx, client, ids); err != nil {
+		return err
+	}
+
+	var volumes []string
+	for _, t := range targets {
+		volumes = append(volumes, t.Volumes...)
+	}
+	if len(volumes) == 0 {
+		return nil
+	}
+	fmt.Println("Waiting for the instances to terminate before deleting their volumes...")
+	waiter := ec2.NewInstanceTerminatedWaiter(client)
+	if err := waiter.Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: ids}, 5*time.Minute); err != nil {
+		return fmt.Errorf("waiting for instances to terminate: %w", err)
+	}
+	for _, volID := range volumes {
+		_, err := client.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: aws.String(volID)})
+		switch {
+		case err == nil:
+			fmt.Printf("Deleted volume %s\n", volID)
+		case apiErrorCode(err) == "InvalidVolume.NotFound":
+			// Deleted with the instance.
+		default:
+			fmt.Fprintf(os.Stderr, "Warning: failed to delete volume %s: %v\n", volID, err)
+		}
+	}
+	return nil
+}
+
+// managedDataVolumes returns the non-root volumes of inst that devbox
+// created, i.e. that are tagged devbox-managed.
+func managedDataVolumes(ctx context.Context, client *ec2.Client, inst types.Instance) ([]string, error) {
+	var ids []string
+	for _, bdm := range inst.BlockDeviceMappings {
+		if bdm.Ebs == nil || aws.ToString(bdm.DeviceName) == aws.ToString(inst.RootDeviceName) {
+			continue
+		}
+		ids = append(ids, aws.ToString(bdm.Ebs.VolumeId))
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	desc, err := client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: ids})
+	if err != nil {
+		return nil, fmt.Errorf("describing volumes of %s: %w", aws.ToString(inst.InstanceId), err)
+	}
+	var managed []string
+	for _, v := range desc.Volumes {
+		if awsutil.TagValue(v.Tags, "devbox-managed") == "true" {
+			managed = append(managed, aws.ToString(v.VolumeId))
+		}
+	}
+	return managed, nil
+}
+
+// deleteARecordsFor removes the A records in the configured zone whose
+// only value is one of ips.
+func deleteARecordsFor(ctx context.Context, dcfg config.DevboxConfig, r53client *route53.Client, ips map[string]bool) error {
+	zoneID, err := awsutil.FindHostedZone(ctx, r53client, dcfg.DNSZone)
+	if err != nil {
+		return err
+	}
+	var changes []r53types.Change
+	paginator := route53.NewListResourceRecordSetsPaginator(r53client, &route53.ListResourceRecordSetsInput{
+		HostedZoneId: aws.String(zoneID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing DNS records: %w", err)
+		}
+		for _, rrs := range page.ResourceRecordSets {
+			if rrs.Type != r53types.RRTypeA || len(rrs.ResourceRecords) != 1 {
+				continue
+			}
+			if ips[aws.ToString(rrs.ResourceRecords[0].Value)] {
+				changes = append(changes, r53types.Change{Action: r53types.ChangeActionDelete, ResourceRecordSet: &rrs})
+				fmt.Printf("Deleting DNS record %s -> %s\n", aws.ToString(rrs.Name), aws.ToString(rrs.ResourceRecords[0].Value))
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	_, err = r53client.ChangeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(zoneID),
+		ChangeBatch: &r53types.ChangeBatch{
+			Comment: aws.String("devbox reap: remove records of expired boxes"),
+			Changes: changes,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("deleting DNS records: %w", err)
+	}
+	return nil
+}
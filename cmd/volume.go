@@ -9,9 +9,9 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/spf13/cobra"
 
 	"github.com/emaland/devbox/internal/awsutil"
@@ -21,7 +21,7 @@ import (
 func newVolumeCmd() *cobra.Command {
 	vol := &cobra.Command{
 		Use:   "volume",
-		Short: "Manage EBS volumes (ls, create, attach, detach, snapshot, snapshots, destroy, move)",
+		Short: "Manage EBS volumes (ls, create, attach, detach, snapshot, snapshots, destroy, move, modify, encrypt, restore, browse, backup-policy, backup)",
 	}
 
 	vol.AddCommand(
@@ -33,6 +33,12 @@ func newVolumeCmd() *cobra.Command {
 		newVolumeSnapshotsCmd(),
 		newVolumeDestroyCmd(),
 		newVolumeMoveCmd(),
+		newVolumeModifyCmd(),
+		newVolumeEncryptCmd(),
+		newVolumeRestoreCmd(),
+		newVolumeBrowseCmd(),
+		newVolumeBackupPolicyCmd(),
+		newVolumeBackupCmd(),
 	)
 
 	return vol
@@ -58,7 +64,7 @@ func volumeLS(ctx context.Context, client *ec2.Client) error {
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
-	fmt.Fprintln(w, "VOLUME ID\tNAME\tSIZE\tTYPE\tIOPS\tSTATE\tAZ\tATTACHED TO")
+	fmt.Fprintln(w, "VOLUME ID\tNAME\tSIZE\tTYPE\tIOPS\tENCRYPTED\tSTATE\tAZ\tATTACHED TO")
 	for _, v := range result.Volumes {
 		name := awsutil.NameTag(v.Tags)
 		attached := "-"
@@ -69,12 +75,13 @@ func volumeLS(ctx context.Context, client *ec2.Client) error {
 		if v.Iops != nil {
 			iops = fmt.Sprintf("%d", *v.Iops)
 		}
-		fmt.Fprintf(w, "%s\t%s\t%d GiB\t%s\t%s\t%s\t%s\t%s\n",
+		fmt.Fprintf(w, "%s\t%s\t%d GiB\t%s\t%s\t%s\t%s\t%s\t%s\n",
 			*v.VolumeId,
 			name,
 			*v.Size,
 			string(v.VolumeType),
 			iops,
+			encryptionLabel(v),
 			string(v.State),
 			*v.AvailabilityZone,
 			attached,
@@ -94,6 +101,7 @@ func newVolumeCreateCmd() *cobra.Command {
 		throughput int
 		az         string
 		name       string
+		enc        volumeEncryption
 	)
 
 	cmd := &cobra.Command{
@@ -103,7 +111,7 @@ func newVolumeCreateCmd() *cobra.Command {
 			if az == "" {
 				az = dcfg.DefaultAZ
 			}
-			return volumeCreate(cmd.Context(), dcfg, ec2Client, size, volType, iops, throughput, az, name)
+			return volumeCreate(cmd.Context(), dcfg, ec2Client, size, volType, iops, throughput, az, name, enc)
 		},
 	}
 
@@ -113,11 +121,49 @@ func newVolumeCreateCmd() *cobra.Command {
 	cmd.Flags().IntVar(&throughput, "throughput", 250, "Throughput MB/s")
 	cmd.Flags().StringVar(&az, "az", "", "Availability zone (default from config)")
 	cmd.Flags().StringVar(&name, "name", "dev-data-volume", "Name tag")
+	cmd.Flags().BoolVar(&enc.Encrypt, "encrypt", false, "Encrypt the volume (with the account's default EBS key unless --kms-key is given)")
+	cmd.Flags().StringVar(&enc.KMSKey, "kms-key", "", "KMS key ID, ARN or alias to encrypt with; implies --encrypt")
 
 	return cmd
 }
 
-func volumeCreate(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, size int, volType string, iops, throughput int, az, name string) error {
+// volumeEncryption is how a new volume or snapshot copy is encrypted.
+type volumeEncryption struct {
+	Encrypt bool
+	// KMSKey is a key ID, ARN or alias; it implies Encrypt. Empty means
+	// the account's default EBS key.
+	KMSKey string
+}
+
+func (e volumeEncryption) enabled() bool {
+	return e.Encrypt || e.KMSKey != ""
+}
+
+// kmsKeyID returns the key for an API call, nil for the default key.
+func (e volumeEncryption) kmsKeyID() *string {
+	if e.KMSKey == "" {
+		return nil
+	}
+	return aws.String(e.KMSKey)
+}
+
+// encryptionLabel shows how a volume is encrypted: "no", "default" for the
+// account's aws/ebs key, or the customer managed key's ID.
+func encryptionLabel(v types.Volume) string {
+	if !aws.ToBool(v.Encrypted) {
+		return "no"
+	}
+	key := aws.ToString(v.KmsKeyId)
+	if key == "" {
+		return "default"
+	}
+	if i := strings.LastIndex(key, "/"); i != -1 {
+		key = key[i+1:]
+	}
+	return key
+}
+
+func volumeCreate(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, size int, volType string, iops, throughput int, az, name string, enc volumeEncryption) error {
 	input := &ec2.CreateVolumeInput{
 		AvailabilityZone: aws.String(az),
 		Size:             aws.Int32(int32(size)),
@@ -137,6 +183,10 @@ func volumeCreate(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Cli
 	if volType == "gp3" {
 		input.Throughput = aws.Int32(int32(throughput))
 	}
+	if enc.enabled() {
+		input.Encrypted = aws.Bool(true)
+		input.KmsKeyId = enc.kmsKeyID()
+	}
 
 	result, err := client.CreateVolume(ctx, input)
 	if err != nil {
@@ -149,6 +199,9 @@ func volumeCreate(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Cli
 		return err
 	}
 	fmt.Printf("Volume %s is available.\n", volID)
+	if enc.enabled() {
+		return verifyEncrypted(ctx, client, volID)
+	}
 	return nil
 }
 
@@ -287,13 +340,25 @@ func volumeSnapshot(ctx context.Context, client *ec2.Client, volumeRef, name str
 // --- snapshots ---
 
 func newVolumeSnapshotsCmd() *cobra.Command {
-	return &cobra.Command{
+	var instanceID string
+
+	cmd := &cobra.Command{
 		Use:   "snapshots",
 		Short: "List snapshots",
+		Long: `List the account's snapshots. With --instance, list only the snapshots
+of that box's data volume, including those taken before earlier restores,
+and, when run interactively, offer to restore one.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if instanceID != "" {
+				return instanceSnapshots(cmd.Context(), ec2Client, instanceID)
+			}
 			return volumeSnapshots(cmd.Context(), ec2Client)
 		},
 	}
+
+	cmd.Flags().StringVar(&instanceID, "instance", "", "Only snapshots of this instance's data volume, with a restore picker")
+
+	return cmd
 }
 
 func volumeSnapshots(ctx context.Context, client *ec2.Client) error {
@@ -308,10 +373,50 @@ func volumeSnapshots(ctx context.Context, client *ec2.Client) error {
 		fmt.Println("No snapshots found.")
 		return nil
 	}
+	printSnapshots(result.Snapshots, false)
+	return nil
+}
+
+// instanceSnapshots lists the snapshots of an instance's data volume and,
+// on a terminal, offers to restore one.
+func instanceSnapshots(ctx context.Context, client *ec2.Client, instanceID string) error {
+	inst, err := describeInstance(ctx, client, instanceID)
+	if err != nil {
+		return err
+	}
+	vol, device, err := restoreTarget(ctx, client, inst, "")
+	if err != nil {
+		return err
+	}
+	snaps, err := volumeSnapshotsOf(ctx, client, volumeLineage(vol))
+	if err != nil {
+		return err
+	}
+	if len(snaps) == 0 {
+		fmt.Printf("No snapshots of %s.\n", aws.ToString(vol.VolumeId))
+		return nil
+	}
+	if !stdinIsTerminal() {
+		printSnapshots(snaps, false)
+		return nil
+	}
+	snapID, err := pickSnapshot(snaps)
+	if err != nil || snapID == "" {
+		return err
+	}
+	return volumeRestore(ctx, client, instanceID, restoreOptions{Snapshot: snapID, Device: device})
+}
 
+// printSnapshots prints a snapshot table, with a # column to pick from
+// when numbered.
+func printSnapshots(snaps []types.Snapshot, numbered bool) {
 	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
-	fmt.Fprintln(w, "SNAPSHOT ID\tVOLUME ID\tSIZE\tSTATE\tPROGRESS\tDESCRIPTION\tCREATED")
-	for _, s := range result.Snapshots {
+	header := "SNAPSHOT ID\tVOLUME ID\tSIZE\tSTATE\tPROGRESS\tBACKUP\tDESCRIPTION\tCREATED"
+	if numbered {
+		header = "#\t" + header
+	}
+	fmt.Fprintln(w, header)
+	for i, s := range snaps {
 		desc := "-"
 		if s.Description != nil && *s.Description != "" {
 			desc = *s.Description
@@ -324,18 +429,25 @@ func volumeSnapshots(ctx context.Context, client *ec2.Client) error {
 		if s.Progress != nil {
 			progress = *s.Progress
 		}
-		fmt.Fprintf(w, "%s\t%s\t%d GiB\t%s\t%s\t%s\t%s\n",
-			*s.SnapshotId,
-			*s.VolumeId,
-			*s.VolumeSize,
+		backup := awsutil.TagValue(s.Tags, backupScheduleTag)
+		if backup == "" {
+			backup = "-"
+		}
+		if numbered {
+			fmt.Fprintf(w, "%d\t", i+1)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d GiB\t%s\t%s\t%s\t%s\t%s\n",
+			aws.ToString(s.SnapshotId),
+			aws.ToString(s.VolumeId),
+			aws.ToInt32(s.VolumeSize),
 			string(s.State),
 			progress,
+			backup,
 			desc,
 			created,
 		)
 	}
 	w.Flush()
-	return nil
 }
 
 // --- destroy ---
@@ -373,6 +485,7 @@ func newVolumeMoveCmd() *cobra.Command {
 	var (
 		targetAZ string
 		cleanup  bool
+		kmsKey   string
 	)
 
 	cmd := &cobra.Command{
@@ -380,17 +493,22 @@ func newVolumeMoveCmd() *cobra.Command {
 		Short: "Move a volume to another region",
 		Args:  cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return volumeMove(cmd.Context(), ec2Client, awsCfg, args[0], args[1], targetAZ, cleanup)
+			return volumeMove(cmd.Context(), ec2Client, awsCfg, args[0], args[1], targetAZ, cleanup, kmsKey)
 		},
 	}
 
 	cmd.Flags().StringVar(&targetAZ, "az", "", "Target AZ (default: <region>a)")
 	cmd.Flags().BoolVar(&cleanup, "cleanup", false, "Delete intermediate snapshots after move")
+	cmd.Flags().StringVar(&kmsKey, "kms-key", "", "KMS key in the target region to encrypt the moved volume with")
 
 	return cmd
 }
 
-func volumeMove(ctx context.Context, client *ec2.Client, cfg aws.Config, volumeRef, targetRegion, targetAZ string, cleanup bool) error {
+// volumeMove copies a volume to another region. An encrypted volume stays
+// encrypted. KMS keys are regional, so the copy uses kmsKey, a key in the
+// target region, or else that region's default EBS key; kmsKey also
+// encrypts a volume that wasn't.
+func volumeMove(ctx context.Context, client *ec2.Client, cfg aws.Config, volumeRef, targetRegion, targetAZ string, cleanup bool, kmsKey string) error {
 	volID, err := resolveVolume(ctx, client, volumeRef)
 	if err != nil {
 		return err
@@ -412,6 +530,10 @@ func volumeMove(ctx context.Context, client *ec2.Client, cfg aws.Config, volumeR
 	}
 	srcVol := descVol.Volumes[0]
 	sourceRegion := cfg.Region
+	enc := volumeEncryption{Encrypt: aws.ToBool(srcVol.Encrypted), KMSKey: kmsKey}
+	if aws.ToBool(srcVol.Encrypted) && kmsKey == "" && srcVol.KmsKeyId != nil {
+		fmt.Printf("%s is encrypted with %s; the copy uses %s's default EBS key (pass --kms-key to choose one).\n", volID, encryptionLabel(srcVol), targetRegion)
+	}
 
 	// Step 1: Create snapshot in source region
 	fmt.Printf("Creating snapshot of %s in %s...\n", volID, sourceRegion)
@@ -432,23 +554,23 @@ func volumeMove(ctx context.Context, client *ec2.Client, cfg aws.Config, volumeR
 	fmt.Println("Source snapshot completed.")
 
 	// Step 2: Create client for target region
-	loadOpts := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(targetRegion)}
-	if BaseEndpointOverride != "" {
-		loadOpts = append(loadOpts, awsconfig.WithBaseEndpoint(BaseEndpointOverride))
-	}
-	targetCfg, err := awsconfig.LoadDefaultConfig(ctx, loadOpts...)
+	targetClient, err := regionClient(ctx, targetRegion)
 	if err != nil {
-		return fmt.Errorf("loading config for region %s: %w", targetRegion, err)
+		return err
 	}
-	targetClient := ec2.NewFromConfig(targetCfg)
 
 	// Step 3: Copy snapshot to target region
 	fmt.Printf("Copying snapshot to %s...\n", targetRegion)
-	copyResult, err := targetClient.CopySnapshot(ctx, &ec2.CopySnapshotInput{
+	copyInput := &ec2.CopySnapshotInput{
 		SourceRegion:     aws.String(sourceRegion),
 		SourceSnapshotId: aws.String(srcSnapID),
 		Description:      aws.String(fmt.Sprintf("devbox move: %s from %s", volID, sourceRegion)),
-	})
+	}
+	if enc.enabled() {
+		copyInput.Encrypted = aws.Bool(true)
+		copyInput.KmsKeyId = enc.kmsKeyID()
+	}
+	copyResult, err := targetClient.CopySnapshot(ctx, copyInput)
 	if err != nil {
 		return fmt.Errorf("copying snapshot to %s: %w", targetRegion, err)
 	}
@@ -468,12 +590,7 @@ func volumeMove(ctx context.Context, client *ec2.Client, cfg aws.Config, volumeR
 		Size:             srcVol.Size,
 		VolumeType:       srcVol.VolumeType,
 	}
-	if srcVol.Iops != nil {
-		createInput.Iops = srcVol.Iops
-	}
-	if srcVol.Throughput != nil {
-		createInput.Throughput = srcVol.Throughput
-	}
+	setPerformance(createInput, awsutil.CurrentSpec(srcVol))
 	// Copy tags from source volume
 	if len(srcVol.Tags) > 0 {
 		createInput.TagSpecifications = []types.TagSpecification{
@@ -495,6 +612,12 @@ func volumeMove(ctx context.Context, client *ec2.Client, cfg aws.Config, volumeR
 		return fmt.Errorf("waiting for new volume: %w", err)
 	}
 
+	if enc.enabled() {
+		if err := verifyEncrypted(ctx, targetClient, newVolID); err != nil {
+			return err
+		}
+	}
+
 	fmt.Printf("\nVolume moved successfully!\n")
 	fmt.Printf("  New volume: %s in %s\n", newVolID, targetAZ)
 
@@ -520,8 +643,466 @@ func volumeMove(ctx context.Context, client *ec2.Client, cfg aws.Config, volumeR
 	return nil
 }
 
+// --- modify ---
+
+type volumeModifyOptions struct {
+	Size       string // new GiB, or +N; "" keeps the size
+	Type       string
+	IOPS       int32
+	Throughput int32
+}
+
+func newVolumeModifyCmd() *cobra.Command {
+	var opts volumeModifyOptions
+
+	cmd := &cobra.Command{
+		Use:   "modify <volume>",
+		Short: "Resize, retype or retune a volume in place",
+		Long: `Change a volume's size, type, IOPS or throughput with ModifyVolume while
+it stays attached, and wait until the change is in effect. If the volume
+grew and is attached to a running instance, its filesystem is grown over
+SSH too.
+
+Unset flags keep the current value. When the type changes, unset IOPS and
+throughput fall back to the new type's defaults. EBS volumes can't shrink,
+and can be modified at most once every six hours.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return volumeModify(cmd.Context(), dcfg, ec2Client, args[0], opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.Size, "size", "", "New size in GiB, or +N to add N GiB")
+	cmd.Flags().StringVar(&opts.Type, "type", "", "New volume type (gp3, gp2, io1, io2, st1, sc1)")
+	cmd.Flags().Int32Var(&opts.IOPS, "iops", 0, "Provisioned IOPS")
+	cmd.Flags().Int32Var(&opts.Throughput, "throughput", 0, "Provisioned throughput in MiB/s")
+
+	return cmd
+}
+
+// modifiedSpec returns the volume as it will be after opts, so the
+// combination can be validated before calling ModifyVolume.
+func modifiedSpec(vol types.Volume, opts volumeModifyOptions) (awsutil.VolumeSpec, error) {
+	if opts.Size == "" && opts.Type == "" && opts.IOPS == 0 && opts.Throughput == 0 {
+		return awsutil.VolumeSpec{}, fmt.Errorf("nothing to modify: give --size, --type, --iops or --throughput")
+	}
+	spec := awsutil.VolumeSpec{
+		Type:    string(vol.VolumeType),
+		SizeGiB: aws.ToInt32(vol.Size),
+	}
+	if opts.Size != "" {
+		size, err := parseGrowSize(opts.Size, spec.SizeGiB)
+		if err != nil {
+			return awsutil.VolumeSpec{}, err
+		}
+		spec.SizeGiB = size
+	}
+	if opts.Type != "" && opts.Type != spec.Type {
+		// A new type starts from its own defaults.
+		spec.Type = opts.Type
+	} else if spec.Type != "gp2" && spec.Type != "st1" && spec.Type != "sc1" && spec.Type != "standard" {
+		// The same type keeps its provisioned performance; gp2 and HDD
+		// volumes report IOPS they don't take as a setting.
+		spec.IOPS = aws.ToInt32(vol.Iops)
+		spec.Throughput = aws.ToInt32(vol.Throughput)
+	}
+	if opts.IOPS != 0 {
+		spec.IOPS = opts.IOPS
+	}
+	if opts.Throughput != 0 {
+		spec.Throughput = opts.Throughput
+	}
+	if err := spec.Validate(); err != nil {
+		return awsutil.VolumeSpec{}, err
+	}
+	return spec, nil
+}
+
+func volumeModify(ctx context.Context, dcfg config.DevboxConfig, client *ec2.Client, volumeRef string, opts volumeModifyOptions) error {
+	volID, err := resolveVolume(ctx, client, volumeRef)
+	if err != nil {
+		return err
+	}
+	vol, err := describeVolume(ctx, client, volID)
+	if err != nil {
+		return err
+	}
+	spec, err := modifiedSpec(vol, opts)
+	if err != nil {
+		return err
+	}
+
+	// 1. Modify the volume, sending only what changes.
+	input := &ec2.ModifyVolumeInput{VolumeId: aws.String(volID)}
+	var changes []string
+	if spec.SizeGiB != aws.ToInt32(vol.Size) {
+		input.Size = aws.Int32(spec.SizeGiB)
+		changes = append(changes, fmt.Sprintf("size %d -> %d GiB", aws.ToInt32(vol.Size), spec.SizeGiB))
+	}
+	if spec.Type != string(vol.VolumeType) {
+		input.VolumeType = types.VolumeType(spec.Type)
+		changes = append(changes, fmt.Sprintf("type %s -> %s", vol.VolumeType, spec.Type))
+	}
+	if opts.IOPS != 0 && opts.IOPS != aws.ToInt32(vol.Iops) {
+		input.Iops = aws.Int32(opts.IOPS)
+		changes = append(changes, fmt.Sprintf("IOPS %d -> %d", aws.ToInt32(vol.Iops), opts.IOPS))
+	}
+	if opts.Throughput != 0 && opts.Throughput != aws.ToInt32(vol.Throughput) {
+		input.Throughput = aws.Int32(opts.Throughput)
+		changes = append(changes, fmt.Sprintf("throughput %d -> %d MiB/s", aws.ToInt32(vol.Throughput), opts.Throughput))
+	}
+	if len(changes) == 0 {
+		fmt.Printf("%s already matches; nothing to modify.\n", volID)
+		return nil
+	}
+	fmt.Printf("Modifying %s: %s...\n", volID, strings.Join(changes, ", "))
+	if _, err := client.ModifyVolume(ctx, input); err != nil {
+		return fmt.Errorf("modifying volume %s: %w", volID, err)
+	}
+
+	// 2. The changes are in effect once the modification is optimizing.
+	if err := waitVolumeModification(ctx, client, volID, 30*time.Minute); err != nil {
+		return err
+	}
+
+	// 3. Grow the filesystem if the volume grew under a running instance.
+	if input.Size == nil {
+		return nil
+	}
+	if len(vol.Attachments) == 0 {
+		fmt.Println("The volume isn't attached; grow its filesystem (resize2fs or xfs_growfs) once it is.")
+		return nil
+	}
+	att := vol.Attachments[0]
+	inst, err := describeInstance(ctx, client, aws.ToString(att.InstanceId))
+	if err != nil {
+		return err
+	}
+	if inst.State.Name != types.InstanceStateNameRunning || inst.PublicIpAddress == nil {
+		fmt.Printf("%s isn't running; grow the filesystem (resize2fs or xfs_growfs) once it is.\n", aws.ToString(att.InstanceId))
+		return nil
+	}
+	return growFilesystem(ctx, dcfg, *inst.PublicIpAddress, volID, aws.ToString(att.Device))
+}
+
+// --- encrypt ---
+
+func newVolumeEncryptCmd() *cobra.Command {
+	var (
+		kmsKey      string
+		deleteOld   bool
+		autoApprove bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "encrypt <volume>",
+		Short: "Replace a volume with an encrypted copy",
+		Long: `Replace a volume with an encrypted copy: snapshot it, copy the
+snapshot with encryption, create a volume from the copy with the same size,
+type, performance and tags, and swap it in where the original was attached.
+A running instance is stopped for the snapshot and started again afterwards.
+
+The original is kept, renamed <name>-unencrypted, unless --delete-old is
+given. With --kms-key an encrypted volume is re-encrypted under that key.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return volumeEncrypt(cmd.Context(), ec2Client, kms.NewFromConfig(awsCfg), args[0], kmsKey, deleteOld, autoApprove)
+		},
+	}
+
+	cmd.Flags().StringVar(&kmsKey, "kms-key", "", "KMS key ID, ARN or alias (default: the account's default EBS key)")
+	cmd.Flags().BoolVar(&deleteOld, "delete-old", false, "Delete the original volume once the copy is verified")
+	cmd.Flags().BoolVar(&autoApprove, "auto-approve", false, "Stop an attached running instance without asking")
+
+	return cmd
+}
+
+// sameKMSKey reports whether keyARN, a volume's key, is the key ref names.
+// ref may be a key ID, key ARN, alias name or alias ARN, so it is resolved
+// with DescribeKey; if that fails, a key ID or ARN still matches by suffix.
+func sameKMSKey(ctx context.Context, kmsClient *kms.Client, keyARN, ref string) bool {
+	out, err := kmsClient.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: aws.String(ref)})
+	if err == nil && out.KeyMetadata != nil {
+		return aws.ToString(out.KeyMetadata.Arn) == keyARN
+	}
+	fmt.Fprintf(os.Stderr, "Warning: could not look up KMS key %s: %v\n", ref, err)
+	return strings.HasSuffix(keyARN, ref)
+}
+
+// setPerformance sets the IOPS and throughput of spec on a new volume.
+// Zero values are left out, so EBS applies the type's defaults.
+func setPerformance(input *ec2.CreateVolumeInput, spec awsutil.VolumeSpec) {
+	if spec.IOPS > 0 {
+		input.Iops = aws.Int32(spec.IOPS)
+	}
+	if spec.Throughput > 0 {
+		input.Throughput = aws.Int32(spec.Throughput)
+	}
+}
+
+func volumeEncrypt(ctx context.Context, client *ec2.Client, kmsClient *kms.Client, volumeRef, kmsKey string, deleteOld, autoApprove bool) error {
+	volID, err := resolveVolume(ctx, client, volumeRef)
+	if err != nil {
+		return err
+	}
+	vol, err := describeVolume(ctx, client, volID)
+	if err != nil {
+		return err
+	}
+	if aws.ToBool(vol.Encrypted) && (kmsKey == "" || sameKMSKey(ctx, kmsClient, aws.ToString(vol.KmsKeyId), kmsKey)) {
+		fmt.Printf("%s is already encrypted (%s).\n", volID, encryptionLabel(vol))
+		return nil
+	}
+	enc := volumeEncryption{Encrypt: true, KMSKey: kmsKey}
+
+	// The attachment to restore once the copy is swapped in.
+	var att *types.VolumeAttachment
+	wasRunning := false
+	if len(vol.Attachments) > 0 {
+		att = &vol.Attachments[0]
+		inst, err := describeInstance(ctx, client, aws.ToString(att.InstanceId))
+		if err != nil {
+			return err
+		}
+		switch inst.State.Name {
+		case types.InstanceStateNameRunning, types.InstanceStateNamePending:
+			wasRunning = true
+		case types.InstanceStateNameStopped:
+		default:
+			return fmt.Errorf("%s is attached to %s, which is %s", volID, aws.ToString(att.InstanceId), inst.State.Name)
+		}
+	}
+	instanceID := ""
+	if att != nil {
+		instanceID = aws.ToString(att.InstanceId)
+	}
+
+	// 1. Stop the instance so the snapshot is consistent.
+	if wasRunning {
+		if !autoApprove {
+			ok, err := promptYesNo(fmt.Sprintf("%s is attached to running instance %s, which has to be stopped. Stop it?", volID, instanceID))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				fmt.Println("Aborted.")
+				return nil
+			}
+		}
+		if err := stopAndWait(ctx, client, instanceID); err != nil {
+			return err
+		}
+	}
+	// Until the copy is swapped in, a failure leaves the original in place;
+	// start the instance again rather than leave it down.
+	swapped := false
+	defer func() {
+		if wasRunning && !swapped {
+			fmt.Fprintf(os.Stderr, "Starting %s again with its original volume...\n", instanceID)
+			if err := startInstances(ctx, client, []string{instanceID}); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+		}
+	}()
+
+	// 2. Snapshot the volume and copy the snapshot with encryption.
+	fmt.Printf("Creating snapshot of %s...\n", volID)
+	snap, err := client.CreateSnapshot(ctx, &ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(volID),
+		Description: aws.String(fmt.Sprintf("devbox encrypt: %s", volID)),
+	})
+	if err != nil {
+		return fmt.Errorf("creating snapshot of %s: %w", volID, err)
+	}
+	plainSnap := aws.ToString(snap.SnapshotId)
+	defer deleteSnapshotOrWarn(ctx, client, plainSnap)
+	if err := pollSnapshotState(ctx, client, plainSnap, "completed", SnapshotPollInterval, 2*time.Hour); err != nil {
+		return fmt.Errorf("waiting for snapshot %s: %w", plainSnap, err)
+	}
+
+	fmt.Printf("Copying %s with encryption...\n", plainSnap)
+	copied, err := client.CopySnapshot(ctx, &ec2.CopySnapshotInput{
+		SourceRegion:     aws.String(client.Options().Region),
+		SourceSnapshotId: aws.String(plainSnap),
+		Description:      aws.String(fmt.Sprintf("devbox encrypt: %s (encrypted)", volID)),
+		Encrypted:        aws.Bool(true),
+		KmsKeyId:         enc.kmsKeyID(),
+	})
+	if err != nil {
+		return fmt.Errorf("copying snapshot %s: %w", plainSnap, err)
+	}
+	encSnap := aws.ToString(copied.SnapshotId)
+	defer deleteSnapshotOrWarn(ctx, client, encSnap)
+	if err := pollSnapshotState(ctx, client, encSnap, "completed", SnapshotPollInterval, 2*time.Hour); err != nil {
+		return fmt.Errorf("waiting for snapshot %s: %w", encSnap, err)
+	}
+
+	// 3. Create the encrypted volume next to the original.
+	input := &ec2.CreateVolumeInput{
+		AvailabilityZone: vol.AvailabilityZone,
+		SnapshotId:       aws.String(encSnap),
+		Size:             vol.Size,
+		VolumeType:       vol.VolumeType,
+	}
+	setPerformance(input, awsutil.CurrentSpec(vol))
+	input.TagSpecifications = []types.TagSpecification{{ResourceType: types.ResourceTypeVolume, Tags: successorTags(vol)}}
+	newVol, err := client.CreateVolume(ctx, input)
+	if err != nil {
+		return fmt.Errorf("creating encrypted volume: %w", err)
+	}
+	newID := aws.ToString(newVol.VolumeId)
+	fmt.Printf("Created encrypted volume %s, waiting for available state...\n", newID)
+	if err := awsutil.PollVolumeState(ctx, client, newID, "available", VolumePollInterval, 5*time.Minute); err != nil {
+		return err
+	}
+
+	// 4. Rename the original, so lookups by name find the copy.
+	retireVolume(ctx, client, vol, "unencrypted")
+
+	// 5. Swap the copy in where the original was attached.
+	if att != nil {
+		if err := swapVolume(ctx, client, instanceID, volID, newID, aws.ToString(att.Device), aws.ToBool(att.DeleteOnTermination)); err != nil {
+			return err
+		}
+		swapped = true
+		if wasRunning {
+			if err := startAndWait(ctx, client, instanceID); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 6. Verify before touching the original.
+	if err := verifyEncrypted(ctx, client, newID); err != nil {
+		return err
+	}
+	if att != nil {
+		got, err := describeVolume(ctx, client, newID)
+		if err != nil {
+			return err
+		}
+		if len(got.Attachments) == 0 || aws.ToString(got.Attachments[0].InstanceId) != instanceID {
+			return fmt.Errorf("%s is not attached to %s; the original %s is untouched", newID, instanceID, volID)
+		}
+		fmt.Printf("Verified: %s is attached to %s as %s.\n", newID, instanceID, aws.ToString(got.Attachments[0].Device))
+	}
+
+	if deleteOld {
+		if _, err := client.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: aws.String(volID)}); err != nil {
+			return fmt.Errorf("deleting original volume %s: %w", volID, err)
+		}
+		fmt.Printf("Deleted original volume %s.\n", volID)
+	} else {
+		fmt.Printf("Original volume %s was kept; delete it with: devbox volume destroy %s\n", volID, volID)
+	}
+	fmt.Printf("\nDone. %s replaces %s.\n", newID, volID)
+	return nil
+}
+
+// swapVolume replaces oldID with newID on a stopped instance, at the same
+// device and with the same delete-on-termination setting.
+func swapVolume(ctx context.Context, client *ec2.Client, instanceID, oldID, newID, device string, deleteOnTermination bool) error {
+	fmt.Printf("Detaching %s from %s...\n", oldID, instanceID)
+	if _, err := client.DetachVolume(ctx, &ec2.DetachVolumeInput{
+		VolumeId:   aws.String(oldID),
+		InstanceId: aws.String(instanceID),
+	}); err != nil {
+		return fmt.Errorf("detaching %s: %w", oldID, err)
+	}
+	if err := awsutil.PollVolumeState(ctx, client, oldID, "available", VolumePollInterval, 2*time.Minute); err != nil {
+		return fmt.Errorf("waiting for %s to detach: %w", oldID, err)
+	}
+
+	fmt.Printf("Attaching %s to %s as %s...\n", newID, instanceID, device)
+	if _, err := client.AttachVolume(ctx, &ec2.AttachVolumeInput{
+		VolumeId:   aws.String(newID),
+		InstanceId: aws.String(instanceID),
+		Device:     aws.String(device),
+	}); err != nil {
+		// Put the original back so the instance isn't left without it.
+		client.AttachVolume(ctx, &ec2.AttachVolumeInput{
+			VolumeId: aws.String(oldID), InstanceId: aws.String(instanceID), Device: aws.String(device),
+		})
+		return fmt.Errorf("attaching %s: %w", newID, err)
+	}
+	if err := awsutil.PollVolumeState(ctx, client, newID, "in-use", VolumePollInterval, 2*time.Minute); err != nil {
+		return fmt.Errorf("waiting for %s to attach: %w", newID, err)
+	}
+
+	if deleteOnTermination {
+		if _, err := client.ModifyInstanceAttribute(ctx, &ec2.ModifyInstanceAttributeInput{
+			InstanceId: aws.String(instanceID),
+			BlockDeviceMappings: []types.InstanceBlockDeviceMappingSpecification{{
+				DeviceName: aws.String(device),
+				Ebs: &types.EbsInstanceBlockDeviceSpecification{
+					VolumeId:            aws.String(newID),
+					DeleteOnTermination: aws.Bool(true),
+				},
+			}},
+		}); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s will outlive %s: %v\n", newID, instanceID, err)
+		}
+	}
+	return nil
+}
+
+// verifyEncrypted checks that a volume came out encrypted.
+func verifyEncrypted(ctx context.Context, client *ec2.Client, volID string) error {
+	vol, err := describeVolume(ctx, client, volID)
+	if err != nil {
+		return err
+	}
+	if !aws.ToBool(vol.Encrypted) {
+		return fmt.Errorf("volume %s is not encrypted", volID)
+	}
+	fmt.Printf("Verified: %s is encrypted (%s).\n", volID, encryptionLabel(vol))
+	return nil
+}
+
+// stopAndWait stops an instance and waits until it is stopped.
+func stopAndWait(ctx context.Context, client *ec2.Client, instanceID string) error {
+	if err := stopInstances(ctx, client, []string{instanceID}); err != nil {
+		return err
+	}
+	waiter := ec2.NewInstanceStoppedWaiter(client)
+	if err := waiter.Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceID}}, 5*time.Minute); err != nil {
+		return fmt.Errorf("waiting for %s to stop: %w", instanceID, err)
+	}
+	return nil
+}
+
+// startAndWait starts an instance and waits until it is running.
+func startAndWait(ctx context.Context, client *ec2.Client, instanceID string) error {
+	fmt.Printf("Starting %s...\n", instanceID)
+	if err := startInstances(ctx, client, []string{instanceID}); err != nil {
+		return err
+	}
+	waiter := ec2.NewInstanceRunningWaiter(client)
+	if err := waiter.Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceID}}, 5*time.Minute); err != nil {
+		return fmt.Errorf("waiting for %s to start: %w", instanceID, err)
+	}
+	return nil
+}
+
+func deleteSnapshotOrWarn(ctx context.Context, client *ec2.Client, snapID string) {
+	if _, err := client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(snapID)}); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not delete snapshot %s: %v\n", snapID, err)
+	}
+}
+
 // --- helpers ---
 
+func describeVolume(ctx context.Context, client *ec2.Client, volID string) (types.Volume, error) {
+	desc, err := client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{volID}})
+	if err != nil {
+		return types.Volume{}, fmt.Errorf("describing volume %s: %w", volID, err)
+	}
+	if len(desc.Volumes) == 0 {
+		return types.Volume{}, fmt.Errorf("volume %s not found", volID)
+	}
+	return desc.Volumes[0], nil
+}
+
 func resolveVolume(ctx context.Context, client *ec2.Client, nameOrID string) (string, error) {
 	if strings.HasPrefix(nameOrID, "vol-") {
 		return nameOrID, nil
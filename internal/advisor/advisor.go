@@ -0,0 +1,196 @@
+// Package advisor reads a local copy of the AWS Spot Instance Advisor
+// dataset, which buckets each instance type's monthly interruption rate
+// per region into a small number of bands ("<5%", "5-10%", ...).
+//
+// The file is not fetched automatically; `devbox search --update-advisor`
+// refreshes it from DefaultURL or any other URL or local path.
+package advisor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultURL is the dataset behind the Spot Instance Advisor web page.
+const DefaultURL = "https://spot-bid-advisor.s3.amazonaws.com/spot-advisor-data.json"
+
+// Band is one interruption-frequency bucket.
+type Band struct {
+	Index int    `json:"index"`
+	Label string `json:"label"`
+	Max   int    `json:"max"`
+}
+
+type typeEntry struct {
+	Savings int `json:"s"`
+	Range   int `json:"r"`
+}
+
+// Data is a parsed advisor dataset.
+type Data struct {
+	Ranges      []Band                                     `json:"ranges"`
+	SpotAdvisor map[string]map[string]map[string]typeEntry `json:"spot_advisor"`
+}
+
+// Path returns where the local dataset lives.
+func Path() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "devbox", "spot-advisor.json"), nil
+}
+
+// Parse decodes and sanity-checks a dataset.
+func Parse(b []byte) (*Data, error) {
+	var d Data
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, fmt.Errorf("parsing spot advisor data: %w", err)
+	}
+	if len(d.Ranges) == 0 || len(d.SpotAdvisor) == 0 {
+		return nil, fmt.Errorf("spot advisor data has no ranges or regions")
+	}
+	return &d, nil
+}
+
+// Load reads the dataset at path. A missing file yields (nil, nil) so callers
+// can treat the data as optional.
+func Load(path string) (*Data, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	d, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return d, nil
+}
+
+// LoadDefault loads the dataset from Path.
+func LoadDefault() (*Data, error) {
+	path, err := Path()
+	if err != nil {
+		return nil, nil
+	}
+	return Load(path)
+}
+
+// Update fetches the dataset from src (an http(s) URL or a local path),
+// validates it and atomically replaces the file at dest.
+func Update(ctx context.Context, src, dest string) (*Data, error) {
+	var b []byte
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("fetching %s: %w", src, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: %s", src, resp.Status)
+		}
+		if b, err = io.ReadAll(resp.Body); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", src, err)
+		}
+	} else {
+		var err error
+		if b, err = os.ReadFile(src); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", src, err)
+		}
+	}
+
+	d, err := Parse(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".spot-advisor-*.json")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("writing %s: %w", dest, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return nil, fmt.Errorf("writing %s: %w", dest, err)
+	}
+	return d, nil
+}
+
+// Band returns the Linux interruption band for an instance type in a region.
+func (d *Data) Band(region, instanceType string) (Band, bool) {
+	if d == nil {
+		return Band{}, false
+	}
+	e, ok := d.SpotAdvisor[region]["Linux"][instanceType]
+	if !ok {
+		return Band{}, false
+	}
+	for _, b := range d.Ranges {
+		if b.Index == e.Range {
+			return b, true
+		}
+	}
+	return Band{}, false
+}
+
+// Stability maps a band to [0,1], where 0 is the least interrupted band and
+// 1 the most. Unknown types score 0.5.
+func (d *Data) Stability(region, instanceType string) float64 {
+	b, ok := d.Band(region, instanceType)
+	if !ok || len(d.Ranges) < 2 {
+		return 0.5
+	}
+	return float64(b.Index) / float64(len(d.Ranges)-1)
+}
+
+// Regions returns the number of regions and instance-type entries, for
+// reporting after an update.
+func (d *Data) Regions() (regions, entries int) {
+	for _, oses := range d.SpotAdvisor {
+		regions++
+		entries += len(oses["Linux"])
+	}
+	return regions, entries
+}
+
+// Weights balances price against stability when ranking candidates.
+type Weights struct {
+	Price     float64
+	Stability float64
+}
+
+// Score ranks a candidate; lower is better. price is normalized against the
+// [lo, hi] range of the candidate set and stability comes from Stability.
+func Score(price, lo, hi, stability float64, w Weights) float64 {
+	norm := 0.0
+	if hi > lo {
+		norm = (price - lo) / (hi - lo)
+	}
+	total := w.Price + w.Stability
+	if total <= 0 {
+		return norm
+	}
+	return (w.Price*norm + w.Stability*stability) / total
+}
@@ -0,0 +1,106 @@
+package advisor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const sampleData = `{
+  "ranges": [
+    {"index": 0, "label": "<5%", "dots": 0, "max": 5},
+    {"index": 1, "label": "5-10%", "dots": 1, "max": 11},
+    {"index": 2, "label": "10-15%", "dots": 2, "max": 16},
+    {"index": 3, "label": "15-20%", "dots": 3, "max": 22},
+    {"index": 4, "label": ">20%", "dots": 4, "max": 100}
+  ],
+  "spot_advisor": {
+    "us-east-2": {
+      "Linux": {
+        "m6i.4xlarge": {"s": 62, "r": 0},
+        "c5.4xlarge": {"s": 70, "r": 4}
+      }
+    }
+  }
+}`
+
+func TestBand(t *testing.T) {
+	d, err := Parse([]byte(sampleData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, ok := d.Band("us-east-2", "c5.4xlarge")
+	if !ok || b.Label != ">20%" {
+		t.Errorf("Band(c5.4xlarge) = %+v, %v; want >20%%", b, ok)
+	}
+	if _, ok := d.Band("us-west-2", "c5.4xlarge"); ok {
+		t.Error("Band found an entry for a region not in the data")
+	}
+	if got := d.Stability("us-east-2", "m6i.4xlarge"); got != 0 {
+		t.Errorf("Stability(m6i.4xlarge) = %v, want 0", got)
+	}
+	if got := d.Stability("us-east-2", "r7i.large"); got != 0.5 {
+		t.Errorf("Stability(unknown) = %v, want 0.5", got)
+	}
+	var nilData *Data
+	if _, ok := nilData.Band("us-east-2", "c5.4xlarge"); ok {
+		t.Error("Band on nil data reported a match")
+	}
+}
+
+func TestParseRejectsEmpty(t *testing.T) {
+	if _, err := Parse([]byte(`{"ranges": []}`)); err == nil {
+		t.Error("Parse accepted a dataset with no ranges")
+	}
+}
+
+func TestScore(t *testing.T) {
+	w := Weights{Price: 0.5, Stability: 0.5}
+	// The cheapest but most interrupted type should lose to a slightly
+	// pricier, stable one.
+	cheapFlaky := Score(0.40, 0.40, 0.50, 1, w)
+	stable := Score(0.45, 0.40, 0.50, 0, w)
+	if stable >= cheapFlaky {
+		t.Errorf("stable score %v >= cheap/flaky score %v", stable, cheapFlaky)
+	}
+	// Price-only weights reduce to price order.
+	if Score(0.40, 0.40, 0.50, 1, Weights{Price: 1}) != 0 {
+		t.Error("price-only weight did not rank the cheapest first")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "nested", "spot-advisor.json")
+
+	src := filepath.Join(dir, "src.json")
+	if err := os.WriteFile(src, []byte(sampleData), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Update(context.Background(), src, dest); err != nil {
+		t.Fatalf("Update from path: %v", err)
+	}
+	d, err := Load(dest)
+	if err != nil || d == nil {
+		t.Fatalf("Load after update: %v, %v", d, err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not json"))
+	}))
+	defer srv.Close()
+	if _, err := Update(context.Background(), srv.URL, dest); err == nil {
+		t.Fatal("Update accepted an invalid dataset")
+	}
+	// A failed update leaves the previous file intact.
+	if d, err := Load(dest); err != nil || d == nil {
+		t.Errorf("previous dataset lost after failed update: %v", err)
+	}
+
+	if d, err := Load(filepath.Join(dir, "missing.json")); d != nil || err != nil {
+		t.Errorf("Load(missing) = %v, %v; want nil, nil", d, err)
+	}
+}
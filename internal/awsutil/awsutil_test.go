@@ -1,10 +1,14 @@
 package awsutil
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/emaland/devbox/internal/cache"
 )
 
 func TestNameTag(t *testing.T) {
@@ -19,3 +23,206 @@ func TestNameTag(t *testing.T) {
 		t.Errorf("NameTag(nil) = %q, want %q", got, "-")
 	}
 }
+
+func TestTagValue(t *testing.T) {
+	tags := []types.Tag{
+		{Key: aws.String("Name"), Value: aws.String("my-box")},
+		{Key: aws.String("devbox-managed"), Value: aws.String("true")},
+	}
+	if got := TagValue(tags, "devbox-managed"); got != "true" {
+		t.Errorf("TagValue = %q, want %q", got, "true")
+	}
+	if got := TagValue(tags, "missing"); got != "" {
+		t.Errorf("TagValue(missing) = %q, want empty", got)
+	}
+}
+
+func TestTypeFilter(t *testing.T) {
+	m7i := InstanceTypeInfo{Name: "m7i.4xlarge", Manufacturer: "Intel", NetworkGbps: 12.5}
+	c7a := InstanceTypeInfo{Name: "c7a.4xlarge", Manufacturer: "AMD", NetworkGbps: 12.5}
+	m7gd := InstanceTypeInfo{Name: "m7gd.4xlarge", Manufacturer: "AWS", NetworkGbps: 15, NVMeGB: 950}
+	t3 := InstanceTypeInfo{Name: "t3.2xlarge", Manufacturer: "Intel", NetworkGbps: 0.5, Burstable: true}
+	all := []InstanceTypeInfo{m7i, c7a, m7gd, t3}
+
+	tests := []struct {
+		name   string
+		filter TypeFilter
+		want   []string
+	}{
+		{"zero value", TypeFilter{}, []string{"m7i.4xlarge", "c7a.4xlarge", "m7gd.4xlarge", "t3.2xlarge"}},
+		{"families", TypeFilter{Families: []string{"m7i", "c7a"}}, []string{"m7i.4xlarge", "c7a.4xlarge"}},
+		{"family glob", TypeFilter{Families: []string{"m7*"}}, []string{"m7i.4xlarge", "m7gd.4xlarge"}},
+		{"exclude", TypeFilter{ExcludeFamilies: []string{"t*", "c7a"}}, []string{"m7i.4xlarge", "m7gd.4xlarge"}},
+		{"network", TypeFilter{MinNetGbps: 15}, []string{"m7gd.4xlarge"}},
+		{"nvme", TypeFilter{NVMe: true}, []string{"m7gd.4xlarge"}},
+		{"cpu", TypeFilter{CPU: "graviton"}, []string{"m7gd.4xlarge"}},
+		{"cpu case", TypeFilter{CPU: "Intel"}, []string{"m7i.4xlarge", "t3.2xlarge"}},
+		{"no burstable", TypeFilter{NoBurstable: true}, []string{"m7i.4xlarge", "c7a.4xlarge", "m7gd.4xlarge"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, info := range tt.filter.Apply(all) {
+			got = append(got, info.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if err := (TypeFilter{CPU: "arm"}).Validate(); err == nil {
+		t.Error("Validate accepted --cpu arm")
+	}
+	if err := (TypeFilter{Families: []string{"m7["}}).Validate(); err == nil {
+		t.Error("Validate accepted a malformed family glob")
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Range
+		wantErr bool
+	}{
+		{"8-16", Range{8, 16}, false},
+		{"32-", Range{32, 0}, false},
+		{"-64", Range{0, 64}, false},
+		{"8", Range{8, 8}, false},
+		{"", Range{}, false},
+		{"16-8", Range{}, true},
+		{"eight", Range{}, true},
+		{"8-x", Range{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRange(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRange(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRange(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTypeFilterRequirements(t *testing.T) {
+	f := TypeFilter{Families: []string{"m7i", "c7*"}, CPU: "graviton", NVMe: true, NoBurstable: true, MinNetGbps: 10}
+	req, err := f.Requirements(Range{8, 16}, Range{32, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.ToInt32(req.VCpuCount.Min) != 8 || aws.ToInt32(req.VCpuCount.Max) != 16 {
+		t.Errorf("VCpuCount = %d-%d, want 8-16", aws.ToInt32(req.VCpuCount.Min), aws.ToInt32(req.VCpuCount.Max))
+	}
+	if aws.ToInt32(req.MemoryMiB.Min) != 32768 || req.MemoryMiB.Max != nil {
+		t.Errorf("MemoryMiB = %v-%v, want 32768 with no max", aws.ToInt32(req.MemoryMiB.Min), req.MemoryMiB.Max)
+	}
+	if strings.Join(req.AllowedInstanceTypes, ",") != "m7i.*,c7*.*" {
+		t.Errorf("AllowedInstanceTypes = %v", req.AllowedInstanceTypes)
+	}
+	if len(req.CpuManufacturers) != 1 || req.CpuManufacturers[0] != types.CpuManufacturerAmazonWebServices {
+		t.Errorf("CpuManufacturers = %v", req.CpuManufacturers)
+	}
+	if req.LocalStorage != types.LocalStorageRequired || req.BurstablePerformance != types.BurstablePerformanceExcluded {
+		t.Errorf("LocalStorage = %s, BurstablePerformance = %s", req.LocalStorage, req.BurstablePerformance)
+	}
+	if aws.ToFloat64(req.NetworkBandwidthGbps.Min) != 10 {
+		t.Errorf("NetworkBandwidthGbps.Min = %v, want 10", aws.ToFloat64(req.NetworkBandwidthGbps.Min))
+	}
+
+	if _, err := (TypeFilter{Families: []string{"m[67]i"}}).Requirements(Range{8, 0}, Range{}); err == nil {
+		t.Error("Requirements accepted a non-* glob")
+	}
+	if _, err := (TypeFilter{Families: []string{"m7i"}, ExcludeFamilies: []string{"m7i"}}).Requirements(Range{8, 0}, Range{}); err == nil {
+		t.Error("Requirements accepted both --family and --exclude-family")
+	}
+}
+
+func TestVolumeSpecValidate(t *testing.T) {
+	valid := []VolumeSpec{
+		{Type: "gp3", SizeGiB: 75},
+		{Type: "gp3", SizeGiB: 200, IOPS: 6000, Throughput: 500},
+		{Type: "gp3", SizeGiB: 1, IOPS: 3000},
+		{Type: "io2", SizeGiB: 100, IOPS: 50000},
+		{Type: "gp3", IOPS: 16000}, // size unchanged
+		{Type: "st1", SizeGiB: 500},
+	}
+	for _, s := range valid {
+		if err := s.Validate(); err != nil {
+			t.Errorf("%+v: %v", s, err)
+		}
+	}
+
+	invalid := map[string]VolumeSpec{
+		"unknown type":         {Type: "gp4", SizeGiB: 10},
+		"too small":            {Type: "st1", SizeGiB: 100},
+		"gp2 iops":             {Type: "gp2", SizeGiB: 100, IOPS: 3000},
+		"io1 without iops":     {Type: "io1", SizeGiB: 100},
+		"iops per GiB":         {Type: "gp3", SizeGiB: 10, IOPS: 10000},
+		"gp3 iops too high":    {Type: "gp3", SizeGiB: 1000, IOPS: 90000},
+		"io2 throughput":       {Type: "io2", SizeGiB: 100, IOPS: 5000, Throughput: 500},
+		"throughput over iops": {Type: "gp3", SizeGiB: 100, IOPS: 3000, Throughput: 1000},
+		"throughput too low":   {Type: "gp3", SizeGiB: 100, Throughput: 100},
+	}
+	for name, s := range invalid {
+		if err := s.Validate(); err == nil {
+			t.Errorf("%s: %+v validated", name, s)
+		}
+	}
+}
+
+func TestMergeSpotPrices(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	Cache = &cache.Store{Dir: t.TempDir(), Refresh: true}
+	t.Cleanup(func() { Cache = nil })
+
+	key := "spot-prices/us-east-2"
+	onDisk := map[string]spotPriceEntry{
+		"m6i.large": {FetchedAt: now.Add(-time.Minute), Prices: map[string]float64{"us-east-2a": 0.05}},
+		"c7i.large": {FetchedAt: now.Add(time.Second), Prices: map[string]float64{"us-east-2a": 0.04}},
+		"r5.large":  {FetchedAt: now.Add(-48 * time.Hour), Prices: map[string]float64{"us-east-2a": 0.03}},
+	}
+	if err := Cache.Put(key, onDisk); err != nil {
+		t.Fatal(err)
+	}
+
+	got := mergeSpotPrices(key, map[string]spotPriceEntry{
+		"c7i.large": {FetchedAt: now, Prices: map[string]float64{"us-east-2a": 0.09}},
+		"t3.large":  {FetchedAt: now, Prices: map[string]float64{"us-east-2b": 0.02}},
+	}, now)
+
+	if _, ok := got["m6i.large"]; !ok {
+		t.Error("entry written by another run was dropped")
+	}
+	if p := got["c7i.large"].Prices["us-east-2a"]; p != 0.04 {
+		t.Errorf("c7i.large price = %v, want the newer 0.04", p)
+	}
+	if _, ok := got["t3.large"]; !ok {
+		t.Error("fresh entry missing")
+	}
+	if _, ok := got["r5.large"]; ok {
+		t.Error("entry older than InstanceTypeTTL was kept")
+	}
+}
+
+func TestCurrentSpec(t *testing.T) {
+	vol := func(typ string, size, iops, throughput int32) types.Volume {
+		return types.Volume{VolumeType: types.VolumeType(typ), Size: aws.Int32(size), Iops: aws.Int32(iops), Throughput: aws.Int32(throughput)}
+	}
+	tests := []struct {
+		vol  types.Volume
+		want VolumeSpec
+	}{
+		{vol("gp2", 100, 300, 0), VolumeSpec{Type: "gp2", SizeGiB: 100}},
+		{vol("gp3", 100, 4000, 250), VolumeSpec{Type: "gp3", SizeGiB: 100, IOPS: 4000, Throughput: 250}},
+		{vol("io2", 100, 10000, 0), VolumeSpec{Type: "io2", SizeGiB: 100, IOPS: 10000}},
+		{vol("st1", 500, 40, 0), VolumeSpec{Type: "st1", SizeGiB: 500}},
+	}
+	for _, tt := range tests {
+		if got := CurrentSpec(tt.vol); got != tt.want {
+			t.Errorf("CurrentSpec(%s) = %+v, want %+v", tt.vol.VolumeType, got, tt.want)
+		}
+		if err := CurrentSpec(tt.vol).Validate(); err != nil {
+			t.Errorf("CurrentSpec(%s) doesn't validate: %v", tt.vol.VolumeType, err)
+		}
+	}
+}
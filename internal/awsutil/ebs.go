@@ -0,0 +1,93 @@
+package awsutil
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// VolumeSpec is the size and performance of an EBS volume. Zero IOPS or
+// Throughput means the volume type's default.
+type VolumeSpec struct {
+	Type       string
+	SizeGiB    int32
+	IOPS       int32
+	Throughput int32 // MiB/s
+}
+
+// volumeLimits are the EBS limits per volume type. maxIOPSPerGiB is zero
+// for types whose IOPS can't be provisioned.
+type volumeLimits struct {
+	minSize, maxSize       int32
+	minIOPS, maxIOPS       int32
+	maxIOPSPerGiB          int32
+	minThrough, maxThrough int32 // zero if throughput can't be provisioned
+}
+
+var ebsLimits = map[string]volumeLimits{
+	"gp3":      {minSize: 1, maxSize: 65536, minIOPS: 3000, maxIOPS: 80000, maxIOPSPerGiB: 500, minThrough: 125, maxThrough: 2000},
+	"gp2":      {minSize: 1, maxSize: 16384},
+	"io1":      {minSize: 4, maxSize: 16384, minIOPS: 100, maxIOPS: 64000, maxIOPSPerGiB: 50},
+	"io2":      {minSize: 4, maxSize: 65536, minIOPS: 100, maxIOPS: 256000, maxIOPSPerGiB: 1000},
+	"st1":      {minSize: 125, maxSize: 16384},
+	"sc1":      {minSize: 125, maxSize: 16384},
+	"standard": {minSize: 1, maxSize: 1024},
+}
+
+// Validate reports a spec EBS would reject. A zero SizeGiB isn't checked,
+// for volumes whose size comes from a snapshot or is left unchanged.
+func (s VolumeSpec) Validate() error {
+	l, ok := ebsLimits[s.Type]
+	if !ok {
+		return fmt.Errorf("unknown volume type %q: want gp3, gp2, io1, io2, st1, sc1 or standard", s.Type)
+	}
+	if s.SizeGiB != 0 && (s.SizeGiB < l.minSize || s.SizeGiB > l.maxSize) {
+		return fmt.Errorf("%s volumes are %d-%d GiB, not %d", s.Type, l.minSize, l.maxSize, s.SizeGiB)
+	}
+	if s.IOPS != 0 {
+		if l.maxIOPSPerGiB == 0 {
+			return fmt.Errorf("%s volumes don't take provisioned IOPS", s.Type)
+		}
+		if s.IOPS < l.minIOPS || s.IOPS > l.maxIOPS {
+			return fmt.Errorf("%s volumes take %d-%d IOPS, not %d", s.Type, l.minIOPS, l.maxIOPS, s.IOPS)
+		}
+		if s.SizeGiB != 0 && s.IOPS > s.SizeGiB*l.maxIOPSPerGiB && s.IOPS > l.minIOPS {
+			return fmt.Errorf("%d IOPS needs at least %d GiB on %s (%d IOPS per GiB)", s.IOPS, (s.IOPS+l.maxIOPSPerGiB-1)/l.maxIOPSPerGiB, s.Type, l.maxIOPSPerGiB)
+		}
+	} else if s.Type == "io1" || s.Type == "io2" {
+		return fmt.Errorf("%s volumes need provisioned IOPS", s.Type)
+	}
+	if s.Throughput != 0 {
+		if l.maxThrough == 0 {
+			return fmt.Errorf("%s volumes don't take provisioned throughput", s.Type)
+		}
+		if s.Throughput < l.minThrough || s.Throughput > l.maxThrough {
+			return fmt.Errorf("%s volumes take %d-%d MiB/s, not %d", s.Type, l.minThrough, l.maxThrough, s.Throughput)
+		}
+		iops := s.IOPS
+		if iops == 0 {
+			iops = l.minIOPS
+		}
+		if s.Throughput*4 > iops && s.Throughput > l.minThrough {
+			return fmt.Errorf("%d MiB/s needs at least %d IOPS (0.25 MiB/s per IOPS)", s.Throughput, s.Throughput*4)
+		}
+	}
+	return nil
+}
+
+// CurrentSpec returns the size and provisioned performance of an existing
+// volume. DescribeVolumes reports baseline IOPS for gp2 and HDD volumes,
+// which EBS rejects as a setting, so only the IOPS and throughput the
+// volume's type accepts are kept.
+func CurrentSpec(vol types.Volume) VolumeSpec {
+	spec := VolumeSpec{Type: string(vol.VolumeType), SizeGiB: aws.ToInt32(vol.Size)}
+	l := ebsLimits[spec.Type]
+	if l.maxIOPSPerGiB > 0 {
+		spec.IOPS = aws.ToInt32(vol.Iops)
+	}
+	if l.maxThrough > 0 {
+		spec.Throughput = aws.ToInt32(vol.Throughput)
+	}
+	return spec
+}
@@ -0,0 +1,91 @@
+package awsutil
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// TypeFilter narrows a set of instance types beyond the arch, vCPU, memory
+// and GPU checks in FetchInstanceTypes. The zero value matches everything.
+type TypeFilter struct {
+	Families        []string // family names or globs, e.g. "m7i", "c7*"
+	ExcludeFamilies []string
+	MinNetGbps      float64
+	NVMe            bool   // require local NVMe instance storage
+	CPU             string // "intel", "amd" or "graviton"
+	NoBurstable     bool
+}
+
+// cpuManufacturers maps --cpu values to EC2's processor manufacturer names.
+var cpuManufacturers = map[string]string{
+	"intel":    "Intel",
+	"amd":      "AMD",
+	"graviton": "AWS",
+}
+
+// Validate reports filter values that can never match.
+func (f TypeFilter) Validate() error {
+	if f.CPU != "" {
+		if _, ok := cpuManufacturers[strings.ToLower(f.CPU)]; !ok {
+			return fmt.Errorf("invalid --cpu %q: want intel, amd or graviton", f.CPU)
+		}
+	}
+	for _, fam := range append(append([]string{}, f.Families...), f.ExcludeFamilies...) {
+		if _, err := path.Match(fam, ""); err != nil {
+			return fmt.Errorf("invalid family pattern %q: %w", fam, err)
+		}
+	}
+	return nil
+}
+
+// Family returns the family part of an instance type name ("m7i" for
+// "m7i.4xlarge").
+func Family(instanceType string) string {
+	family, _, _ := strings.Cut(instanceType, ".")
+	return family
+}
+
+// Match reports whether an instance type passes the filter.
+func (f TypeFilter) Match(info InstanceTypeInfo) bool {
+	family := Family(info.Name)
+	if len(f.Families) > 0 && !matchesAny(f.Families, family) {
+		return false
+	}
+	if matchesAny(f.ExcludeFamilies, family) {
+		return false
+	}
+	if f.MinNetGbps > 0 && info.NetworkGbps < f.MinNetGbps {
+		return false
+	}
+	if f.NVMe && info.NVMeGB == 0 {
+		return false
+	}
+	if f.CPU != "" && info.Manufacturer != cpuManufacturers[strings.ToLower(f.CPU)] {
+		return false
+	}
+	if f.NoBurstable && info.Burstable {
+		return false
+	}
+	return true
+}
+
+// Apply returns the instance types that pass the filter.
+func (f TypeFilter) Apply(infos []InstanceTypeInfo) []InstanceTypeInfo {
+	var out []InstanceTypeInfo
+	for _, info := range infos {
+		if f.Match(info) {
+			out = append(out, info)
+		}
+	}
+	return out
+}
+
+func matchesAny(patterns []string, family string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, family); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -76,3 +76,13 @@ func PollVolumeState(ctx context.Context, client *ec2.Client, volumeID, desiredS
 		time.Sleep(interval)
 	}
 }
+
+// TagValue returns the value of the tag with the given key, or "" if absent.
+func TagValue(tags []types.Tag, key string) string {
+	for _, t := range tags {
+		if t.Key != nil && *t.Key == key && t.Value != nil {
+			return *t.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+package awsutil
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// PlacementScore is how likely a spot request is to be fulfilled in a region
+// or AZ, from 1 (unlikely) to 10 (very likely).
+type PlacementScore struct {
+	Region string
+	// AZ is the zone name in the caller's account, or the zone ID when the
+	// name isn't known. Empty for region-level scores.
+	AZ    string
+	AZID  string
+	Score int32
+}
+
+// PlacementRequest is what to score. Set either InstanceTypes or
+// Requirements.
+type PlacementRequest struct {
+	InstanceTypes []string
+	Requirements  *types.InstanceRequirementsWithMetadataRequest
+	// Regions limits the regions scored; empty scores every region.
+	Regions []string
+	// SingleAZ scores AZs instead of regions.
+	SingleAZ bool
+	// Capacity is the number of instances wanted; 0 means 1.
+	Capacity int32
+}
+
+// PlacementScorer ranks where a spot request is likely to succeed.
+type PlacementScorer interface {
+	PlacementScores(ctx context.Context, req PlacementRequest) ([]PlacementScore, error)
+}
+
+// EC2PlacementScorer scores placements with GetSpotPlacementScores.
+type EC2PlacementScorer struct {
+	Client *ec2.Client
+}
+
+// PlacementScores returns the scores sorted best first. AZ IDs in the
+// client's region are translated to zone names.
+func (s *EC2PlacementScorer) PlacementScores(ctx context.Context, req PlacementRequest) ([]PlacementScore, error) {
+	capacity := req.Capacity
+	if capacity <= 0 {
+		capacity = 1
+	}
+	input := &ec2.GetSpotPlacementScoresInput{
+		TargetCapacity:         aws.Int32(capacity),
+		SingleAvailabilityZone: aws.Bool(req.SingleAZ),
+		RegionNames:            req.Regions,
+	}
+	if req.Requirements != nil {
+		input.InstanceRequirementsWithMetadata = req.Requirements
+	} else {
+		input.InstanceTypes = req.InstanceTypes
+	}
+
+	var zoneNames map[string]string
+	if req.SingleAZ {
+		var err error
+		if zoneNames, err = zoneNamesByID(ctx, s.Client); err != nil {
+			return nil, err
+		}
+	}
+
+	var scores []PlacementScore
+	paginator := ec2.NewGetSpotPlacementScoresPaginator(s.Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("getting spot placement scores: %w", err)
+		}
+		for _, sc := range page.SpotPlacementScores {
+			p := PlacementScore{
+				Region: aws.ToString(sc.Region),
+				AZID:   aws.ToString(sc.AvailabilityZoneId),
+				Score:  aws.ToInt32(sc.Score),
+			}
+			p.AZ = p.AZID
+			if name, ok := zoneNames[p.AZID]; ok {
+				p.AZ = name
+			}
+			scores = append(scores, p)
+		}
+	}
+	SortPlacementScores(scores)
+	return scores, nil
+}
+
+// zoneNamesByID maps the AZ IDs of the client's region to this account's
+// zone names.
+func zoneNamesByID(ctx context.Context, client *ec2.Client) (map[string]string, error) {
+	out, err := client.DescribeAvailabilityZones(ctx, &ec2.DescribeAvailabilityZonesInput{})
+	if err != nil {
+		return nil, fmt.Errorf("describing availability zones: %w", err)
+	}
+	names := make(map[string]string, len(out.AvailabilityZones))
+	for _, z := range out.AvailabilityZones {
+		names[aws.ToString(z.ZoneId)] = aws.ToString(z.ZoneName)
+	}
+	return names, nil
+}
+
+// SortPlacementScores orders scores best first, then by region and AZ.
+func SortPlacementScores(scores []PlacementScore) {
+	sort.Slice(scores, func(i, j int) bool {
+		a, b := scores[i], scores[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Region != b.Region {
+			return a.Region < b.Region
+		}
+		return a.AZ < b.AZ
+	})
+}
@@ -0,0 +1,116 @@
+package awsutil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Range is an inclusive numeric range from a flag like "8-16", "32-" or
+// "-64". A zero Max means no upper bound.
+type Range struct {
+	Min, Max float64
+}
+
+// ParseRange parses "N", "N-M", "N-" or "-M". A bare N means exactly N.
+func ParseRange(s string) (Range, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Range{}, nil
+	}
+	lo, hi, isRange := strings.Cut(s, "-")
+	var r Range
+	var err error
+	if lo != "" {
+		if r.Min, err = strconv.ParseFloat(lo, 64); err != nil || r.Min < 0 {
+			return Range{}, fmt.Errorf("invalid range %q", s)
+		}
+	}
+	if !isRange {
+		r.Max = r.Min
+		return r, nil
+	}
+	if hi != "" {
+		if r.Max, err = strconv.ParseFloat(hi, 64); err != nil || r.Max <= 0 {
+			return Range{}, fmt.Errorf("invalid range %q", s)
+		}
+		if r.Max < r.Min {
+			return Range{}, fmt.Errorf("invalid range %q: max is below min", s)
+		}
+	}
+	return r, nil
+}
+
+func (r Range) String() string {
+	switch {
+	case r.Max == 0:
+		return fmt.Sprintf("%g+", r.Min)
+	case r.Min == r.Max:
+		return fmt.Sprintf("%g", r.Min)
+	}
+	return fmt.Sprintf("%g-%g", r.Min, r.Max)
+}
+
+// Requirements translates vCPU and memory (GiB) ranges and the filter into
+// EC2 attribute-based instance requirements. EC2 only understands "*"
+// wildcards, so family patterns using other glob syntax are rejected.
+func (f TypeFilter) Requirements(vcpu, memGiB Range) (*types.InstanceRequirementsRequest, error) {
+	req := &types.InstanceRequirementsRequest{
+		VCpuCount: &types.VCpuCountRangeRequest{Min: aws.Int32(int32(vcpu.Min))},
+		MemoryMiB: &types.MemoryMiBRequest{Min: aws.Int32(int32(memGiB.Min * 1024))},
+	}
+	if vcpu.Max > 0 {
+		req.VCpuCount.Max = aws.Int32(int32(vcpu.Max))
+	}
+	if memGiB.Max > 0 {
+		req.MemoryMiB.Max = aws.Int32(int32(memGiB.Max * 1024))
+	}
+
+	familyPatterns := func(families []string) ([]string, error) {
+		var out []string
+		for _, fam := range families {
+			if strings.ContainsAny(fam, "?[]\\") {
+				return nil, fmt.Errorf("family pattern %q: only * wildcards work with attribute-based launches", fam)
+			}
+			out = append(out, fam+".*")
+		}
+		return out, nil
+	}
+	var err error
+	if req.AllowedInstanceTypes, err = familyPatterns(f.Families); err != nil {
+		return nil, err
+	}
+	if req.ExcludedInstanceTypes, err = familyPatterns(f.ExcludeFamilies); err != nil {
+		return nil, err
+	}
+	if len(req.AllowedInstanceTypes) > 0 && len(req.ExcludedInstanceTypes) > 0 {
+		return nil, fmt.Errorf("--family and --exclude-family can't be combined in attribute-based launches")
+	}
+
+	if f.MinNetGbps > 0 {
+		req.NetworkBandwidthGbps = &types.NetworkBandwidthGbpsRequest{Min: aws.Float64(f.MinNetGbps)}
+	}
+	if f.NVMe {
+		req.LocalStorage = types.LocalStorageRequired
+		req.LocalStorageTypes = []types.LocalStorageType{types.LocalStorageTypeSsd}
+	}
+	if f.CPU != "" {
+		switch strings.ToLower(f.CPU) {
+		case "intel":
+			req.CpuManufacturers = []types.CpuManufacturer{types.CpuManufacturerIntel}
+		case "amd":
+			req.CpuManufacturers = []types.CpuManufacturer{types.CpuManufacturerAmd}
+		case "graviton":
+			req.CpuManufacturers = []types.CpuManufacturer{types.CpuManufacturerAmazonWebServices}
+		}
+	}
+	if f.NoBurstable {
+		req.BurstablePerformance = types.BurstablePerformanceExcluded
+	} else {
+		req.BurstablePerformance = types.BurstablePerformanceIncluded
+	}
+	return req, nil
+}
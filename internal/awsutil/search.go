@@ -3,17 +3,66 @@ package awsutil
 import (
 	"context"
 	"fmt"
+	"maps"
+	"sort"
 	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/emaland/devbox/internal/cache"
+)
+
+// Cache, when set, keeps instance-type catalogues and spot prices between
+// runs. Leave it nil to always call the API.
+var Cache *cache.Store
+
+const (
+	// InstanceTypeTTL is how long a cached instance-type catalogue is used.
+	InstanceTypeTTL = 24 * time.Hour
+	// SpotPriceTTL is how long a cached spot price is used.
+	SpotPriceTTL = 5 * time.Minute
 )
 
+var cachedArchitectures = []string{"x86_64", "arm64"}
+
+func instanceTypesKey(client *ec2.Client, arch string) string {
+	return "instance-types/" + client.Options().Region + "/" + arch
+}
+
 func FetchInstanceTypes(ctx context.Context, client *ec2.Client, arch string, minVCPU int, minMem float64, requireGPU bool) ([]InstanceTypeInfo, error) {
+	catalogue, err := instanceTypeCatalogue(ctx, client, arch)
+	if err != nil {
+		return nil, err
+	}
+
 	var results []InstanceTypeInfo
 	minMemMiB := int64(minMem * 1024)
+	for _, it := range catalogue {
+		if int(it.VCPUs) < minVCPU {
+			continue
+		}
+		if it.MemoryMiB < minMemMiB {
+			continue
+		}
+		if requireGPU && !it.HasGPU {
+			continue
+		}
+		results = append(results, it)
+	}
+	return results, nil
+}
+
+// instanceTypeCatalogue returns every current-generation, spot-capable
+// instance type for an architecture in the client's region.
+func instanceTypeCatalogue(ctx context.Context, client *ec2.Client, arch string) ([]InstanceTypeInfo, error) {
+	key := instanceTypesKey(client, arch)
+	var results []InstanceTypeInfo
+	if Cache.Get(key, InstanceTypeTTL, &results) {
+		return results, nil
+	}
 
 	input := &ec2.DescribeInstanceTypesInput{
 		Filters: []types.Filter{
@@ -30,78 +79,176 @@ func FetchInstanceTypes(ctx context.Context, client *ec2.Client, arch string, mi
 			return nil, fmt.Errorf("describing instance types: %w", err)
 		}
 		for _, it := range page.InstanceTypes {
-			vcpus := *it.VCpuInfo.DefaultVCpus
-			memMiB := *it.MemoryInfo.SizeInMiB
-			hasGPU := it.GpuInfo != nil && len(it.GpuInfo.Gpus) > 0
-
-			if int(vcpus) < minVCPU {
-				continue
-			}
-			if memMiB < minMemMiB {
-				continue
-			}
-			if requireGPU && !hasGPU {
-				continue
-			}
-
-			netPerf := ""
-			if it.NetworkInfo != nil && it.NetworkInfo.NetworkPerformance != nil {
-				netPerf = *it.NetworkInfo.NetworkPerformance
-			}
-			results = append(results, InstanceTypeInfo{
-				Name:               string(it.InstanceType),
-				VCPUs:              vcpus,
-				MemoryMiB:          memMiB,
-				HasGPU:             hasGPU,
-				NetworkPerformance: netPerf,
-			})
+			results = append(results, instanceTypeInfo(it))
 		}
 	}
+	// A failed cache write only costs a slower next run.
+	_ = Cache.Put(key, results)
 	return results, nil
 }
 
+// DescribeSpecificTypes describes the named instance types, answering from
+// cached catalogues where it can.
 func DescribeSpecificTypes(ctx context.Context, client *ec2.Client, typeNames []types.InstanceType) ([]InstanceTypeInfo, error) {
+	known := map[string]InstanceTypeInfo{}
+	for _, arch := range cachedArchitectures {
+		var catalogue []InstanceTypeInfo
+		if Cache.Get(instanceTypesKey(client, arch), InstanceTypeTTL, &catalogue) {
+			for _, it := range catalogue {
+				known[it.Name] = it
+			}
+		}
+	}
+	// Types outside the catalogues (previous generation, on-demand only)
+	// are cached individually.
+	namedKey := instanceTypesKey(client, "named")
+	named := map[string]InstanceTypeInfo{}
+	Cache.Get(namedKey, InstanceTypeTTL, &named)
+	maps.Copy(known, named)
+
+	var infos []InstanceTypeInfo
+	var missing []types.InstanceType
+	for _, name := range typeNames {
+		if it, ok := known[string(name)]; ok {
+			infos = append(infos, it)
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return infos, nil
+	}
+
 	result, err := client.DescribeInstanceTypes(ctx, &ec2.DescribeInstanceTypesInput{
-		InstanceTypes: typeNames,
+		InstanceTypes: missing,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("describing instance types: %w", err)
 	}
-	var infos []InstanceTypeInfo
 	for _, it := range result.InstanceTypes {
-		hasGPU := it.GpuInfo != nil && len(it.GpuInfo.Gpus) > 0
-		netPerf := ""
-		if it.NetworkInfo != nil && it.NetworkInfo.NetworkPerformance != nil {
-			netPerf = *it.NetworkInfo.NetworkPerformance
-		}
-		infos = append(infos, InstanceTypeInfo{
-			Name:               string(it.InstanceType),
-			VCPUs:              *it.VCpuInfo.DefaultVCpus,
-			MemoryMiB:          *it.MemoryInfo.SizeInMiB,
-			HasGPU:             hasGPU,
-			NetworkPerformance: netPerf,
-		})
+		info := instanceTypeInfo(it)
+		infos = append(infos, info)
+		named[info.Name] = info
 	}
+	_ = Cache.Put(namedKey, named)
 	return infos, nil
 }
 
+// instanceTypeInfo flattens the parts of an EC2 instance type description
+// that search and recover filter on.
+func instanceTypeInfo(it types.InstanceTypeInfo) InstanceTypeInfo {
+	info := InstanceTypeInfo{
+		Name:       string(it.InstanceType),
+		VCPUs:      aws.ToInt32(it.VCpuInfo.DefaultVCpus),
+		HasGPU:     it.GpuInfo != nil && len(it.GpuInfo.Gpus) > 0,
+		Burstable:  aws.ToBool(it.BurstablePerformanceSupported),
+		Hypervisor: string(it.Hypervisor),
+	}
+	if it.MemoryInfo != nil {
+		info.MemoryMiB = aws.ToInt64(it.MemoryInfo.SizeInMiB)
+	}
+	if p := it.ProcessorInfo; p != nil {
+		if len(p.SupportedArchitectures) > 0 {
+			info.Arch = string(p.SupportedArchitectures[0])
+		}
+		info.Manufacturer = aws.ToString(p.Manufacturer)
+		info.ClockGHz = aws.ToFloat64(p.SustainedClockSpeedInGhz)
+	}
+	if s := it.InstanceStorageInfo; s != nil && s.NvmeSupport != types.EphemeralNvmeSupportUnsupported {
+		info.NVMeGB = aws.ToInt64(s.TotalSizeInGB)
+	}
+	if n := it.NetworkInfo; n != nil {
+		info.NetworkPerformance = aws.ToString(n.NetworkPerformance)
+		for _, card := range n.NetworkCards {
+			info.NetworkGbps += aws.ToFloat64(card.BaselineBandwidthInGbps)
+		}
+	}
+	if e := it.EbsInfo; e != nil && e.EbsOptimizedInfo != nil {
+		info.EBSMbps = aws.ToInt32(e.EbsOptimizedInfo.BaselineBandwidthInMbps)
+	}
+	return info
+}
+
+// spotPriceEntry is one instance type's cached latest prices, by AZ.
+type spotPriceEntry struct {
+	FetchedAt time.Time          `json:"fetched_at"`
+	Prices    map[string]float64 `json:"prices"`
+}
+
 func FetchSpotPrices(ctx context.Context, client *ec2.Client, instanceTypes []InstanceTypeInfo, azFilter string) ([]SpotSearchResult, error) {
-	// Build lookup map
-	infoMap := map[string]InstanceTypeInfo{}
+	// Prices are cached per region and type for every AZ, so searches with
+	// different filters share entries. Only stale types are fetched.
+	key := "spot-prices/" + client.Options().Region
+	cached := map[string]spotPriceEntry{}
+	Cache.Get(key, InstanceTypeTTL, &cached)
+
+	now := time.Now()
 	var typeNames []types.InstanceType
 	for _, it := range instanceTypes {
-		infoMap[it.Name] = it
+		if e, ok := cached[it.Name]; ok && now.Sub(e.FetchedAt) <= SpotPriceTTL {
+			continue
+		}
 		typeNames = append(typeNames, types.InstanceType(it.Name))
 	}
 
-	// Paginate spot price history in batches (API allows ~100 instance types per call)
-	type priceKey struct {
-		itype string
-		az    string
+	if len(typeNames) > 0 {
+		fetched, err := fetchLatestSpotPrices(ctx, client, typeNames)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range typeNames {
+			cached[string(name)] = spotPriceEntry{FetchedAt: now, Prices: fetched[string(name)]}
+		}
+		_ = Cache.Put(key, mergeSpotPrices(key, cached, now))
+	}
+
+	var results []SpotSearchResult
+	for _, info := range instanceTypes {
+		for az, price := range cached[info.Name].Prices {
+			if azFilter != "" && az != azFilter {
+				continue
+			}
+			results = append(results, SpotSearchResult{
+				InstanceType:       info.Name,
+				VCPUs:              info.VCPUs,
+				MemoryMiB:          info.MemoryMiB,
+				AZ:                 az,
+				Price:              price,
+				GPU:                info.HasGPU,
+				NetworkPerformance: info.NetworkPerformance,
+			})
+		}
+	}
+	return results, nil
+}
+
+// mergeSpotPrices combines entries with what is on disk under key right
+// now, so a --refresh or a concurrent run doesn't drop types it didn't
+// query. The newer of two entries for a type wins, and entries older than
+// InstanceTypeTTL are pruned.
+func mergeSpotPrices(key string, entries map[string]spotPriceEntry, now time.Time) map[string]spotPriceEntry {
+	merged := map[string]spotPriceEntry{}
+	Cache.Peek(key, &merged)
+	for name, e := range entries {
+		if old, ok := merged[name]; !ok || e.FetchedAt.After(old.FetchedAt) {
+			merged[name] = e
+		}
 	}
-	latest := map[priceKey]types.SpotPrice{}
+	for name, e := range merged {
+		if now.Sub(e.FetchedAt) > InstanceTypeTTL {
+			delete(merged, name)
+		}
+	}
+	return merged
+}
+
+// fetchLatestSpotPrices returns the most recent Linux/UNIX spot price for
+// each type in every AZ of the client's region.
+func fetchLatestSpotPrices(ctx context.Context, client *ec2.Client, typeNames []types.InstanceType) (map[string]map[string]float64, error) {
+	latest := map[string]map[string]types.SpotPrice{}
 	startTime := time.Now().Add(-1 * time.Hour)
 
+	// Paginate spot price history in batches (API allows ~100 instance types per call)
 	batchSize := 100
 	for i := 0; i < len(typeNames); i += batchSize {
 		end := i + batchSize
@@ -123,31 +270,74 @@ func FetchSpotPrices(ctx context.Context, client *ec2.Client, instanceTypes []In
 				return nil, fmt.Errorf("describing spot price history: %w", err)
 			}
 			for _, sp := range page.SpotPriceHistory {
-				if azFilter != "" && *sp.AvailabilityZone != azFilter {
-					continue
+				itype, az := string(sp.InstanceType), aws.ToString(sp.AvailabilityZone)
+				if latest[itype] == nil {
+					latest[itype] = map[string]types.SpotPrice{}
 				}
-				k := priceKey{string(sp.InstanceType), *sp.AvailabilityZone}
-				existing, ok := latest[k]
+				existing, ok := latest[itype][az]
 				if !ok || sp.Timestamp.After(*existing.Timestamp) {
-					latest[k] = sp
+					latest[itype][az] = sp
 				}
 			}
 		}
 	}
 
-	var results []SpotSearchResult
-	for k, sp := range latest {
-		info := infoMap[k.itype]
-		price, _ := strconv.ParseFloat(*sp.SpotPrice, 64)
-		results = append(results, SpotSearchResult{
-			InstanceType:       k.itype,
-			VCPUs:              info.VCPUs,
-			MemoryMiB:          info.MemoryMiB,
-			AZ:                 k.az,
-			Price:              price,
-			GPU:                info.HasGPU,
-			NetworkPerformance: info.NetworkPerformance,
-		})
+	prices := map[string]map[string]float64{}
+	for itype, byAZ := range latest {
+		prices[itype] = map[string]float64{}
+		for az, sp := range byAZ {
+			price, _ := strconv.ParseFloat(*sp.SpotPrice, 64)
+			prices[itype][az] = price
+		}
 	}
-	return results, nil
+	return prices, nil
+}
+
+// FetchSpotPriceHistory returns every Linux/UNIX spot price change for the
+// given instance types since the start time, oldest first. An empty azFilter
+// returns all AZs in the client's region.
+func FetchSpotPriceHistory(ctx context.Context, client *ec2.Client, instanceTypes []string, azFilter string, since time.Time) ([]SpotPricePoint, error) {
+	var points []SpotPricePoint
+	batchSize := 100
+	for i := 0; i < len(instanceTypes); i += batchSize {
+		end := i + batchSize
+		if end > len(instanceTypes) {
+			end = len(instanceTypes)
+		}
+		var batch []types.InstanceType
+		for _, it := range instanceTypes[i:end] {
+			batch = append(batch, types.InstanceType(it))
+		}
+
+		input := &ec2.DescribeSpotPriceHistoryInput{
+			InstanceTypes:       batch,
+			StartTime:           aws.Time(since),
+			ProductDescriptions: []string{"Linux/UNIX"},
+		}
+		if azFilter != "" {
+			input.AvailabilityZone = aws.String(azFilter)
+		}
+
+		paginator := ec2.NewDescribeSpotPriceHistoryPaginator(client, input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("describing spot price history: %w", err)
+			}
+			for _, sp := range page.SpotPriceHistory {
+				price, err := strconv.ParseFloat(aws.ToString(sp.SpotPrice), 64)
+				if err != nil {
+					continue
+				}
+				points = append(points, SpotPricePoint{
+					InstanceType: string(sp.InstanceType),
+					AZ:           aws.ToString(sp.AvailabilityZone),
+					Price:        price,
+					Timestamp:    aws.ToTime(sp.Timestamp),
+				})
+			}
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Timestamp.Before(points[j].Timestamp) })
+	return points, nil
 }
@@ -1,11 +1,21 @@
 package awsutil
 
+import "time"
+
 type InstanceTypeInfo struct {
 	Name               string
 	VCPUs              int32
 	MemoryMiB          int64
 	HasGPU             bool
 	NetworkPerformance string
+	Arch               string
+	Manufacturer       string  // "Intel", "AMD" or "AWS" (Graviton)
+	ClockGHz           float64 // sustained clock speed, 0 if unknown
+	NVMeGB             int64   // local NVMe instance storage, 0 if none
+	NetworkGbps        float64 // baseline network bandwidth
+	EBSMbps            int32   // baseline EBS bandwidth
+	Burstable          bool
+	Hypervisor         string
 }
 
 type SpotSearchResult struct {
@@ -17,3 +27,10 @@ type SpotSearchResult struct {
 	GPU                bool
 	NetworkPerformance string
 }
+
+type SpotPricePoint struct {
+	InstanceType string
+	AZ           string
+	Price        float64
+	Timestamp    time.Time
+}
@@ -0,0 +1,248 @@
+// Package bid turns symbolic spot bid strategies into a concrete max price.
+//
+// A strategy is a base price optionally followed by one adjustment:
+//
+//	0.50            literal $/hr
+//	on-demand       the on-demand price from the bundled price table
+//	current         the latest spot price in the AZ
+//	p95             the time-weighted 95th percentile over the last 30 days
+//
+//	p95+10%         base plus a percentage
+//	current+0.05    base plus a dollar amount
+//	current*1.5     base times a factor
+//
+// spawn, resize, recover and rebid all resolve --bid through this package so
+// a given expression always yields the same number.
+package bid
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+
+	"github.com/emaland/devbox/internal/awsutil"
+	"github.com/emaland/devbox/internal/spotstats"
+)
+
+// HistoryWindow is how far back percentile strategies look.
+const HistoryWindow = 30 * 24 * time.Hour
+
+type base int
+
+const (
+	baseLiteral base = iota
+	baseOnDemand
+	baseCurrent
+	basePercentile
+)
+
+// Strategy is a parsed bid expression.
+type Strategy struct {
+	expr       string
+	base       base
+	literal    float64
+	percentile float64
+	op         byte // 0, '+', '-' or '*'
+	operand    float64
+	percent    bool
+}
+
+// Inputs carries the market data a strategy is evaluated against.
+type Inputs struct {
+	InstanceType string
+	Region       string
+	AZ           string
+	Now          time.Time
+	History      []awsutil.SpotPricePoint
+	OnDemand     float64
+}
+
+// Result is a resolved max price and the steps that produced it.
+type Result struct {
+	Price float64
+	Steps []string
+}
+
+// MaxPrice formats the price the way the EC2 API expects it.
+func (r Result) MaxPrice() string {
+	return strconv.FormatFloat(r.Price, 'f', 4, 64)
+}
+
+// Explain renders the derivation, one step per line.
+func (r Result) Explain() string {
+	return "  " + strings.Join(r.Steps, "\n  ")
+}
+
+// Parse parses a bid expression.
+func Parse(expr string) (Strategy, error) {
+	s := Strategy{expr: expr}
+	e := strings.ToLower(strings.TrimSpace(expr))
+	if e == "" {
+		return s, fmt.Errorf("empty bid strategy")
+	}
+
+	// Split off the adjustment. The base never contains '+' or '*', and
+	// only "on-demand" contains '-', so look for the operator after it.
+	head, tail := e, ""
+	searchFrom := 0
+	if strings.HasPrefix(e, "on-demand") {
+		searchFrom = len("on-demand")
+	}
+	if i := strings.IndexAny(e[searchFrom:], "+-*"); i >= 0 {
+		head, tail = e[:searchFrom+i], e[searchFrom+i:]
+	}
+
+	switch {
+	case head == "on-demand" || head == "ondemand":
+		s.base = baseOnDemand
+	case head == "current":
+		s.base = baseCurrent
+	case strings.HasPrefix(head, "p"):
+		p, err := strconv.ParseFloat(head[1:], 64)
+		if err != nil || p <= 0 || p > 100 {
+			return s, fmt.Errorf("invalid percentile %q in bid %q: want p1..p100", head, expr)
+		}
+		s.base = basePercentile
+		s.percentile = p
+	default:
+		v, err := strconv.ParseFloat(head, 64)
+		if err != nil || v <= 0 {
+			return s, fmt.Errorf("invalid bid %q: want a price, on-demand, current or pNN, optionally followed by +N%%, +N or *N", expr)
+		}
+		s.base = baseLiteral
+		s.literal = v
+	}
+
+	if tail == "" {
+		return s, nil
+	}
+	if s.base == baseLiteral {
+		return s, fmt.Errorf("invalid bid %q: a literal price takes no adjustment", expr)
+	}
+	s.op = tail[0]
+	num := tail[1:]
+	if strings.HasSuffix(num, "%") {
+		if s.op == '*' {
+			return s, fmt.Errorf("invalid bid %q: use *1.5 rather than *150%%", expr)
+		}
+		s.percent = true
+		num = strings.TrimSuffix(num, "%")
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return s, fmt.Errorf("invalid adjustment %q in bid %q", tail, expr)
+	}
+	if s.op == '*' && v == 0 {
+		return s, fmt.Errorf("invalid bid %q: factor must be positive", expr)
+	}
+	s.operand = v
+	return s, nil
+}
+
+func (s Strategy) String() string { return s.expr }
+
+// NeedsHistory reports whether evaluating the strategy requires spot history.
+func (s Strategy) NeedsHistory() bool {
+	return s.base == baseCurrent || s.base == basePercentile
+}
+
+// NeedsOnDemand reports whether evaluating the strategy requires the on-demand price.
+func (s Strategy) NeedsOnDemand() bool {
+	return s.base == baseOnDemand
+}
+
+// Evaluate computes the max price from already-fetched inputs.
+func (s Strategy) Evaluate(in Inputs) (Result, error) {
+	var r Result
+	var price float64
+
+	switch s.base {
+	case baseLiteral:
+		price = s.literal
+		r.Steps = append(r.Steps, fmt.Sprintf("literal price $%.4f", price))
+	case baseOnDemand:
+		if in.OnDemand <= 0 {
+			return r, fmt.Errorf("no on-demand price for %s in %s; use a literal --bid instead", in.InstanceType, in.Region)
+		}
+		price = in.OnDemand
+		r.Steps = append(r.Steps, fmt.Sprintf("on-demand price for %s in %s: $%.4f (bundled table)", in.InstanceType, in.Region, price))
+	case baseCurrent:
+		if len(in.History) == 0 {
+			return r, fmt.Errorf("no spot price history for %s in %s", in.InstanceType, in.AZ)
+		}
+		last := in.History[len(in.History)-1]
+		price = last.Price
+		r.Steps = append(r.Steps, fmt.Sprintf("current spot price for %s in %s: $%.4f (as of %s)",
+			in.InstanceType, in.AZ, price, last.Timestamp.Format("2006-01-02 15:04")))
+	case basePercentile:
+		if len(in.History) == 0 {
+			return r, fmt.Errorf("no spot price history for %s in %s", in.InstanceType, in.AZ)
+		}
+		start := in.Now.Add(-HistoryWindow)
+		price = spotstats.Percentile(in.History, start, in.Now, s.percentile)
+		r.Steps = append(r.Steps, fmt.Sprintf("p%g of %d spot price changes for %s in %s over %d days: $%.4f",
+			s.percentile, len(in.History), in.InstanceType, in.AZ, int(HistoryWindow.Hours()/24), price))
+	}
+
+	switch s.op {
+	case '+', '-':
+		delta := s.operand
+		desc := fmt.Sprintf("$%.4f", delta)
+		if s.percent {
+			delta = price * s.operand / 100
+			desc = fmt.Sprintf("%g%% ($%.4f)", s.operand, delta)
+		}
+		if s.op == '-' {
+			delta = -delta
+		}
+		price += delta
+		r.Steps = append(r.Steps, fmt.Sprintf("%c %s = $%.4f", s.op, desc, price))
+	case '*':
+		price *= s.operand
+		r.Steps = append(r.Steps, fmt.Sprintf("* %g = $%.4f", s.operand, price))
+	}
+
+	if price <= 0 {
+		return r, fmt.Errorf("bid %q resolves to a non-positive price ($%.4f)", s.expr, price)
+	}
+	r.Price = price
+	r.Steps = append(r.Steps, fmt.Sprintf("max price: $%s/hr", r.MaxPrice()))
+	return r, nil
+}
+
+// Resolve parses expr and evaluates it for an instance type in an AZ,
+// fetching spot history only when the strategy needs it.
+func Resolve(ctx context.Context, client *ec2.Client, expr, instanceType, az string) (Result, error) {
+	s, err := Parse(expr)
+	if err != nil {
+		return Result{}, err
+	}
+	in := Inputs{
+		InstanceType: instanceType,
+		Region:       RegionFromAZ(az),
+		AZ:           az,
+		Now:          time.Now(),
+	}
+	if s.NeedsOnDemand() {
+		in.OnDemand, _ = OnDemandPrice(in.Region, instanceType)
+	}
+	if s.NeedsHistory() {
+		in.History, err = awsutil.FetchSpotPriceHistory(ctx, client, []string{instanceType}, az, in.Now.Add(-HistoryWindow))
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	return s.Evaluate(in)
+}
+
+// RegionFromAZ strips the zone letter from an availability zone name.
+func RegionFromAZ(az string) string {
+	if len(az) > 0 && az[len(az)-1] >= 'a' && az[len(az)-1] <= 'z' {
+		return az[:len(az)-1]
+	}
+	return az
+}
@@ -0,0 +1,97 @@
+package bid
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/emaland/devbox/internal/awsutil"
+)
+
+func TestParse(t *testing.T) {
+	valid := []string{"0.50", "on-demand", "on-demand-10%", "current", "current*1.5", "current+0.05", "p95", "p95+10%", "P50"}
+	for _, expr := range valid {
+		if _, err := Parse(expr); err != nil {
+			t.Errorf("Parse(%q): %v", expr, err)
+		}
+	}
+	invalid := []string{"", "cheap", "p0", "p101", "0.50+10%", "current*0", "current*150%", "current+abc", "-1"}
+	for _, expr := range invalid {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	// 0.10 for 29 days, then 0.40 for the last day.
+	history := []awsutil.SpotPricePoint{
+		{Price: 0.10, Timestamp: now.Add(-30 * 24 * time.Hour)},
+		{Price: 0.40, Timestamp: now.Add(-24 * time.Hour)},
+	}
+	in := Inputs{
+		InstanceType: "m6i.4xlarge",
+		Region:       "us-east-2",
+		AZ:           "us-east-2a",
+		Now:          now,
+		History:      history,
+		OnDemand:     0.768,
+	}
+
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{"0.50", 0.50},
+		{"on-demand", 0.768},
+		{"on-demand-50%", 0.384},
+		{"current", 0.40},
+		{"current*1.5", 0.60},
+		{"current+0.05", 0.45},
+		{"p50", 0.10},
+		{"p50+10%", 0.11},
+		{"p100", 0.40},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.expr, err)
+		}
+		r, err := s.Evaluate(in)
+		if err != nil {
+			t.Fatalf("Evaluate(%q): %v", tt.expr, err)
+		}
+		if math.Abs(r.Price-tt.want) > 1e-9 {
+			t.Errorf("Evaluate(%q) = %.4f, want %.4f", tt.expr, r.Price, tt.want)
+		}
+		if len(r.Steps) == 0 {
+			t.Errorf("Evaluate(%q) produced no explanation", tt.expr)
+		}
+	}
+}
+
+func TestEvaluateMissingData(t *testing.T) {
+	for _, expr := range []string{"on-demand", "current", "p95"} {
+		s, _ := Parse(expr)
+		if _, err := s.Evaluate(Inputs{InstanceType: "x9.huge", Region: "us-east-2"}); err == nil {
+			t.Errorf("Evaluate(%q) with no data succeeded, want error", expr)
+		}
+	}
+}
+
+func TestOnDemandPrice(t *testing.T) {
+	price, ok := OnDemandPrice("us-east-2", "m6i.4xlarge")
+	if !ok || math.Abs(price-0.768) > 1e-9 {
+		t.Errorf("OnDemandPrice(m6i.4xlarge) = %v, %v; want 0.768, true", price, ok)
+	}
+	if _, ok := OnDemandPrice("us-east-2", "x9.huge"); ok {
+		t.Error("OnDemandPrice found a nonexistent type")
+	}
+}
+
+func TestRegionFromAZ(t *testing.T) {
+	if got := RegionFromAZ("us-east-2a"); got != "us-east-2" {
+		t.Errorf("RegionFromAZ = %q, want us-east-2", got)
+	}
+}
@@ -0,0 +1,31 @@
+package bid
+
+import (
+	_ "embed"
+	"encoding/json"
+	"sync"
+)
+
+//go:embed ondemand.json
+var onDemandJSON []byte
+
+type onDemandTable struct {
+	Regions map[string]map[string]float64 `json:"regions"`
+}
+
+var (
+	onDemandOnce  sync.Once
+	onDemandCache onDemandTable
+)
+
+// OnDemandPrice looks up the Linux on-demand $/hr for an instance type in the
+// bundled price table.
+func OnDemandPrice(region, instanceType string) (float64, bool) {
+	onDemandOnce.Do(func() {
+		// The table is embedded at build time; a parse failure leaves it
+		// empty and every lookup misses.
+		_ = json.Unmarshal(onDemandJSON, &onDemandCache)
+	})
+	price, ok := onDemandCache.Regions[region][instanceType]
+	return price, ok
+}
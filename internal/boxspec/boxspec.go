@@ -0,0 +1,160 @@
+// Package boxspec parses declarative box specs: YAML files describing a
+// devbox that `devbox plan` and `devbox apply` reconcile against AWS.
+package boxspec
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Spec is the desired state of one box. Only Name is required; fields left
+// empty are either filled from the devbox config at spawn time or not
+// reconciled at all.
+type Spec struct {
+	// Name is the instance's Name tag and how apply finds the box.
+	Name string `yaml:"name"`
+	// Type and Requirements are mutually exclusive. Requirements only
+	// matter when the box is spawned: an existing box is never resized to
+	// match them.
+	Type         string        `yaml:"type"`
+	Requirements *Requirements `yaml:"requirements"`
+	// AZ is an availability zone or "auto". An existing box in another
+	// AZ is moved; "auto" only applies at spawn time.
+	AZ       string `yaml:"az"`
+	MaxPrice string `yaml:"max_price"`
+	// From is the instance ID or Name tag of the box whose user_data a
+	// spawned box clones. It only matters without a launch template;
+	// empty means the box dns_name points at.
+	From    string   `yaml:"from"`
+	Volumes []Volume `yaml:"volumes"`
+	// DNS lists A records to point at the box's public IP.
+	DNS []string `yaml:"dns"`
+	// AutoStop is the auto-stop delay set on the box, e.g. "8h", or "off".
+	AutoStop string            `yaml:"auto_stop"`
+	Tags     map[string]string `yaml:"tags"`
+	// NixConfig is a configuration.nix to push to the box. A relative
+	// path is taken relative to the spec file.
+	NixConfig string `yaml:"nix_config"`
+}
+
+// Requirements describes the box by attributes; EC2 Fleet picks the type.
+type Requirements struct {
+	VCPU     string   `yaml:"vcpu"`
+	Mem      string   `yaml:"mem"`
+	Strategy string   `yaml:"strategy"`
+	Families []string `yaml:"families"`
+	CPU      string   `yaml:"cpu"`
+	// OneTime must be set: EC2 Fleet only launches one-time spot
+	// instances, which terminate rather than stop when interrupted.
+	OneTime bool `yaml:"one_time"`
+}
+
+// Volume is an EBS volume, by ID or Name tag, and the device to attach it as.
+type Volume struct {
+	Volume string `yaml:"volume"`
+	Device string `yaml:"device"`
+}
+
+// reservedTags are managed by devbox and can't be set from a spec.
+var reservedTags = []string{"Name", "devbox-managed"}
+
+// Load reads and validates the spec at path. Volumes without a device get
+// the next free one from /dev/xvdf on.
+func Load(path string) (*Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if spec.NixConfig != "" && !filepath.IsAbs(spec.NixConfig) {
+		spec.NixConfig = filepath.Join(filepath.Dir(path), spec.NixConfig)
+	}
+	return spec, nil
+}
+
+// Parse decodes and validates a spec. Unknown fields are errors, so a typo
+// doesn't silently leave part of the box unreconciled.
+func Parse(data []byte) (*Spec, error) {
+	var spec Spec
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("parsing box spec: %w", err)
+	}
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	spec.assignDevices()
+	return &spec, nil
+}
+
+func (s *Spec) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if s.Type != "" && s.Requirements != nil {
+		return fmt.Errorf("type and requirements can't both be set")
+	}
+	if r := s.Requirements; r != nil && r.VCPU == "" && r.Mem == "" {
+		return fmt.Errorf("requirements need vcpu or mem")
+	}
+	if r := s.Requirements; r != nil && !r.OneTime {
+		return fmt.Errorf("requirements launch a one-time spot instance that terminates when interrupted; set one_time: true to accept that, or use type")
+	}
+	if s.AutoStop != "" && s.AutoStop != "off" {
+		if _, err := time.ParseDuration(s.AutoStop); err != nil {
+			return fmt.Errorf("auto_stop %q: want a duration like 8h or off", s.AutoStop)
+		}
+	}
+	devices := map[string]bool{}
+	for _, v := range s.Volumes {
+		if v.Volume == "" {
+			return fmt.Errorf("volumes: every entry needs a volume ID or name")
+		}
+		if v.Device == "" {
+			continue
+		}
+		if devices[v.Device] {
+			return fmt.Errorf("volumes: device %s used twice", v.Device)
+		}
+		devices[v.Device] = true
+	}
+	for _, name := range s.DNS {
+		if name == "" || strings.Contains(name, " ") {
+			return fmt.Errorf("dns: invalid name %q", name)
+		}
+	}
+	for _, k := range reservedTags {
+		if _, ok := s.Tags[k]; ok {
+			return fmt.Errorf("tags: %s is managed by devbox", k)
+		}
+	}
+	return nil
+}
+
+func (s *Spec) assignDevices() {
+	used := map[string]bool{}
+	for _, v := range s.Volumes {
+		used[v.Device] = true
+	}
+	next := 'f'
+	for i := range s.Volumes {
+		if s.Volumes[i].Device != "" {
+			continue
+		}
+		for used["/dev/xvd"+string(next)] {
+			next++
+		}
+		s.Volumes[i].Device = "/dev/xvd" + string(next)
+		used[s.Volumes[i].Device] = true
+	}
+}
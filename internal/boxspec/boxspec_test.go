@@ -0,0 +1,80 @@
+package boxspec
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	spec, err := Parse([]byte(`
+name: dev-workstation
+type: m6i.4xlarge
+az: us-east-2a
+max_price: p95+10%
+from: dev-primary
+volumes:
+  - volume: dev-data-volume
+  - volume: vol-0abc
+    device: /dev/xvdf
+  - volume: scratch
+dns: [dev.frob.io, box.frob.io]
+auto_stop: 8h
+tags:
+  team: infra
+nix_config: configuration.nix
+`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if spec.Name != "dev-workstation" || spec.Type != "m6i.4xlarge" || spec.MaxPrice != "p95+10%" || spec.From != "dev-primary" {
+		t.Errorf("spec = %+v", spec)
+	}
+	var devices []string
+	for _, v := range spec.Volumes {
+		devices = append(devices, v.Device)
+	}
+	if got := strings.Join(devices, " "); got != "/dev/xvdg /dev/xvdf /dev/xvdh" {
+		t.Errorf("devices = %s, want explicit ones kept and the rest assigned in order", got)
+	}
+	if len(spec.DNS) != 2 || spec.Tags["team"] != "infra" {
+		t.Errorf("DNS = %v, Tags = %v", spec.DNS, spec.Tags)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name, yaml, want string
+	}{
+		{"no name", "type: m6i.large\n", "name is required"},
+		{"unknown field", "name: a\ninstance_type: m6i.large\n", "instance_type"},
+		{"type and requirements", "name: a\ntype: m6i.large\nrequirements: {vcpu: 8-16}\n", "can't both be set"},
+		{"empty requirements", "name: a\nrequirements: {strategy: lowest-price}\n", "vcpu or mem"},
+		{"requirements without one_time", "name: a\nrequirements: {vcpu: 8-16}\n", "one_time"},
+		{"bad auto_stop", "name: a\nauto_stop: soon\n", "auto_stop"},
+		{"duplicate device", "name: a\nvolumes: [{volume: x, device: /dev/xvdf}, {volume: y, device: /dev/xvdf}]\n", "used twice"},
+		{"reserved tag", "name: a\ntags: {Name: b}\n", "managed by devbox"},
+	}
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.yaml))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want it to mention %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestLoadResolvesNixConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "box.yaml")
+	if err := os.WriteFile(path, []byte("name: a\nnix_config: nix/configuration.nix\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	spec, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if want := filepath.Join(dir, "nix", "configuration.nix"); spec.NixConfig != want {
+		t.Errorf("NixConfig = %q, want %q", spec.NixConfig, want)
+	}
+}
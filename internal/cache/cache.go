@@ -0,0 +1,124 @@
+// Package cache is a small on-disk JSON cache under ~/.cache/devbox.
+//
+// Entries are written to a temporary file and renamed into place, so
+// concurrent devbox processes never see a partial entry. Two processes that
+// miss at the same time both fetch and the last write wins, which is fine
+// for data that is only ever a cache. Entries that collect many independent
+// items re-read the file with Peek and merge just before writing, so a
+// concurrent writer's items are kept.
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Store is a directory of cached entries.
+type Store struct {
+	Dir string
+	// Refresh ignores existing entries on read; fresh data is still written.
+	Refresh bool
+	// Now is the clock used for TTL checks; nil means time.Now.
+	Now func() time.Time
+}
+
+type envelope struct {
+	StoredAt time.Time       `json:"stored_at"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// DefaultDir returns $XDG_CACHE_HOME/devbox, falling back to ~/.cache/devbox.
+func DefaultDir() (string, error) {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "devbox"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".cache", "devbox"), nil
+}
+
+func (s *Store) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+func (s *Store) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key)+".json")
+}
+
+// Get decodes the entry for key into v if it exists and is younger than
+// ttl. A nil Store always misses.
+func (s *Store) Get(key string, ttl time.Duration, v any) bool {
+	if s == nil || s.Refresh {
+		return false
+	}
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return false
+	}
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return false
+	}
+	if s.now().Sub(env.StoredAt) > ttl {
+		return false
+	}
+	return json.Unmarshal(env.Data, v) == nil
+}
+
+// Peek decodes the entry for key into v whatever its age, ignoring
+// Refresh. Callers that merge into an entry use it to keep what other
+// processes have written. A nil Store always misses.
+func (s *Store) Peek(key string, v any) bool {
+	if s == nil {
+		return false
+	}
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return false
+	}
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return false
+	}
+	return json.Unmarshal(env.Data, v) == nil
+}
+
+// Put stores v under key. A nil Store discards it.
+func (s *Store) Put(key string, v any) error {
+	if s == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	out, err := json.Marshal(envelope{StoredAt: s.now(), Data: data})
+	if err != nil {
+		return err
+	}
+
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetPut(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	s := &Store{Dir: t.TempDir(), Now: func() time.Time { return now }}
+
+	var got []string
+	if s.Get("instance-types/us-east-2/x86_64", time.Hour, &got) {
+		t.Fatal("Get hit on an empty cache")
+	}
+	if err := s.Put("instance-types/us-east-2/x86_64", []string{"m6i.large"}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Get("instance-types/us-east-2/x86_64", time.Hour, &got) || len(got) != 1 || got[0] != "m6i.large" {
+		t.Fatalf("Get = %v, want [m6i.large]", got)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if s.Get("instance-types/us-east-2/x86_64", time.Hour, &got) {
+		t.Error("Get hit on an expired entry")
+	}
+
+	s.Refresh = true
+	if s.Get("instance-types/us-east-2/x86_64", 24*time.Hour, &got) {
+		t.Error("Get hit with Refresh set")
+	}
+
+	if !s.Peek("instance-types/us-east-2/x86_64", &got) || len(got) != 1 {
+		t.Error("Peek should ignore age and Refresh")
+	}
+
+	var nilStore *Store
+	if nilStore.Get("k", time.Hour, &got) || nilStore.Peek("k", &got) || nilStore.Put("k", got) != nil {
+		t.Error("nil Store should miss and discard")
+	}
+}
+
+func TestConcurrentPut(t *testing.T) {
+	s := &Store{Dir: t.TempDir()}
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Put("spot-prices/us-east-2", map[string]string{"writer": fmt.Sprint(i)}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	var got map[string]string
+	if !s.Get("spot-prices/us-east-2", time.Hour, &got) || got["writer"] == "" {
+		t.Errorf("entry unreadable after concurrent writes: %v", got)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/emaland/devbox/internal/awsutil"
 )
 
 type DevboxConfig struct {
@@ -22,6 +24,47 @@ type DevboxConfig struct {
 	SpawnName        string `json:"spawn_name"`
 	NixOSAMIOwner   string `json:"nixos_ami_owner"`
 	NixOSAMIPattern string `json:"nixos_ami_pattern"`
+	// NixOSAMIPins maps an architecture ("x86_64", "arm64") to an AMI
+	// that is used instead of the latest one matching NixOSAMIPattern.
+	NixOSAMIPins map[string]string `json:"nixos_ami_pins"`
+
+	// LaunchTemplate names the EC2 launch template that defines a box.
+	// spawn, resize and rebid launch from it when it exists.
+	LaunchTemplate string `json:"launch_template"`
+
+	// RootVolume is the root EBS volume of every box devbox launches
+	// without a launch template, and of the template it syncs.
+	RootVolume RootVolume `json:"root_volume"`
+
+	// Weights for ranking `recover --yes` candidates by spot price and
+	// interruption frequency.
+	RecoverPriceWeight     float64 `json:"recover_price_weight"`
+	RecoverStabilityWeight float64 `json:"recover_stability_weight"`
+}
+
+// RootVolume describes a box's root EBS volume. Zero IOPS or Throughput
+// leaves the volume type's default.
+type RootVolume struct {
+	SizeGiB    int32  `json:"size"`
+	Type       string `json:"type"`
+	IOPS       int32  `json:"iops"`
+	Throughput int32  `json:"throughput"`
+	// KMSKeyID encrypts the volume with a customer managed key; it
+	// implies Encrypted. Encrypted alone uses the account's EBS key.
+	KMSKeyID  string `json:"kms_key_id"`
+	Encrypted bool   `json:"encrypted"`
+}
+
+// Validate reports a root volume EBS would reject.
+func (r RootVolume) Validate() error {
+	spec := awsutil.VolumeSpec{Type: r.Type, SizeGiB: r.SizeGiB, IOPS: r.IOPS, Throughput: r.Throughput}
+	if r.SizeGiB < 1 {
+		return fmt.Errorf("root_volume: size must be at least 1 GiB")
+	}
+	if err := spec.Validate(); err != nil {
+		return fmt.Errorf("root_volume: %w", err)
+	}
+	return nil
 }
 
 func LoadConfig() (DevboxConfig, error) {
@@ -39,14 +82,17 @@ func LoadConfig() (DevboxConfig, error) {
 		SpawnName:        "dev-workstation-tmp",
 		NixOSAMIOwner:   "427812963091",
 		NixOSAMIPattern: "nixos/24.11*",
+		LaunchTemplate:  "devbox",
+		RootVolume:      RootVolume{SizeGiB: 75, Type: "gp3"},
+
+		RecoverPriceWeight:     0.7,
+		RecoverStabilityWeight: 0.3,
 	}
 
-	home, err := os.UserHomeDir()
+	path, err := Path()
 	if err != nil {
 		return cfg, nil
 	}
-
-	path := filepath.Join(home, ".config", "devbox", "default.json")
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -58,9 +104,63 @@ func LoadConfig() (DevboxConfig, error) {
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return cfg, fmt.Errorf("parsing config %s: %w", path, err)
 	}
+	if err := cfg.RootVolume.Validate(); err != nil {
+		return cfg, fmt.Errorf("config %s: %w", path, err)
+	}
 	return cfg, nil
 }
 
+// Path returns where the config file lives: ~/.config/devbox/default.json.
+func Path() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "devbox", "default.json"), nil
+}
+
+// Update sets fields in the config file, creating it if needed, and leaves
+// the other fields as they are. values maps JSON field names to values; a
+// nil value removes the field so it falls back to the default. The file is
+// rewritten with its keys sorted.
+func Update(values map[string]any) error {
+	path, err := Path()
+	if err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return fmt.Errorf("parsing config %s: %w", path, err)
+		}
+	case !os.IsNotExist(err):
+		return fmt.Errorf("reading config %s: %w", path, err)
+	}
+
+	for k, v := range values {
+		if v == nil {
+			delete(fields, k)
+			continue
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("encoding %s: %w", k, err)
+		}
+		fields[k] = raw
+	}
+
+	out, err := json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(out, '\n'), 0o644)
+}
+
 func (c DevboxConfig) ResolveSSHKeyPath() string {
 	if strings.HasPrefix(c.SSHKeyPath, "~/") {
 		home, err := os.UserHomeDir()
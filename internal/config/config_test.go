@@ -46,6 +46,9 @@ func TestLoadConfigDefaults(t *testing.T) {
 	if cfg.DNSName != "dev.frob.io" {
 		t.Errorf("default DNSName = %q, want %q", cfg.DNSName, "dev.frob.io")
 	}
+	if cfg.RecoverPriceWeight != 0.7 || cfg.RecoverStabilityWeight != 0.3 {
+		t.Errorf("default recover weights = %v/%v, want 0.7/0.3", cfg.RecoverPriceWeight, cfg.RecoverStabilityWeight)
+	}
 }
 
 func TestResolveSSHKeyPath(t *testing.T) {
@@ -61,6 +64,37 @@ func TestResolveSSHKeyPath(t *testing.T) {
 	}
 }
 
+func TestUpdate(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+
+	// Creates the file when there is none.
+	if err := Update(map[string]any{"nixos_ami_pattern": "nixos/25.05*"}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := Update(map[string]any{
+		"nixos_ami_pins": map[string]string{"arm64": "ami-0123"},
+		"dns_name":       "box.example.com",
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.NixOSAMIPattern != "nixos/25.05*" || cfg.NixOSAMIPins["arm64"] != "ami-0123" || cfg.DNSName != "box.example.com" {
+		t.Errorf("cfg = %+v, want earlier updates kept", cfg)
+	}
+
+	// nil removes the field, restoring the default.
+	if err := Update(map[string]any{"dns_name": nil}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if cfg, _ = LoadConfig(); cfg.DNSName != "dev.frob.io" || cfg.NixOSAMIPattern != "nixos/25.05*" {
+		t.Errorf("after removing dns_name: DNSName = %q, pattern = %q", cfg.DNSName, cfg.NixOSAMIPattern)
+	}
+}
+
 func TestLoadConfigBadJSON(t *testing.T) {
 	dir := t.TempDir()
 	cfgDir := filepath.Join(dir, ".config", "devbox")
@@ -0,0 +1,126 @@
+// Package perf scores instance types by relative per-vCPU performance so
+// that search and recover can rank on value rather than raw price.
+//
+// Scores come from a table bundled with devbox, keyed by family. Entries in
+// ~/.config/devbox/perf.json replace or extend the bundled ones.
+package perf
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//go:embed perf.json
+var bundledJSON []byte
+
+// Table maps instance families to relative per-vCPU performance.
+type Table struct {
+	Families map[string]float64 `json:"families"`
+}
+
+// OverridePath returns where user overrides live.
+func OverridePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "devbox", "perf.json"), nil
+}
+
+// Bundled returns the table shipped with devbox.
+func Bundled() Table {
+	var t Table
+	// The table is embedded at build time; a parse failure leaves it empty
+	// and every family scores the default.
+	_ = json.Unmarshal(bundledJSON, &t)
+	return t
+}
+
+// Load returns the bundled table merged with the overrides at path. A
+// missing override file is not an error.
+func Load(path string) (Table, error) {
+	t := Bundled()
+	if path == "" {
+		return t, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return t, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if t.Families == nil {
+		t.Families = map[string]float64{}
+	}
+	var override Table
+	if err := json.Unmarshal(data, &override); err != nil {
+		return t, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for family, score := range override.Families {
+		if score <= 0 {
+			return t, fmt.Errorf("%s: score for %s must be positive", path, family)
+		}
+		t.Families[family] = score
+	}
+	return t, nil
+}
+
+// LoadDefault loads the bundled table with overrides from OverridePath.
+func LoadDefault() (Table, error) {
+	path, err := OverridePath()
+	if err != nil {
+		return Bundled(), nil
+	}
+	return Load(path)
+}
+
+// Score returns the relative per-vCPU performance of an instance type. A
+// family without an entry falls back to the longest listed prefix, so
+// m6idn and m6id inherit from m6i; anything else scores 1.0 and ok is false.
+func (t Table) Score(instanceType string) (score float64, ok bool) {
+	family, _, _ := strings.Cut(instanceType, ".")
+	for f := family; len(f) >= 2; f = f[:len(f)-1] {
+		if s, found := t.Families[f]; found {
+			return s, true
+		}
+	}
+	return 1.0, false
+}
+
+// PerVCPUHour is the hourly price per vCPU.
+func PerVCPUHour(price float64, vcpus int32) float64 {
+	if vcpus <= 0 {
+		return 0
+	}
+	return price / float64(vcpus)
+}
+
+// PerGiBHour is the hourly price per GiB of memory.
+func PerGiBHour(price float64, memMiB int64) float64 {
+	if memMiB <= 0 {
+		return 0
+	}
+	return price / (float64(memMiB) / 1024)
+}
+
+// PerfPerDollar is performance-weighted vCPUs per dollar-hour.
+func (t Table) PerfPerDollar(instanceType string, price float64, vcpus int32) float64 {
+	if price <= 0 {
+		return 0
+	}
+	score, _ := t.Score(instanceType)
+	return float64(vcpus) * score / price
+}
+
+// MemPerDollar is GiB of memory per dollar-hour.
+func MemPerDollar(price float64, memMiB int64) float64 {
+	if price <= 0 {
+		return 0
+	}
+	return float64(memMiB) / 1024 / price
+}
@@ -0,0 +1,82 @@
+package perf
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScore(t *testing.T) {
+	tbl := Bundled()
+	tests := []struct {
+		itype string
+		want  float64
+		ok    bool
+	}{
+		{"c7i.8xlarge", 1.35, true},
+		{"c5.8xlarge", 1.00, true},
+		{"m6idn.4xlarge", 1.15, true}, // falls back to m6i
+		{"m7i-flex.large", 1.25, true},
+		{"x9.huge", 1.0, false},
+	}
+	for _, tt := range tests {
+		got, ok := tbl.Score(tt.itype)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Score(%s) = %v, %v; want %v, %v", tt.itype, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestLoadOverride(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "perf.json")
+	if err := os.WriteFile(path, []byte(`{"families": {"c5": 0.5, "x9": 3}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tbl, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := tbl.Score("c5.large"); s != 0.5 {
+		t.Errorf("overridden c5 score = %v, want 0.5", s)
+	}
+	if s, _ := tbl.Score("x9.huge"); s != 3 {
+		t.Errorf("added x9 score = %v, want 3", s)
+	}
+	if s, _ := tbl.Score("c7i.large"); s != 1.35 {
+		t.Errorf("bundled c7i score = %v, want 1.35", s)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"families": {"c5": 0}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("Load accepted a zero score")
+	}
+	if _, err := Load(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("Load(missing) = %v, want nil", err)
+	}
+}
+
+func TestPerDollar(t *testing.T) {
+	tbl := Bundled()
+	// Same price and vCPUs: the newer family wins on perf per dollar.
+	c5 := tbl.PerfPerDollar("c5.8xlarge", 0.60, 32)
+	c7i := tbl.PerfPerDollar("c7i.8xlarge", 0.60, 32)
+	if c7i <= c5 {
+		t.Errorf("c7i perf/$ %v <= c5 perf/$ %v", c7i, c5)
+	}
+	if got := PerVCPUHour(0.64, 32); got != 0.02 {
+		t.Errorf("PerVCPUHour = %v, want 0.02", got)
+	}
+	if got := PerGiBHour(0.64, 64*1024); got != 0.01 {
+		t.Errorf("PerGiBHour = %v, want 0.01", got)
+	}
+	if got := MemPerDollar(0.5, 64*1024); math.Abs(got-128) > 1e-9 {
+		t.Errorf("MemPerDollar = %v, want 128", got)
+	}
+	if PerVCPUHour(1, 0) != 0 || MemPerDollar(0, 1024) != 0 {
+		t.Error("zero inputs should yield zero")
+	}
+}
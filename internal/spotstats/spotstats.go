@@ -0,0 +1,226 @@
+// Package spotstats computes statistics over spot price history.
+//
+// Spot prices are step functions: each history point is the price in effect
+// until the next change. Statistics are therefore weighted by how long each
+// price was in effect rather than by the number of change events.
+package spotstats
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emaland/devbox/internal/awsutil"
+)
+
+type span struct {
+	price    float64
+	duration time.Duration
+}
+
+// spans turns a single series (one type, one AZ) into price/duration pairs
+// clipped to [start, end]. Points must be sorted oldest first.
+func spans(points []awsutil.SpotPricePoint, start, end time.Time) []span {
+	var out []span
+	for i, p := range points {
+		from := p.Timestamp
+		if from.Before(start) {
+			from = start
+		}
+		to := end
+		if i+1 < len(points) {
+			to = points[i+1].Timestamp
+		}
+		if to.After(end) {
+			to = end
+		}
+		if !to.After(from) {
+			continue
+		}
+		out = append(out, span{price: p.Price, duration: to.Sub(from)})
+	}
+	return out
+}
+
+// Percentile returns the time-weighted p-th percentile (0-100) of a single
+// price series over [start, end]. It returns 0 for an empty series.
+func Percentile(points []awsutil.SpotPricePoint, start, end time.Time, p float64) float64 {
+	ss := spans(points, start, end)
+	if len(ss) == 0 {
+		if len(points) > 0 {
+			return points[len(points)-1].Price
+		}
+		return 0
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].price < ss[j].price })
+	var total time.Duration
+	for _, s := range ss {
+		total += s.duration
+	}
+	target := time.Duration(float64(total) * p / 100)
+	var acc time.Duration
+	for _, s := range ss {
+		acc += s.duration
+		if acc >= target {
+			return s.price
+		}
+	}
+	return ss[len(ss)-1].price
+}
+
+// Summary describes one price series over a window.
+type Summary struct {
+	Min     float64
+	Median  float64
+	P95     float64
+	Max     float64
+	Mean    float64
+	Current float64
+	// Changes counts price changes inside the window.
+	Changes int
+	// Volatility is the time-weighted coefficient of variation (stddev/mean).
+	Volatility float64
+	Risk       Risk
+}
+
+// Risk is a coarse interruption-risk estimate derived from volatility.
+// It is a heuristic: a price that moves a lot means capacity in that pool
+// is being reclaimed and re-offered often.
+type Risk string
+
+const (
+	RiskLow    Risk = "low"
+	RiskMedium Risk = "medium"
+	RiskHigh   Risk = "high"
+)
+
+// Rank orders risks for sorting, low first.
+func (r Risk) Rank() int {
+	switch r {
+	case RiskLow:
+		return 0
+	case RiskMedium:
+		return 1
+	case RiskHigh:
+		return 2
+	}
+	return 3
+}
+
+// Summarize computes statistics for a single series (one type, one AZ)
+// sorted oldest first.
+func Summarize(points []awsutil.SpotPricePoint, start, end time.Time) Summary {
+	var s Summary
+	if len(points) == 0 {
+		return s
+	}
+	s.Current = points[len(points)-1].Price
+	s.Min = Percentile(points, start, end, 0)
+	s.Median = Percentile(points, start, end, 50)
+	s.P95 = Percentile(points, start, end, 95)
+	s.Max = Percentile(points, start, end, 100)
+
+	for i := 1; i < len(points); i++ {
+		if points[i].Timestamp.After(start) && points[i].Price != points[i-1].Price {
+			s.Changes++
+		}
+	}
+
+	ss := spans(points, start, end)
+	var total time.Duration
+	var sum float64
+	for _, sp := range ss {
+		total += sp.duration
+		sum += sp.price * sp.duration.Hours()
+	}
+	if total > 0 {
+		s.Mean = sum / total.Hours()
+		var variance float64
+		for _, sp := range ss {
+			d := sp.price - s.Mean
+			variance += d * d * sp.duration.Hours()
+		}
+		variance /= total.Hours()
+		if s.Mean > 0 {
+			s.Volatility = math.Sqrt(variance) / s.Mean
+		}
+	} else {
+		s.Mean = s.Current
+	}
+
+	days := end.Sub(start).Hours() / 24
+	changesPerDay := 0.0
+	if days > 0 {
+		changesPerDay = float64(s.Changes) / days
+	}
+	switch {
+	case s.Volatility < 0.05 && changesPerDay < 1:
+		s.Risk = RiskLow
+	case s.Volatility < 0.15 && changesPerDay < 4:
+		s.Risk = RiskMedium
+	default:
+		s.Risk = RiskHigh
+	}
+	return s
+}
+
+// Series groups mixed history points by instance type and AZ, keeping each
+// series sorted oldest first.
+func Series(points []awsutil.SpotPricePoint) map[SeriesKey][]awsutil.SpotPricePoint {
+	out := map[SeriesKey][]awsutil.SpotPricePoint{}
+	for _, p := range points {
+		k := SeriesKey{InstanceType: p.InstanceType, AZ: p.AZ}
+		out[k] = append(out[k], p)
+	}
+	for k := range out {
+		sort.Slice(out[k], func(i, j int) bool { return out[k][i].Timestamp.Before(out[k][j].Timestamp) })
+	}
+	return out
+}
+
+// SeriesKey identifies one spot price series.
+type SeriesKey struct {
+	InstanceType string
+	AZ           string
+}
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// Sparkline renders the series as width characters, each the time-weighted
+// average price of its slice of [start, end], scaled between lo and hi.
+// Pass the same lo/hi to several series to make them comparable.
+func Sparkline(points []awsutil.SpotPricePoint, start, end time.Time, width int, lo, hi float64) string {
+	if width <= 0 || len(points) == 0 || !end.After(start) {
+		return ""
+	}
+	step := end.Sub(start) / time.Duration(width)
+	var b strings.Builder
+	for i := 0; i < width; i++ {
+		bs := start.Add(time.Duration(i) * step)
+		be := bs.Add(step)
+		var total time.Duration
+		var sum float64
+		for _, sp := range spans(points, bs, be) {
+			total += sp.duration
+			sum += sp.price * sp.duration.Hours()
+		}
+		if total == 0 {
+			b.WriteRune(' ')
+			continue
+		}
+		avg := sum / total.Hours()
+		idx := 0
+		if hi > lo {
+			idx = int((avg - lo) / (hi - lo) * float64(len(sparkBlocks)-1))
+		}
+		if idx < 0 {
+			idx = 0
+		}
+		if idx >= len(sparkBlocks) {
+			idx = len(sparkBlocks) - 1
+		}
+		b.WriteRune(sparkBlocks[idx])
+	}
+	return b.String()
+}
@@ -0,0 +1,99 @@
+package spotstats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emaland/devbox/internal/awsutil"
+)
+
+func TestPercentileTimeWeighted(t *testing.T) {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(10 * time.Hour)
+	// Three change events, but 0.10 holds for 8 of the 10 hours.
+	points := []awsutil.SpotPricePoint{
+		{Price: 0.30, Timestamp: start.Add(-time.Hour)},
+		{Price: 0.10, Timestamp: start.Add(time.Hour)},
+		{Price: 0.50, Timestamp: start.Add(9 * time.Hour)},
+	}
+	if got := Percentile(points, start, end, 50); got != 0.10 {
+		t.Errorf("p50 = %v, want 0.10", got)
+	}
+	if got := Percentile(points, start, end, 85); got != 0.30 {
+		t.Errorf("p85 = %v, want 0.30", got)
+	}
+	if got := Percentile(points, start, end, 100); got != 0.50 {
+		t.Errorf("p100 = %v, want 0.50", got)
+	}
+	if got := Percentile(nil, start, end, 50); got != 0 {
+		t.Errorf("empty p50 = %v, want 0", got)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(10 * 24 * time.Hour)
+
+	flat := []awsutil.SpotPricePoint{{Price: 0.20, Timestamp: start.Add(-time.Hour)}}
+	s := Summarize(flat, start, end)
+	if s.Min != 0.20 || s.Max != 0.20 || s.Median != 0.20 || s.Changes != 0 || s.Volatility != 0 {
+		t.Errorf("flat series summary = %+v", s)
+	}
+	if s.Risk != RiskLow {
+		t.Errorf("flat series risk = %s, want low", s.Risk)
+	}
+
+	var choppy []awsutil.SpotPricePoint
+	for i := 0; i < 80; i++ {
+		price := 0.10
+		if i%2 == 1 {
+			price = 0.30
+		}
+		choppy = append(choppy, awsutil.SpotPricePoint{Price: price, Timestamp: start.Add(time.Duration(i) * 3 * time.Hour)})
+	}
+	s = Summarize(choppy, start, end)
+	if s.Changes != 79 {
+		t.Errorf("choppy changes = %d, want 79", s.Changes)
+	}
+	if s.Min != 0.10 || s.Max != 0.30 {
+		t.Errorf("choppy min/max = %v/%v, want 0.10/0.30", s.Min, s.Max)
+	}
+	if s.Risk != RiskHigh {
+		t.Errorf("choppy risk = %s, want high", s.Risk)
+	}
+	if s.Current != 0.30 {
+		t.Errorf("choppy current = %v, want 0.30", s.Current)
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(4 * time.Hour)
+	points := []awsutil.SpotPricePoint{
+		{Price: 0.10, Timestamp: start},
+		{Price: 0.50, Timestamp: start.Add(2 * time.Hour)},
+	}
+	if got := Sparkline(points, start, end, 4, 0.10, 0.50); got != "▁▁██" {
+		t.Errorf("Sparkline = %q, want %q", got, "▁▁██")
+	}
+	if got := Sparkline(nil, start, end, 4, 0, 1); got != "" {
+		t.Errorf("Sparkline(nil) = %q, want empty", got)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	now := time.Now()
+	points := []awsutil.SpotPricePoint{
+		{InstanceType: "m6i.large", AZ: "us-east-2b", Price: 0.2, Timestamp: now},
+		{InstanceType: "m6i.large", AZ: "us-east-2a", Price: 0.1, Timestamp: now},
+		{InstanceType: "m6i.large", AZ: "us-east-2a", Price: 0.3, Timestamp: now.Add(-time.Hour)},
+	}
+	series := Series(points)
+	a := series[SeriesKey{InstanceType: "m6i.large", AZ: "us-east-2a"}]
+	if len(series) != 2 || len(a) != 2 {
+		t.Fatalf("Series grouped into %d series, us-east-2a has %d points", len(series), len(a))
+	}
+	if a[0].Price != 0.3 {
+		t.Errorf("series not sorted oldest first: %+v", a)
+	}
+}
@@ -26,6 +26,63 @@
     options = [ "defaults" "nofail" ];
   };
 
+  # ── Format a blank data volume ──────────────────────────────────
+  # `devbox spawn --data new:<size>` attaches an empty EBS volume.
+  # Before /home is mounted, give it an ext4 filesystem labelled
+  # home-data. Does nothing if a home-data volume already exists, and
+  # refuses to guess if more than one blank EBS disk is attached.
+  systemd.services.devbox-format-home = {
+    description = "Format a blank EBS volume as home-data";
+    after       = [ "systemd-udev-settle.service" ];
+    before      = [ "home.mount" ];
+    wantedBy    = [ "local-fs.target" ];
+    unitConfig.DefaultDependencies = false;
+    serviceConfig = {
+      Type      = "oneshot";
+      ExecStart = toString (pkgs.writeShellScript "devbox-format-home" ''
+        if [ -e /dev/disk/by-label/home-data ]; then
+          exit 0
+        fi
+
+        BLANK=()
+        for DEV in $(${pkgs.util-linux}/bin/lsblk -dnpo NAME,TYPE | ${pkgs.gawk}/bin/awk '$2 == "disk" { print $1 }'); do
+          MODEL=$(${pkgs.util-linux}/bin/lsblk -dno MODEL "$DEV")
+          case "$MODEL" in
+            *"Instance Storage"*) continue ;;
+          esac
+          # Skip disks with partitions or any recognisable signature
+          if [ "$(${pkgs.util-linux}/bin/lsblk -no NAME "$DEV" | wc -l)" -gt 1 ]; then
+            continue
+          fi
+          if ${pkgs.util-linux}/bin/blkid -p "$DEV" >/dev/null 2>&1; then
+            continue
+          fi
+          BLANK+=("$DEV")
+        done
+
+        if [ "''${#BLANK[@]}" -eq 0 ]; then
+          exit 0
+        fi
+        if [ "''${#BLANK[@]}" -gt 1 ]; then
+          echo "Several blank EBS disks (''${BLANK[*]}), not formatting any"
+          exit 0
+        fi
+
+        echo "Formatting ''${BLANK[0]} as home-data"
+        ${pkgs.e2fsprogs}/bin/mkfs.ext4 -L home-data "''${BLANK[0]}"
+
+        # Create emaland's home on the new filesystem, since the one
+        # made at activation ends up hidden under the mount.
+        MNT=$(mktemp -d)
+        ${pkgs.util-linux}/bin/mount "''${BLANK[0]}" "$MNT"
+        install -d -o ${toString config.users.users.emaland.uid} -g users -m 700 "$MNT/emaland"
+        ${pkgs.util-linux}/bin/umount "$MNT"
+        rmdir "$MNT"
+        ${pkgs.systemd}/bin/udevadm settle
+      '');
+    };
+  };
+
   # ── Users ─────────────────────────────────────────────────────────
   users.users.emaland = {
     isNormalUser = true;
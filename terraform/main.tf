@@ -8,6 +8,9 @@ provider "aws" {
 
 locals {
   devbox = jsondecode(file(pathexpand("~/.config/devbox/default.json")))
+
+  # root_volume fields the config leaves out fall back to the CLI defaults.
+  root_volume = merge({ size = 75, type = "gp3" }, lookup(local.devbox, "root_volume", {}))
 }
 
 # ── Variables that aren't in the devbox config ──────────────────────
@@ -22,6 +25,18 @@ variable "ssh_public_key" {
   type        = string
 }
 
+variable "data_volume_encrypted" {
+  description = "Encrypt the data volume (with the account's default EBS key unless data_volume_kms_key_id is set)"
+  type        = bool
+  default     = false
+}
+
+variable "data_volume_kms_key_id" {
+  description = "KMS key ARN to encrypt the data volume with"
+  type        = string
+  default     = null
+}
+
 # ── Key pair ────────────────────────────────────────────────────────
 
 resource "aws_key_pair" "dev" {
@@ -97,6 +112,38 @@ resource "aws_iam_role_policy" "route53_update" {
   })
 }
 
+# Lets a box spawned with --ttl terminate itself and remove its DNS records.
+# Cancelling and terminating are limited to spot requests and instances that
+# carry the devbox-expires tag.
+resource "aws_iam_role_policy" "ttl" {
+  name = "devbox-ttl"
+  role = aws_iam_role.dev.id
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect   = "Allow"
+        Action   = ["ec2:DescribeInstances", "ec2:DescribeSpotInstanceRequests"]
+        Resource = "*"
+      },
+      {
+        Effect   = "Allow"
+        Action   = ["ec2:CancelSpotInstanceRequests", "ec2:TerminateInstances"]
+        Resource = "*"
+        Condition = {
+          Null = { "aws:ResourceTag/devbox-expires" = "false" }
+        }
+      },
+      {
+        Effect   = "Allow"
+        Action   = "route53:ListResourceRecordSets"
+        Resource = "arn:aws:route53:::hostedzone/${var.dns_zone_id}"
+      },
+    ]
+  })
+}
+
 resource "aws_iam_role_policy_attachment" "ssm" {
   role       = aws_iam_role.dev.name
   policy_arn = "arn:aws:iam::aws:policy/AmazonSSMManagedInstanceCore"
@@ -116,6 +163,12 @@ resource "aws_ebs_volume" "data" {
   iops              = 3000
   throughput        = 250
 
+  # Changing encryption replaces the volume, which prevent_destroy blocks.
+  # To encrypt an existing volume, run `devbox volume encrypt`, then
+  # `terraform state rm aws_ebs_volume.data` and import the new volume.
+  encrypted  = var.data_volume_encrypted || var.data_volume_kms_key_id != null
+  kms_key_id = var.data_volume_kms_key_id
+
   tags = {
     Name = "dev-data-volume"
   }
@@ -124,3 +177,61 @@ resource "aws_ebs_volume" "data" {
     prevent_destroy = true
   }
 }
+
+# ── Launch template ─────────────────────────────────────────────────
+# The canonical box definition. spawn, resize and rebid launch from it
+# and override the instance type, subnet, spot options and Name tag.
+# `devbox template diff` shows how it differs from what the CLI would
+# build; manage it here or with `devbox template sync`, not both.
+
+data "aws_ami" "nixos" {
+  owners      = [local.devbox.nixos_ami_owner]
+  most_recent = true
+
+  filter {
+    name   = "name"
+    values = [local.devbox.nixos_ami_pattern]
+  }
+
+  filter {
+    name   = "architecture"
+    values = ["x86_64"]
+  }
+}
+
+resource "aws_launch_template" "devbox" {
+  name                   = lookup(local.devbox, "launch_template", "devbox")
+  image_id               = data.aws_ami.nixos.id
+  key_name               = aws_key_pair.dev.key_name
+  vpc_security_group_ids = [aws_security_group.dev_instance.id]
+  user_data              = base64encode(file("${path.module}/configuration.nix"))
+  update_default_version = true
+
+  iam_instance_profile {
+    name = aws_iam_instance_profile.dev.name
+  }
+
+  block_device_mappings {
+    device_name = "/dev/xvda"
+
+    ebs {
+      volume_size = local.root_volume.size
+      volume_type = local.root_volume.type
+      iops        = lookup(local.root_volume, "iops", null)
+      throughput  = lookup(local.root_volume, "throughput", null)
+      encrypted   = lookup(local.root_volume, "encrypted", false) || lookup(local.root_volume, "kms_key_id", "") != ""
+      kms_key_id  = lookup(local.root_volume, "kms_key_id", null)
+    }
+  }
+
+  tag_specifications {
+    resource_type = "instance"
+    tags = {
+      "devbox-managed" = "true"
+    }
+  }
+
+  tags = {
+    "devbox-managed" = "true"
+  }
+}